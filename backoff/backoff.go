@@ -0,0 +1,49 @@
+package backoff
+
+import (
+	"math/rand"
+	"time"
+)
+
+//Backoff computes delays between attempts that grow exponentially
+type Backoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	//Jitter is the fraction of the delay that is randomized, between 0 and 1
+	Jitter float64
+}
+
+//Delay returns how long to wait before the attempt-th retry, starting with 0
+func (b Backoff) Delay(attempt int) time.Duration {
+	delay := float64(b.Initial)
+	for i := 0; i < attempt && b.Multiplier > 1 && delay < float64(b.Max); i++ {
+		delay *= b.Multiplier
+	}
+	if delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+	if b.Jitter > 0 {
+		delay -= delay * b.Jitter * rand.Float64()
+	}
+	return time.Duration(delay)
+}
+
+//Clock tells the time and waits, tests move a fake one forward instead of sleeping
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+//SystemClock is Clock of the system
+var SystemClock Clock = systemClock{}
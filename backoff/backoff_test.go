@@ -0,0 +1,36 @@
+package backoff_test
+
+import (
+	"pub-sub/backoff"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	policy := backoff.Backoff{Initial: 100 * time.Millisecond, Max: time.Second}
+	testCases := []struct {
+		desc       string
+		attempt    int
+		jitter     float64
+		multiplier float64
+		min, max   time.Duration
+	}{
+		{desc: "First attempt", attempt: 0, multiplier: 2, min: 100 * time.Millisecond, max: 100 * time.Millisecond},
+		{desc: "Grows exponentially", attempt: 3, multiplier: 2, min: 800 * time.Millisecond, max: 800 * time.Millisecond},
+		{desc: "Capped at max", attempt: 50, multiplier: 2, min: time.Second, max: time.Second},
+		{desc: "Jitter shortens delay", attempt: 50, multiplier: 2, jitter: 0.5, min: 500 * time.Millisecond, max: time.Second},
+		{desc: "Constant without multiplier", attempt: 5, min: 100 * time.Millisecond, max: 100 * time.Millisecond},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			b := policy
+			b.Multiplier, b.Jitter = tC.multiplier, tC.jitter
+			for i := 0; i < 100; i++ {
+				delay := b.Delay(tC.attempt)
+				if delay < tC.min || delay > tC.max {
+					t.Fatalf("Expected delay between %s and %s, got %s", tC.min, tC.max, delay)
+				}
+			}
+		})
+	}
+}
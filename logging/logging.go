@@ -0,0 +1,185 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+//Level is the severity of a record
+type Level int32
+
+//Levels from the least to the most severe
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return "unknown"
+}
+
+//ParseLevel returns level by its name, e.g. "info"
+func ParseLevel(name string) (Level, error) {
+	for level := LevelDebug; level <= LevelError; level++ {
+		if strings.EqualFold(name, level.String()) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, want debug, info, warn or error", name)
+}
+
+//AtomicLevel is a Level that can be changed while it is used by sinks
+type AtomicLevel struct {
+	level int32
+}
+
+//NewAtomicLevel returns new AtomicLevel set to level
+func NewAtomicLevel(level Level) *AtomicLevel {
+	return &AtomicLevel{level: int32(level)}
+}
+
+//Level returns current level
+func (a *AtomicLevel) Level() Level {
+	return Level(atomic.LoadInt32(&a.level))
+}
+
+//Set changes level
+func (a *AtomicLevel) Set(level Level) {
+	atomic.StoreInt32(&a.level, int32(level))
+}
+
+//Keys of fields that are shared by the services
+const (
+	KeyRequestID = "request_id"
+	KeyAccountID = "account_id"
+	KeyMessageID = "message_id"
+	KeyError     = "error"
+)
+
+//Field is a key with value attached to a record
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+//F returns field with key and value
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+//Err returns field with the message of err under KeyError
+func Err(err error) Field {
+	if err == nil {
+		return F(KeyError, nil)
+	}
+	return F(KeyError, err.Error())
+}
+
+//Record is a single log entry
+type Record struct {
+	Time    time.Time
+	Level   Level
+	Message string
+	Fields  []Field
+}
+
+//Field returns value of the last field with key
+func (r Record) Field(key string) (interface{}, bool) {
+	for i := len(r.Fields) - 1; i >= 0; i-- {
+		if r.Fields[i].Key == key {
+			return r.Fields[i].Value, true
+		}
+	}
+	return nil, false
+}
+
+//Sink receives records from Logger
+type Sink interface {
+	//Enabled reports whether records of level are written, so that they are not built in vain
+	Enabled(level Level) bool
+	Write(record Record)
+}
+
+//Logger builds records with its fields and passes them to a sink. Nil Logger discards records.
+type Logger struct {
+	sink   Sink
+	fields []Field
+}
+
+//New returns new Logger that writes to sink
+func New(sink Sink) *Logger {
+	return &Logger{sink: sink}
+}
+
+//Nop returns Logger that discards all records
+func Nop() *Logger {
+	return nil
+}
+
+//With returns Logger that adds fields to all records
+func (l *Logger) With(fields ...Field) *Logger {
+	if l == nil {
+		return nil
+	}
+	return &Logger{sink: l.sink, fields: append(append([]Field{}, l.fields...), fields...)}
+}
+
+//Debug logs message with fields at LevelDebug
+func (l *Logger) Debug(message string, fields ...Field) {
+	l.log(LevelDebug, message, fields)
+}
+
+//Info logs message with fields at LevelInfo
+func (l *Logger) Info(message string, fields ...Field) {
+	l.log(LevelInfo, message, fields)
+}
+
+//Warn logs message with fields at LevelWarn
+func (l *Logger) Warn(message string, fields ...Field) {
+	l.log(LevelWarn, message, fields)
+}
+
+//Error logs message with fields at LevelError
+func (l *Logger) Error(message string, fields ...Field) {
+	l.log(LevelError, message, fields)
+}
+
+func (l *Logger) log(level Level, message string, fields []Field) {
+	if l == nil || l.sink == nil || !l.sink.Enabled(level) {
+		return
+	}
+	l.sink.Write(Record{
+		Time:    time.Now(),
+		Level:   level,
+		Message: message,
+		Fields:  append(append(make([]Field, 0, len(l.fields)+len(fields)), l.fields...), fields...),
+	})
+}
+
+type contextKey struct{}
+
+//NewContext returns ctx that carries logger
+func NewContext(ctx context.Context, logger *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+//FromContext returns logger of ctx, or Nop when there is none
+func FromContext(ctx context.Context) *Logger {
+	logger, _ := ctx.Value(contextKey{}).(*Logger)
+	return logger
+}
@@ -0,0 +1,128 @@
+package logging_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"pub-sub/logging"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriter(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		format   logging.Format
+		expected string
+	}{
+		{
+			desc:     "Logfmt",
+			format:   logging.FormatLogfmt,
+			expected: `level=warn msg="publisher unreachable" request_id=abc account_id=5555e2d316ca1b6d40aaaaaa attempts=3 delay=1.5s error="connection refused" empty=""`,
+		},
+		{
+			desc:     "JSON",
+			format:   logging.FormatJSON,
+			expected: `"level":"warn","msg":"publisher unreachable","request_id":"abc","account_id":"5555e2d316ca1b6d40aaaaaa","attempts":3,"delay":"1.5s","error":"connection refused","empty":""}`,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			var out bytes.Buffer
+			logger := logging.New(logging.NewWriter(&out, tC.format, logging.NewAtomicLevel(logging.LevelInfo)))
+			logger = logger.With(logging.F(logging.KeyRequestID, "abc"))
+			logger.Warn("publisher unreachable",
+				logging.F(logging.KeyAccountID, "5555e2d316ca1b6d40aaaaaa"),
+				logging.F("attempts", 3),
+				logging.F("delay", 1500*time.Millisecond),
+				logging.Err(errors.New("connection refused")),
+				logging.F("empty", ""),
+			)
+
+			line := out.String()
+			if !strings.HasSuffix(line, tC.expected+"\n") {
+				t.Errorf("Expected line ending with %s, got %s", tC.expected, line)
+			}
+			if tC.format == logging.FormatJSON {
+				var record map[string]interface{}
+				if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+					t.Fatalf("Expected valid JSON, got %v", err)
+				}
+				if _, err := time.Parse(time.RFC3339Nano, record["time"].(string)); err != nil {
+					t.Errorf("Expected RFC 3339 time, got %v", record["time"])
+				}
+			}
+		})
+	}
+}
+
+func TestWriterLevel(t *testing.T) {
+	var out bytes.Buffer
+	level := logging.NewAtomicLevel(logging.LevelWarn)
+	logger := logging.New(logging.NewWriter(&out, logging.FormatLogfmt, level))
+
+	logger.Info("hidden")
+	logger.Error("shown")
+	level.Set(logging.LevelDebug)
+	logger.Debug("shown after change")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], "msg=shown") || !strings.Contains(lines[1], `msg="shown after change"`) {
+		t.Errorf("Expected 2 lines at enabled levels, got %q", lines)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	recorder := logging.NewRecorder()
+	logger := logging.New(recorder).With(logging.F(logging.KeyRequestID, "abc"))
+	logger.Debug("first", logging.F(logging.KeyMessageID, "1"))
+	logger.With(logging.F(logging.KeyRequestID, "def")).Error("second")
+
+	records := recorder.Records()
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records, got %d", len(records))
+	}
+	if records[0].Level != logging.LevelDebug || records[0].Message != "first" {
+		t.Errorf("Expected debug record first, got %+v", records[0])
+	}
+	if id, ok := records[0].Field(logging.KeyMessageID); !ok || id != "1" {
+		t.Errorf("Expected message ID 1, got %v", id)
+	}
+	if id, _ := records[1].Field(logging.KeyRequestID); id != "def" {
+		t.Errorf("Expected the last request ID to win, got %v", id)
+	}
+	if found := recorder.Find("second"); len(found) != 1 || found[0].Level != logging.LevelError {
+		t.Errorf("Expected to find error record, got %+v", found)
+	}
+}
+
+func TestNopAndContext(t *testing.T) {
+	// nil loggers discard records, so that they can be left out
+	logger := logging.Nop()
+	logger.With(logging.F("key", "value")).Info("discarded")
+	logging.FromContext(context.Background()).Error("discarded")
+
+	recorder := logging.NewRecorder()
+	ctx := logging.NewContext(context.Background(), logging.New(recorder))
+	logging.FromContext(ctx).Info("kept")
+	if len(recorder.Records()) != 1 {
+		t.Errorf("Expected record of context logger, got %+v", recorder.Records())
+	}
+}
+
+func TestParse(t *testing.T) {
+	if level, err := logging.ParseLevel("WARN"); err != nil || level != logging.LevelWarn {
+		t.Errorf("Expected warn, got %v and %v", level, err)
+	}
+	if _, err := logging.ParseLevel("verbose"); err == nil {
+		t.Error("Expected error for unknown level")
+	}
+	if format, err := logging.ParseFormat("json"); err != nil || format != logging.FormatJSON {
+		t.Errorf("Expected json, got %v and %v", format, err)
+	}
+	if _, err := logging.ParseFormat("xml"); err == nil {
+		t.Error("Expected error for unknown format")
+	}
+}
@@ -0,0 +1,168 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+//Format is the encoding of records written by NewWriter
+type Format string
+
+//Formats of NewWriter
+const (
+	//FormatLogfmt writes records as key=value pairs
+	FormatLogfmt Format = "logfmt"
+	//FormatJSON writes records as JSON objects
+	FormatJSON Format = "json"
+)
+
+//ParseFormat returns format by its name
+func ParseFormat(name string) (Format, error) {
+	switch format := Format(name); format {
+	case FormatLogfmt, FormatJSON:
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown log format %q, want logfmt or json", name)
+}
+
+// writer writes records to w, one per line
+type writer struct {
+	format Format
+	level  *AtomicLevel
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+//NewWriter returns Sink that writes records at level or above to w in format, one per line
+func NewWriter(w io.Writer, format Format, level *AtomicLevel) Sink {
+	return &writer{w: w, format: format, level: level}
+}
+
+func (w *writer) Enabled(level Level) bool {
+	return level >= w.level.Level()
+}
+
+func (w *writer) Write(record Record) {
+	fields := append([]Field{
+		F("time", record.Time.UTC().Format(time.RFC3339Nano)),
+		F("level", record.Level.String()),
+		F("msg", record.Message),
+	}, record.Fields...)
+
+	var line bytes.Buffer
+	if w.format == FormatJSON {
+		encodeJSON(&line, fields)
+	} else {
+		encodeLogfmt(&line, fields)
+	}
+	line.WriteByte('\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.w.Write(line.Bytes())
+}
+
+// plain returns value as it is written, errors and values with String method as their text
+func plain(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return value
+}
+
+func encodeJSON(buf *bytes.Buffer, fields []Field) {
+	buf.WriteByte('{')
+	for i, field := range fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(field.Key)
+		buf.Write(key)
+		buf.WriteByte(':')
+		value, err := json.Marshal(plain(field.Value))
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(field.Value))
+		}
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+}
+
+func encodeLogfmt(buf *bytes.Buffer, fields []Field) {
+	for i, field := range fields {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(logfmtValue(field.Key))
+		buf.WriteByte('=')
+		value := plain(field.Value)
+		if value == nil {
+			continue
+		}
+		buf.WriteString(logfmtValue(fmt.Sprint(value)))
+	}
+}
+
+// logfmtValue quotes text when it would not be read back as a single value
+func logfmtValue(text string) string {
+	if text == "" {
+		return `""`
+	}
+	if strings.IndexFunc(text, func(r rune) bool {
+		return r <= ' ' || r == '=' || r == '"' || !unicode.IsPrint(r)
+	}) >= 0 {
+		return strconv.Quote(text)
+	}
+	return text
+}
+
+//Recorder is a Sink that keeps all records in memory, for tests
+type Recorder struct {
+	mu      sync.Mutex
+	records []Record
+}
+
+//NewRecorder returns new empty Recorder
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+//Enabled records all levels
+func (r *Recorder) Enabled(level Level) bool {
+	return true
+}
+
+func (r *Recorder) Write(record Record) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records = append(r.records, record)
+}
+
+//Records returns all records written so far
+func (r *Recorder) Records() []Record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Record{}, r.records...)
+}
+
+//Find returns records with message
+func (r *Recorder) Find(message string) []Record {
+	found := []Record{}
+	for _, record := range r.Records() {
+		if record.Message == message {
+			found = append(found, record)
+		}
+	}
+	return found
+}
@@ -1,11 +1,24 @@
 
 const WebSocket = require('ws');
+const fs = require('fs')
+const https = require('https')
 const path = require('path')
 const config = require(path.resolve('config.json'))
 
-
-const server = new WebSocket.Server({ host: config.host, port: config.port });
-console.log('Socket server listening on', config.host, config.port)
+// with certFile and keyFile clients connect with wss://
+let server
+if (config.certFile && config.keyFile) {
+    const httpsServer = https.createServer({
+        cert: fs.readFileSync(config.certFile),
+        key: fs.readFileSync(config.keyFile)
+    });
+    server = new WebSocket.Server({ server: httpsServer });
+    httpsServer.listen(config.port, config.host);
+    console.log('Secure socket server listening on', config.host, config.port)
+} else {
+    server = new WebSocket.Server({ host: config.host, port: config.port });
+    console.log('Socket server listening on', config.host, config.port)
+}
 
 server.broadcast = (message, sender) => {
     for(listener of server.clients) {
@@ -0,0 +1,263 @@
+package subscriber
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"pub-sub/logging"
+	"sync"
+)
+
+//ErrClientClosed is returned by Subscribe after Close
+var ErrClientClosed = errors.New("client is closed")
+
+//Message struct definition
+type Message struct {
+	ID        string `json:"id"`
+	AccountID string `json:"accountId"`
+	Data      string `json:"data"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+//Config configures Client
+type Config struct {
+	//Address is host:port of the publisher
+	Address string
+	//TLS makes the client connect with wss:// when it is set
+	TLS *tls.Config
+	//Reconnect decides when to connect again, DefaultReconnect is used when it is nil
+	Reconnect ReconnectPolicy
+	//Clock waits between attempts to connect, SystemClock is used when it is nil
+	Clock Clock
+	//Buffer is the capacity of message channels
+	Buffer int
+	Logger *logging.Logger
+}
+
+//Options select messages of a subscription, all messages are passed without them
+type Options struct {
+	//AccountID passes only messages of the account
+	AccountID string
+	//AccountIDs passes only messages of these accounts, together with AccountID
+	AccountIDs []string
+	//ExcludeAccountIDs drops messages of these accounts
+	ExcludeAccountIDs []string
+	//Filter passes only messages it returns true for
+	Filter func(Message) bool
+}
+
+// matcher returns function that reports whether a message passes options, sets of accounts
+// are built once for all messages
+func (o Options) matcher() func(Message) bool {
+	include := set(o.AccountIDs)
+	if o.AccountID != "" {
+		include[o.AccountID] = true
+	}
+	exclude := set(o.ExcludeAccountIDs)
+	return func(msg Message) bool {
+		if len(include) > 0 && !include[msg.AccountID] || exclude[msg.AccountID] {
+			return false
+		}
+		return o.Filter == nil || o.Filter(msg)
+	}
+}
+
+func set(values []string) map[string]bool {
+	result := map[string]bool{}
+	for _, value := range values {
+		result[value] = true
+	}
+	return result
+}
+
+//Client subscribes to messages of the publisher, every subscription has its own connection
+type Client struct {
+	config Config
+
+	mu            sync.Mutex
+	closed        bool
+	subscriptions map[*Subscription]bool
+}
+
+//NewClient returns new Client for the publisher in config
+func NewClient(config Config) *Client {
+	return &Client{config: config, subscriptions: map[*Subscription]bool{}}
+}
+
+//Subscribe connects to the publisher and returns Subscription with messages that match options.
+//The subscription ends when ctx is done, when it is closed, or when the reconnect policy gives
+//up. Subscribe returns error if that happens before the first connection.
+func (c *Client) Subscribe(ctx context.Context, options Options) (*Subscription, error) {
+	config := c.config
+	if config.Clock == nil {
+		config.Clock = SystemClock
+	}
+	receiver := newMessageReceiver(config.Address, config.TLS, config.Logger)
+	receiver.Reconnect = config.Reconnect
+	receiver.Clock = config.Clock
+	messages := make(chan Message, config.Buffer)
+	events := make(chan Event, eventsBuffer)
+	s := &Subscription{
+		Messages: messages,
+		Events:   events,
+		receiver: receiver,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClientClosed
+	}
+	c.subscriptions[s] = true
+	c.mu.Unlock()
+
+	go s.watch(ctx)
+	if err := receiver.Connect(); err != nil {
+		close(s.done)
+		c.remove(s)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	go func() {
+		s.run(options, config, messages, events)
+		c.remove(s)
+	}()
+	return s, nil
+}
+
+//SubscribeFunc passes messages that match options to handle until the subscription ends, and
+//returns why it ended. It returns nil when the client is closed.
+func (c *Client) SubscribeFunc(ctx context.Context, options Options, handle func(Message)) error {
+	s, err := c.Subscribe(ctx, options)
+	if err != nil {
+		return err
+	}
+	for msg := range s.Messages {
+		handle(msg)
+	}
+	return s.Err()
+}
+
+//Close ends all subscriptions and waits until their messages channels are closed
+func (c *Client) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	subscriptions := []*Subscription{}
+	for s := range c.subscriptions {
+		subscriptions = append(subscriptions, s)
+	}
+	c.mu.Unlock()
+
+	for _, s := range subscriptions {
+		s.Close()
+	}
+	return nil
+}
+
+func (c *Client) remove(s *Subscription) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.subscriptions, s)
+}
+
+//Subscription is a stream of messages from one connection to the publisher
+type Subscription struct {
+	//Messages is closed when the subscription ends, Err tells why
+	Messages <-chan Message
+	//Events tells when messages were missed because the connection was lost. It is closed
+	//together with Messages, events are dropped when it is full.
+	Events <-chan Event
+
+	receiver *MessageReceiver
+	// stop is closed by Close or when ctx is done, done once Messages is closed
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+//Err returns why the subscription ended, nil while it runs and after Close
+func (s *Subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+//Status returns counts of attempts to connect to the publisher
+func (s *Subscription) Status() ReceiverStatus {
+	return s.receiver.Status()
+}
+
+//Done returns channel that is closed once Messages is closed
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+//Close ends the subscription and waits until Messages is closed. Messages that were not read are dropped.
+func (s *Subscription) Close() error {
+	s.halt()
+	<-s.done
+	return nil
+}
+
+func (s *Subscription) halt() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+}
+
+// watch closes the receiver when ctx is done or the subscription is closed, also while it
+// connects for the first time
+func (s *Subscription) watch(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		s.setErr(ctx.Err())
+		s.halt()
+	case <-s.stop:
+	case <-s.done:
+		return
+	}
+	s.receiver.CloseMessage()
+	s.receiver.Close()
+}
+
+func (s *Subscription) setErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// run passes messages through the pipeline until the receiver is closed, and closes done once
+// messages and events are closed
+func (s *Subscription) run(options Options, config Config, messages chan<- Message, events chan<- Event) {
+	defer close(s.done)
+	raw := make(chan []byte, config.Buffer)
+	parsed := make(chan Message, config.Buffer)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		messageParserHandler(raw, parsed, config.Logger)
+	}()
+	go func() {
+		defer wg.Done()
+		messageFilterHandler(parsed, messages, options.matcher(), s.stop)
+	}()
+
+	if err := messageReceiverHandler(s.receiver, raw, events, s.stop, config.Clock, config.Logger); err != nil {
+		s.setErr(err)
+		s.receiver.Close()
+	}
+	close(events)
+	close(raw)
+	wg.Wait()
+}
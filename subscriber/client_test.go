@@ -0,0 +1,316 @@
+package subscriber_test
+
+import (
+	"context"
+	"errors"
+	"pub-sub/logging"
+	"pub-sub/subscriber"
+	"pub-sub/subscriber/subscribertest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// receive reads messages of subscription until one with ID that starts with last, or until a second passes
+func receive(subscription *subscriber.Subscription, last string) []subscriber.Message {
+	received := []subscriber.Message{}
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case msg, ok := <-subscription.Messages:
+			if !ok || strings.HasPrefix(msg.ID, last) {
+				return received
+			}
+			received = append(received, msg)
+		case <-timeout:
+			return received
+		}
+	}
+}
+
+// ended waits until Messages of subscription is closed
+func ended(t *testing.T, subscription *subscriber.Subscription) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-subscription.Messages:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("Expected messages channel to be closed")
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	messages := []string{
+		"wrong",
+		`{"id": "1", "accountId": "test", "data": "data", "timestamp": 1}`,
+		`{"id": "2", "accountId": "test1", "data": "temperature", "timestamp": 2}`,
+		`{"id": "3", "accountId": "test", "data": "temperature", "timestamp": 3}`,
+		// one of them passes every filter, so that the test knows all messages were received
+		`{"id": "last", "accountId": "test", "data": "temperature", "timestamp": 4}`,
+		`{"id": "last1", "accountId": "test1", "data": "temperature", "timestamp": 5}`,
+	}
+	testCases := []struct {
+		desc     string
+		options  subscriber.Options
+		expected []string
+	}{
+		{
+			desc:     "Should receive every parsed message without options",
+			expected: []string{"1", "2", "3"},
+		},
+		{
+			desc:     "Should receive only messages of account",
+			options:  subscriber.Options{AccountID: "test"},
+			expected: []string{"1", "3"},
+		},
+		{
+			desc:     "Should receive only messages of accounts",
+			options:  subscriber.Options{AccountIDs: []string{"test1", "other"}},
+			expected: []string{"2"},
+		},
+		{
+			desc:     "Should receive messages of account and accounts",
+			options:  subscriber.Options{AccountID: "test", AccountIDs: []string{"test1"}},
+			expected: []string{"1", "2", "3"},
+		},
+		{
+			desc:     "Should not receive messages of excluded accounts",
+			options:  subscriber.Options{ExcludeAccountIDs: []string{"test1"}},
+			expected: []string{"1", "3"},
+		},
+		{
+			desc:     "Should not receive messages of excluded accounts that are included too",
+			options:  subscriber.Options{AccountIDs: []string{"test", "test1"}, ExcludeAccountIDs: []string{"test"}},
+			expected: []string{"2"},
+		},
+		{
+			desc: "Should receive only messages passing filter",
+			options: subscriber.Options{Filter: func(msg subscriber.Message) bool {
+				return strings.HasPrefix(msg.Data, "temp")
+			}},
+			expected: []string{"2", "3"},
+		},
+		{
+			desc: "Should receive only messages of account passing filter",
+			options: subscriber.Options{AccountID: "test", Filter: func(msg subscriber.Message) bool {
+				return strings.HasPrefix(msg.Data, "temp")
+			}},
+			expected: []string{"3"},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			publisher := subscribertest.NewPublisher()
+			defer publisher.Close()
+			client := subscriber.NewClient(subscriber.Config{Address: publisher.Address()})
+			defer client.Close()
+
+			subscription, err := client.Subscribe(context.Background(), tC.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			publisher.Publish(t, messages...)
+
+			ids := []string{}
+			for _, msg := range receive(subscription, "last") {
+				ids = append(ids, msg.ID)
+			}
+			if !reflect.DeepEqual(ids, tC.expected) {
+				t.Errorf("Expected messages %v, got %v", tC.expected, ids)
+			}
+		})
+	}
+}
+
+// nextEvent returns the next event of subscription
+func nextEvent(t *testing.T, subscription *subscriber.Subscription) subscriber.Event {
+	select {
+	case event := <-subscription.Events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected event")
+	}
+	return subscriber.Event{}
+}
+
+func TestSubscriptionReconnects(t *testing.T) {
+	publisher := subscribertest.NewPublisher()
+	defer publisher.Close()
+	recorder := logging.NewRecorder()
+	client := subscriber.NewClient(subscriber.Config{
+		Address:   publisher.Address(),
+		Reconnect: subscriber.Backoff{Initial: time.Millisecond, Max: 10 * time.Millisecond, Multiplier: 2},
+		Logger:    logging.New(recorder),
+	})
+	defer client.Close()
+
+	subscription, err := client.Subscribe(context.Background(), subscriber.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher.Publish(t, `{"id": "1"}`)
+	if msg := <-subscription.Messages; msg.ID != "1" {
+		t.Fatalf("Expected message 1, got %v", msg)
+	}
+
+	// the second connection is lost right after it was restored
+	for i := 0; i < 2; i++ {
+		publisher.Disconnect()
+		if event := nextEvent(t, subscription); event.Type != subscriber.EventDisconnected || event.Err == nil {
+			t.Errorf("Expected disconnected event with error, got %+v", event)
+		}
+		if event := nextEvent(t, subscription); event.Type != subscriber.EventReconnected || event.Downtime < 0 {
+			t.Errorf("Expected reconnected event, got %+v", event)
+		}
+	}
+	publisher.Publish(t, `{"id": "2"}`, `{"id": "3"}`, `{"id": "last"}`)
+
+	ids := []string{}
+	for _, msg := range receive(subscription, "last") {
+		ids = append(ids, msg.ID)
+	}
+	if expected := []string{"2", "3"}; !reflect.DeepEqual(ids, expected) {
+		t.Errorf("Expected messages %v after reconnecting, got %v", expected, ids)
+	}
+	if status := subscription.Status(); status.Reconnects != 2 {
+		t.Errorf("Expected 2 reconnects, got %+v", status)
+	}
+	if banners := recorder.Find("Publisher confirmed connection"); len(banners) != 3 {
+		t.Errorf("Expected banner of every connection to be handled, got %d", len(banners))
+	}
+	if skipped := recorder.Find("Skipping message that is not JSON"); len(skipped) != 0 {
+		t.Errorf("Expected no message to be skipped, got %v", skipped)
+	}
+}
+
+func TestSubscriptionEnds(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		end           func(cancel context.CancelFunc, client *subscriber.Client, subscription *subscriber.Subscription, publisher *subscribertest.Publisher)
+		expectedError error
+	}{
+		{
+			desc: "Context is canceled",
+			end: func(cancel context.CancelFunc, client *subscriber.Client, subscription *subscriber.Subscription, publisher *subscribertest.Publisher) {
+				cancel()
+			},
+			expectedError: context.Canceled,
+		},
+		{
+			desc: "Subscription is closed",
+			end: func(cancel context.CancelFunc, client *subscriber.Client, subscription *subscriber.Subscription, publisher *subscribertest.Publisher) {
+				subscription.Close()
+			},
+		},
+		{
+			desc: "Client is closed",
+			end: func(cancel context.CancelFunc, client *subscriber.Client, subscription *subscriber.Subscription, publisher *subscribertest.Publisher) {
+				client.Close()
+			},
+		},
+		{
+			desc: "Reconnect policy gives up",
+			end: func(cancel context.CancelFunc, client *subscriber.Client, subscription *subscriber.Subscription, publisher *subscribertest.Publisher) {
+				publisher.Close()
+			},
+			expectedError: subscriber.ErrGaveUp,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			publisher := subscribertest.NewPublisher()
+			defer publisher.Close()
+			client := subscriber.NewClient(subscriber.Config{Address: publisher.Address(), Reconnect: subscriber.NoReconnect})
+			defer client.Close()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			subscription, err := client.Subscribe(ctx, subscriber.Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// nobody reads the messages when the subscription ends
+			publisher.Publish(t, `{"id": "1"}`, `{"id": "2"}`)
+			time.Sleep(100 * time.Millisecond)
+
+			tC.end(cancel, client, subscription, publisher)
+			ended(t, subscription)
+			if err := subscription.Err(); !errors.Is(err, tC.expectedError) || (err == nil) != (tC.expectedError == nil) {
+				t.Errorf("Expected %v, got %v", tC.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestSubscribeFails(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	closed := subscriber.NewClient(subscriber.Config{})
+	closed.Close()
+
+	testCases := []struct {
+		desc          string
+		client        *subscriber.Client
+		ctx           context.Context
+		expectedError error
+	}{
+		{
+			desc:          "Publisher is unreachable",
+			client:        subscriber.NewClient(subscriber.Config{Address: subscribertest.Unreachable(), Reconnect: subscriber.NoReconnect}),
+			ctx:           context.Background(),
+			expectedError: subscriber.ErrGaveUp,
+		},
+		{
+			desc:          "Context is canceled while connecting",
+			client:        subscriber.NewClient(subscriber.Config{Address: subscribertest.Unreachable(), Reconnect: subscriber.ConstantDelay(time.Hour)}),
+			ctx:           canceled,
+			expectedError: context.Canceled,
+		},
+		{
+			desc:          "Client is closed",
+			client:        closed,
+			ctx:           context.Background(),
+			expectedError: subscriber.ErrClientClosed,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			subscription, err := tC.client.Subscribe(tC.ctx, subscriber.Options{})
+			if subscription != nil {
+				t.Error("Expected no subscription")
+			}
+			if !errors.Is(err, tC.expectedError) {
+				t.Errorf("Expected %v, got %v", tC.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestSubscribeFunc(t *testing.T) {
+	publisher := subscribertest.NewPublisher()
+	defer publisher.Close()
+	client := subscriber.NewClient(subscriber.Config{Address: publisher.Address()})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go publisher.Publish(t, `{"id": "1", "accountId": "test"}`, `{"id": "2", "accountId": "test1"}`, `{"id": "3", "accountId": "test"}`)
+	received := []string{}
+	err := client.SubscribeFunc(ctx, subscriber.Options{AccountID: "test"}, func(msg subscriber.Message) {
+		received = append(received, msg.ID)
+		if len(received) == 2 {
+			cancel()
+		}
+	})
+
+	if err != context.Canceled {
+		t.Errorf("Expected %v, got %v", context.Canceled, err)
+	}
+	if expected := []string{"1", "3"}; !reflect.DeepEqual(received, expected) {
+		t.Errorf("Expected messages %v, got %v", expected, received)
+	}
+}
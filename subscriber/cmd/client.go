@@ -1,181 +1,205 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/tls"
 	"flag"
-	"log"
+	"fmt"
 	"os"
 	"os/signal"
+	"pub-sub/logging"
+	"pub-sub/subscriber"
 	"time"
 )
 
-//Message struct definition
-type Message struct {
-	AccountID string `json:"accountId"`
-	Data      string `json:"data"`
-	Timestamp int64  `json:"timestamp"`
+// messageFields identify message in log records
+func messageFields(msg subscriber.Message) []logging.Field {
+	return []logging.Field{logging.F(logging.KeyMessageID, msg.ID), logging.F(logging.KeyAccountID, msg.AccountID)}
 }
 
-func messageReceiverHandler(messages chan []byte, close chan bool, messageReceiver Receiver) {
-	for {
-		if messageReceiver.IsClosed() {
-			//send close to all three other routines
-			for i := 0; i < 3; i++ {
-				close <- true
-			}
-			return
+// subscriptionHandler closes subscription once ctx is done, and fails when the subscription ends by itself
+func subscriptionHandler(ctx context.Context, subscription *subscriber.Subscription) error {
+	select {
+	case <-ctx.Done():
+		return subscription.Close()
+	case <-subscription.Done():
+		if ctx.Err() != nil {
+			//ended because of the same cancellation
+			return nil
 		}
-
-		message := messageReceiver.ReadMessage()
-		if len(message) == 0 {
-			continue
-		}
-
-		messages <- message
+		return subscription.Err()
 	}
 }
 
-func messageParserHandler(messages chan []byte, close chan bool, parsedMessages chan Message) {
-	for {
-		select {
-		case msg := <-messages:
-			messageObject := Message{}
-			err := json.Unmarshal(msg, &messageObject)
-			if err != nil {
-				continue
-			}
-			parsedMessages <- messageObject
-		case <-close:
-			return
-		}
-	}
-}
+// multiplexerHandler passes filtered messages to the aggregator or the printer, and closes both
+// channels once filteredMessages is closed
+func multiplexerHandler(ctx context.Context, filteredMessages <-chan subscriber.Message, aggregatedMessages chan<- subscriber.Message, printedMessages chan<- subscriber.Message, aggregateMessages bool) error {
+	defer close(aggregatedMessages)
+	defer close(printedMessages)
 
-func messageFilterHandler(parsedMessages chan Message, filteredMessages chan Message, close chan bool, idFilter string) {
-	for {
-		select {
-		case msg := <-parsedMessages:
-			if idFilter != "" {
-				if msg.AccountID == idFilter {
-					filteredMessages <- msg
-				}
-				continue
-			}
-			filteredMessages <- msg
-		case <-close:
-			return
-		}
+	out := printedMessages
+	if aggregateMessages {
+		out = aggregatedMessages
 	}
-}
-
-func multiplexerHandler(filteredMessages chan Message, aggregatedMessages chan Message, printedMessages chan Message, close chan bool, aggregateMessages bool) {
-	for {
+	for msg := range filteredMessages {
 		select {
-		case msg := <-filteredMessages:
-			if aggregateMessages {
-				aggregatedMessages <- msg
-				continue
-			}
-			printedMessages <- msg
-		case <-close:
-			return
+		case out <- msg:
+		case <-ctx.Done():
+			return nil
 		}
-
 	}
+	return nil
 }
 
-func messagePrinterHandler(printedMessages chan Message, interrupt chan os.Signal, done chan bool, close chan bool, messageReceiver Receiver) {
-	for {
-		select {
-		case msg := <-printedMessages:
-			log.Printf("Received a data from active account id %s: data: %s, time: %d", msg.AccountID, msg.Data, msg.Timestamp)
-		case <-interrupt:
-			messageReceiver.Close()
-			messageReceiver.CloseMessage()
-			select {
-			case <-time.After(time.Second):
-			}
-			done <- true
-			return
-		case <-close:
-			return
-		}
-
+// messagePrinterHandler prints messages until printedMessages is closed
+func messagePrinterHandler(printedMessages <-chan subscriber.Message, logger *logging.Logger) error {
+	for msg := range printedMessages {
+		logger.Info("Received message", append(messageFields(msg), logging.F("data", msg.Data), logging.F("timestamp", msg.Timestamp))...)
 	}
+	return nil
 }
 
-func messageAggregatorHandler(aggregatedMessages chan Message, aggregateFrequency int, interrupt chan os.Signal, done chan bool, close chan bool, messageReceiver Receiver) {
+// messageAggregatorHandler counts messages by account and prints the counts every aggregateFrequency
+// seconds until aggregatedMessages is closed
+func messageAggregatorHandler(aggregatedMessages <-chan subscriber.Message, aggregateFrequency int, logger *logging.Logger) error {
 	ticker := time.NewTicker(time.Duration(aggregateFrequency) * time.Second)
 	defer ticker.Stop()
 
 	aggregateCounter := map[string]int{}
 	for {
 		select {
-		case msg := <-aggregatedMessages:
+		case msg, ok := <-aggregatedMessages:
+			if !ok {
+				return nil
+			}
 			aggregateCounter[msg.AccountID] = aggregateCounter[msg.AccountID] + 1
 		case <-ticker.C:
-			log.Print("Aggregated messages received for accounts\n")
 			for key, val := range aggregateCounter {
-				log.Printf("ID: %s, number of messages %d", key, val)
+				logger.Info("Aggregated messages received", logging.F(logging.KeyAccountID, key), logging.F("messages", val))
 			}
-		case <-interrupt:
-			messageReceiver.Close()
-			messageReceiver.CloseMessage()
-
-			select {
-			case <-time.After(time.Second):
-			}
-			done <- true
-			return
-		case <-close:
-			return
 		}
 	}
 }
 
-func createMessageHandler(messageReceiver Receiver, filter string, aggregate bool, aggregateFrequency int, interrupt chan os.Signal, done chan bool) {
-	messages := make(chan []byte, 5)
-	close := make(chan bool, 1)
-	parsedMessages := make(chan Message, 5)
-	filteredMessages := make(chan Message, 5)
-	aggregatedMessages := make(chan Message, 5)
-	printedMessages := make(chan Message, 5)
-
-	go messageReceiverHandler(messages, close, messageReceiver)
-	go messageParserHandler(messages, close, parsedMessages)
-	go messageFilterHandler(parsedMessages, filteredMessages, close, filter)
-	go multiplexerHandler(filteredMessages, aggregatedMessages, printedMessages, close, aggregate)
+// eventHandler logs gaps in messages until events is closed
+func eventHandler(events <-chan subscriber.Event, logger *logging.Logger) error {
+	for event := range events {
+		if event.Type == subscriber.EventReconnected {
+			logger.Warn("Messages published while reconnecting were missed", logging.F("downtime", event.Downtime))
+		}
+	}
+	return nil
+}
 
+// createMessageHandler prints or aggregates messages of subscription until ctx is done or the
+// subscription ends. Stages are stopped in order, every one once its input is closed, and the
+// first failure stops all of them.
+func createMessageHandler(ctx context.Context, subscription *subscriber.Subscription, aggregate bool, aggregateFrequency int, logger *logging.Logger) error {
+	aggregatedMessages := make(chan subscriber.Message, 5)
+	printedMessages := make(chan subscriber.Message, 5)
+
+	g, ctx := newGroup(ctx)
+	g.Go(func() error {
+		return subscriptionHandler(ctx, subscription)
+	})
+	g.Go(func() error {
+		return eventHandler(subscription.Events, logger)
+	})
+	g.Go(func() error {
+		return multiplexerHandler(ctx, subscription.Messages, aggregatedMessages, printedMessages, aggregate)
+	})
 	if aggregate {
-		go messageAggregatorHandler(aggregatedMessages, aggregateFrequency, interrupt, done, close, messageReceiver)
+		g.Go(func() error {
+			return messageAggregatorHandler(aggregatedMessages, aggregateFrequency, logger)
+		})
 	} else {
-		go messagePrinterHandler(printedMessages, interrupt, done, close, messageReceiver)
+		g.Go(func() error {
+			return messagePrinterHandler(printedMessages, logger)
+		})
 	}
+	return g.Wait()
 }
 
 func main() {
 	var (
 		addr               = flag.String("addr", "0.0.0.0:8000", "http service address")
-		filter             = flag.String("filter", "", "AccountID to filter data")
 		aggregate          = flag.Bool("agg", false, "Print messages of aggregated amount of messages")
 		aggregateFrequency = flag.Int("aggfreq", 3, "Only if agg=true, set time for updation of screen for aggregated data")
+		secure             = flag.Bool("tls", false, "Connect to publisher with wss://")
+		caFile             = flag.String("cacert", "", "Only if tls=true, PEM file with CAs to trust instead of the system ones")
+		serverName         = flag.String("servername", "", "Only if tls=true, name in the publisher certificate, if it is not the host of addr")
+		logLevel           = flag.String("loglevel", "info", "Log level: debug, info, warn or error")
+		logFormat          = flag.String("logformat", "logfmt", "Log format: logfmt or json")
+		reconnect          = subscriber.Backoff{}
+		accounts           accountList
+		excluded           accountList
+		accountsFile       = flag.String("filterfile", "", "File with AccountIDs to filter data, one per line")
+		excludedFile       = flag.String("excludefile", "", "File with AccountIDs to drop data of, one per line")
+		expression         = flag.String("expr", "", `Filter expression over id, accountId, data and timestamp, e.g. accountId in ("a", "b") && data =~ "^temp" && timestamp > now-5m`)
 	)
+	flag.Var(&accounts, "filter", "AccountID to filter data, repeat to filter more accounts")
+	flag.Var(&excluded, "exclude", "AccountID to drop data of, can be repeated")
+	flag.DurationVar(&reconnect.Initial, "reconnect.initial", 500*time.Millisecond, "Delay before the first reconnect attempt, multiplied after every failed attempt")
+	flag.DurationVar(&reconnect.Max, "reconnect.max", 30*time.Second, "Longest delay between reconnect attempts")
+	flag.Float64Var(&reconnect.Multiplier, "reconnect.multiplier", 2, "Multiplier of the delay after every failed attempt")
+	flag.Float64Var(&reconnect.Jitter, "reconnect.jitter", 0.2, "Fraction of every delay that is randomized, between 0 and 1")
+	flag.IntVar(&reconnect.MaxAttempts, "reconnect.attempts", 0, "Exit after that many failed attempts to connect in a row, 0 tries forever")
+	flag.DurationVar(&reconnect.Deadline, "reconnect.deadline", 0, "Exit when connecting fails for that long, 0 tries forever")
 	flag.Parse()
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
-	done := make(chan bool, 1)
 
-	log.Printf("connecting to %s", *addr)
-	messageReceiver := NewMessageReceiver(*addr)
-	messageReceiver.Connect()
-	defer messageReceiver.Close()
+	if err := reconnect.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	options, err := subscriptionOptions(accounts, excluded, *accountsFile, *excludedFile, *expression)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
-	createMessageHandler(messageReceiver, *filter, *aggregate, *aggregateFrequency, interrupt, done)
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	format, err := logging.ParseFormat(*logFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	logger := logging.New(logging.NewWriter(os.Stderr, format, logging.NewAtomicLevel(level)))
 
-	for {
-		select {
-		case <-done:
-			os.Exit(0)
+	var tlsConfig *tls.Config
+	if *secure {
+		if tlsConfig, err = subscriber.NewTLSConfig(*caFile, *serverName); err != nil {
+			logger.Error("Invalid TLS config", logging.Err(err))
+			os.Exit(1)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		cancel()
+	}()
+
+	logger.Info("Connecting to publisher", logging.F("address", *addr))
+	client := subscriber.NewClient(subscriber.Config{Address: *addr, TLS: tlsConfig, Reconnect: reconnect, Buffer: 5, Logger: logger})
+	subscription, err := client.Subscribe(ctx, options)
+	if err != nil {
+		if ctx.Err() != nil {
+			//interrupted while connecting
+			return
 		}
+		logger.Error("Subscribing to publisher failed", logging.Err(err))
+		os.Exit(1)
+	}
+
+	if err := createMessageHandler(ctx, subscription, *aggregate, *aggregateFrequency, logger); err != nil {
+		status := subscription.Status()
+		logger.Error("Subscription ended", logging.Err(err), logging.F("reconnects", status.Reconnects), logging.F("failed_attempts", status.FailedAttempts))
+		os.Exit(1)
 	}
 }
@@ -1,514 +1,465 @@
 package main
 
 import (
-	"bufio"
-	"log"
-	"os"
+	"context"
+	"errors"
+	"fmt"
+	"pub-sub/logging"
+	"pub-sub/subscriber"
+	"pub-sub/subscriber/subscribertest"
 	"reflect"
+	"runtime"
 	"testing"
 	"time"
 )
 
-func setLoggerToFile(fileName string) {
-	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-	if err != nil {
-		log.Fatalln("Failed to open log file %s, %s", fileName, err)
+// printedMessages returns "account: data" of every message printed to recorder
+func printedMessages(recorder *logging.Recorder) []string {
+	printed := []string{}
+	for _, record := range recorder.Find("Received message") {
+		accountID, _ := record.Field(logging.KeyAccountID)
+		data, _ := record.Field("data")
+		printed = append(printed, fmt.Sprintf("%v: %v", accountID, data))
 	}
-	log.SetFlags(0)
-	log.SetOutput(file)
+	return printed
 }
 
-func Test_messageReceiverHandler(t *testing.T) {
-	sendMessageString := `{"accountId": "test", "data": "data", "timestamp": 1}`
-	receiveMessage := `{"accountId": "test", "data": "data", "timestamp": 1}`
-	t.Run("Should receive and resend the data he gets", func(t *testing.T) {
-		mr := connectWS()
-		defer closeWS(mr)
-		messages := make(chan []byte)
-		close := make(chan bool)
-		go messageReceiverHandler(messages, close, mr)
-
-		//firt message should be successfully connected one
-		successMsg := <-messages
-		if string(successMsg) != ConnectedMessage {
-			t.Errorf("Expected successfully connected message: %s, got %s", ConnectedMessage, successMsg)
-		}
-
-		go sendMessage(sendMessageString)
-
-		msg := <-messages
-		if string(msg) != receiveMessage {
-			t.Errorf("Expected %s, got %s", receiveMessage, msg)
-		}
-	})
-}
-func Test_messageParserHandler(t *testing.T) {
-	sendMessageString := `{"accountId": "test", "data": "data", "timestamp": 1}`
-	testCases := []struct {
-		desc           string
-		sendMessages   []string
-		expectedObject Message
-	}{
-		{
-			desc:           "Should parse correct JSON data",
-			sendMessages:   []string{sendMessageString},
-			expectedObject: Message{"test", "data", 1},
-		},
-		{
-			desc:           "Should skip incorrect JSON data",
-			sendMessages:   []string{"wrong", "wrong2", "wrong3", sendMessageString},
-			expectedObject: Message{"test", "data", 1},
-		},
+// aggregatedCounts returns the last number of messages aggregated to recorder by account
+func aggregatedCounts(recorder *logging.Recorder) map[string]interface{} {
+	counts := map[string]interface{}{}
+	for _, record := range recorder.Find("Aggregated messages received") {
+		accountID, _ := record.Field(logging.KeyAccountID)
+		counts[fmt.Sprint(accountID)], _ = record.Field("messages")
 	}
-	for _, tC := range testCases {
-		messages := make(chan []byte)
-		close := make(chan bool)
-		parsedData := make(chan Message)
-		go messageParserHandler(messages, close, parsedData)
-
-		for _, msg := range tC.sendMessages {
-			messages <- []byte(msg)
-		}
-
-		parsedObject := <-parsedData
+	return counts
+}
 
-		eq := reflect.DeepEqual(parsedObject, tC.expectedObject)
-		if !eq {
-			t.Errorf("Expected %v, got %v", tC.expectedObject, parsedObject)
+// checkGoroutines fails the test if more than before goroutines still run after a second
+func checkGoroutines(t *testing.T, before int) {
+	for start := time.Now(); runtime.NumGoroutine() > before; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			stacks := make([]byte, 1<<16)
+			stacks = stacks[:runtime.Stack(stacks, true)]
+			t.Fatalf("Expected at most %d goroutines, got %d:\n%s", before, runtime.NumGoroutine(), stacks)
 		}
-		close <- true
 	}
 }
 
-func Test_messageFilterHandler(t *testing.T) {
-	testCases := []struct {
-		desc           string
-		filter         string
-		sendMessages   []Message
-		expectedObject Message
-	}{
-		{
-			desc:           "Should send every data if filter is empty",
-			sendMessages:   []Message{Message{"test", "data", 1}},
-			expectedObject: Message{"test", "data", 1},
-		},
-		{
-			desc:           "Should send only data with correct id",
-			sendMessages:   []Message{Message{"test", "data", 1}, Message{"test2", "data", 1}, Message{"test3", "data", 1}},
-			filter:         "test3",
-			expectedObject: Message{"test3", "data", 1},
-		},
-	}
-	for _, tC := range testCases {
-		t.Run(tC.desc, func(t *testing.T) {
-			parsedData := make(chan Message)
-			filteredData := make(chan Message)
-			close := make(chan bool)
-			go messageFilterHandler(parsedData, filteredData, close, tC.filter)
-
-			for _, msg := range tC.sendMessages {
-				parsedData <- msg
-			}
-
-			filteredObject := <-filteredData
-
-			eq := reflect.DeepEqual(filteredObject, tC.expectedObject)
-			if !eq {
-				t.Errorf("Expected %v, got %v", tC.expectedObject, filteredObject)
-			}
-		})
+// subscribe returns subscription to publisher with messages of account filter
+func subscribe(t *testing.T, publisher *subscribertest.Publisher, filter string) *subscriber.Subscription {
+	client := subscriber.NewClient(subscriber.Config{Address: publisher.Address(), Reconnect: subscriber.NoReconnect, Buffer: 5})
+	subscription, err := client.Subscribe(context.Background(), subscriber.Options{AccountID: filter})
+	if err != nil {
+		t.Fatal(err)
 	}
+	return subscription
 }
 
 func Test_multiplexerHandler(t *testing.T) {
 	testCases := []struct {
 		desc           string
-		sendMessage    Message
-		expectedObject Message
+		sendMessage    subscriber.Message
+		expectedObject subscriber.Message
 		isAggregator   bool
 	}{
 		{
 			desc:           "Should send data to printed data channel",
-			sendMessage:    Message{"test", "data", 1},
-			expectedObject: Message{"test", "data", 1},
+			sendMessage:    subscriber.Message{AccountID: "test", Data: "data", Timestamp: 1},
+			expectedObject: subscriber.Message{AccountID: "test", Data: "data", Timestamp: 1},
 		},
 		{
 			desc:           "Should send data to aggregated data channel",
-			sendMessage:    Message{"test", "data", 1},
+			sendMessage:    subscriber.Message{AccountID: "test", Data: "data", Timestamp: 1},
 			isAggregator:   true,
-			expectedObject: Message{"test", "data", 1},
+			expectedObject: subscriber.Message{AccountID: "test", Data: "data", Timestamp: 1},
 		},
 	}
 	for _, tC := range testCases {
 		t.Run(tC.desc, func(t *testing.T) {
-			filteredData := make(chan Message)
-			printedData := make(chan Message)
-			aggregatedData := make(chan Message)
-			close := make(chan bool)
-			go multiplexerHandler(filteredData, aggregatedData, printedData, close, tC.isAggregator)
+			filteredData := make(chan subscriber.Message, 1)
+			printedData := make(chan subscriber.Message, 1)
+			aggregatedData := make(chan subscriber.Message, 1)
 
 			filteredData <- tC.sendMessage
+			close(filteredData)
+			if err := multiplexerHandler(context.Background(), filteredData, aggregatedData, printedData, tC.isAggregator); err != nil {
+				t.Fatal(err)
+			}
 
+			out, other := printedData, aggregatedData
 			if tC.isAggregator {
-				aggregatedObject := <-aggregatedData
-				eq := reflect.DeepEqual(aggregatedObject, tC.expectedObject)
-				if !eq {
-					t.Errorf("Expected %v, got %v", tC.expectedObject, aggregatedObject)
-				}
-			} else {
-				printedData := <-printedData
-				eq := reflect.DeepEqual(printedData, tC.expectedObject)
-				if !eq {
-					t.Errorf("Expected %v, got %v", tC.expectedObject, printedData)
-				}
+				out, other = aggregatedData, printedData
+			}
+			if msg := <-out; !reflect.DeepEqual(msg, tC.expectedObject) {
+				t.Errorf("Expected %v, got %v", tC.expectedObject, msg)
+			}
+			if _, ok := <-out; ok {
+				t.Error("Expected channel to be closed")
+			}
+			if _, ok := <-other; ok {
+				t.Error("Expected other channel to be closed")
 			}
-
 		})
 	}
+	t.Run("Should stop sending when context is canceled", func(t *testing.T) {
+		filteredData := make(chan subscriber.Message, 1)
+		printedData := make(chan subscriber.Message)
+		aggregatedData := make(chan subscriber.Message)
+		ctx, cancel := context.WithCancel(context.Background())
+
+		filteredData <- subscriber.Message{AccountID: "test"}
+		cancel()
+		if err := multiplexerHandler(ctx, filteredData, aggregatedData, printedData, false); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := <-printedData; ok {
+			t.Error("Expected printed data channel to be closed")
+		}
+	})
 }
 
 func Test_messagePrinterHandler(t *testing.T) {
 	testCases := []struct {
-		desc         string
-		fileName     string
-		sendMessage  Message
-		expected     string
-		expectedLogs int
+		desc        string
+		sendMessage subscriber.Message
 	}{
 		{
-			desc:         "Should print received data",
-			fileName:     "test2.txt",
-			sendMessage:  Message{"test", "data", 1},
-			expected:     "Received a data from active account id test: data: data, time: 1",
-			expectedLogs: 1,
+			desc:        "Should print received data",
+			sendMessage: subscriber.Message{ID: "message-1", AccountID: "test", Data: "data", Timestamp: 1},
 		},
 	}
 	for _, tC := range testCases {
 		t.Run(tC.desc, func(t *testing.T) {
-			setLoggerToFile(tC.fileName)
-
-			printedData := make(chan Message)
-			close := make(chan bool)
+			recorder := logging.NewRecorder()
+			printedData := make(chan subscriber.Message, 1)
 
-			go messagePrinterHandler(printedData, nil, nil, close, nil)
 			printedData <- tC.sendMessage
-
-			//wait for aggregator to log something
-			time.Sleep(500 * time.Millisecond)
-
-			fileWritten, err := os.OpenFile(tC.fileName, os.O_RDONLY, 0666)
-			if err != nil {
+			close(printedData)
+			if err := messagePrinterHandler(printedData, logging.New(recorder)); err != nil {
 				t.Fatal(err)
 			}
-			scanner := bufio.NewScanner(fileWritten)
-			counter := 0
-			for scanner.Scan() {
-				counter += 1
-				readLine := scanner.Text()
-				if readLine != tC.expected {
-					t.Errorf("Wanted logged line %s  got: %s", tC.expected, readLine)
-				}
+
+			records := recorder.Records()
+			if len(records) != 1 || records[0].Message != "Received message" {
+				t.Fatalf("Expected one received message record, got %v", records)
 			}
-			if counter != tC.expectedLogs {
-				t.Errorf("Expected number of logs: %d, got %d", tC.expectedLogs, counter)
+			expected := map[string]interface{}{
+				logging.KeyMessageID: tC.sendMessage.ID,
+				logging.KeyAccountID: tC.sendMessage.AccountID,
+				"data":               tC.sendMessage.Data,
+				"timestamp":          tC.sendMessage.Timestamp,
+			}
+			for key, value := range expected {
+				if field, _ := records[0].Field(key); field != value {
+					t.Errorf("Expected %s %v, got %v", key, value, field)
+				}
 			}
-			os.Remove(tC.fileName)
-
 		})
 	}
 }
 
 func Test_messageAggregatorHandler(t *testing.T) {
-	aggregateHeader := "Aggregated messages received for accounts"
 	testCases := []struct {
 		desc        string
-		fileName    string
-		sendMessage Message
-		expected    string
+		sendMessage subscriber.Message
 	}{
 		{
 			desc:        "Should print aggregated data",
-			fileName:    "test1.txt",
-			sendMessage: Message{"test", "data", 1},
-			expected:    "ID: test, number of messages 1",
+			sendMessage: subscriber.Message{AccountID: "test", Data: "data", Timestamp: 1},
 		},
 	}
 	for _, tC := range testCases {
 		t.Run(tC.desc, func(t *testing.T) {
-			setLoggerToFile(tC.fileName)
+			recorder := logging.NewRecorder()
+			aggregatedData := make(chan subscriber.Message)
+			done := make(chan error, 1)
 
-			aggregatedData := make(chan Message)
-			close := make(chan bool)
-
-			go messageAggregatorHandler(aggregatedData, 1, nil, nil, close, nil)
+			go func() {
+				done <- messageAggregatorHandler(aggregatedData, 1, logging.New(recorder))
+			}()
 			aggregatedData <- tC.sendMessage
 			//wait for aggregator to log something
-			time.Sleep(2 * time.Second)
-			close <- true
-			fileWritten, err := os.OpenFile(tC.fileName, os.O_RDONLY, 0666)
-			if err != nil {
+			time.Sleep(1500 * time.Millisecond)
+			close(aggregatedData)
+			if err := <-done; err != nil {
 				t.Fatal(err)
 			}
-			scanner := bufio.NewScanner(fileWritten)
-			for scanner.Scan() {
-				readLine := scanner.Text()
-				if readLine != aggregateHeader && readLine != tC.expected {
-					t.Errorf("Wanted logged line %s or %s, got: %s", aggregateHeader, tC.expected, readLine)
-				}
+
+			expected := map[string]interface{}{"test": 1}
+			if counts := aggregatedCounts(recorder); !reflect.DeepEqual(counts, expected) {
+				t.Errorf("Expected aggregated %v, got %v", expected, counts)
 			}
-			os.Remove(tC.fileName)
 		})
 	}
 }
 
-func Test_createMessageHandler_printer_filtering(t *testing.T) {
-	aggregateHeader := "Aggregated messages received for accounts"
+func Test_eventHandler(t *testing.T) {
 	testCases := []struct {
-		desc               string
-		fileName           string
-		filter             string
-		aggregate          bool
-		aggregateFrequency int
-		sendMessage        string
-		sendMessageFalse   string
-		expected           string
-		count              int
+		desc     string
+		events   []subscriber.Event
+		expected []interface{}
 	}{
 		{
-			desc:             "Should print received data, with filtering",
-			fileName:         "test3b.txt",
-			filter:           "test",
-			sendMessage:      `{"accountId": "test", "data": "data", "timestamp": 1}`,
-			sendMessageFalse: `{"accountId": "test1", "data": "data", "timestamp": 1}`,
-			expected:         "Received a data from active account id test: data: data, time: 1",
-			count:            1,
+			desc:   "Should not log lost connection",
+			events: []subscriber.Event{{Type: subscriber.EventDisconnected, Err: errors.New("connection reset")}},
+		},
+		{
+			desc: "Should log gap once reconnected",
+			events: []subscriber.Event{
+				{Type: subscriber.EventDisconnected, Err: errors.New("connection reset")},
+				{Type: subscriber.EventReconnected, Downtime: time.Second},
+			},
+			expected: []interface{}{time.Second},
 		},
 	}
 	for _, tC := range testCases {
 		t.Run(tC.desc, func(t *testing.T) {
-			mr := connectWS()
-			setLoggerToFile(tC.fileName)
-
-			interrupt := make(chan os.Signal, 1)
-			createMessageHandler(mr, tC.filter, tC.aggregate, tC.aggregateFrequency, interrupt, nil)
-
-			go sendMessage(tC.sendMessageFalse)
-			go sendMessage(tC.sendMessageFalse)
-			go sendMessage(tC.sendMessage)
-
-			//wait for aggregator to log something
-			time.Sleep(500 * time.Millisecond)
-			closeWS(mr)
-
-			fileWritten, err := os.OpenFile(tC.fileName, os.O_RDONLY, 0666)
-			if err != nil {
+			recorder := logging.NewRecorder()
+			events := make(chan subscriber.Event, len(tC.events))
+			for _, event := range tC.events {
+				events <- event
+			}
+			close(events)
+			if err := eventHandler(events, logging.New(recorder)); err != nil {
 				t.Fatal(err)
 			}
-			scanner := bufio.NewScanner(fileWritten)
-			counter := 0
-			for scanner.Scan() {
-				counter++
-				readLine := scanner.Text()
-				if readLine != aggregateHeader && readLine != tC.expected {
-					t.Errorf("Wanted logged line %s or %s, got: %s", aggregateHeader, tC.expected, readLine)
-				}
+
+			downtimes := []interface{}{}
+			for _, record := range recorder.Find("Messages published while reconnecting were missed") {
+				downtime, _ := record.Field("downtime")
+				downtimes = append(downtimes, downtime)
 			}
-			if counter != tC.count {
-				t.Errorf("Wanted %d messages, got %d", tC.count, counter)
+			if len(downtimes) != len(tC.expected) || len(downtimes) > 0 && !reflect.DeepEqual(downtimes, tC.expected) {
+				t.Errorf("Expected gaps %v, got %v", tC.expected, downtimes)
 			}
-			os.Remove(tC.fileName)
 		})
 	}
 }
+
 func Test_createMessageHandler_printer(t *testing.T) {
-	aggregateHeader := "Aggregated messages received for accounts"
 	testCases := []struct {
-		desc               string
-		fileName           string
-		filter             string
-		aggregate          bool
-		aggregateFrequency int
-		sendMessage        string
-		sendMessageFalse   string
-		expected           string
-		count              int
+		desc             string
+		filter           string
+		sendMessage      string
+		sendMessageFalse string
+		expected         []string
 	}{
 		{
 			desc:        "Should print received data",
-			fileName:    "test3a.txt",
 			sendMessage: `{"accountId": "test", "data": "data", "timestamp": 1}`,
-			expected:    "Received a data from active account id test: data: data, time: 1",
-			count:       1,
+			expected:    []string{"test: data"},
+		},
+		{
+			desc:             "Should print received data, with filtering",
+			filter:           "test",
+			sendMessage:      `{"accountId": "test", "data": "data", "timestamp": 1}`,
+			sendMessageFalse: `{"accountId": "test1", "data": "data", "timestamp": 1}`,
+			expected:         []string{"test: data"},
 		},
 	}
 	for _, tC := range testCases {
 		t.Run(tC.desc, func(t *testing.T) {
-			mr := connectWS()
-			setLoggerToFile(tC.fileName)
-			interrupt := make(chan os.Signal, 1)
-			createMessageHandler(mr, tC.filter, tC.aggregate, tC.aggregateFrequency, interrupt, nil)
-
-			go sendMessage(tC.sendMessageFalse)
-			go sendMessage(tC.sendMessageFalse)
-			go sendMessage(tC.sendMessage)
+			publisher := subscribertest.NewPublisher()
+			defer publisher.Close()
+			subscription := subscribe(t, publisher, tC.filter)
+			recorder := logging.NewRecorder()
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() {
+				done <- createMessageHandler(ctx, subscription, false, 0, logging.New(recorder))
+			}()
+
+			if tC.sendMessageFalse != "" {
+				publisher.Publish(t, tC.sendMessageFalse, tC.sendMessageFalse)
+			}
+			publisher.Publish(t, tC.sendMessage)
 			//wait to log something
 			time.Sleep(500 * time.Millisecond)
-			closeWS(mr)
-
-			fileWritten, err := os.OpenFile(tC.fileName, os.O_RDONLY, 0666)
-			if err != nil {
+			cancel()
+			if err := <-done; err != nil {
 				t.Fatal(err)
 			}
-			scanner := bufio.NewScanner(fileWritten)
-			counter := 0
-			for scanner.Scan() {
-				counter++
-				readLine := scanner.Text()
-				if readLine != tC.expected {
-					t.Errorf("Wanted logged line %s or %s, got: %s", aggregateHeader, tC.expected, readLine)
-				}
-			}
-			if counter != tC.count {
-				t.Errorf("Wanted %d messages, got %d", tC.count, counter)
-			}
 
-			os.Remove(tC.fileName)
+			if printed := printedMessages(recorder); !reflect.DeepEqual(printed, tC.expected) {
+				t.Errorf("Expected printed messages %v, got %v", tC.expected, printed)
+			}
 		})
 	}
 }
 
-func Test_createMessageHandler_aggregator_filtering(t *testing.T) {
-	aggregateHeader := "Aggregated messages received for accounts"
+func Test_createMessageHandler_aggregator(t *testing.T) {
 	testCases := []struct {
-		desc               string
-		fileName           string
-		filter             string
-		aggregate          bool
-		aggregateFrequency int
-		sendMessage        string
-		sendMessageFalse   string
-		expected           string
-		count              int
+		desc             string
+		filter           string
+		sendMessages     []string
+		sendMessageFalse string
+		expected         map[string]interface{}
 	}{
 		{
-			desc:               "Should print received data, with filtering",
-			fileName:           "test4b.txt",
-			filter:             "test",
-			sendMessage:        `{"accountId": "test", "data": "data", "timestamp": 1}`,
-			sendMessageFalse:   `{"accountId": "test1", "data": "data", "timestamp": 1}`,
-			expected:           "ID: test, number of messages 1",
-			count:              2,
-			aggregate:          true,
-			aggregateFrequency: 1,
+			desc: "Should print received data",
+			sendMessages: []string{
+				`{"accountId": "test1", "data": "data", "timestamp": 1}`,
+				`{"accountId": "test", "data": "data", "timestamp": 1}`,
+			},
+			expected: map[string]interface{}{"test": 1, "test1": 1},
+		},
+		{
+			desc:             "Should print received data, with filtering",
+			filter:           "test",
+			sendMessages:     []string{`{"accountId": "test", "data": "data", "timestamp": 1}`},
+			sendMessageFalse: `{"accountId": "test1", "data": "data", "timestamp": 1}`,
+			expected:         map[string]interface{}{"test": 1},
 		},
 	}
 	for _, tC := range testCases {
 		t.Run(tC.desc, func(t *testing.T) {
-			mr := connectWS()
-			setLoggerToFile(tC.fileName)
-
-			interrupt := make(chan os.Signal, 1)
-			createMessageHandler(mr, tC.filter, tC.aggregate, tC.aggregateFrequency, interrupt, nil)
-
-			go sendMessage(tC.sendMessageFalse)
-			go sendMessage(tC.sendMessageFalse)
-			go sendMessage(tC.sendMessage)
-			time.Sleep(500 * time.Millisecond)
-			closeWS(mr)
+			publisher := subscribertest.NewPublisher()
+			defer publisher.Close()
+			subscription := subscribe(t, publisher, tC.filter)
+			recorder := logging.NewRecorder()
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() {
+				done <- createMessageHandler(ctx, subscription, true, 1, logging.New(recorder))
+			}()
+
+			if tC.sendMessageFalse != "" {
+				publisher.Publish(t, tC.sendMessageFalse, tC.sendMessageFalse)
+			}
+			publisher.Publish(t, tC.sendMessages...)
 			//wait for aggregator to log something
-			time.Sleep(1000 * time.Millisecond)
-			interrupt <- os.Kill
-
-			fileWritten, err := os.OpenFile(tC.fileName, os.O_RDONLY, 0666)
-			if err != nil {
+			time.Sleep(1500 * time.Millisecond)
+			cancel()
+			if err := <-done; err != nil {
 				t.Fatal(err)
 			}
 
-			scanner := bufio.NewScanner(fileWritten)
-			counter := 0
-			aggHeadCounter := 0
-			for scanner.Scan() {
-				counter++
-				readLine := scanner.Text()
-				if readLine == aggregateHeader {
-					aggHeadCounter++
-				}
-				if readLine != aggregateHeader && readLine != tC.expected {
-					t.Errorf("Wanted logged line %s or %s, got: %s", aggregateHeader, tC.expected, readLine)
-				}
+			if counts := aggregatedCounts(recorder); !reflect.DeepEqual(counts, tC.expected) {
+				t.Errorf("Expected aggregated %v, got %v", tC.expected, counts)
 			}
-			counter -= (aggHeadCounter - 1)
-			if counter != tC.count {
-				t.Errorf("Wanted %d messages, got %d", tC.count, counter)
-			}
-			os.Remove(tC.fileName)
 		})
 	}
 }
-func Test_createMessageHandler_aggregator(t *testing.T) {
-	aggregateHeader := "Aggregated messages received for accounts"
+
+func Test_createMessageHandler_shutdown(t *testing.T) {
 	testCases := []struct {
-		desc               string
-		fileName           string
-		filter             string
-		aggregate          bool
-		aggregateFrequency int
-		sendMessage        string
-		sendMessage2       string
-		sendMessageFalse   string
-		expected           string
-		expected2          string
-		count              int
+		desc          string
+		aggregate     bool
+		shutdown      func(cancel context.CancelFunc, subscription *subscriber.Subscription, publisher *subscribertest.Publisher)
+		expectedError error
 	}{
 		{
-			desc:               "Should print received data",
-			fileName:           "test4b.txt",
-			sendMessage:        `{"accountId": "test", "data": "data", "timestamp": 1}`,
-			sendMessage2:       `{"accountId": "test1", "data": "data", "timestamp": 1}`,
-			expected:           "ID: test, number of messages 1",
-			expected2:          "ID: test1, number of messages 1",
-			count:              3,
-			aggregate:          true,
-			aggregateFrequency: 1,
+			desc: "Printer stops when context is canceled",
+			shutdown: func(cancel context.CancelFunc, subscription *subscriber.Subscription, publisher *subscribertest.Publisher) {
+				cancel()
+			},
+		},
+		{
+			desc:      "Aggregator stops when context is canceled",
+			aggregate: true,
+			shutdown: func(cancel context.CancelFunc, subscription *subscriber.Subscription, publisher *subscribertest.Publisher) {
+				cancel()
+			},
+		},
+		{
+			desc: "Printer stops when subscription is closed",
+			shutdown: func(cancel context.CancelFunc, subscription *subscriber.Subscription, publisher *subscribertest.Publisher) {
+				subscription.Close()
+			},
+		},
+		{
+			desc:      "Aggregator stops when subscription is closed",
+			aggregate: true,
+			shutdown: func(cancel context.CancelFunc, subscription *subscriber.Subscription, publisher *subscribertest.Publisher) {
+				subscription.Close()
+			},
+		},
+		{
+			desc: "Printer fails when reconnecting gives up",
+			shutdown: func(cancel context.CancelFunc, subscription *subscriber.Subscription, publisher *subscribertest.Publisher) {
+				publisher.Close()
+			},
+			expectedError: subscriber.ErrGaveUp,
+		},
+		{
+			desc:      "Aggregator fails when reconnecting gives up",
+			aggregate: true,
+			shutdown: func(cancel context.CancelFunc, subscription *subscriber.Subscription, publisher *subscribertest.Publisher) {
+				publisher.Close()
+			},
+			expectedError: subscriber.ErrGaveUp,
 		},
 	}
 	for _, tC := range testCases {
 		t.Run(tC.desc, func(t *testing.T) {
-			mr := connectWS()
-			setLoggerToFile(tC.fileName)
-			interrupt := make(chan os.Signal, 1)
-			createMessageHandler(mr, tC.filter, tC.aggregate, tC.aggregateFrequency, interrupt, nil)
+			publisher := subscribertest.NewPublisher()
+			defer publisher.Close()
+			before := runtime.NumGoroutine()
+			subscription := subscribe(t, publisher, "")
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan error, 1)
+			go func() {
+				done <- createMessageHandler(ctx, subscription, tC.aggregate, 1, nil)
+			}()
+
+			// messages are still in the pipeline when it shuts down
+			publisher.Publish(t, `{"accountId": "test"}`, `{"accountId": "test"}`, `{"accountId": "test"}`)
+			tC.shutdown(cancel, subscription, publisher)
+			select {
+			case err := <-done:
+				if !errors.Is(err, tC.expectedError) || (err == nil) != (tC.expectedError == nil) {
+					t.Errorf("Expected %v, got %v", tC.expectedError, err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Expected pipeline to shut down")
+			}
+			checkGoroutines(t, before)
+		})
+	}
+}
 
-			go sendMessage(tC.sendMessage2)
-			go sendMessage(tC.sendMessage)
-			time.Sleep(500 * time.Millisecond)
-			closeWS(mr)
-			//wait for aggregator to log something
-			time.Sleep(1000 * time.Millisecond)
-			interrupt <- os.Kill
-			fileWritten, err := os.OpenFile(tC.fileName, os.O_RDONLY, 0666)
-			if err != nil {
-				t.Fatal(err)
+func Test_group(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		failure       error
+		expectedError error
+	}{
+		{
+			desc: "Waits for all stages",
+		},
+		{
+			desc:          "Stops other stages when one fails",
+			failure:       errors.New("stage failed"),
+			expectedError: errors.New("stage failed"),
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			before := runtime.NumGoroutine()
+			parent, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			g, ctx := newGroup(parent)
+			for i := 0; i < 3; i++ {
+				g.Go(func() error {
+					<-ctx.Done()
+					return nil
+				})
 			}
-			scanner := bufio.NewScanner(fileWritten)
-			counter := 0
-			// because of undeterministic data, we only substract multiple aggregate header lines
-			aggHeader := 0
-			for scanner.Scan() {
-				counter++
-				readLine := scanner.Text()
-				if readLine == aggregateHeader {
-					aggHeader++
-				}
-				if readLine != aggregateHeader && readLine != tC.expected && readLine != tC.expected2 {
-					t.Errorf("Wanted logged line %s or %s or %s, got: %s", aggregateHeader, tC.expected, tC.expected2, readLine)
-				}
+			g.Go(func() error {
+				return tC.failure
+			})
+			if tC.failure == nil {
+				cancel()
+			}
+
+			if err := g.Wait(); !reflect.DeepEqual(err, tC.expectedError) {
+				t.Errorf("Expected %v, got %v", tC.expectedError, err)
 			}
-			counter -= (aggHeader - 1)
-			if counter != tC.count {
-				t.Errorf("Wanted %d messages, got %d", tC.count, counter)
+			if ctx.Err() == nil {
+				t.Error("Expected context to be done once all stages returned")
 			}
-			os.Remove(tC.fileName)
+			checkGoroutines(t, before)
 		})
 	}
 }
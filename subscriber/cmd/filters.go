@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"pub-sub/subscriber"
+	"pub-sub/subscriber/filter"
+	"strings"
+)
+
+// accountList is a flag that can be repeated, every value is an account ID
+type accountList []string
+
+func (l *accountList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *accountList) Set(value string) error {
+	if value != "" {
+		*l = append(*l, value)
+	}
+	return nil
+}
+
+// readAccountIDs returns account IDs in file path, one per line. Blank lines and lines that
+// start with # are skipped.
+func readAccountIDs(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read account IDs: %w", err)
+	}
+	defer file.Close()
+
+	ids := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ids = append(ids, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read account IDs from %s: %w", path, err)
+	}
+	return ids, nil
+}
+
+// subscriptionOptions returns options with accounts and excluded accounts, given in flags and
+// in files when they are set, and with compiled expression when it is set
+func subscriptionOptions(accounts, excluded accountList, accountsFile, excludedFile, expression string) (subscriber.Options, error) {
+	options := subscriber.Options{AccountIDs: accounts, ExcludeAccountIDs: excluded}
+	if accountsFile != "" {
+		ids, err := readAccountIDs(accountsFile)
+		if err != nil {
+			return options, err
+		}
+		if len(ids) == 0 {
+			return options, fmt.Errorf("no account IDs in %s", accountsFile)
+		}
+		options.AccountIDs = append(options.AccountIDs, ids...)
+	}
+	if excludedFile != "" {
+		ids, err := readAccountIDs(excludedFile)
+		if err != nil {
+			return options, err
+		}
+		options.ExcludeAccountIDs = append(options.ExcludeAccountIDs, ids...)
+	}
+	if expression != "" {
+		f, err := filter.Compile(expression, nil)
+		if err != nil {
+			return options, err
+		}
+		options.Filter = f.Match
+	}
+	return options, nil
+}
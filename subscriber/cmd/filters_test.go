@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"pub-sub/subscriber"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_accountList(t *testing.T) {
+	var accounts accountList
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.Var(&accounts, "filter", "")
+	if err := flags.Parse([]string{"-filter", "a", "-filter=", "-filter=b"}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := (accountList{"a", "b"}); !reflect.DeepEqual(accounts, expected) {
+		t.Errorf("Expected %v, got %v", expected, accounts)
+	}
+}
+
+func Test_subscriptionOptions(t *testing.T) {
+	accountsFile, err := ioutil.TempFile("", "accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(accountsFile.Name())
+	accountsFile.WriteString("# accounts of the demo data\nc\n\n  d  \n")
+	accountsFile.Close()
+	emptyFile, err := ioutil.TempFile("", "accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(emptyFile.Name())
+	emptyFile.Close()
+
+	testCases := []struct {
+		desc             string
+		accounts         accountList
+		excluded         accountList
+		accountsFile     string
+		excludedFile     string
+		expression       string
+		expectedAccounts []string
+		expectedExcluded []string
+		expectedError    string
+	}{
+		{
+			desc: "No filters",
+		},
+		{
+			desc:             "Accounts from flags",
+			accounts:         accountList{"a", "b"},
+			excluded:         accountList{"e"},
+			expectedAccounts: []string{"a", "b"},
+			expectedExcluded: []string{"e"},
+		},
+		{
+			desc:             "Accounts from flags and file",
+			accounts:         accountList{"a"},
+			accountsFile:     accountsFile.Name(),
+			expectedAccounts: []string{"a", "c", "d"},
+		},
+		{
+			desc:             "Excluded accounts from file",
+			excludedFile:     accountsFile.Name(),
+			expectedExcluded: []string{"c", "d"},
+		},
+		{
+			desc:          "Missing file",
+			accountsFile:  accountsFile.Name() + ".missing",
+			expectedError: "failed to read account IDs",
+		},
+		{
+			desc:          "File without accounts",
+			accountsFile:  emptyFile.Name(),
+			expectedError: "no account IDs in",
+		},
+		{
+			desc:       "Expression",
+			expression: `data =~ "^temp"`,
+		},
+		{
+			desc:          "Invalid expression",
+			expression:    `data =~`,
+			expectedError: "filter: position 8: expected regular expression string",
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			options, err := subscriptionOptions(tC.accounts, tC.excluded, tC.accountsFile, tC.excludedFile, tC.expression)
+			if tC.expectedError == "" && err != nil || tC.expectedError != "" && (err == nil || !strings.Contains(err.Error(), tC.expectedError)) {
+				t.Fatalf("Expected error %q, got %v", tC.expectedError, err)
+			}
+			if err != nil {
+				return
+			}
+			if len(options.AccountIDs) != len(tC.expectedAccounts) || len(tC.expectedAccounts) > 0 && !reflect.DeepEqual(options.AccountIDs, tC.expectedAccounts) {
+				t.Errorf("Expected accounts %v, got %v", tC.expectedAccounts, options.AccountIDs)
+			}
+			if len(options.ExcludeAccountIDs) != len(tC.expectedExcluded) || len(tC.expectedExcluded) > 0 && !reflect.DeepEqual(options.ExcludeAccountIDs, tC.expectedExcluded) {
+				t.Errorf("Expected excluded accounts %v, got %v", tC.expectedExcluded, options.ExcludeAccountIDs)
+			}
+			if (options.Filter != nil) != (tC.expression != "") {
+				t.Fatalf("Expected filter %t, got %t", tC.expression != "", options.Filter != nil)
+			}
+			if options.Filter != nil && !options.Filter(subscriber.Message{Data: "temperature"}) {
+				t.Error("Expected message to pass filter")
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// group runs stages of the pipeline and cancels its context when the first of them fails, so
+// that the other stages stop too
+type group struct {
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	errOnce sync.Once
+	err     error
+}
+
+// newGroup returns group and context that is done once a stage fails or ctx is done
+func newGroup(ctx context.Context) (*group, context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	return &group{cancel: cancel}, ctx
+}
+
+// Go runs stage in new goroutine
+func (g *group) Go(stage func() error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if err := stage(); err != nil {
+			g.errOnce.Do(func() {
+				g.err = err
+				g.cancel()
+			})
+		}
+	}()
+}
+
+// Wait waits until all stages return and returns error of the first stage that failed
+func (g *group) Wait() error {
+	g.wg.Wait()
+	g.cancel()
+	return g.err
+}
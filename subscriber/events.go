@@ -0,0 +1,45 @@
+package subscriber
+
+import "time"
+
+//EventType tells what happened to the connection of a subscription
+type EventType int
+
+const (
+	//EventDisconnected means the connection was lost, messages published until EventReconnected are missed
+	EventDisconnected EventType = iota
+	//EventReconnected means the connection was restored
+	EventReconnected
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventDisconnected:
+		return "disconnected"
+	case EventReconnected:
+		return "reconnected"
+	}
+	return "unknown"
+}
+
+//Event is a change of the connection of a subscription
+type Event struct {
+	Type EventType
+	Time time.Time
+	//Err is why the connection was lost, set for EventDisconnected
+	Err error
+	//Downtime is how long the connection was lost, set for EventReconnected
+	Downtime time.Duration
+}
+
+// eventsBuffer is the capacity of Events, later events are dropped when nobody reads them
+const eventsBuffer = 16
+
+// emit sends event to events unless its buffer is full, so that the pipeline never waits for
+// consumers that don't care about events
+func emit(events chan<- Event, event Event) {
+	select {
+	case events <- event:
+	default:
+	}
+}
@@ -0,0 +1,66 @@
+//Package filter compiles expressions over fields of subscriber messages, such as
+//
+//	accountId in ("a", "b") && data =~ "^temp" && timestamp > now-5m
+//
+//Fields are id, accountId, data and timestamp, which is in Unix seconds like now. Comparisons
+//are ==, !=, <, <=, >, >=, in (...) and not in (...), =~ and !~ match regular expressions.
+//Numbers can be added to and subtracted from, durations such as 30s, 5m, 2h or 1d are numbers
+//of seconds. Comparisons are combined with &&, || and !, and grouped with parentheses.
+package filter
+
+import (
+	"fmt"
+	"pub-sub/subscriber"
+	"time"
+)
+
+//SyntaxError is returned by Compile for invalid expressions
+type SyntaxError struct {
+	//Pos is the position in the expression where the error is, starting with 1
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("filter: position %d: %s", e.Pos, e.Msg)
+}
+
+// predicate reports whether m matches, now is the Unix time the message is matched at
+type predicate func(m *subscriber.Message, now int64) bool
+
+//Filter is a compiled expression
+type Filter struct {
+	expr  string
+	match predicate
+	now   func() time.Time
+}
+
+//Compile parses expr once, so that Match only evaluates it. now is the clock of now in
+//expressions, time.Now is used when it is nil.
+func Compile(expr string, now func() time.Time) (*Filter, error) {
+	tokens, err := lex(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	match, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEnd {
+		return nil, p.errorf(t, "unexpected %s", t)
+	}
+	if now == nil {
+		now = time.Now
+	}
+	return &Filter{expr: expr, match: match, now: now}, nil
+}
+
+//Match reports whether msg matches the expression
+func (f *Filter) Match(msg subscriber.Message) bool {
+	return f.match(&msg, f.now().Unix())
+}
+
+func (f *Filter) String() string {
+	return f.expr
+}
@@ -0,0 +1,110 @@
+package filter_test
+
+import (
+	"pub-sub/subscriber"
+	"pub-sub/subscriber/filter"
+	"testing"
+	"time"
+)
+
+func TestMatch(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	message := subscriber.Message{ID: "message-1", AccountID: "5937e2d316ca1b6d4066aa20", Data: "temperature=21", Timestamp: now.Unix() - 60}
+	testCases := []struct {
+		desc     string
+		expr     string
+		expected bool
+	}{
+		{desc: "Equal string", expr: `accountId == "5937e2d316ca1b6d4066aa20"`, expected: true},
+		{desc: "Not equal string", expr: `accountId != "5937e2d316ca1b6d4066aa20"`, expected: false},
+		{desc: "String order", expr: `id < "message-2"`, expected: true},
+		{desc: "In list", expr: `accountId in ("a", "5937e2d316ca1b6d4066aa20")`, expected: true},
+		{desc: "Not in list", expr: `accountId in ("a", "b")`, expected: false},
+		{desc: "Excluded by not in", expr: `accountId not in ("5937e2d316ca1b6d4066aa20")`, expected: false},
+		{desc: "Number in list", expr: `timestamp in (1, 999940)`, expected: true},
+		{desc: "Regular expression", expr: `data =~ "^temp"`, expected: true},
+		{desc: "Negated regular expression", expr: `data !~ "^temp"`, expected: false},
+		{desc: "Escaped string", expr: `data =~ "^temperature=\\d+$"`, expected: true},
+		{desc: "Recent timestamp", expr: `timestamp > now-5m`, expected: true},
+		{desc: "Old timestamp", expr: `timestamp > now - 30s`, expected: false},
+		{desc: "Timestamp in days", expr: `timestamp >= now - 1d && timestamp <= now`, expected: true},
+		{desc: "Timestamp arithmetic", expr: `timestamp + 60 == now`, expected: true},
+		{desc: "Unix timestamp", expr: `timestamp < 999941`, expected: true},
+		{desc: "And", expr: `accountId in ("5937e2d316ca1b6d4066aa20") && data =~ "^temp" && timestamp > now-5m`, expected: true},
+		{desc: "And with false", expr: `data =~ "^temp" && timestamp > now`, expected: false},
+		{desc: "Or", expr: `id == "other" || data =~ "21$"`, expected: true},
+		{desc: "And before or", expr: `id == "message-1" || id == "other" && data == "other"`, expected: true},
+		{desc: "Parentheses", expr: `(id == "message-1" || id == "other") && data == "other"`, expected: false},
+		{desc: "Not", expr: `!(data == "other")`, expected: true},
+		{desc: "Double not", expr: `!!(data == "other")`, expected: false},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			f, err := filter.Compile(tC.expr, func() time.Time { return now })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if matched := f.Match(message); matched != tC.expected {
+				t.Errorf("Expected %s to be %t, got %t", tC.expr, tC.expected, matched)
+			}
+		})
+	}
+}
+
+func TestMatchNow(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	f, err := filter.Compile(`timestamp > now-5m`, func() time.Time { return now })
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := subscriber.Message{Timestamp: now.Unix()}
+	if !f.Match(message) {
+		t.Error("Expected recent message to match")
+	}
+	now = now.Add(time.Hour)
+	if f.Match(message) {
+		t.Error("Expected message to be too old an hour later")
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		expr        string
+		expectedPos int
+		expectedMsg string
+	}{
+		{desc: "Empty", expr: ``, expectedPos: 1, expectedMsg: "expected field, string or number but found end of expression"},
+		{desc: "Unknown field", expr: `account == "a"`, expectedPos: 1, expectedMsg: `unknown field "account", use id, accountId, data or timestamp`},
+		{desc: "Missing comparison", expr: `accountId`, expectedPos: 10, expectedMsg: `expected comparison after "accountId" but found end of expression`},
+		{desc: "Missing operand", expr: `accountId == `, expectedPos: 14, expectedMsg: "expected field, string or number but found end of expression"},
+		{desc: "Unterminated string", expr: `data == "temp`, expectedPos: 9, expectedMsg: "string is not terminated"},
+		{desc: "Unexpected character", expr: `data == 'temp'`, expectedPos: 9, expectedMsg: `unexpected character '\''`},
+		{desc: "Single ampersand", expr: `id == "a" & id == "b"`, expectedPos: 11, expectedMsg: `unexpected character '&'`},
+		{desc: "Unknown duration unit", expr: `timestamp > now-5w`, expectedPos: 18, expectedMsg: `unknown duration unit "w", use s, m, h or d`},
+		{desc: "Compare string with number", expr: `accountId == 5`, expectedPos: 11, expectedMsg: "can't compare string with number"},
+		{desc: "Regular expression on number", expr: `timestamp =~ "1"`, expectedPos: 11, expectedMsg: "can't match number with regular expression"},
+		{desc: "Invalid regular expression", expr: `data =~ "(temp"`, expectedPos: 9, expectedMsg: "invalid regular expression: error parsing regexp: missing closing ): `(temp`"},
+		{desc: "Regular expression not a string", expr: `data =~ id`, expectedPos: 9, expectedMsg: `expected regular expression string after "=~" but found "id"`},
+		{desc: "Field in list", expr: `accountId in ("a", id)`, expectedPos: 20, expectedMsg: `expected string or number in list but found "id"`},
+		{desc: "Mixed list", expr: `accountId in ("a", 1)`, expectedPos: 20, expectedMsg: "can't compare string with number"},
+		{desc: "List without parentheses", expr: `accountId in "a"`, expectedPos: 14, expectedMsg: `expected "(" but found "\"a\""`},
+		{desc: "Unclosed list", expr: `accountId in ("a"`, expectedPos: 18, expectedMsg: `expected ")" but found end of expression`},
+		{desc: "Not without in", expr: `accountId not ("a")`, expectedPos: 15, expectedMsg: `expected "in" but found "("`},
+		{desc: "Unclosed parenthesis", expr: `(id == "a"`, expectedPos: 11, expectedMsg: `expected ")" but found end of expression`},
+		{desc: "Sum of strings", expr: `data + "a" == "b"`, expectedPos: 6, expectedMsg: `can't use "+" with strings`},
+		{desc: "Trailing tokens", expr: `id == "a" id == "b"`, expectedPos: 11, expectedMsg: `unexpected "id"`},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			_, err := filter.Compile(tC.expr, nil)
+			syntaxErr, ok := err.(*filter.SyntaxError)
+			if !ok {
+				t.Fatalf("Expected syntax error, got %v", err)
+			}
+			if syntaxErr.Pos != tC.expectedPos || syntaxErr.Msg != tC.expectedMsg {
+				t.Errorf("Expected error at %d: %s, got %d: %s", tC.expectedPos, tC.expectedMsg, syntaxErr.Pos, syntaxErr.Msg)
+			}
+		})
+	}
+}
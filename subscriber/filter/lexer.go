@@ -0,0 +1,119 @@
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenDuration
+	tokenOperator
+)
+
+// token is a word of an expression, pos is its position in the expression starting with 1
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+	// value is the unquoted string or the number of seconds of numbers and durations
+	str string
+	num int64
+}
+
+func (t token) String() string {
+	if t.kind == tokenEnd {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+// operators are ordered so that longer ones are matched first
+var operators = []string{"&&", "||", "==", "!=", "<=", ">=", "=~", "!~", "!", "<", ">", "(", ")", ",", "+", "-"}
+
+// durationUnits are seconds of the units durations can have, timestamps are in seconds
+var durationUnits = map[string]int64{"s": 1, "m": 60, "h": 60 * 60, "d": 24 * 60 * 60}
+
+// lex splits expr into tokens, the last one is always tokenEnd
+func lex(expr string) ([]token, error) {
+	tokens := []token{}
+	for i := 0; i < len(expr); {
+		c := rune(expr[i])
+		start := i
+		switch {
+		case unicode.IsSpace(c):
+			i++
+			continue
+		case isDigit(c):
+			for i < len(expr) && isDigit(rune(expr[i])) {
+				i++
+			}
+			digits := expr[start:i]
+			for i < len(expr) && isLetter(rune(expr[i])) {
+				i++
+			}
+			n, err := strconv.ParseInt(digits, 10, 64)
+			if err != nil {
+				return nil, &SyntaxError{Pos: start + 1, Msg: fmt.Sprintf("number %s is out of range", digits)}
+			}
+			if unit := expr[start+len(digits) : i]; unit != "" {
+				seconds, ok := durationUnits[unit]
+				if !ok {
+					return nil, &SyntaxError{Pos: start + len(digits) + 1, Msg: fmt.Sprintf("unknown duration unit %q, use s, m, h or d", unit)}
+				}
+				tokens = append(tokens, token{kind: tokenDuration, text: expr[start:i], pos: start + 1, num: n * seconds})
+				continue
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: digits, pos: start + 1, num: n})
+		case isLetter(c):
+			for i < len(expr) && (isLetter(rune(expr[i])) || isDigit(rune(expr[i]))) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: expr[start:i], pos: start + 1})
+		case c == '"':
+			for i++; i < len(expr) && expr[i] != '"'; i++ {
+				if expr[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(expr) {
+				return nil, &SyntaxError{Pos: start + 1, Msg: "string is not terminated"}
+			}
+			i++
+			str, err := strconv.Unquote(expr[start:i])
+			if err != nil {
+				return nil, &SyntaxError{Pos: start + 1, Msg: fmt.Sprintf("invalid string %s", expr[start:i])}
+			}
+			tokens = append(tokens, token{kind: tokenString, text: expr[start:i], pos: start + 1, str: str})
+		default:
+			operator := ""
+			for _, o := range operators {
+				if strings.HasPrefix(expr[i:], o) {
+					operator = o
+					break
+				}
+			}
+			if operator == "" {
+				return nil, &SyntaxError{Pos: start + 1, Msg: fmt.Sprintf("unexpected character %q", expr[i])}
+			}
+			i += len(operator)
+			tokens = append(tokens, token{kind: tokenOperator, text: operator, pos: start + 1})
+		}
+	}
+	return append(tokens, token{kind: tokenEnd, pos: len(expr) + 1}), nil
+}
+
+func isDigit(c rune) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
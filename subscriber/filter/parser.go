@@ -0,0 +1,325 @@
+package filter
+
+import (
+	"fmt"
+	"pub-sub/subscriber"
+	"regexp"
+	"strings"
+)
+
+type valueType int
+
+const (
+	typeString valueType = iota
+	typeNumber
+)
+
+func (t valueType) String() string {
+	if t == typeString {
+		return "string"
+	}
+	return "number"
+}
+
+// operand is a field, literal or sum of a comparison. Only one of str and num is set, by typ.
+type operand struct {
+	typ valueType
+	str func(m *subscriber.Message) string
+	num func(m *subscriber.Message, now int64) int64
+	// literal is set for strings and numbers written in the expression
+	literal bool
+	// first is the token the operand starts with
+	first token
+}
+
+// fields of messages by their names in JSON
+var fields = map[string]operand{
+	"id":        {typ: typeString, str: func(m *subscriber.Message) string { return m.ID }},
+	"accountId": {typ: typeString, str: func(m *subscriber.Message) string { return m.AccountID }},
+	"data":      {typ: typeString, str: func(m *subscriber.Message) string { return m.Data }},
+	"timestamp": {typ: typeNumber, num: func(m *subscriber.Message, now int64) int64 { return m.Timestamp }},
+}
+
+// parser compiles tokens with recursive descent, from the lowest precedence:
+//
+//	or         = and { "||" and }
+//	and        = unary { "&&" unary }
+//	unary      = "!" unary | "(" or ")" | comparison
+//	comparison = sum ( op sum | [ "not" ] "in" "(" sum { "," sum } ")" )
+//	sum        = term { ( "+" | "-" ) term }
+//	term       = field | "now" | string | number | duration
+type parser struct {
+	tokens []token
+	i      int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.i]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.i]
+	if t.kind != tokenEnd {
+		p.i++
+	}
+	return t
+}
+
+func (p *parser) is(text string) bool {
+	t := p.peek()
+	return (t.kind == tokenOperator || t.kind == tokenIdent) && t.text == text
+}
+
+func (p *parser) expect(text string) error {
+	if t := p.next(); !(t.kind == tokenOperator || t.kind == tokenIdent) || t.text != text {
+		return p.errorf(t, "expected %q but found %s", text, t)
+	}
+	return nil
+}
+
+func (p *parser) errorf(t token, format string, args ...interface{}) error {
+	return &SyntaxError{Pos: t.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) parseOr() (predicate, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.is("||") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = or(left, right)
+	}
+	return left, nil
+}
+
+func or(left, right predicate) predicate {
+	return func(m *subscriber.Message, now int64) bool { return left(m, now) || right(m, now) }
+}
+
+func (p *parser) parseAnd() (predicate, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.is("&&") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = and(left, right)
+	}
+	return left, nil
+}
+
+func and(left, right predicate) predicate {
+	return func(m *subscriber.Message, now int64) bool { return left(m, now) && right(m, now) }
+}
+
+func (p *parser) parseUnary() (predicate, error) {
+	switch {
+	case p.is("!"):
+		p.next()
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(m *subscriber.Message, now int64) bool { return !inner(m, now) }, nil
+	case p.is("("):
+		p.next()
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return inner, p.expect(")")
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (predicate, error) {
+	left, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+
+	op := p.next()
+	switch {
+	case op.kind == tokenIdent && (op.text == "in" || op.text == "not"):
+		if op.text == "not" {
+			if err := p.expect("in"); err != nil {
+				return nil, err
+			}
+		}
+		in, err := p.parseList(left)
+		if err != nil {
+			return nil, err
+		}
+		if op.text == "not" {
+			return func(m *subscriber.Message, now int64) bool { return !in(m, now) }, nil
+		}
+		return in, nil
+	case op.kind == tokenOperator && (op.text == "=~" || op.text == "!~"):
+		return p.parseMatch(left, op)
+	case op.kind == tokenOperator && comparisons[op.text]:
+		right, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if left.typ != right.typ {
+			return nil, p.errorf(op, "can't compare %s with %s", left.typ, right.typ)
+		}
+		return compare(left, op.text, right), nil
+	}
+	return nil, p.errorf(op, "expected comparison after %s but found %s", left.first, op)
+}
+
+// parseList parses literals of "in" and returns predicate that reports whether left is one of them
+func (p *parser) parseList(left operand) (predicate, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	strs := map[string]bool{}
+	nums := map[int64]bool{}
+	for {
+		item, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if !item.literal {
+			return nil, p.errorf(item.first, "expected string or number in list but found %s", item.first)
+		}
+		if item.typ != left.typ {
+			return nil, p.errorf(item.first, "can't compare %s with %s", left.typ, item.typ)
+		}
+		if item.typ == typeString {
+			strs[item.str(nil)] = true
+		} else {
+			nums[item.num(nil, 0)] = true
+		}
+		if !p.is(",") {
+			break
+		}
+		p.next()
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	if left.typ == typeString {
+		return func(m *subscriber.Message, now int64) bool { return strs[left.str(m)] }, nil
+	}
+	return func(m *subscriber.Message, now int64) bool { return nums[left.num(m, now)] }, nil
+}
+
+// parseMatch compiles the regular expression of =~ or !~ op
+func (p *parser) parseMatch(left operand, op token) (predicate, error) {
+	if left.typ != typeString {
+		return nil, p.errorf(op, "can't match %s with regular expression", left.typ)
+	}
+	t := p.next()
+	if t.kind != tokenString {
+		return nil, p.errorf(t, "expected regular expression string after %s but found %s", op, t)
+	}
+	re, err := regexp.Compile(t.str)
+	if err != nil {
+		return nil, p.errorf(t, "invalid regular expression: %s", err)
+	}
+	negate := op.text == "!~"
+	return func(m *subscriber.Message, now int64) bool { return re.MatchString(left.str(m)) != negate }, nil
+}
+
+var comparisons = map[string]bool{"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true}
+
+func compare(left operand, op string, right operand) predicate {
+	if left.typ == typeString {
+		return func(m *subscriber.Message, now int64) bool {
+			a, b := left.str(m), right.str(m)
+			return holds(op, strings.Compare(a, b))
+		}
+	}
+	return func(m *subscriber.Message, now int64) bool {
+		a, b := left.num(m, now), right.num(m, now)
+		switch {
+		case a < b:
+			return holds(op, -1)
+		case a > b:
+			return holds(op, 1)
+		}
+		return holds(op, 0)
+	}
+}
+
+// holds reports whether op holds for operands that compare like cmp
+func holds(op string, cmp int) bool {
+	switch op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	}
+	return cmp >= 0
+}
+
+func (p *parser) parseSum() (operand, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return operand{}, err
+	}
+	for p.is("+") || p.is("-") {
+		op := p.next()
+		right, err := p.parseTerm()
+		if err != nil {
+			return operand{}, err
+		}
+		if left.typ != typeNumber || right.typ != typeNumber {
+			return operand{}, p.errorf(op, "can't use %s with strings", op)
+		}
+		left = sum(left, op.text, right)
+	}
+	return left, nil
+}
+
+func sum(left operand, op string, right operand) operand {
+	a, b := left.num, right.num
+	result := operand{typ: typeNumber, literal: left.literal && right.literal, first: left.first}
+	if op == "+" {
+		result.num = func(m *subscriber.Message, now int64) int64 { return a(m, now) + b(m, now) }
+	} else {
+		result.num = func(m *subscriber.Message, now int64) int64 { return a(m, now) - b(m, now) }
+	}
+	return result
+}
+
+func (p *parser) parseTerm() (operand, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenIdent:
+		if t.text == "now" {
+			return operand{typ: typeNumber, num: func(m *subscriber.Message, now int64) int64 { return now }, first: t}, nil
+		}
+		field, ok := fields[t.text]
+		if !ok {
+			return operand{}, p.errorf(t, "unknown field %s, use id, accountId, data or timestamp", t)
+		}
+		field.first = t
+		return field, nil
+	case tokenString:
+		str := t.str
+		return operand{typ: typeString, str: func(m *subscriber.Message) string { return str }, literal: true, first: t}, nil
+	case tokenNumber, tokenDuration:
+		num := t.num
+		return operand{typ: typeNumber, num: func(m *subscriber.Message, now int64) int64 { return num }, literal: true, first: t}, nil
+	}
+	return operand{}, p.errorf(t, "expected field, string or number but found %s", t)
+}
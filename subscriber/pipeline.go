@@ -0,0 +1,82 @@
+package subscriber
+
+import (
+	"encoding/json"
+	"pub-sub/logging"
+)
+
+// messageReceiverHandler reads messages from messageReceiver into messages until it is closed,
+// and returns error when it can't be reconnected after the connection is lost. Banners of the
+// publisher are not passed on.
+func messageReceiverHandler(messageReceiver Receiver, messages chan<- []byte, events chan<- Event, stop <-chan struct{}, clock Clock, logger *logging.Logger) error {
+	for {
+		message, err := messageReceiver.ReadMessage()
+		if messageReceiver.IsClosed() {
+			return nil
+		}
+		if err != nil {
+			err = reconnect(messageReceiver, err, events, clock, logger)
+			if err == ErrClosed {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if string(message) == ConnectedBanner {
+			logger.Debug("Publisher confirmed connection")
+			continue
+		}
+
+		select {
+		case messages <- message:
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// reconnect connects messageReceiver again after its connection was lost because of cause, and
+// reports the gap to events
+func reconnect(messageReceiver Receiver, cause error, events chan<- Event, clock Clock, logger *logging.Logger) error {
+	lost := clock.Now()
+	logger.Warn("Lost connection to publisher", logging.Err(cause))
+	emit(events, Event{Type: EventDisconnected, Time: lost, Err: cause})
+
+	if err := messageReceiver.Connect(); err != nil {
+		return err
+	}
+	now := clock.Now()
+	emit(events, Event{Type: EventReconnected, Time: now, Downtime: now.Sub(lost)})
+	return nil
+}
+
+// messageParserHandler parses messages into parsedMessages and closes it once messages is closed
+func messageParserHandler(messages <-chan []byte, parsedMessages chan<- Message, logger *logging.Logger) {
+	defer close(parsedMessages)
+	for msg := range messages {
+		messageObject := Message{}
+		err := json.Unmarshal(msg, &messageObject)
+		if err != nil {
+			logger.Debug("Skipping message that is not JSON", logging.Err(err))
+			continue
+		}
+		parsedMessages <- messageObject
+	}
+}
+
+// messageFilterHandler passes parsed messages that match to filteredMessages and closes it once
+// parsedMessages is closed. Messages are dropped after stop, nobody reads them anymore.
+func messageFilterHandler(parsedMessages <-chan Message, filteredMessages chan<- Message, match func(Message) bool, stop <-chan struct{}) {
+	defer close(filteredMessages)
+	for msg := range parsedMessages {
+		if !match(msg) {
+			continue
+		}
+		select {
+		case filteredMessages <- msg:
+		case <-stop:
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package subscriber
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"pub-sub/backoff"
+	"pub-sub/logging"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+//Errors of Connect and ReadMessage
+var (
+	ErrClosed       = errors.New("receiver is closed")
+	ErrGaveUp       = errors.New("gave up connecting to publisher")
+	ErrNotConnected = errors.New("receiver is not connected")
+)
+
+//ConnectedBanner is sent by the publisher as the first message of every connection
+const ConnectedBanner = "Successfully connected to publisher"
+
+//ReconnectPolicy decides how long to wait before the next attempt to connect. Attempt counts
+//failed attempts from 0 and elapsed is the time since the first of them, false gives up.
+type ReconnectPolicy interface {
+	Delay(attempt int, elapsed time.Duration) (time.Duration, bool)
+}
+
+//ConstantDelay is ReconnectPolicy that tries again after the same delay forever
+type ConstantDelay time.Duration
+
+//Delay returns d for every attempt
+func (d ConstantDelay) Delay(attempt int, elapsed time.Duration) (time.Duration, bool) {
+	return time.Duration(d), true
+}
+
+type limitedAttempts struct {
+	policy   ReconnectPolicy
+	attempts int
+}
+
+func (l limitedAttempts) Delay(attempt int, elapsed time.Duration) (time.Duration, bool) {
+	if attempt+1 >= l.attempts {
+		return 0, false
+	}
+	return l.policy.Delay(attempt, elapsed)
+}
+
+//LimitAttempts returns ReconnectPolicy that waits like policy and gives up after attempts failed attempts
+func LimitAttempts(policy ReconnectPolicy, attempts int) ReconnectPolicy {
+	return limitedAttempts{policy: policy, attempts: attempts}
+}
+
+//Backoff is ReconnectPolicy with delays that grow exponentially
+type Backoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	//Jitter is the fraction of the delay that is randomized, between 0 and 1
+	Jitter float64
+	//MaxAttempts gives up after that many failed attempts, 0 tries forever
+	MaxAttempts int
+	//Deadline gives up once the attempts took that long, 0 tries forever
+	Deadline time.Duration
+}
+
+//Delay returns how long to wait before the attempt-th retry, starting with 0. The last
+//delay is shortened to try once more right at the deadline.
+func (b Backoff) Delay(attempt int, elapsed time.Duration) (time.Duration, bool) {
+	if b.MaxAttempts > 0 && attempt+1 >= b.MaxAttempts || b.Deadline > 0 && elapsed >= b.Deadline {
+		return 0, false
+	}
+	delay := backoff.Backoff{Initial: b.Initial, Max: b.Max, Multiplier: b.Multiplier, Jitter: b.Jitter}.Delay(attempt)
+	if b.Deadline > 0 && elapsed+delay > b.Deadline {
+		return b.Deadline - elapsed, true
+	}
+	return delay, true
+}
+
+//Validate returns error that lists all invalid settings of b
+func (b Backoff) Validate() error {
+	problems := []string{}
+	if b.Initial <= 0 {
+		problems = append(problems, "initial delay must be positive")
+	}
+	if b.Max < b.Initial {
+		problems = append(problems, "max delay must not be shorter than initial delay")
+	}
+	if b.Multiplier < 1 {
+		problems = append(problems, "multiplier must be at least 1")
+	}
+	if b.Jitter < 0 || b.Jitter > 1 {
+		problems = append(problems, "jitter must be between 0 and 1")
+	}
+	if b.MaxAttempts < 0 {
+		problems = append(problems, "max attempts must not be negative")
+	}
+	if b.Deadline < 0 {
+		problems = append(problems, "deadline must not be negative")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid reconnect policy: %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+//Reconnect policies
+var (
+	//DefaultReconnect tries forever, after 500ms at first and up to 30s later on
+	DefaultReconnect ReconnectPolicy = Backoff{Initial: 500 * time.Millisecond, Max: 30 * time.Second, Multiplier: 2, Jitter: 0.2}
+	//NoReconnect gives up after the first failed attempt
+	NoReconnect = LimitAttempts(ConstantDelay(0), 1)
+)
+
+//Clock tells the time and waits, tests move a fake one forward instead of sleeping
+type Clock = backoff.Clock
+
+//SystemClock is Clock of the system
+var SystemClock = backoff.SystemClock
+
+//ReceiverStatus counts connection attempts of a receiver
+type ReceiverStatus struct {
+	//Reconnects is the number of times the connection was restored after the first one
+	Reconnects int
+	//FailedAttempts is the number of attempts to connect that failed
+	FailedAttempts int
+	LastError      error
+}
+
+//Receiver interface definition
+type Receiver interface {
+	Connect() error
+	ReadMessage() ([]byte, error)
+	Close() error
+	CloseMessage() error
+	IsClosed() bool
+}
+
+//MessageReceiver is a receiver for messages
+type MessageReceiver struct {
+	Connection *websocket.Conn
+	URL        string
+	Dialer     *websocket.Dialer
+	Logger     *logging.Logger
+	//Reconnect decides when to connect again, DefaultReconnect is used when it is nil
+	Reconnect ReconnectPolicy
+	//Clock waits between attempts, SystemClock is used when it is nil
+	Clock Clock
+	sync.Mutex
+	Closed bool
+
+	connections int
+	status      ReceiverStatus
+	// done wakes up Connect waiting for the next attempt when the receiver is closed
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+//NewMessageReceiver returns new MessageReceiver. It connects with wss:// when tlsConfig is not nil.
+func NewMessageReceiver(address string, tlsConfig *tls.Config, logger *logging.Logger) Receiver {
+	return newMessageReceiver(address, tlsConfig, logger)
+}
+
+func newMessageReceiver(address string, tlsConfig *tls.Config, logger *logging.Logger) *MessageReceiver {
+	u := url.URL{Scheme: "ws", Host: address}
+	dialer := *websocket.DefaultDialer
+	if tlsConfig != nil {
+		u.Scheme = "wss"
+		dialer.TLSClientConfig = tlsConfig
+	}
+	return &MessageReceiver{
+		URL:    u.String(),
+		Dialer: &dialer,
+		Logger: logger,
+		done:   make(chan struct{}),
+	}
+}
+
+//NewTLSConfig returns TLS config that trusts CAs in PEM file caFile instead of the system ones
+//when it is set, and checks the server certificate for serverName instead of the host when it is set
+func NewTLSConfig(caFile string, serverName string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}
+	if caFile == "" {
+		return config, nil
+	}
+	bundle, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	config.RootCAs = x509.NewCertPool()
+	if !config.RootCAs.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("no certificates in CA file %s", caFile)
+	}
+	return config, nil
+}
+
+//Connect connects MessageReceiver to socket. It tries again as long as the reconnect policy
+//allows, and returns ErrGaveUp when it doesn't or ErrClosed when the receiver is closed.
+func (mr *MessageReceiver) Connect() error {
+	policy := mr.Reconnect
+	if policy == nil {
+		policy = DefaultReconnect
+	}
+	clock := mr.Clock
+	if clock == nil {
+		clock = SystemClock
+	}
+
+	start := clock.Now()
+	for attempt := 0; ; attempt++ {
+		if mr.IsClosed() {
+			return ErrClosed
+		}
+		connection, _, err := mr.Dialer.Dial(mr.URL, nil)
+		if err == nil {
+			mr.Lock()
+			if mr.Closed {
+				mr.Unlock()
+				connection.Close()
+				return ErrClosed
+			}
+			if mr.Connection != nil {
+				mr.Connection.Close()
+			}
+			mr.Connection = connection
+			mr.connections++
+			if mr.connections > 1 {
+				mr.status.Reconnects++
+			}
+			mr.Unlock()
+			mr.Logger.Info("Connected to publisher", logging.F("url", mr.URL), logging.F("attempts", attempt+1))
+			return nil
+		}
+
+		mr.Lock()
+		mr.status.FailedAttempts++
+		mr.status.LastError = err
+		mr.Unlock()
+		elapsed := clock.Now().Sub(start)
+		delay, ok := policy.Delay(attempt, elapsed)
+		if !ok {
+			mr.Logger.Error("Giving up connecting to publisher", logging.F("url", mr.URL), logging.F("attempts", attempt+1), logging.F("elapsed", elapsed), logging.Err(err))
+			return fmt.Errorf("%w after %d attempts in %s: %s", ErrGaveUp, attempt+1, elapsed, err)
+		}
+		mr.Logger.Warn("Error connecting to publisher", logging.F("url", mr.URL), logging.F("attempt", attempt+1), logging.Err(err), logging.F("retry_in", delay))
+		select {
+		case <-clock.After(delay):
+		case <-mr.done:
+			return ErrClosed
+		}
+	}
+}
+
+//ReadMessage reads a message from socket connection. It returns error of the connection when
+//it is lost, Connect restores it.
+func (mr *MessageReceiver) ReadMessage() ([]byte, error) {
+	mr.Lock()
+	connection, closed := mr.Connection, mr.Closed
+	mr.Unlock()
+	if closed {
+		return nil, ErrClosed
+	}
+	if connection == nil {
+		return nil, ErrNotConnected
+	}
+	_, msg, err := connection.ReadMessage()
+	if err != nil && mr.IsClosed() {
+		return nil, ErrClosed
+	}
+	return msg, err
+}
+
+//Status returns counts of connection attempts
+func (mr *MessageReceiver) Status() ReceiverStatus {
+	mr.Lock()
+	defer mr.Unlock()
+	return mr.status
+}
+
+//Close closes WS connection
+func (mr *MessageReceiver) Close() error {
+	mr.Lock()
+	mr.Closed = true
+	connection := mr.Connection
+	mr.Unlock()
+	mr.closeOnce.Do(func() {
+		if mr.done != nil {
+			close(mr.done)
+		}
+	})
+	if connection == nil {
+		return nil
+	}
+	return connection.Close()
+}
+
+//CloseMessage sends close message to socket
+func (mr *MessageReceiver) CloseMessage() error {
+	mr.Lock()
+	mr.Closed = true
+	connection := mr.Connection
+	mr.Unlock()
+	if connection == nil {
+		return nil
+	}
+	err := connection.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	return err
+}
+
+//IsClosed reports whether the receiver was closed
+func (mr *MessageReceiver) IsClosed() bool {
+	mr.Lock()
+	tmp := mr.Closed
+	mr.Unlock()
+	return tmp
+}
@@ -0,0 +1,347 @@
+package subscriber_test
+
+import (
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"pub-sub/logging"
+	"pub-sub/subscriber"
+	"pub-sub/subscriber/subscribertest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReadMessage(t *testing.T) {
+	publisher := subscribertest.NewPublisher()
+	defer publisher.Close()
+
+	mr := subscriber.NewMessageReceiver(publisher.Address(), nil, nil)
+	if _, err := mr.ReadMessage(); err != subscriber.ErrNotConnected {
+		t.Errorf("Expected %v before connecting, got %v", subscriber.ErrNotConnected, err)
+	}
+	if err := mr.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, err := mr.ReadMessage(); err != nil || string(msg) != subscriber.ConnectedBanner {
+		t.Errorf("Expected successfully connected message: %s, got %s, %v", subscriber.ConnectedBanner, msg, err)
+	}
+	publisher.Publish(t, "test")
+	if msg, err := mr.ReadMessage(); err != nil || string(msg) != "test" {
+		t.Errorf("Expected test, got %s, %v", msg, err)
+	}
+
+	mr.Close()
+	if _, err := mr.ReadMessage(); err != subscriber.ErrClosed {
+		t.Errorf("Expected %v after close, got %v", subscriber.ErrClosed, err)
+	}
+}
+
+func TestReadMessageConnectionLost(t *testing.T) {
+	publisher := subscribertest.NewPublisher()
+	defer publisher.Close()
+
+	mr := subscriber.NewMessageReceiver(publisher.Address(), nil, nil).(*subscriber.MessageReceiver)
+	if err := mr.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	mr.ReadMessage()
+	publisher.Disconnect()
+
+	// reconnecting is up to the caller
+	if msg, err := mr.ReadMessage(); err == nil || err == subscriber.ErrClosed {
+		t.Errorf("Expected error of lost connection, got %s, %v", msg, err)
+	}
+	if mr.IsClosed() {
+		t.Error("Expected receiver to stay open")
+	}
+	if status := mr.Status(); status.Reconnects != 0 {
+		t.Errorf("Expected no reconnect, got %+v", status)
+	}
+
+	if err := mr.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := mr.ReadMessage(); err != nil || string(msg) != subscriber.ConnectedBanner {
+		t.Errorf("Expected successfully connected message: %s, got %s, %v", subscriber.ConnectedBanner, msg, err)
+	}
+	if status := mr.Status(); status.Reconnects != 1 {
+		t.Errorf("Expected 1 reconnect, got %+v", status)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		policy        subscriber.ReconnectPolicy
+		expectedError error
+	}{
+		{
+			desc:          "Gives up without reconnecting",
+			policy:        subscriber.NoReconnect,
+			expectedError: subscriber.ErrGaveUp,
+		},
+		{
+			desc:          "Gives up after limited attempts",
+			policy:        subscriber.LimitAttempts(subscriber.ConstantDelay(time.Millisecond), 3),
+			expectedError: subscriber.ErrGaveUp,
+		},
+		{
+			desc:          "Stops reconnecting once closed",
+			policy:        subscriber.ConstantDelay(time.Hour),
+			expectedError: subscriber.ErrClosed,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			mr := subscriber.NewMessageReceiver(subscribertest.Unreachable(), nil, nil)
+			mr.(*subscriber.MessageReceiver).Reconnect = tC.policy
+			if tC.expectedError == subscriber.ErrClosed {
+				time.AfterFunc(100*time.Millisecond, func() { mr.Close() })
+			}
+
+			err := mr.Connect()
+			if !errors.Is(err, tC.expectedError) {
+				t.Errorf("Expected %v, got %v", tC.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestLimitAttempts(t *testing.T) {
+	policy := subscriber.LimitAttempts(subscriber.ConstantDelay(time.Second), 3)
+	for attempt, expected := range []bool{true, true, false} {
+		delay, ok := policy.Delay(attempt, 0)
+		if ok != expected {
+			t.Errorf("Expected attempt %d to be retried %t, got %t", attempt, expected, ok)
+		}
+		if ok && delay != time.Second {
+			t.Errorf("Expected delay 1s, got %s", delay)
+		}
+	}
+}
+
+// fakeClock moves forward by every delay it is asked to wait for, right away
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	delays []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	c.delays = append(c.delays, d)
+	after := make(chan time.Time, 1)
+	after <- c.now
+	return after
+}
+
+func TestConnectBackoff(t *testing.T) {
+	testCases := []struct {
+		desc           string
+		backoff        subscriber.Backoff
+		expectedDelays []time.Duration
+	}{
+		{
+			desc:           "Gives up after max attempts",
+			backoff:        subscriber.Backoff{Initial: 100 * time.Millisecond, Max: time.Second, Multiplier: 2, MaxAttempts: 5},
+			expectedDelays: []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond},
+		},
+		{
+			desc:           "Gives up at deadline",
+			backoff:        subscriber.Backoff{Initial: 100 * time.Millisecond, Max: time.Second, Multiplier: 2, Deadline: time.Second},
+			expectedDelays: []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 300 * time.Millisecond},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			recorder := logging.NewRecorder()
+			clock := &fakeClock{now: time.Now()}
+			mr := subscriber.NewMessageReceiver(subscribertest.Unreachable(), nil, logging.New(recorder)).(*subscriber.MessageReceiver)
+			mr.Reconnect = tC.backoff
+			mr.Clock = clock
+
+			err := mr.Connect()
+			if !errors.Is(err, subscriber.ErrGaveUp) {
+				t.Errorf("Expected %v, got %v", subscriber.ErrGaveUp, err)
+			}
+			if !reflect.DeepEqual(clock.delays, tC.expectedDelays) {
+				t.Errorf("Expected delays %v, got %v", tC.expectedDelays, clock.delays)
+			}
+			attempts := len(tC.expectedDelays) + 1
+			if status := mr.Status(); status.FailedAttempts != attempts || status.LastError == nil {
+				t.Errorf("Expected %d failed attempts with last error, got %+v", attempts, status)
+			}
+			retries := recorder.Find("Error connecting to publisher")
+			if len(retries) != len(tC.expectedDelays) {
+				t.Fatalf("Expected %d retries to be logged, got %v", len(tC.expectedDelays), retries)
+			}
+			for i, record := range retries {
+				if attempt, _ := record.Field("attempt"); attempt != i+1 {
+					t.Errorf("Expected attempt %d, got %v", i+1, attempt)
+				}
+			}
+			if gaveUp := recorder.Find("Giving up connecting to publisher"); len(gaveUp) != 1 {
+				t.Errorf("Expected giving up to be logged, got %v", recorder.Records())
+			}
+		})
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	backoff := subscriber.Backoff{Initial: 100 * time.Millisecond, Max: time.Second, Multiplier: 2}
+	testCases := []struct {
+		desc        string
+		attempt     int
+		elapsed     time.Duration
+		jitter      float64
+		maxAttempts int
+		deadline    time.Duration
+		min, max    time.Duration
+		giveUp      bool
+	}{
+		{desc: "First attempt", attempt: 0, min: 100 * time.Millisecond, max: 100 * time.Millisecond},
+		{desc: "Grows exponentially", attempt: 3, min: 800 * time.Millisecond, max: 800 * time.Millisecond},
+		{desc: "Capped at max", attempt: 50, min: time.Second, max: time.Second},
+		{desc: "Jitter shortens delay", attempt: 50, jitter: 0.5, min: 500 * time.Millisecond, max: time.Second},
+		{desc: "Tries forever without limits", attempt: 1000, elapsed: 1000 * time.Hour, min: time.Second, max: time.Second},
+		{desc: "Retries before max attempts", attempt: 1, maxAttempts: 3, min: 200 * time.Millisecond, max: 200 * time.Millisecond},
+		{desc: "Gives up after max attempts", attempt: 2, maxAttempts: 3, giveUp: true},
+		{desc: "Shortened to deadline", attempt: 3, elapsed: 1500 * time.Millisecond, deadline: 2 * time.Second, min: 500 * time.Millisecond, max: 500 * time.Millisecond},
+		{desc: "Gives up at deadline", attempt: 3, elapsed: 2 * time.Second, deadline: 2 * time.Second, giveUp: true},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			b := backoff
+			b.Jitter = tC.jitter
+			b.MaxAttempts = tC.maxAttempts
+			b.Deadline = tC.deadline
+			for i := 0; i < 100; i++ {
+				delay, ok := b.Delay(tC.attempt, tC.elapsed)
+				if ok == tC.giveUp {
+					t.Fatalf("Expected to give up %t, got %t", tC.giveUp, !ok)
+				}
+				if ok && (delay < tC.min || delay > tC.max) {
+					t.Fatalf("Expected delay between %s and %s, got %s", tC.min, tC.max, delay)
+				}
+			}
+		})
+	}
+}
+
+func TestBackoffValidate(t *testing.T) {
+	valid := subscriber.Backoff{Initial: time.Second, Max: time.Minute, Multiplier: 2, Jitter: 0.2}
+	testCases := []struct {
+		desc          string
+		change        func(b *subscriber.Backoff)
+		expectedError string
+	}{
+		{desc: "Valid", change: func(b *subscriber.Backoff) {}},
+		{desc: "No initial delay", change: func(b *subscriber.Backoff) { b.Initial = 0 }, expectedError: "initial delay must be positive"},
+		{desc: "Max shorter than initial", change: func(b *subscriber.Backoff) { b.Max = time.Millisecond }, expectedError: "max delay must not be shorter than initial delay"},
+		{desc: "Shrinking delays", change: func(b *subscriber.Backoff) { b.Multiplier = 0.5 }, expectedError: "multiplier must be at least 1"},
+		{desc: "Jitter over 1", change: func(b *subscriber.Backoff) { b.Jitter = 2 }, expectedError: "jitter must be between 0 and 1"},
+		{desc: "Negative max attempts", change: func(b *subscriber.Backoff) { b.MaxAttempts = -1 }, expectedError: "max attempts must not be negative"},
+		{desc: "Negative deadline", change: func(b *subscriber.Backoff) { b.Deadline = -time.Second }, expectedError: "deadline must not be negative"},
+		{
+			desc: "All problems at once",
+			change: func(b *subscriber.Backoff) {
+				b.Multiplier = 0
+				b.Jitter = -1
+			},
+			expectedError: "multiplier must be at least 1, jitter must be between 0 and 1",
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			b := valid
+			tC.change(&b)
+			err := b.Validate()
+			if tC.expectedError == "" && err != nil || tC.expectedError != "" && (err == nil || !strings.Contains(err.Error(), tC.expectedError)) {
+				t.Errorf("Expected error %q, got %v", tC.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestConnectTLS(t *testing.T) {
+	publisher := subscribertest.NewTLSPublisher()
+	defer publisher.Close()
+
+	// the test server certificate is self-signed for example.com and 127.0.0.1
+	caFile, err := ioutil.TempFile("", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(caFile.Name())
+	pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: publisher.Certificate().Raw})
+	caFile.Close()
+
+	testCases := []struct {
+		desc       string
+		serverName string
+	}{
+		{desc: "Connects to host in certificate"},
+		{desc: "Connects with overridden server name", serverName: "example.com"},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			tlsConfig, err := subscriber.NewTLSConfig(caFile.Name(), tC.serverName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mr := subscriber.NewMessageReceiver(publisher.Address(), tlsConfig, nil)
+			if !strings.HasPrefix(mr.(*subscriber.MessageReceiver).URL, "wss://") {
+				t.Errorf("Expected wss URL, got %s", mr.(*subscriber.MessageReceiver).URL)
+			}
+			if err := mr.Connect(); err != nil {
+				t.Fatal(err)
+			}
+			defer mr.Close()
+			if msg, err := mr.ReadMessage(); err != nil || string(msg) != subscriber.ConnectedBanner {
+				t.Errorf("Expected %s, got %s, %v", subscriber.ConnectedBanner, msg, err)
+			}
+		})
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	notPEM, err := ioutil.TempFile("", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(notPEM.Name())
+	notPEM.WriteString("not a certificate")
+	notPEM.Close()
+
+	testCases := []struct {
+		desc          string
+		caFile        string
+		expectedError string
+	}{
+		{desc: "System CAs"},
+		{desc: "Missing CA file", caFile: notPEM.Name() + ".missing", expectedError: "failed to read CA file"},
+		{desc: "CA file without certificates", caFile: notPEM.Name(), expectedError: "no certificates in CA file"},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			_, err := subscriber.NewTLSConfig(tC.caFile, "")
+			if tC.expectedError == "" && err != nil || tC.expectedError != "" && (err == nil || !strings.Contains(err.Error(), tC.expectedError)) {
+				t.Errorf("Expected error %q, got %v", tC.expectedError, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package subscribertest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"pub-sub/subscriber"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+//Publisher is a fake publisher that greets subscribers like the real one and sends them
+//published messages
+type Publisher struct {
+	*httptest.Server
+	mu          sync.Mutex
+	connections []*websocket.Conn
+	// closed rejects subscribers that connect while the publisher is closing
+	closed bool
+}
+
+//NewPublisher returns new Publisher listening for ws:// connections
+func NewPublisher() *Publisher {
+	p := &Publisher{}
+	p.Server = httptest.NewServer(p.handler())
+	return p
+}
+
+//NewTLSPublisher returns new Publisher listening for wss:// connections, with the certificate
+//of httptest.NewTLSServer
+func NewTLSPublisher() *Publisher {
+	p := &Publisher{}
+	p.Server = httptest.NewTLSServer(p.handler())
+	return p
+}
+
+func (p *Publisher) handler() http.Handler {
+	upgrader := websocket.Upgrader{}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn.WriteMessage(websocket.TextMessage, []byte(subscriber.ConnectedBanner))
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.closed {
+			conn.Close()
+			return
+		}
+		p.connections = append(p.connections, conn)
+	})
+}
+
+//Address returns host:port of the publisher
+func (p *Publisher) Address() string {
+	return p.Listener.Addr().String()
+}
+
+//Publish waits until there are subscribers connected and sends messages to all of them
+func (p *Publisher) Publish(t testing.TB, messages ...string) {
+	for start := time.Now(); p.Subscribers() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Error("No subscriber connected to publisher")
+			return
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conn := range p.connections {
+		for _, message := range messages {
+			conn.WriteMessage(websocket.TextMessage, []byte(message))
+		}
+	}
+}
+
+//Subscribers returns the number of connected subscribers
+func (p *Publisher) Subscribers() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.connections)
+}
+
+//Disconnect drops connections of all subscribers
+func (p *Publisher) Disconnect() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conn := range p.connections {
+		conn.Close()
+	}
+	p.connections = nil
+}
+
+//Close disconnects all subscribers and stops the publisher
+func (p *Publisher) Close() {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	p.Disconnect()
+	p.Server.Close()
+}
+
+//Unreachable returns address nobody listens on
+func Unreachable() string {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	return strings.TrimPrefix(server.URL, "http://")
+}
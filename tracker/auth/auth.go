@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Headers of authenticated requests. A request has either the API key, or a signature of the
+//request made with it and the time it was signed.
+const (
+	KeyHeader       = "X-Api-Key"
+	SignatureHeader = "X-Signature"
+	TimestampHeader = "X-Timestamp"
+)
+
+//Errors returned by Verifier.Verify
+var (
+	ErrMissingCredentials = errors.New("credentials not present")
+	ErrInvalidKey         = errors.New("invalid API key")
+	ErrInvalidSignature   = errors.New("invalid signature")
+	ErrExpired            = errors.New("timestamp is outside of the allowed window")
+	ErrReplayed           = errors.New("request was already sent")
+	ErrReplayUnavailable  = errors.New("replayed requests can't be checked")
+)
+
+// keySize is the number of random bytes in an API key
+const keySize = 32
+
+//NewKey returns new random API key
+func NewKey() (string, error) {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+//HashKey returns the hex SHA-256 hash of key, which is stored instead of the key to look it up
+func HashKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+//SigningSecret returns the hex HMAC-SHA256 of "sign" keyed with key, the secret requests are
+//signed with. It is derived from the key, so clients that have the key don't need another
+//secret, and it is stored apart from HashKey, so the hash alone can't sign requests.
+func SigningSecret(key string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte("sign"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//Sign returns the hex HMAC-SHA256 of the request, keyed with SigningSecret of the API key. Signed
+//message is the timestamp in Unix seconds, method and URI (path with query) of the request, each
+//followed by a newline, and the body.
+func Sign(signingSecret string, timestamp int64, method string, uri string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(signingSecret))
+	fmt.Fprintf(mac, "%d\n%s\n%s\n", timestamp, method, uri)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//HasCredentials reports whether request has an API key or a signature
+func HasCredentials(r *http.Request) bool {
+	return r.Header.Get(KeyHeader) != "" || r.Header.Get(SignatureHeader) != ""
+}
+
+//Credentials are what is stored of an API key, empty when there is no key
+type Credentials struct {
+	KeyHash       string
+	SigningSecret string
+}
+
+//Verifier checks credentials of requests. Signatures are only accepted within window of their
+//timestamp, and only once, so that captured requests can't be replayed. Accepted signatures are
+//remembered in a ReplayStore, which has to be shared when more trackers run behind a load balancer.
+type Verifier struct {
+	now     func() time.Time
+	replays ReplayStore
+
+	mu     sync.Mutex
+	window time.Duration
+	// notBefore rejects signatures that may have been forgotten before the window grew
+	notBefore time.Time
+}
+
+//NewVerifier returns new Verifier that accepts signatures made at most window before or after now,
+//and remembers them in replays
+func NewVerifier(window time.Duration, replays ReplayStore, now func() time.Time) *Verifier {
+	return &Verifier{window: window, replays: replays, now: now}
+}
+
+//Verify checks that request with body has the API key of credentials, or is signed with it
+func (v *Verifier) Verify(credentials Credentials, r *http.Request, body []byte) error {
+	if credentials.KeyHash == "" {
+		return ErrInvalidKey
+	}
+	if key := r.Header.Get(KeyHeader); key != "" {
+		if subtle.ConstantTimeCompare([]byte(HashKey(key)), []byte(credentials.KeyHash)) != 1 {
+			return ErrInvalidKey
+		}
+		return nil
+	}
+
+	signature, timestamp := strings.ToLower(r.Header.Get(SignatureHeader)), r.Header.Get(TimestampHeader)
+	if signature == "" {
+		return ErrMissingCredentials
+	}
+	// keys created before signing secrets were stored can only be sent as they are
+	if credentials.SigningSecret == "" {
+		return ErrInvalidSignature
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	expected := Sign(credentials.SigningSecret, seconds, r.Method, r.URL.RequestURI(), body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return ErrInvalidSignature
+	}
+
+	now, signed := v.now(), time.Unix(seconds, 0)
+	v.mu.Lock()
+	window, notBefore := v.window, v.notBefore
+	v.mu.Unlock()
+	if signed.Before(now.Add(-window)) || signed.After(now.Add(window)) || signed.Before(notBefore) {
+		return ErrExpired
+	}
+
+	first, err := v.replays.Remember(signature, signed.Add(window))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrReplayUnavailable, err)
+	}
+	if !first {
+		return ErrReplayed
+	}
+	return nil
+}
+
+//SetWindow changes how far timestamps may be from now. When the window grows, signatures made
+//before are rejected as expired, because they are remembered only for the old window.
+func (v *Verifier) SetWindow(window time.Duration) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if window > v.window {
+		v.notBefore = v.now()
+	}
+	v.window = window
+}
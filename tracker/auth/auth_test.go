@@ -0,0 +1,217 @@
+package auth_test
+
+import (
+	"net/http"
+	"pub-sub/tracker/auth"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const key = "3f1c7d2b9a8e4f605d1c2b3a4e5f60718293a4b5c6d7e8f901a2b3c4d5e6f708"
+
+func signedRequest(signingSecret string, timestamp time.Time, body string) *http.Request {
+	req, _ := http.NewRequest("POST", "/v1/accounts/5555e2d316ca1b6d40aaaaaa/events?source=test", nil)
+	seconds := timestamp.Unix()
+	req.Header.Set(auth.TimestampHeader, strconv.FormatInt(seconds, 10))
+	req.Header.Set(auth.SignatureHeader, auth.Sign(signingSecret, seconds, req.Method, req.URL.RequestURI(), []byte(body)))
+	return req
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Date(2020, time.June, 11, 12, 0, 0, 0, time.UTC)
+	credentials := auth.Credentials{KeyHash: auth.HashKey(key), SigningSecret: auth.SigningSecret(key)}
+	body := `{"data": "test"}`
+
+	testCases := []struct {
+		desc        string
+		request     func() *http.Request
+		body        string
+		credentials auth.Credentials
+		expected    error
+	}{
+		{
+			desc: "API key",
+			request: func() *http.Request {
+				req, _ := http.NewRequest("POST", "/", nil)
+				req.Header.Set(auth.KeyHeader, key)
+				return req
+			},
+			credentials: credentials,
+		},
+		{
+			desc: "Wrong API key",
+			request: func() *http.Request {
+				req, _ := http.NewRequest("POST", "/", nil)
+				req.Header.Set(auth.KeyHeader, "wrong")
+				return req
+			},
+			credentials: credentials,
+			expected:    auth.ErrInvalidKey,
+		},
+		{
+			desc: "Account without key",
+			request: func() *http.Request {
+				req, _ := http.NewRequest("POST", "/", nil)
+				req.Header.Set(auth.KeyHeader, key)
+				return req
+			},
+			expected: auth.ErrInvalidKey,
+		},
+		{
+			desc: "No credentials",
+			request: func() *http.Request {
+				req, _ := http.NewRequest("POST", "/", nil)
+				return req
+			},
+			credentials: credentials,
+			expected:    auth.ErrMissingCredentials,
+		},
+		{
+			desc:        "Signature",
+			request:     func() *http.Request { return signedRequest(credentials.SigningSecret, now, body) },
+			body:        body,
+			credentials: credentials,
+		},
+		{
+			desc:        "Signature within window",
+			request:     func() *http.Request { return signedRequest(credentials.SigningSecret, now.Add(-4*time.Minute), body) },
+			body:        body,
+			credentials: credentials,
+		},
+		{
+			desc:        "Signature with other key",
+			request:     func() *http.Request { return signedRequest(auth.SigningSecret("other"), now, body) },
+			body:        body,
+			credentials: credentials,
+			expected:    auth.ErrInvalidSignature,
+		},
+		{
+			desc:        "Signature keyed with key hash",
+			request:     func() *http.Request { return signedRequest(credentials.KeyHash, now, body) },
+			body:        body,
+			credentials: credentials,
+			expected:    auth.ErrInvalidSignature,
+		},
+		{
+			desc:        "Signature without stored signing secret",
+			request:     func() *http.Request { return signedRequest(credentials.SigningSecret, now, body) },
+			body:        body,
+			credentials: auth.Credentials{KeyHash: credentials.KeyHash},
+			expected:    auth.ErrInvalidSignature,
+		},
+		{
+			desc:        "Changed body",
+			request:     func() *http.Request { return signedRequest(credentials.SigningSecret, now, body) },
+			body:        `{"data": "changed"}`,
+			credentials: credentials,
+			expected:    auth.ErrInvalidSignature,
+		},
+		{
+			desc: "Changed URI",
+			request: func() *http.Request {
+				req := signedRequest(credentials.SigningSecret, now, body)
+				req.URL.RawQuery = "source=other"
+				return req
+			},
+			body:        body,
+			credentials: credentials,
+			expected:    auth.ErrInvalidSignature,
+		},
+		{
+			desc: "Invalid timestamp",
+			request: func() *http.Request {
+				req := signedRequest(credentials.SigningSecret, now, body)
+				req.Header.Set(auth.TimestampHeader, "yesterday")
+				return req
+			},
+			body:        body,
+			credentials: credentials,
+			expected:    auth.ErrInvalidSignature,
+		},
+		{
+			desc:        "Old signature",
+			request:     func() *http.Request { return signedRequest(credentials.SigningSecret, now.Add(-6*time.Minute), body) },
+			body:        body,
+			credentials: credentials,
+			expected:    auth.ErrExpired,
+		},
+		{
+			desc:        "Signature from the future",
+			request:     func() *http.Request { return signedRequest(credentials.SigningSecret, now.Add(6*time.Minute), body) },
+			body:        body,
+			credentials: credentials,
+			expected:    auth.ErrExpired,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			verifier := auth.NewVerifier(5*time.Minute, auth.NewMemoryReplayStore(func() time.Time { return now }), func() time.Time { return now })
+			if err := verifier.Verify(tC.credentials, tC.request(), []byte(tC.body)); err != tC.expected {
+				t.Errorf("Expected %v, got %v", tC.expected, err)
+			}
+		})
+	}
+}
+
+func TestVerifyRejectsReplays(t *testing.T) {
+	now := time.Date(2020, time.June, 11, 12, 0, 0, 0, time.UTC)
+	verifier := auth.NewVerifier(5*time.Minute, auth.NewMemoryReplayStore(func() time.Time { return now }), func() time.Time { return now })
+	credentials := auth.Credentials{KeyHash: auth.HashKey(key), SigningSecret: auth.SigningSecret(key)}
+
+	if err := verifier.Verify(credentials, signedRequest(credentials.SigningSecret, now, "first"), []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifier.Verify(credentials, signedRequest(credentials.SigningSecret, now, "first"), []byte("first")); err != auth.ErrReplayed {
+		t.Errorf("Expected %v, got %v", auth.ErrReplayed, err)
+	}
+	if err := verifier.Verify(credentials, signedRequest(credentials.SigningSecret, now, "second"), []byte("second")); err != nil {
+		t.Errorf("Expected other request to be accepted, got %v", err)
+	}
+}
+
+func TestVerifierSetWindow(t *testing.T) {
+	start := time.Date(2020, time.June, 11, 12, 0, 0, 0, time.UTC)
+	now := start
+	verifier := auth.NewVerifier(5*time.Minute, auth.NewMemoryReplayStore(func() time.Time { return now }), func() time.Time { return now })
+	credentials := auth.Credentials{KeyHash: auth.HashKey(key), SigningSecret: auth.SigningSecret(key)}
+
+	if err := verifier.Verify(credentials, signedRequest(credentials.SigningSecret, start, "first"), []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first signature is forgotten, but it must not be accepted again in the grown window
+	now = start.Add(6 * time.Minute)
+	if err := verifier.Verify(credentials, signedRequest(credentials.SigningSecret, now, "second"), []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	verifier.SetWindow(10 * time.Minute)
+	if err := verifier.Verify(credentials, signedRequest(credentials.SigningSecret, start, "first"), []byte("first")); err != auth.ErrExpired {
+		t.Errorf("Expected %v, got %v", auth.ErrExpired, err)
+	}
+	if err := verifier.Verify(credentials, signedRequest(credentials.SigningSecret, now, "second"), []byte("second")); err != auth.ErrReplayed {
+		t.Errorf("Expected %v, got %v", auth.ErrReplayed, err)
+	}
+
+	verifier.SetWindow(time.Minute)
+	if err := verifier.Verify(credentials, signedRequest(credentials.SigningSecret, now.Add(-2*time.Minute), "third"), []byte("third")); err != auth.ErrExpired {
+		t.Errorf("Expected %v in smaller window, got %v", auth.ErrExpired, err)
+	}
+}
+
+func TestNewKey(t *testing.T) {
+	first, err := auth.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := auth.NewKey()
+	if len(first) != 64 || first == second {
+		t.Errorf("Expected two different keys of 64 characters, got %s and %s", first, second)
+	}
+	if auth.HashKey(first) == first || len(auth.HashKey(first)) != 64 {
+		t.Errorf("Expected hex SHA-256 hash, got %s", auth.HashKey(first))
+	}
+	if secret := auth.SigningSecret(first); secret == auth.HashKey(first) || len(secret) != 64 {
+		t.Errorf("Expected hex HMAC-SHA256 apart from the hash, got %s", secret)
+	}
+}
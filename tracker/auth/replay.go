@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+)
+
+//ReplayStore remembers signatures that were accepted until they expire
+type ReplayStore interface {
+	//Remember saves signature until expires, it returns false when signature is saved already
+	Remember(signature string, expires time.Time) (bool, error)
+}
+
+//MemoryReplayStore is a ReplayStore in memory of the process. A captured request can be replayed
+//to each other process and after a restart, so it is only enough for a single tracker.
+type MemoryReplayStore struct {
+	now func() time.Time
+
+	mu sync.Mutex
+	// seen maps signatures that were accepted to the time they expire
+	seen  map[string]time.Time
+	swept time.Time
+}
+
+//NewMemoryReplayStore returns new empty MemoryReplayStore
+func NewMemoryReplayStore(now func() time.Time) *MemoryReplayStore {
+	return &MemoryReplayStore{now: now, seen: map[string]time.Time{}, swept: now()}
+}
+
+//Remember saves signature until expires, it returns false when signature is saved already
+func (ms *MemoryReplayStore) Remember(signature string, expires time.Time) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.sweep(ms.now())
+	if _, ok := ms.seen[signature]; ok {
+		return false, nil
+	}
+	ms.seen[signature] = expires
+	return true, nil
+}
+
+// sweepInterval is how often expired signatures are forgotten
+const sweepInterval = time.Minute
+
+// sweep forgets expired signatures, ms.mu must be held
+func (ms *MemoryReplayStore) sweep(now time.Time) {
+	if now.Sub(ms.swept) < sweepInterval {
+		return
+	}
+	ms.swept = now
+	for signature, expires := range ms.seen {
+		if now.After(expires) {
+			delete(ms.seen, signature)
+		}
+	}
+}
+
+//MongoReplayStore is a ReplayStore in a MongoDB collection, shared by all trackers that use it
+type MongoReplayStore struct {
+	Collection *mgo.Collection
+}
+
+type mongoSignature struct {
+	Signature string    `bson:"_id"`
+	Expires   time.Time `bson:"expires"`
+}
+
+//NewMongoReplayStore returns MongoReplayStore in collection of table, MongoDB removes expired
+//signatures by a TTL index
+func NewMongoReplayStore(db *mgo.Session, table, collection string) (*MongoReplayStore, error) {
+	dbCollection := db.DB(table).C(collection)
+	index := mgo.Index{Key: []string{"expires"}, ExpireAfter: time.Second}
+	if err := dbCollection.EnsureIndex(index); err != nil {
+		return nil, err
+	}
+	return &MongoReplayStore{Collection: dbCollection}, nil
+}
+
+//Remember inserts signature, which fails when it is saved already. Signatures that expired but
+//were not removed yet are only found when they would be rejected as expired anyway.
+func (ms *MongoReplayStore) Remember(signature string, expires time.Time) (bool, error) {
+	err := ms.Collection.Insert(mongoSignature{Signature: signature, Expires: expires})
+	if mgo.IsDup(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
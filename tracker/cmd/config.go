@@ -1,57 +1,266 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	"log"
+	"os"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
 
+//duration is time.Duration that can be decoded from TOML strings like "500ms"
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+type reconnectConfig struct {
+	Initial    duration
+	Max        duration
+	Multiplier float64
+	Jitter     float64
+}
+
 type databaseConfig struct {
+	Driver     string
+	Fixture    string
+	File       string
 	Server     string
 	Port       string
 	Table      string
 	Collection string
 }
 
+type cacheConfig struct {
+	Enabled     bool
+	Size        int
+	TTL         duration
+	NegativeTTL duration `toml:"negative_ttl"`
+	Watch       bool
+	WatchRetry  duration `toml:"watch_retry"`
+}
+
+type rateLimitConfig struct {
+	Enabled    bool
+	PerSecond  float64 `toml:"per_second"`
+	Burst      int
+	Daily      int64
+	Monthly    int64
+	Collection string
+}
+
+type idempotencyConfig struct {
+	Enabled    bool
+	Driver     string
+	Size       int
+	Window     duration
+	Collection string
+}
+
+type authConfig struct {
+	Enabled            bool
+	AdminKeyHash       string `toml:"admin_key_hash" secret:"true"`
+	AdminSigningSecret string `toml:"admin_signing_secret" secret:"true"`
+	Window             duration
+	ReplayDriver       string `toml:"replay_driver"`
+	ReplayCollection   string `toml:"replay_collection"`
+}
+
+type logConfig struct {
+	Level  string
+	Format string
+}
+
+type tlsConfig struct {
+	Enabled      bool
+	CertFile     string `toml:"cert_file"`
+	KeyFile      string `toml:"key_file"`
+	ClientAuth   string `toml:"client_auth"`
+	ClientCAFile string `toml:"client_ca_file"`
+}
+
+type publisherTLSConfig struct {
+	CAFile     string `toml:"ca_file"`
+	ServerName string `toml:"server_name"`
+	CertFile   string `toml:"cert_file"`
+	KeyFile    string `toml:"key_file"`
+}
+
 type publisherConfig struct {
-	URL    string
-	Port   string
-	Method string
+	URL       string
+	Port      string
+	Method    string
+	QueueSize int    `toml:"queue_size"`
+	Overflow  string `toml:"overflow"`
+	Reconnect reconnectConfig
+	TLS       publisherTLSConfig
+}
+
+type outboxConfig struct {
+	Enabled       bool
+	Directory     string
+	SegmentSize   int64    `toml:"segment_size"`
+	Fsync         string   `toml:"fsync"`
+	FsyncInterval duration `toml:"fsync_interval"`
 }
 
 //Config definition
 type Config struct {
-	Address   string
-	Database  databaseConfig
-	Publisher publisherConfig
+	Address         string
+	MaxBatchSize    int      `toml:"max_batch_size"`
+	ShutdownTimeout duration `toml:"shutdown_timeout"`
+	ReloadInterval  duration `toml:"reload_interval"`
+	Log             logConfig
+	TLS             tlsConfig
+	Database        databaseConfig
+	Cache           cacheConfig
+	RateLimit       rateLimitConfig `toml:"rate_limit"`
+	Auth            authConfig
+	Idempotency     idempotencyConfig
+	Publisher       publisherConfig
+	Outbox          outboxConfig
+	// path is the config file the config was loaded from
+	path string
 }
 
-//LoadConfig loads config from path and returns loaded config
-func LoadConfig(path string) *Config {
-	defaultConfig := defaultConfig()
-	fmt.Println(path)
-	fmt.Println(defaultConfig)
-	if _, err := toml.DecodeFile(path, defaultConfig); err != nil {
-		log.Fatal("error", err.Error())
+// usageHeader is printed by -help before the list of flags
+const usageHeader = `Usage of tracker:
+
+Settings come from built-in defaults, the config file, TRACKER_* environment variables and
+these flags, each overriding the ones before. Without config.toml in the working directory the
+defaults are used, a file given by -config or TRACKER_CONFIG must exist.
+
+The defaults differ from the config.toml next to the tracker, which is meant for docker-compose
+and local development: authentication is enabled (auth.enabled = false in config.toml), the
+tracker listens on localhost:8080 and MongoDB and the publisher are on localhost.
+
+`
+
+//LoadConfig returns config from defaults, overridden by the config file, then by TRACKER_*
+//environment variables and then by command-line flags in args. The config file is given by the
+//-config flag or TRACKER_CONFIG and must exist then, a missing config.toml leaves the defaults.
+//Returns flag.ErrHelp when args ask for usage.
+func LoadConfig(args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	config := defaultConfig()
+	fields := configFields(config)
+
+	flags := flag.NewFlagSet("tracker", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usageHeader)
+		flags.PrintDefaults()
+	}
+	path := flags.String("config", "config.toml", "Path for config file, "+configPathEnv+" in environment")
+	overrides := map[string]string{}
+	for _, f := range fields {
+		flags.Var(&flagOverride{field: f, overrides: overrides}, f.key, f.usage())
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	explicit := flagSet(flags, "config")
+	if env, ok := lookupEnv(configPathEnv); ok && !explicit {
+		*path, explicit = env, true
+	}
+
+	// only the default config file may be missing, the file is watched in case it is created
+	if _, err := toml.DecodeFile(*path, config); err != nil && (explicit || !os.IsNotExist(err)) {
+		return nil, fmt.Errorf("failed to load config file %s: %w", *path, err)
 	}
-	fmt.Println(defaultConfig)
-	return defaultConfig
+	config.path = *path
+
+	var errs configErrors
+	for _, f := range fields {
+		if env, ok := lookupEnv(f.env()); ok {
+			if err := f.set(env); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", f.env(), err))
+			}
+		}
+	}
+	for _, f := range fields {
+		if value, ok := overrides[f.key]; ok {
+			// values were checked when flags were parsed
+			f.set(value)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return config, config.validate()
 }
 
 func defaultConfig() *Config {
 	return &Config{
-		Address: "localhost:8080",
+		Address:         "localhost:8080",
+		MaxBatchSize:    100,
+		ShutdownTimeout: duration{15 * time.Second},
+		ReloadInterval:  duration{5 * time.Second},
+		Log: logConfig{
+			Level:  "info",
+			Format: "logfmt",
+		},
 		Database: databaseConfig{
+			Driver:     "mongo",
+			Fixture:    "fixtures/accounts.json",
+			File:       "accounts.json",
 			Server:     "localhost",
 			Port:       "27017",
 			Table:      "tracker",
 			Collection: "user",
 		},
+		Cache: cacheConfig{
+			Enabled:     true,
+			Size:        10000,
+			TTL:         duration{30 * time.Second},
+			NegativeTTL: duration{5 * time.Second},
+			WatchRetry:  duration{5 * time.Second},
+		},
+		RateLimit: rateLimitConfig{
+			Enabled:    true,
+			PerSecond:  10,
+			Burst:      20,
+			Collection: "quota",
+		},
+		Idempotency: idempotencyConfig{
+			Enabled:    true,
+			Driver:     "memory",
+			Size:       100000,
+			Window:     duration{24 * time.Hour},
+			Collection: "idempotency",
+		},
+		TLS: tlsConfig{
+			ClientAuth: "none",
+		},
+		Auth: authConfig{
+			Enabled:          true,
+			Window:           duration{5 * time.Minute},
+			ReplayDriver:     "memory",
+			ReplayCollection: "signatures",
+		},
 		Publisher: publisherConfig{
-			URL:    "localhost",
-			Port:   "8000",
-			Method: "ws",
+			URL:       "localhost",
+			Port:      "8000",
+			Method:    "ws",
+			QueueSize: 1024,
+			Overflow:  "reject",
+			Reconnect: reconnectConfig{
+				Initial:    duration{500 * time.Millisecond},
+				Max:        duration{30 * time.Second},
+				Multiplier: 2,
+				Jitter:     0.2,
+			},
+		},
+		Outbox: outboxConfig{
+			Enabled:       true,
+			Directory:     "outbox",
+			SegmentSize:   16 << 20,
+			Fsync:         "always",
+			FsyncInterval: duration{time.Second},
 		},
 	}
 }
@@ -1,14 +1,25 @@
 package main
 
 import (
+	"context"
+	"expvar"
 	"flag"
 	"fmt"
-	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
+	"pub-sub/backoff"
+	"pub-sub/logging"
+	"pub-sub/tracker/auth"
 	"pub-sub/tracker/database"
 	"pub-sub/tracker/handler"
+	"pub-sub/tracker/idempotency"
+	"pub-sub/tracker/metrics"
+	"pub-sub/tracker/ratelimit"
 	"pub-sub/tracker/socket"
+	"pub-sub/tracker/tlsconfig"
+	"syscall"
 	"time"
 
 	"github.com/globalsign/mgo"
@@ -16,11 +27,6 @@ import (
 	"github.com/gorilla/websocket"
 )
 
-func testHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte(`{"a": "a"}`))
-}
-
 func connectToDatabase(databaseConfig databaseConfig) *mgo.Session {
 	databaseURL := fmt.Sprintf("%s:%s", databaseConfig.Server, databaseConfig.Port)
 	session, err := mgo.Dial(databaseURL)
@@ -30,53 +36,429 @@ func connectToDatabase(databaseConfig databaseConfig) *mgo.Session {
 	return session
 }
 
-func publisherConnection(publisherConfig publisherConfig) *websocket.Conn {
+// stores are the storages of the tracker
+type stores struct {
+	users    database.Storage
+	counters ratelimit.CounterStore
+	// requests is nil when idempotency keys are disabled
+	requests idempotency.Store
+	replays  auth.ReplayStore
+	// database is nil when users are not kept in MongoDB
+	database handler.Pinger
+	close    func()
+}
+
+// openStores returns stores for the configured drivers. Quota counters are kept in MongoDB with
+// the mongo driver and in memory otherwise.
+func openStores(config *Config, logger *logging.Logger) (*stores, error) {
+	databaseConfig := config.Database
+	switch databaseConfig.Driver {
+	case "mongo":
+		session := connectToDatabase(databaseConfig)
+		counters, err := ratelimit.NewMongoCounterStore(session, databaseConfig.Table, config.RateLimit.Collection)
+		if err != nil {
+			session.Close()
+			return nil, err
+		}
+		requests, err := openIdempotencyStore(config, session)
+		if err != nil {
+			session.Close()
+			return nil, err
+		}
+		replays, err := openReplayStore(config, session)
+		if err != nil {
+			session.Close()
+			return nil, err
+		}
+
+		ping := pingDatabase(session)
+		var storage database.Storage = database.NewUserStorage(session, databaseConfig.Table, databaseConfig.Collection, logger)
+		if config.Cache.Watch {
+			source := database.NewChangeSource(session, databaseConfig.Table, databaseConfig.Collection, logger)
+			view := database.NewAccountView(storage, source, config.Cache.WatchRetry.Duration, logger)
+			return &stores{users: view, counters: counters, requests: requests, replays: replays, database: ping, close: func() { view.Close(); session.Close() }}, nil
+		}
+		if config.Cache.Enabled {
+			storage = database.NewCachedStorage(storage, cacheOptions(config.Cache))
+		}
+		return &stores{users: storage, counters: counters, requests: requests, replays: replays, database: ping, close: session.Close}, nil
+	case "memory", "file":
+		seed := []database.Person{}
+		if databaseConfig.Fixture != "" {
+			var err error
+			if seed, err = database.LoadFixture(databaseConfig.Fixture); err != nil {
+				return nil, err
+			}
+		}
+		counters := ratelimit.NewMemoryCounterStore(time.Now)
+		requests, err := openIdempotencyStore(config, nil)
+		if err != nil {
+			return nil, err
+		}
+		replays, err := openReplayStore(config, nil)
+		if err != nil {
+			return nil, err
+		}
+		if databaseConfig.Driver == "memory" {
+			return &stores{users: database.NewMemoryStorage(seed), counters: counters, requests: requests, replays: replays, close: func() {}}, nil
+		}
+		storage, err := database.NewFileStorage(databaseConfig.File, seed)
+		if err != nil {
+			return nil, err
+		}
+		return &stores{users: storage, counters: counters, requests: requests, replays: replays, close: func() {}}, nil
+	}
+	return nil, fmt.Errorf("unknown database driver %q", databaseConfig.Driver)
+}
+
+func cacheOptions(cacheConfig cacheConfig) database.CacheOptions {
+	return database.CacheOptions{
+		Size:        cacheConfig.Size,
+		TTL:         cacheConfig.TTL.Duration,
+		NegativeTTL: cacheConfig.NegativeTTL.Duration,
+	}
+}
+
+// openIdempotencyStore returns store of idempotency keys, session is nil without MongoDB
+func openIdempotencyStore(config *Config, session *mgo.Session) (idempotency.Store, error) {
+	idempotencyConfig := config.Idempotency
+	if !idempotencyConfig.Enabled {
+		return nil, nil
+	}
+	switch idempotencyConfig.Driver {
+	case "memory":
+		return idempotency.NewMemoryStore(idempotencyConfig.Size, idempotencyConfig.Window.Duration, time.Now), nil
+	case "mongo":
+		if session == nil {
+			return nil, fmt.Errorf("idempotency driver mongo needs database driver mongo")
+		}
+		return idempotency.NewMongoStore(session, config.Database.Table, idempotencyConfig.Collection, idempotencyConfig.Window.Duration, time.Now)
+	}
+	return nil, fmt.Errorf("unknown idempotency driver %q", idempotencyConfig.Driver)
+}
+
+// openReplayStore returns store of accepted signatures, session is nil without MongoDB
+func openReplayStore(config *Config, session *mgo.Session) (auth.ReplayStore, error) {
+	switch config.Auth.ReplayDriver {
+	case "memory":
+		return auth.NewMemoryReplayStore(time.Now), nil
+	case "mongo":
+		if session == nil {
+			return nil, fmt.Errorf("replay driver mongo needs database driver mongo")
+		}
+		return auth.NewMongoReplayStore(session, config.Database.Table, config.Auth.ReplayCollection)
+	}
+	return nil, fmt.Errorf("unknown replay driver %q", config.Auth.ReplayDriver)
+}
+
+// adminCredentials returns credentials of the admin key from config
+func adminCredentials(authConfig authConfig) auth.Credentials {
+	return auth.Credentials{KeyHash: authConfig.AdminKeyHash, SigningSecret: authConfig.AdminSigningSecret}
+}
+
+// pingTimeout limits how long readiness checks wait for MongoDB
+const pingTimeout = 2 * time.Second
+
+// pingDatabase returns Pinger that pings MongoDB on a copy of session, so that a slow ping
+// doesn't hold up other requests
+func pingDatabase(session *mgo.Session) handler.Pinger {
+	return handler.PingerFunc(func() error {
+		ping := session.Copy()
+		defer ping.Close()
+		ping.SetSyncTimeout(pingTimeout)
+		ping.SetSocketTimeout(pingTimeout)
+		return ping.Ping()
+	})
+}
+
+// publishVars exposes the state of publisher and cache in /debug/vars
+func publishVars(users database.Storage, publisher socket.Client) {
+	expvar.Publish("publisher", expvar.Func(func() interface{} {
+		status := publisher.Status()
+		lastError := ""
+		if status.LastError != nil {
+			lastError = status.LastError.Error()
+		}
+		return map[string]interface{}{
+			"state":      status.State.String(),
+			"queueDepth": status.QueueDepth,
+			"reconnects": status.Reconnects,
+			"lastError":  lastError,
+		}
+	}))
+	if cache, ok := users.(*database.CachedStorage); ok {
+		expvar.Publish("cache", expvar.Func(func() interface{} {
+			return cache.Stats()
+		}))
+	}
+}
+
+func serverTLSOptions(tlsConfig tlsConfig) tlsconfig.ServerOptions {
+	return tlsconfig.ServerOptions{
+		CertFile:     tlsConfig.CertFile,
+		KeyFile:      tlsConfig.KeyFile,
+		ClientAuth:   tlsConfig.ClientAuth,
+		ClientCAFile: tlsConfig.ClientCAFile,
+	}
+}
+
+func publisherTLSOptions(tlsConfig publisherTLSConfig) tlsconfig.ClientOptions {
+	return tlsconfig.ClientOptions{
+		CAFile:     tlsConfig.CAFile,
+		ServerName: tlsConfig.ServerName,
+		CertFile:   tlsConfig.CertFile,
+		KeyFile:    tlsConfig.KeyFile,
+	}
+}
+
+// newLogger returns logger that writes to stderr in the configured format, and its level that
+// can be changed on reload. Invalid settings fall back to defaults, they are reported by validate.
+func newLogger(logConfig logConfig) (*logging.Logger, *logging.AtomicLevel) {
+	level, err := logging.ParseLevel(logConfig.Level)
+	if err != nil {
+		level = logging.LevelInfo
+	}
+	format, err := logging.ParseFormat(logConfig.Format)
+	if err != nil {
+		format = logging.FormatLogfmt
+	}
+	atomicLevel := logging.NewAtomicLevel(level)
+	return logging.New(logging.NewWriter(os.Stderr, format, atomicLevel)), atomicLevel
+}
+
+// fatal logs err and exits, it is only used while the tracker starts
+func fatal(logger *logging.Logger, message string, err error) {
+	logger.Error(message, logging.Err(err))
+	os.Exit(1)
+}
+
+// publisherDialer returns DialFunc for the publisher, connections with method wss are verified
+// with CAs and server name of publisher TLS config
+func publisherDialer(publisherConfig publisherConfig, logger *logging.Logger) (socket.DialFunc, error) {
 	host := fmt.Sprintf("%s:%s", publisherConfig.URL, publisherConfig.Port)
 	u := url.URL{Scheme: publisherConfig.Method, Host: host}
-	log.Printf("connecting to %s", u.String())
 
-	var c *websocket.Conn
-	for {
-		var err error
-		c, _, err = websocket.DefaultDialer.Dial(u.String(), nil)
-		if err == nil {
-			log.Print("Successfully connected to publisher")
-			break
+	dialer := *websocket.DefaultDialer
+	if publisherConfig.Method == "wss" {
+		tlsConfig, err := tlsconfig.Client(publisherTLSOptions(publisherConfig.TLS))
+		if err != nil {
+			return nil, err
 		}
-		log.Print("error", err)
-		time.Sleep(3 * time.Second)
+		dialer.TLSClientConfig = tlsConfig
+	}
+
+	return func() (socket.Conn, error) {
+		logger.Debug("Connecting to publisher", logging.F("url", u.String()))
+		c, _, err := dialer.Dial(u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("Connected to publisher", logging.F("url", u.String()))
+		return c, nil
+	}, nil
+}
+
+func durableOutbox(outboxConfig outboxConfig, publisher socket.SyncClient, logger *logging.Logger) (socket.Client, error) {
+	fsync, err := socket.ParseSyncPolicy(outboxConfig.Fsync)
+	if err != nil {
+		return nil, err
 	}
-	return c
+	return socket.NewDurableClient(publisher, socket.WALOptions{
+		Directory:    outboxConfig.Directory,
+		SegmentSize:  outboxConfig.SegmentSize,
+		Sync:         fsync,
+		SyncInterval: outboxConfig.FsyncInterval.Duration,
+	}, logger)
 }
 
-func startServer(address string, database database.Storage, publisher socket.Client) error {
+// newServer returns server with all routes and the authenticator that guards them, it lets
+// everyone in while auth is disabled
+func newServer(config *Config, storage *stores, publisher socket.Client, limiter handler.RateLimiter, verifier *auth.Verifier, registry *metrics.Registry, logger *logging.Logger) (*http.Server, *handler.Authenticator) {
+	// users and messages are measured as the handlers see them, including the cache
+	instruments := handler.NewMetrics(registry)
+	if cache, ok := storage.users.(*database.CachedStorage); ok {
+		instruments.Cache(cache)
+	}
+	if view, ok := storage.users.(*database.AccountView); ok {
+		instruments.View(view)
+	}
+	users, requests := instruments.Storage(storage.users), storage.requests
+	publisher = instruments.Publisher(publisher)
+
 	r := mux.NewRouter()
-	r.HandleFunc("/{accountId}", handler.NewAccountHandler(database, publisher)).Methods("POST")
+	r.Use(handler.NewRequestLogger(logger).Middleware)
+	r.Use(instruments.Middleware)
+	healthz := r.HandleFunc("/healthz", handler.NewLivenessHandler()).Methods("GET")
+	readyz := r.HandleFunc("/readyz", handler.NewReadinessHandler(storage.database, publisher)).Methods("GET")
+	metricsRoute := r.Handle("/metrics", registry.Handler()).Methods("GET")
+	r.Handle("/debug/vars", expvar.Handler()).Methods("GET")
+	events := r.HandleFunc("/v1/accounts/{accountId}/events", handler.NewIdempotentHandler(requests, handler.NewEventHandler(users, publisher, limiter))).Methods("POST")
+	r.HandleFunc("/v1/events:batch", handler.NewIdempotentHandler(requests, handler.NewBatchHandler(users, publisher, limiter, config.MaxBatchSize))).Methods("POST")
+	r.HandleFunc("/v1/accounts", handler.NewListAccountsHandler(users)).Methods("GET")
+	r.HandleFunc("/v1/accounts", handler.NewCreateAccountHandler(users)).Methods("POST")
+	r.HandleFunc("/v1/accounts/{accountId}", handler.NewGetAccountHandler(users)).Methods("GET")
+	r.HandleFunc("/v1/accounts/{accountId}", handler.NewUpdateAccountHandler(users)).Methods("PATCH")
+	r.HandleFunc("/v1/accounts/{accountId}", handler.NewDeleteAccountHandler(users)).Methods("DELETE")
+	r.HandleFunc("/v1/accounts/{accountId}/keys", handler.NewCreateKeyHandler(users)).Methods("POST")
+	r.HandleFunc("/v1/accounts/{accountId}/keys", handler.NewDeleteKeyHandler(users)).Methods("DELETE")
+	publish := r.HandleFunc("/{accountId}", handler.NewIdempotentHandler(requests, handler.NewAccountHandler(users, publisher, limiter))).Methods("POST")
 
-	server := http.Server{
-		Addr:    address,
-		Handler: r,
+	authenticator := handler.NewAuthenticator(users, verifier, adminCredentials(config.Auth))
+	authenticator.AllowAccount(events)
+	authenticator.AllowAccount(publish)
+	authenticator.AllowAnonymous(healthz)
+	authenticator.AllowAnonymous(readyz)
+	authenticator.AllowAnonymous(metricsRoute)
+	authenticator.SetEnabled(config.Auth.Enabled)
+	r.Use(authenticator.Middleware)
+	if !config.Auth.Enabled {
+		logger.Warn("Authentication is disabled, anyone can publish for any account")
 	}
 
-	log.Println("Serving on", server.Addr)
-	return server.ListenAndServe()
+	return &http.Server{
+		Addr:    config.Address,
+		Handler: r,
+	}, authenticator
+}
+
+// shutdown stops server from accepting requests and waits for the ones in flight, then ships
+// queued messages to the publisher and closes it, and closes the stores last. All of it has to
+// be done within timeout, messages that are left are kept in the outbox when it is enabled.
+func shutdown(server *http.Server, publisher socket.Client, storage *stores, timeout time.Duration, logger *logging.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Error("Failed to wait for requests in flight", logging.Err(err))
+	}
+	if err := publisher.Shutdown(ctx); err != nil {
+		logger.Error("Failed to flush messages to publisher", logging.Err(err))
+	}
+	storage.close()
+	logger.Info("Tracker stopped")
 }
 
 func main() {
-	var configPath = flag.String("config", "config.toml", "Path for config file")
-	flag.Parse()
+	config, err := LoadConfig(os.Args[1:], os.LookupEnv)
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		logger, _ := newLogger(defaultConfig().Log)
+		fatal(logger, "Failed to load config", err)
+	}
+	logger, level := newLogger(config.Log)
+	logger.Info("Effective config", config.logFields()...)
+
+	storage, err := openStores(config, logger)
+	if err != nil {
+		fatal(logger, "Failed to open stores", err)
+	}
+
+	rateLimit := config.RateLimit
+	limiter := ratelimit.NewLimiter(database.RateLimit{
+		PerSecond: rateLimit.PerSecond,
+		Burst:     rateLimit.Burst,
+		Daily:     rateLimit.Daily,
+		Monthly:   rateLimit.Monthly,
+	}, storage.counters, time.Now, logger)
+	limiter.SetEnabled(rateLimit.Enabled)
+
+	overflow, err := socket.ParseOverflowPolicy(config.Publisher.Overflow)
+	if err != nil {
+		fatal(logger, "Invalid publisher overflow", err)
+	}
+
+	reconnect := config.Publisher.Reconnect
+	reconnectBackoff := backoff.Backoff{
+		Initial:    reconnect.Initial.Duration,
+		Max:        reconnect.Max.Duration,
+		Multiplier: reconnect.Multiplier,
+		Jitter:     reconnect.Jitter,
+	}
+
+	dial, err := publisherDialer(config.Publisher, logger)
+	if err != nil {
+		fatal(logger, "Invalid publisher TLS config", err)
+	}
+	connection := socket.NewReconnectingConn(dial, reconnectBackoff, logger)
+	publisher := socket.NewSocketSender(connection, config.Publisher.QueueSize, overflow, logger)
+	var userActionNotifier socket.Client = publisher
+	if config.Outbox.Enabled {
+		userActionNotifier, err = durableOutbox(config.Outbox, publisher, logger)
+		if err != nil {
+			fatal(logger, "Failed to open outbox", err)
+		}
+	}
 
-	config := LoadConfig(*configPath)
-	_ = config
+	publishVars(storage.users, userActionNotifier)
+	verifier := auth.NewVerifier(config.Auth.Window.Duration, storage.replays, time.Now)
+	server, authenticator := newServer(config, storage, userActionNotifier, limiter, verifier, metrics.NewRegistry(), logger)
+
+	reloader := &reloader{
+		load:          func() (*Config, error) { return LoadConfig(os.Args[1:], os.LookupEnv) },
+		config:        config,
+		logger:        logger,
+		level:         level,
+		limiter:       limiter,
+		authenticator: authenticator,
+		verifier:      verifier,
+		publisher:     connection,
+	}
+	if cache, ok := storage.users.(*database.CachedStorage); ok {
+		reloader.cache = cache
+	}
 
-	session := connectToDatabase(config.Database)
-	defer session.Close()
+	if config.TLS.Enabled {
+		if server.TLSConfig, err = tlsconfig.Server(serverTLSOptions(config.TLS)); err != nil {
+			fatal(logger, "Invalid TLS config", err)
+		}
+	}
 
-	socketConnection := publisherConnection(config.Publisher)
-	defer socketConnection.Close()
+	serverErrors := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			logger.Info("Serving with TLS", logging.F("address", server.Addr))
+			// certificates are in TLSConfig already
+			serverErrors <- server.ListenAndServeTLS("", "")
+			return
+		}
+		logger.Info("Serving", logging.F("address", server.Addr))
+		serverErrors <- server.ListenAndServe()
+	}()
 
-	userDatabase := database.NewUserStorage(session, config.Database.Table, config.Database.Collection)
-	userActionNotifier := socket.NewSocketSender(socketConnection)
+	// config file is checked for changes every reload_interval, on SIGHUP it is reloaded right away
+	var ticks <-chan time.Time
+	if interval := config.ReloadInterval.Duration; interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	watcher := newFileWatcher(config.path)
 
-	startServer(config.Address, userDatabase, userActionNotifier)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for running := true; running; {
+		select {
+		case err := <-serverErrors:
+			logger.Error("Server stopped", logging.Err(err))
+			running = false
+		case <-ticks:
+			if watcher.changed() {
+				logger.Info("Config file changed, reloading", logging.F("path", watcher.path))
+				reloader.reload()
+			}
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				logger.Info("Received SIGHUP, reloading config")
+				watcher.changed()
+				reloader.reload()
+				continue
+			}
+			logger.Info("Shutting down", logging.F("signal", sig), logging.F("timeout", reloader.config.ShutdownTimeout.Duration))
+			running = false
+		}
+	}
+	signal.Stop(signals)
+	shutdown(server, userActionNotifier, storage, reloader.config.ShutdownTimeout.Duration, logger)
 }
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"pub-sub/logging"
+	"pub-sub/tracker/auth"
+	"pub-sub/tracker/database"
+	"pub-sub/tracker/handler"
+	"pub-sub/tracker/ratelimit"
+	"pub-sub/tracker/socket"
+	"reflect"
+	"strings"
+)
+
+// reloadableKeys are the config keys, or sections ending with a dot, that are applied without
+// restart. Changes of other keys are reported and ignored until the tracker is restarted.
+var reloadableKeys = []string{
+	"shutdown_timeout",
+	"log.level",
+	"rate_limit.enabled",
+	"rate_limit.per_second",
+	"rate_limit.burst",
+	"rate_limit.daily",
+	"rate_limit.monthly",
+	"cache.size",
+	"cache.ttl",
+	"cache.negative_ttl",
+	"auth.",
+	"publisher.url",
+	"publisher.port",
+	"publisher.method",
+	"publisher.tls.",
+}
+
+func reloadable(key string) bool {
+	for _, reloadableKey := range reloadableKeys {
+		if key == reloadableKey || strings.HasSuffix(reloadableKey, ".") && strings.HasPrefix(key, reloadableKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// reloader applies changed config to the running tracker
+type reloader struct {
+	load func() (*Config, error)
+	// config is the config the tracker runs with, only used from the main goroutine
+	config *Config
+	logger *logging.Logger
+	level  *logging.AtomicLevel
+
+	limiter       *ratelimit.Limiter
+	authenticator *handler.Authenticator
+	verifier      *auth.Verifier
+	publisher     *socket.ReconnectingConn
+	// cache is nil when users are not cached
+	cache *database.CachedStorage
+}
+
+// reload loads config again and applies the settings that changed. Config that is invalid, or
+// has a setting that fails to apply, is not applied at all.
+func (r *reloader) reload() {
+	config, err := r.load()
+	if err == nil {
+		err = config.validate()
+	}
+	if err != nil {
+		r.logger.Error("Keeping current config, reloading failed", logging.Err(err))
+		return
+	}
+
+	changed := []int{}
+	current := configFields(r.config)
+	for i, f := range configFields(config) {
+		if reflect.DeepEqual(f.value.Interface(), current[i].value.Interface()) {
+			continue
+		}
+		if !reloadable(f.key) {
+			r.logger.Warn("Not reloading config, it needs a restart of the tracker", logging.F("key", f.key), logging.F("value", f.display()))
+			f.value.Set(current[i].value)
+			continue
+		}
+		changed = append(changed, i)
+	}
+	if len(changed) == 0 {
+		r.logger.Info("Config reloaded, nothing to apply")
+		return
+	}
+
+	if err := r.apply(r.config, config); err != nil {
+		r.logger.Error("Keeping current config, applying failed", logging.Err(err))
+		return
+	}
+	fields := configFields(config)
+	for _, i := range changed {
+		r.logger.Info("Reloaded config", logging.F("key", fields[i].key), logging.F("value", fields[i].display()))
+	}
+	r.config = config
+}
+
+// apply changes settings from old to config. Everything that can fail is prepared first, so
+// that either all settings are applied or, when configErrors are returned, none of them.
+func (r *reloader) apply(old, config *Config) error {
+	var errs configErrors
+	level, err := logging.ParseLevel(config.Log.Level)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("log.level: %w", err))
+	}
+	publisher := config.Publisher
+	var dial socket.DialFunc
+	if old.Publisher.URL != publisher.URL || old.Publisher.Port != publisher.Port || old.Publisher.Method != publisher.Method || old.Publisher.TLS != publisher.TLS {
+		if dial, err = publisherDialer(publisher, r.logger); err != nil {
+			errs = append(errs, fmt.Errorf("publisher: %w", err))
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	r.level.Set(level)
+	rateLimit := config.RateLimit
+	r.limiter.SetDefaults(database.RateLimit{
+		PerSecond: rateLimit.PerSecond,
+		Burst:     rateLimit.Burst,
+		Daily:     rateLimit.Daily,
+		Monthly:   rateLimit.Monthly,
+	})
+	r.limiter.SetEnabled(rateLimit.Enabled)
+
+	if r.cache != nil {
+		r.cache.SetOptions(cacheOptions(config.Cache))
+	}
+
+	r.verifier.SetWindow(config.Auth.Window.Duration)
+	r.authenticator.SetAdmin(adminCredentials(config.Auth))
+	r.authenticator.SetEnabled(config.Auth.Enabled)
+
+	if dial != nil {
+		r.publisher.Redial(dial)
+	}
+	return nil
+}
+
+// fileWatcher notices changes of a file by the hash of its content, since a file can change
+// without changing its size or modification time, e.g. within the resolution of the clock
+type fileWatcher struct {
+	path string
+	hash [sha256.Size]byte
+}
+
+func newFileWatcher(path string) *fileWatcher {
+	w := &fileWatcher{path: path}
+	w.changed()
+	return w
+}
+
+// changed reports whether the file changed since the last call
+func (w *fileWatcher) changed() bool {
+	content, err := ioutil.ReadFile(w.path)
+	if err != nil {
+		// the file may be replaced right now, it is checked again later
+		return false
+	}
+	hash := sha256.Sum256(content)
+	if hash == w.hash {
+		return false
+	}
+	w.hash = hash
+	return true
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"pub-sub/backoff"
+	"pub-sub/logging"
+	"pub-sub/tracker/auth"
+	"pub-sub/tracker/database"
+	"pub-sub/tracker/handler"
+	"pub-sub/tracker/ratelimit"
+	"pub-sub/tracker/socket"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/gorilla/websocket"
+)
+
+// publisherServer is a websocket server that reports every connection on connected, with the
+// default publisher config for it
+func publisherServer(t *testing.T) (*httptest.Server, chan struct{}, publisherConfig) {
+	connected := make(chan struct{}, 10)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		connected <- struct{}{}
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	u, _ := url.Parse(server.URL)
+	publisher := defaultConfig().Publisher
+	publisher.URL, publisher.Port = u.Hostname(), u.Port()
+	return server, connected, publisher
+}
+
+func waitForConnection(t *testing.T, connected chan struct{}) {
+	t.Helper()
+	select {
+	case <-connected:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected connection to publisher")
+	}
+}
+
+func TestReloaderReload(t *testing.T) {
+	oldServer, oldConnected, oldPublisher := publisherServer(t)
+	defer oldServer.Close()
+	newServer, newConnected, newPublisher := publisherServer(t)
+	defer newServer.Close()
+
+	config := defaultConfig()
+	config.Publisher = oldPublisher
+	account := database.Person{ID: bson.ObjectIdHex("5555e2d316ca1b6d40aaaaaa"), IsActive: true}
+	limiter := ratelimit.NewLimiter(database.RateLimit{PerSecond: 10, Burst: 20}, ratelimit.NewMemoryCounterStore(time.Now), time.Now, nil)
+	verifier := auth.NewVerifier(config.Auth.Window.Duration, auth.NewMemoryReplayStore(time.Now), time.Now)
+	cache := database.NewCachedStorage(database.NewMemoryStorage(nil), cacheOptions(config.Cache))
+	dial, err := publisherDialer(config.Publisher, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connection := socket.NewReconnectingConn(dial, backoff.Backoff{Initial: time.Millisecond, Max: time.Millisecond}, nil)
+	defer connection.Close()
+	waitForConnection(t, oldConnected)
+
+	var loaded *Config
+	var loadErr error
+	recorder := logging.NewRecorder()
+	level := logging.NewAtomicLevel(logging.LevelInfo)
+	r := &reloader{
+		load:          func() (*Config, error) { return loaded, loadErr },
+		config:        config,
+		logger:        logging.New(recorder),
+		level:         level,
+		limiter:       limiter,
+		authenticator: handler.NewAuthenticator(cache, verifier, auth.Credentials{}),
+		verifier:      verifier,
+		publisher:     connection,
+		cache:         cache,
+	}
+
+	loaded = defaultConfig()
+	loaded.Publisher = newPublisher
+	loaded.RateLimit.Burst = 5
+	loaded.Cache.Size = 1
+	loaded.Address = ":9999"
+	loaded.Database.Collection = "other"
+	loaded.Log.Level = "debug"
+	r.reload()
+
+	if limits := limiter.Limits(account); limits.Burst != 5 {
+		t.Errorf("Expected burst 5, got %d", limits.Burst)
+	}
+	if r.config.Cache.Size != 1 {
+		t.Errorf("Expected cache size 1, got %d", r.config.Cache.Size)
+	}
+	if r.config.Address != config.Address || r.config.Database.Collection != config.Database.Collection {
+		t.Errorf("Expected address and collection to need a restart, got %s and %s", r.config.Address, r.config.Database.Collection)
+	}
+	notReloaded := map[interface{}]bool{}
+	for _, record := range recorder.Find("Not reloading config, it needs a restart of the tracker") {
+		key, _ := record.Field("key")
+		notReloaded[key] = true
+	}
+	if len(notReloaded) != 2 || !notReloaded["address"] || !notReloaded["database.collection"] {
+		t.Errorf("Expected address and collection to be reported, got %v", notReloaded)
+	}
+	if level.Level() != logging.LevelDebug {
+		t.Errorf("Expected log level debug, got %s", level.Level())
+	}
+	waitForConnection(t, newConnected)
+	if err := connection.WriteMessage(websocket.TextMessage, []byte("message")); err != nil {
+		t.Errorf("Expected message to be written to new publisher, got %v", err)
+	}
+
+	// invalid config is not applied
+	loadErr = errors.New("invalid config")
+	loaded = defaultConfig()
+	r.reload()
+	if limits := limiter.Limits(account); limits.Burst != 5 {
+		t.Errorf("Expected burst 5 to be kept, got %d", limits.Burst)
+	}
+
+	// unchanged publisher is not redialed
+	loadErr = nil
+	loaded = defaultConfig()
+	loaded.Publisher = newPublisher
+	loaded.RateLimit.Enabled = false
+	r.reload()
+	if decision := limiter.Allow(account); decision != (ratelimit.Decision{Allowed: true}) {
+		t.Errorf("Expected rate limit to be disabled, got %+v", decision)
+	}
+	select {
+	case <-newConnected:
+		t.Error("Expected publisher not to be redialed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// config that fails validation is not applied at all, not even its valid settings
+	recorder = logging.NewRecorder()
+	r.logger = logging.New(recorder)
+	loaded = defaultConfig()
+	loaded.Publisher = newPublisher
+	loaded.Publisher.Method = "wss"
+	loaded.Publisher.TLS.CAFile = "missing-ca.pem"
+	loaded.RateLimit.Enabled = false
+	loaded.RateLimit.Burst = 7
+	r.reload()
+	if limits := limiter.Limits(account); limits.Burst != 20 {
+		t.Errorf("Expected burst 20 to be kept, got %d", limits.Burst)
+	}
+	if r.config.Publisher != newPublisher || r.config.RateLimit.Burst != 20 {
+		t.Errorf("Expected current config to be kept, got %v", r.config)
+	}
+	if len(recorder.Find("Keeping current config, reloading failed")) != 1 {
+		t.Errorf("Expected error to be logged, got %v", recorder.Records())
+	}
+	if reloaded := recorder.Find("Reloaded config"); len(reloaded) != 0 {
+		t.Errorf("Expected nothing to be reloaded, got %v", reloaded)
+	}
+}
+
+func TestReloaderApplyIsAtomic(t *testing.T) {
+	config := defaultConfig()
+	account := database.Person{ID: bson.ObjectIdHex("5555e2d316ca1b6d40aaaaaa"), IsActive: true}
+	limiter := ratelimit.NewLimiter(database.RateLimit{PerSecond: 10, Burst: 20}, ratelimit.NewMemoryCounterStore(time.Now), time.Now, nil)
+	level := logging.NewAtomicLevel(logging.LevelInfo)
+	r := &reloader{config: config, logger: logging.New(logging.NewRecorder()), level: level, limiter: limiter}
+
+	// settings that fail to apply, even if the config passed validation, keep all others
+	changed := defaultConfig()
+	changed.Log.Level = "debug"
+	changed.RateLimit.Burst = 7
+	changed.Publisher.Method = "wss"
+	changed.Publisher.TLS.CAFile = "missing-ca.pem"
+	if err := r.apply(config, changed); err == nil {
+		t.Fatal("Expected error for publisher that can't be dialed")
+	}
+	if limits := limiter.Limits(account); limits.Burst != 20 {
+		t.Errorf("Expected burst 20 to be kept, got %d", limits.Burst)
+	}
+	if level.Level() != logging.LevelInfo {
+		t.Errorf("Expected log level info to be kept, got %s", level.Level())
+	}
+}
+
+func TestReloadable(t *testing.T) {
+	testCases := []struct {
+		key      string
+		expected bool
+	}{
+		{key: "rate_limit.burst", expected: true},
+		{key: "rate_limit.collection"},
+		{key: "auth.admin_key_hash", expected: true},
+		{key: "publisher.url", expected: true},
+		{key: "publisher.queue_size"},
+		{key: "database.server"},
+		{key: "address"},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.key, func(t *testing.T) {
+			if reloadable(tC.key) != tC.expected {
+				t.Errorf("Expected reloadable %t", tC.expected)
+			}
+		})
+	}
+}
+
+func TestFileWatcher(t *testing.T) {
+	path := writeConfigFile(t, `address = ":9000"`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	watcher := newFileWatcher(path)
+	if watcher.changed() {
+		t.Error("Expected file not to be changed")
+	}
+	if err := ioutil.WriteFile(path, []byte(`address = ":9001"`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !watcher.changed() {
+		t.Error("Expected file to be changed")
+	}
+	if watcher.changed() {
+		t.Error("Expected change to be reported once")
+	}
+
+	// same size and modification time, other content
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(`address = ":9002"`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if !watcher.changed() {
+		t.Error("Expected change of content to be reported")
+	}
+
+	os.Remove(path)
+	if watcher.changed() {
+		t.Error("Expected missing file not to be reported as changed")
+	}
+}
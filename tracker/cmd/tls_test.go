@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestPublisherDialerTLS(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn.WriteMessage(websocket.TextMessage, []byte("Successfully connected to publisher"))
+		conn.Close()
+	}))
+	defer server.Close()
+
+	// the test server certificate is self-signed for example.com and 127.0.0.1
+	caFile := writeConfigFile(t, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})))
+	defer os.RemoveAll(filepath.Dir(caFile))
+	u, _ := url.Parse(server.URL)
+
+	testCases := []struct {
+		desc          string
+		tls           publisherTLSConfig
+		expectedError string
+	}{
+		{
+			desc: "Trusts server with CA file",
+			tls:  publisherTLSConfig{CAFile: caFile},
+		},
+		{
+			desc: "Checks overridden server name",
+			tls:  publisherTLSConfig{CAFile: caFile, ServerName: "example.com"},
+		},
+		{
+			desc:          "Rejects self-signed server without CA file",
+			expectedError: "certificate",
+		},
+		{
+			desc:          "Rejects wrong server name",
+			tls:           publisherTLSConfig{CAFile: caFile, ServerName: "publisher.test"},
+			expectedError: "publisher.test",
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			dial, err := publisherDialer(publisherConfig{URL: u.Hostname(), Port: u.Port(), Method: "wss", TLS: tC.tls}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := dial()
+			if tC.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tC.expectedError) {
+					t.Errorf("Expected error with %q, got %v", tC.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if _, message, err := conn.ReadMessage(); err != nil || string(message) != "Successfully connected to publisher" {
+				t.Errorf("Expected connected message, got %q and %v", message, err)
+			}
+		})
+	}
+}
+
+func TestPublisherDialerErrors(t *testing.T) {
+	directory, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	_, err = publisherDialer(publisherConfig{URL: "publisher", Port: "8000", Method: "wss", TLS: publisherTLSConfig{CAFile: filepath.Join(directory, "missing.pem")}}, nil)
+	if err == nil || !strings.Contains(err.Error(), "failed to read CA file") {
+		t.Errorf("Expected error for missing CA file, got %v", err)
+	}
+	// plain connections don't load TLS files
+	if _, err := publisherDialer(publisherConfig{URL: "publisher", Port: "8000", Method: "ws", TLS: publisherTLSConfig{CAFile: filepath.Join(directory, "missing.pem")}}, nil); err != nil {
+		t.Errorf("Expected no error for ws, got %v", err)
+	}
+}
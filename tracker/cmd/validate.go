@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"pub-sub/logging"
+	"pub-sub/tracker/socket"
+	"pub-sub/tracker/tlsconfig"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// configErrors are all problems found in config, reported at once
+type configErrors []error
+
+func (e configErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = "  " + err.Error()
+	}
+	return fmt.Sprintf("invalid config, %d errors:\n%s", len(e), strings.Join(messages, "\n"))
+}
+
+// validate returns configErrors with every invalid field, or nil
+func (c *Config) validate() error {
+	var errs configErrors
+	check := func(key string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+		}
+	}
+
+	check("address", validateAddress(c.Address))
+	check("max_batch_size", validatePositive(int64(c.MaxBatchSize)))
+	check("shutdown_timeout", validatePositiveDuration(c.ShutdownTimeout.Duration))
+	if c.ReloadInterval.Duration < 0 {
+		check("reload_interval", fmt.Errorf("must not be negative, got %s", c.ReloadInterval.Duration))
+	}
+
+	_, err := logging.ParseLevel(c.Log.Level)
+	check("log.level", err)
+	_, err = logging.ParseFormat(c.Log.Format)
+	check("log.format", err)
+
+	if c.TLS.Enabled {
+		_, err := tlsconfig.Server(serverTLSOptions(c.TLS))
+		check("tls", err)
+	}
+
+	switch c.Database.Driver {
+	case "mongo":
+		check("database.server", validateNotEmpty(c.Database.Server))
+		check("database.port", validatePort(c.Database.Port))
+		check("database.table", validateNotEmpty(c.Database.Table))
+		check("database.collection", validateNotEmpty(c.Database.Collection))
+		if c.RateLimit.Enabled {
+			check("rate_limit.collection", validateNotEmpty(c.RateLimit.Collection))
+		}
+	case "memory":
+	case "file":
+		check("database.file", validateNotEmpty(c.Database.File))
+	default:
+		check("database.driver", fmt.Errorf("unknown driver %q, want mongo, memory or file", c.Database.Driver))
+	}
+	if c.Cache.Enabled {
+		check("cache.size", validatePositive(int64(c.Cache.Size)))
+	}
+	if c.Cache.Watch {
+		check("cache.watch_retry", validatePositiveDuration(c.Cache.WatchRetry.Duration))
+	}
+	if c.Auth.Enabled {
+		check("auth.window", validatePositiveDuration(c.Auth.Window.Duration))
+	}
+	switch c.Auth.ReplayDriver {
+	case "memory":
+	case "mongo":
+		check("auth.replay_collection", validateNotEmpty(c.Auth.ReplayCollection))
+		if c.Database.Driver != "mongo" {
+			check("auth.replay_driver", fmt.Errorf("mongo needs database driver mongo"))
+		}
+	default:
+		check("auth.replay_driver", fmt.Errorf("unknown driver %q, want memory or mongo", c.Auth.ReplayDriver))
+	}
+
+	if c.Idempotency.Enabled {
+		switch c.Idempotency.Driver {
+		case "memory":
+			check("idempotency.size", validatePositive(int64(c.Idempotency.Size)))
+		case "mongo":
+			check("idempotency.collection", validateNotEmpty(c.Idempotency.Collection))
+			if c.Database.Driver != "mongo" {
+				check("idempotency.driver", fmt.Errorf("mongo needs database driver mongo"))
+			}
+		default:
+			check("idempotency.driver", fmt.Errorf("unknown driver %q, want memory or mongo", c.Idempotency.Driver))
+		}
+	}
+
+	check("publisher.url", validateNotEmpty(c.Publisher.URL))
+	check("publisher.port", validatePort(c.Publisher.Port))
+	switch c.Publisher.Method {
+	case "ws":
+	case "wss":
+		_, err := tlsconfig.Client(publisherTLSOptions(c.Publisher.TLS))
+		check("publisher.tls", err)
+	default:
+		check("publisher.method", fmt.Errorf("unknown scheme %q, want ws or wss", c.Publisher.Method))
+	}
+	check("publisher.queue_size", validatePositive(int64(c.Publisher.QueueSize)))
+	_, err = socket.ParseOverflowPolicy(c.Publisher.Overflow)
+	check("publisher.overflow", err)
+	reconnect := c.Publisher.Reconnect
+	check("publisher.reconnect.initial", validatePositiveDuration(reconnect.Initial.Duration))
+	if reconnect.Max.Duration < reconnect.Initial.Duration {
+		check("publisher.reconnect.max", fmt.Errorf("must not be less than initial %s, got %s", reconnect.Initial.Duration, reconnect.Max.Duration))
+	}
+	if reconnect.Multiplier < 1 {
+		check("publisher.reconnect.multiplier", fmt.Errorf("must be at least 1, got %g", reconnect.Multiplier))
+	}
+	if reconnect.Jitter < 0 || reconnect.Jitter > 1 {
+		check("publisher.reconnect.jitter", fmt.Errorf("must be between 0 and 1, got %g", reconnect.Jitter))
+	}
+
+	if c.Outbox.Enabled {
+		check("outbox.directory", validateNotEmpty(c.Outbox.Directory))
+		check("outbox.segment_size", validatePositive(c.Outbox.SegmentSize))
+		policy, err := socket.ParseSyncPolicy(c.Outbox.Fsync)
+		check("outbox.fsync", err)
+		if policy == socket.SyncInterval {
+			check("outbox.fsync_interval", validatePositiveDuration(c.Outbox.FsyncInterval.Duration))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func validateNotEmpty(value string) error {
+	if strings.TrimSpace(value) == "" {
+		return fmt.Errorf("must not be empty")
+	}
+	return nil
+}
+
+func validatePositive(value int64) error {
+	if value <= 0 {
+		return fmt.Errorf("must be positive, got %d", value)
+	}
+	return nil
+}
+
+func validatePositiveDuration(value time.Duration) error {
+	if value <= 0 {
+		return fmt.Errorf("must be positive, got %s", value)
+	}
+	return nil
+}
+
+func validatePort(port string) error {
+	number, err := strconv.Atoi(port)
+	if err != nil || number < 1 || number > 65535 {
+		return fmt.Errorf("invalid port %q, want 1-65535", port)
+	}
+	return nil
+}
+
+func validateAddress(address string) error {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid address %q, want host:port", address)
+	}
+	return validatePort(port)
+}
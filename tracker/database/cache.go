@@ -0,0 +1,269 @@
+package database
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//CacheOptions configures CachedStorage
+type CacheOptions struct {
+	//Size is the maximum number of cached IDs, found and not found together
+	Size int
+	//TTL is how long found users are cached
+	TTL time.Duration
+	//NegativeTTL is how long IDs that were not found are cached
+	NegativeTTL time.Duration
+}
+
+//CacheStats are counters of CachedStorage lookups
+type CacheStats struct {
+	Hits         int64
+	NegativeHits int64
+	Misses       int64
+	//Collapsed counts lookups that waited for a concurrent lookup of the same ID
+	Collapsed int64
+	Entries   int
+}
+
+type cacheEntry struct {
+	userID  string
+	person  Person
+	found   bool
+	expires time.Time
+}
+
+// lookup is a database call in progress, concurrent misses for the same ID wait for it
+type lookup struct {
+	done   chan struct{}
+	person Person
+	err    error
+}
+
+//CachedStorage is a Storage that caches users from another Storage in memory. It keeps at most
+//Size entries and evicts the least recently used ones. Only one database call is made at a time
+//for the same ID, other callers wait for its result.
+type CachedStorage struct {
+	Storage
+	options CacheOptions
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	lookups map[string]*lookup
+	// writes counts writes through the cache, lookups don't store users if it changed while they were reading
+	writes uint64
+
+	hits         int64
+	negativeHits int64
+	misses       int64
+	collapsed    int64
+}
+
+//NewCachedStorage returns new CachedStorage that reads through to storage
+func NewCachedStorage(storage Storage, options CacheOptions) *CachedStorage {
+	return &CachedStorage{
+		Storage: storage,
+		options: options,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+		lookups: map[string]*lookup{},
+	}
+}
+
+//GetUserByID returns user from cache, or from storage if it is not cached
+func (cs *CachedStorage) GetUserByID(userID string) (Person, error) {
+	if !ValidID(userID) {
+		return Person{}, ErrInvalidID
+	}
+
+	cs.mu.Lock()
+	if entry, ok := cs.get(userID); ok {
+		cs.mu.Unlock()
+		return cs.hit(entry)
+	}
+	if call, ok := cs.lookups[userID]; ok {
+		cs.mu.Unlock()
+		atomic.AddInt64(&cs.collapsed, 1)
+		<-call.done
+		return call.person, call.err
+	}
+	call := &lookup{done: make(chan struct{})}
+	cs.lookups[userID] = call
+	writes := cs.writes
+	cs.mu.Unlock()
+
+	atomic.AddInt64(&cs.misses, 1)
+	call.person, call.err = cs.Storage.GetUserByID(userID)
+
+	cs.mu.Lock()
+	delete(cs.lookups, userID)
+	switch {
+	case writes != cs.writes:
+	case call.err == nil:
+		cs.set(userID, call.person, true)
+	case errors.Is(call.err, ErrNotFound):
+		cs.set(userID, Person{}, false)
+	}
+	cs.mu.Unlock()
+	close(call.done)
+
+	return call.person, call.err
+}
+
+//GetUsersByIDs returns cached users and looks up the rest in one call to storage
+func (cs *CachedStorage) GetUsersByIDs(userIDs []string) (map[string]Person, error) {
+	people := map[string]Person{}
+	missing := []string{}
+
+	cs.mu.Lock()
+	writes := cs.writes
+	for _, userID := range userIDs {
+		if !ValidID(userID) {
+			continue
+		}
+		entry, ok := cs.get(userID)
+		if !ok {
+			missing = append(missing, userID)
+			continue
+		}
+		if entry.found {
+			atomic.AddInt64(&cs.hits, 1)
+			people[userID] = entry.person
+			continue
+		}
+		atomic.AddInt64(&cs.negativeHits, 1)
+	}
+	cs.mu.Unlock()
+
+	if len(missing) == 0 {
+		return people, nil
+	}
+	atomic.AddInt64(&cs.misses, int64(len(missing)))
+	found, err := cs.Storage.GetUsersByIDs(missing)
+	if err != nil {
+		return nil, err
+	}
+
+	cs.mu.Lock()
+	for _, userID := range missing {
+		person, ok := found[userID]
+		if writes == cs.writes {
+			cs.set(userID, person, ok)
+		}
+		if ok {
+			people[userID] = person
+		}
+	}
+	cs.mu.Unlock()
+	return people, nil
+}
+
+//CreateUser creates user in storage and forgets that its ID was not found
+func (cs *CachedStorage) CreateUser(person Person) (Person, error) {
+	created, err := cs.Storage.CreateUser(person)
+	cs.Invalidate(created.ID.Hex())
+	return created, err
+}
+
+//UpdateUser updates user in storage and removes it from cache
+func (cs *CachedStorage) UpdateUser(userID string, update UserUpdate) (Person, error) {
+	defer cs.Invalidate(userID)
+	return cs.Storage.UpdateUser(userID, update)
+}
+
+//DeleteUser deletes user from storage and cache
+func (cs *CachedStorage) DeleteUser(userID string) error {
+	defer cs.Invalidate(userID)
+	return cs.Storage.DeleteUser(userID)
+}
+
+//Invalidate removes user from cache, so that the next lookup goes to storage
+func (cs *CachedStorage) Invalidate(userID string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.writes++
+	if element, ok := cs.entries[userID]; ok {
+		cs.lru.Remove(element)
+		delete(cs.entries, userID)
+	}
+}
+
+//Stats returns lookup counters and number of cached entries
+func (cs *CachedStorage) Stats() CacheStats {
+	cs.mu.Lock()
+	entries := cs.lru.Len()
+	cs.mu.Unlock()
+	return CacheStats{
+		Hits:         atomic.LoadInt64(&cs.hits),
+		NegativeHits: atomic.LoadInt64(&cs.negativeHits),
+		Misses:       atomic.LoadInt64(&cs.misses),
+		Collapsed:    atomic.LoadInt64(&cs.collapsed),
+		Entries:      entries,
+	}
+}
+
+func (cs *CachedStorage) hit(entry *cacheEntry) (Person, error) {
+	if entry.found {
+		atomic.AddInt64(&cs.hits, 1)
+		return entry.person, nil
+	}
+	atomic.AddInt64(&cs.negativeHits, 1)
+	return Person{}, ErrNotFound
+}
+
+// get returns entry that has not expired yet, cs.mu must be held
+func (cs *CachedStorage) get(userID string) (*cacheEntry, bool) {
+	element, ok := cs.entries[userID]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		cs.lru.Remove(element)
+		delete(cs.entries, userID)
+		return nil, false
+	}
+	cs.lru.MoveToFront(element)
+	return entry, true
+}
+
+//SetOptions changes options of the cache. Cached entries keep their expiry, entries over the
+//new size are evicted.
+func (cs *CachedStorage) SetOptions(options CacheOptions) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.options = options
+	cs.evict()
+}
+
+// set stores entry and evicts least recently used ones over the size, cs.mu must be held
+func (cs *CachedStorage) set(userID string, person Person, found bool) {
+	ttl := cs.options.TTL
+	if !found {
+		ttl = cs.options.NegativeTTL
+	}
+	if ttl <= 0 || cs.options.Size <= 0 {
+		return
+	}
+
+	entry := &cacheEntry{userID: userID, person: person, found: found, expires: time.Now().Add(ttl)}
+	if element, ok := cs.entries[userID]; ok {
+		element.Value = entry
+		cs.lru.MoveToFront(element)
+		return
+	}
+	cs.entries[userID] = cs.lru.PushFront(entry)
+	cs.evict()
+}
+
+// evict removes least recently used entries over the size, cs.mu must be held
+func (cs *CachedStorage) evict() {
+	for cs.lru.Len() > cs.options.Size {
+		oldest := cs.lru.Back()
+		cs.lru.Remove(oldest)
+		delete(cs.entries, oldest.Value.(*cacheEntry).userID)
+	}
+}
@@ -0,0 +1,295 @@
+package database_test
+
+import (
+	"errors"
+	"fmt"
+	"pub-sub/tracker/database"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/golang/mock/gomock"
+)
+
+const cachedID = "5555e2d316ca1b6d40aaaaaa"
+
+func cacheOptions() database.CacheOptions {
+	return database.CacheOptions{Size: 2, TTL: time.Minute, NegativeTTL: time.Minute}
+}
+
+func TestCachedStorageGetUserByID(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		options       database.CacheOptions
+		returnPerson  database.Person
+		returnError   error
+		wait          time.Duration
+		databaseCalls int
+		expectedError error
+		expectedStats database.CacheStats
+	}{
+		{
+			desc:          "Found user is cached",
+			options:       cacheOptions(),
+			returnPerson:  database.Person{ID: cachedID, IsActive: true},
+			databaseCalls: 1,
+			expectedStats: database.CacheStats{Hits: 1, Misses: 1, Entries: 1},
+		},
+		{
+			desc:          "Not found user is cached",
+			options:       cacheOptions(),
+			returnError:   database.ErrNotFound,
+			databaseCalls: 1,
+			expectedError: database.ErrNotFound,
+			expectedStats: database.CacheStats{NegativeHits: 1, Misses: 1, Entries: 1},
+		},
+		{
+			desc:          "Not found user is not cached without negative TTL",
+			options:       database.CacheOptions{Size: 2, TTL: time.Minute},
+			returnError:   database.ErrNotFound,
+			databaseCalls: 2,
+			expectedError: database.ErrNotFound,
+			expectedStats: database.CacheStats{Misses: 2},
+		},
+		{
+			desc:          "Other errors are not cached",
+			options:       cacheOptions(),
+			returnError:   fmt.Errorf("%w: no reachable servers", database.ErrUnavailable),
+			databaseCalls: 2,
+			expectedError: database.ErrUnavailable,
+			expectedStats: database.CacheStats{Misses: 2},
+		},
+		{
+			desc:          "Expired user is read again",
+			options:       database.CacheOptions{Size: 2, TTL: 10 * time.Millisecond},
+			returnPerson:  database.Person{ID: cachedID, IsActive: true},
+			wait:          20 * time.Millisecond,
+			databaseCalls: 2,
+			expectedStats: database.CacheStats{Misses: 2, Entries: 1},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockDatabase := database.NewMockStorage(ctrl)
+			mockDatabase.EXPECT().GetUserByID(cachedID).Return(tC.returnPerson, tC.returnError).Times(tC.databaseCalls)
+			cache := database.NewCachedStorage(mockDatabase, tC.options)
+
+			for i := 0; i < 2; i++ {
+				person, err := cache.GetUserByID(cachedID)
+				if !errors.Is(err, tC.expectedError) {
+					t.Errorf("Expected error %v, got %v", tC.expectedError, err)
+				}
+				if person != tC.returnPerson {
+					t.Errorf("Expected %v, got %v", tC.returnPerson, person)
+				}
+				time.Sleep(tC.wait)
+			}
+
+			if stats := cache.Stats(); stats != tC.expectedStats {
+				t.Errorf("Expected stats %+v, got %+v", tC.expectedStats, stats)
+			}
+		})
+	}
+}
+
+func TestCachedStorageEvictsLeastRecentlyUsed(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ids := []string{"5555e2d316ca1b6d40aaaaa1", "5555e2d316ca1b6d40aaaaa2", "5555e2d316ca1b6d40aaaaa3"}
+	mockDatabase := database.NewMockStorage(ctrl)
+	for _, id := range ids {
+		mockDatabase.EXPECT().GetUserByID(id).Return(database.Person{ID: bson.ObjectIdHex(id)}, nil)
+	}
+	// first ID is evicted by the third one, because the second was used more recently
+	mockDatabase.EXPECT().GetUserByID(ids[0]).Return(database.Person{ID: bson.ObjectIdHex(ids[0])}, nil)
+
+	cache := database.NewCachedStorage(mockDatabase, cacheOptions())
+	for _, id := range []string{ids[0], ids[1], ids[1], ids[2], ids[1], ids[0]} {
+		if _, err := cache.GetUserByID(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if stats := cache.Stats(); stats.Hits != 2 || stats.Misses != 4 || stats.Entries != 2 {
+		t.Errorf("Expected 2 hits, 4 misses and 2 entries, got %+v", stats)
+	}
+}
+
+func TestCachedStorageSetOptions(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ids := []string{"5555e2d316ca1b6d40aaaaa1", "5555e2d316ca1b6d40aaaaa2"}
+	mockDatabase := database.NewMockStorage(ctrl)
+	// second ID stays cached with its old expiry, first one is read every time once TTL is zero
+	mockDatabase.EXPECT().GetUserByID(ids[0]).Return(database.Person{ID: bson.ObjectIdHex(ids[0])}, nil).Times(3)
+	mockDatabase.EXPECT().GetUserByID(ids[1]).Return(database.Person{ID: bson.ObjectIdHex(ids[1])}, nil)
+
+	cache := database.NewCachedStorage(mockDatabase, cacheOptions())
+	for _, id := range ids {
+		if _, err := cache.GetUserByID(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// smaller size evicts the least recently used entry, zero TTL stops caching
+	cache.SetOptions(database.CacheOptions{Size: 1, TTL: 0, NegativeTTL: time.Minute})
+	if entries := cache.Stats().Entries; entries != 1 {
+		t.Errorf("Expected 1 entry, got %d", entries)
+	}
+	for _, id := range []string{ids[1], ids[0], ids[0]} {
+		if _, err := cache.GetUserByID(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := cache.Stats(); stats.Hits != 1 || stats.Misses != 4 {
+		t.Errorf("Expected 1 hit and 4 misses, got %+v", stats)
+	}
+}
+
+func TestCachedStorageCollapsesConcurrentMisses(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	release := make(chan struct{})
+	mockDatabase := database.NewMockStorage(ctrl)
+	mockDatabase.EXPECT().GetUserByID(cachedID).Do(func(string) { <-release }).Return(database.Person{ID: cachedID, IsActive: true}, nil)
+	cache := database.NewCachedStorage(mockDatabase, cacheOptions())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			person, err := cache.GetUserByID(cachedID)
+			if err != nil || !person.IsActive {
+				t.Errorf("Expected active user, got %v, %v", person, err)
+			}
+		}()
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for cache.Stats().Collapsed < 19 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if stats := cache.Stats(); stats.Misses != 1 || stats.Collapsed != 19 {
+		t.Errorf("Expected 1 miss and 19 collapsed lookups, got %+v", stats)
+	}
+}
+
+func TestCachedStorageGetUsersByIDs(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	foundID, knownID, notFoundID := "5555e2d316ca1b6d40aaaaa1", "5555e2d316ca1b6d40aaaaa2", "5555e2d316ca1b6d40aaaaa3"
+	found := database.Person{ID: bson.ObjectIdHex(foundID), IsActive: true}
+	cached := database.Person{ID: bson.ObjectIdHex(knownID), IsActive: true}
+
+	mockDatabase := database.NewMockStorage(ctrl)
+	mockDatabase.EXPECT().GetUserByID(knownID).Return(cached, nil)
+	mockDatabase.EXPECT().GetUsersByIDs([]string{foundID, notFoundID}).Return(map[string]database.Person{foundID: found}, nil)
+	cache := database.NewCachedStorage(mockDatabase, database.CacheOptions{Size: 3, TTL: time.Minute, NegativeTTL: time.Minute})
+
+	if _, err := cache.GetUserByID(knownID); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]database.Person{foundID: found, knownID: cached}
+	for i := 0; i < 2; i++ {
+		people, err := cache.GetUsersByIDs([]string{foundID, knownID, notFoundID, "nonobjid"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(people, expected) {
+			t.Errorf("Expected %v, got %v", expected, people)
+		}
+	}
+
+	if _, err := cache.GetUserByID(notFoundID); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("Expected not found user to be cached, got %v", err)
+	}
+}
+
+func TestCachedStorageInvalidate(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDatabase := database.NewMockStorage(ctrl)
+	gomock.InOrder(
+		mockDatabase.EXPECT().GetUserByID(cachedID).Return(database.Person{ID: cachedID, IsActive: true}, nil),
+		mockDatabase.EXPECT().GetUserByID(cachedID).Return(database.Person{ID: cachedID, IsActive: false}, nil),
+	)
+	cache := database.NewCachedStorage(mockDatabase, cacheOptions())
+
+	cache.GetUserByID(cachedID)
+	cache.Invalidate(cachedID)
+	person, err := cache.GetUserByID(cachedID)
+	if err != nil || person.IsActive {
+		t.Errorf("Expected inactive user after invalidation, got %v, %v", person, err)
+	}
+}
+
+func TestCachedStorageWritesInvalidate(t *testing.T) {
+	testCases := []struct {
+		desc  string
+		write func(cache *database.CachedStorage) error
+		first error
+	}{
+		{
+			desc: "Create forgets not found user",
+			write: func(cache *database.CachedStorage) error {
+				_, err := cache.CreateUser(database.Person{ID: bson.ObjectIdHex(cachedID), IsActive: true})
+				return err
+			},
+			first: database.ErrNotFound,
+		},
+		{
+			desc: "Update removes user",
+			write: func(cache *database.CachedStorage) error {
+				active := true
+				_, err := cache.UpdateUser(cachedID, database.UserUpdate{IsActive: &active})
+				return err
+			},
+		},
+		{
+			desc: "Delete removes user",
+			write: func(cache *database.CachedStorage) error {
+				return cache.DeleteUser(cachedID)
+			},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockDatabase := database.NewMockStorage(ctrl)
+			gomock.InOrder(
+				mockDatabase.EXPECT().GetUserByID(cachedID).Return(database.Person{}, tC.first),
+				mockDatabase.EXPECT().GetUserByID(cachedID).Return(database.Person{ID: cachedID, IsActive: true}, nil),
+			)
+			mockDatabase.EXPECT().CreateUser(gomock.Any()).Return(database.Person{ID: bson.ObjectIdHex(cachedID), IsActive: true}, nil).AnyTimes()
+			mockDatabase.EXPECT().UpdateUser(cachedID, gomock.Any()).Return(database.Person{ID: cachedID, IsActive: true}, nil).AnyTimes()
+			mockDatabase.EXPECT().DeleteUser(cachedID).Return(nil).AnyTimes()
+			cache := database.NewCachedStorage(mockDatabase, cacheOptions())
+
+			cache.GetUserByID(cachedID)
+			cache.GetUserByID(cachedID)
+			if err := tC.write(cache); err != nil {
+				t.Fatal(err)
+			}
+			if person, err := cache.GetUserByID(cachedID); err != nil || !person.IsActive {
+				t.Errorf("Expected user to be read again, got %v, %v", person, err)
+			}
+		})
+	}
+}
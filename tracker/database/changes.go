@@ -0,0 +1,193 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"pub-sub/logging"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+//Operations of ChangeEvent
+const (
+	OperationInsert = "insert"
+	OperationUpdate = "update"
+	OperationDelete = "delete"
+)
+
+//ErrFeedInvalidated is returned by ChangeFeed when the collection was dropped or renamed
+var ErrFeedInvalidated = errors.New("change feed invalidated")
+
+//ChangeEvent is a change of one user in the database
+type ChangeEvent struct {
+	//Token resumes the feed after this event, it is only meaningful to the ChangeSource that made it
+	Token     interface{}
+	Operation string
+	ID        bson.ObjectId
+	//Person is the user after the change, nil when it is not known
+	Person *Person
+}
+
+//ChangeFeed streams changes of the user collection
+type ChangeFeed interface {
+	//Next blocks until the next change, an error means the feed is broken and has to be reopened
+	Next() (ChangeEvent, error)
+	Close() error
+}
+
+//ChangeSource opens a ChangeFeed that starts after the event with resumeToken,
+//or with the next change when resumeToken is nil
+type ChangeSource func(resumeToken interface{}) (ChangeFeed, error)
+
+//NewChangeSource returns ChangeSource that reads the collection's change stream, or tails the
+//oplog when the server doesn't support change streams. Both need MongoDB running as a replica set.
+func NewChangeSource(db *mgo.Session, table, collection string, logger *logging.Logger) ChangeSource {
+	return func(resumeToken interface{}) (ChangeFeed, error) {
+		if _, isOplog := resumeToken.(bson.MongoTimestamp); !isOplog {
+			feed, err := openChangeStream(db, table, collection, resumeToken)
+			if err == nil || resumeToken != nil || !changeStreamUnsupported(err) {
+				return feed, err
+			}
+			logger.Info("Change streams not supported, tailing oplog", logging.Err(err))
+		}
+		return openOplog(db, table, collection, resumeToken)
+	}
+}
+
+func changeStreamUnsupported(err error) bool {
+	queryError, ok := err.(*mgo.QueryError)
+	// 40324 is an unknown pipeline stage, returned by servers older than 3.6
+	return ok && queryError.Code == 40324
+}
+
+type changeStream struct {
+	session *mgo.Session
+	iter    *mgo.Iter
+}
+
+type changeStreamEvent struct {
+	ID            bson.Raw `bson:"_id"`
+	OperationType string   `bson:"operationType"`
+	FullDocument  *Person  `bson:"fullDocument"`
+	DocumentKey   struct {
+		ID bson.ObjectId `bson:"_id"`
+	} `bson:"documentKey"`
+}
+
+func openChangeStream(db *mgo.Session, table, collection string, resumeToken interface{}) (ChangeFeed, error) {
+	options := bson.M{"fullDocument": "updateLookup"}
+	if resumeToken != nil {
+		options["resumeAfter"] = resumeToken
+	}
+
+	session := db.Copy()
+	iter := session.DB(table).C(collection).Pipe([]bson.M{{"$changeStream": options}}).Iter()
+	if err := iter.Err(); err != nil {
+		session.Close()
+		return nil, err
+	}
+	return &changeStream{session: session, iter: iter}, nil
+}
+
+func (cs *changeStream) Next() (ChangeEvent, error) {
+	event := changeStreamEvent{}
+	if !cs.iter.Next(&event) {
+		if err := cs.iter.Err(); err != nil {
+			return ChangeEvent{}, err
+		}
+		return ChangeEvent{}, ErrFeedInvalidated
+	}
+
+	change := ChangeEvent{Token: event.ID, ID: event.DocumentKey.ID, Person: event.FullDocument}
+	switch event.OperationType {
+	case "insert":
+		change.Operation = OperationInsert
+	case "update", "replace":
+		change.Operation = OperationUpdate
+	case "delete":
+		change.Operation = OperationDelete
+	default:
+		return ChangeEvent{}, fmt.Errorf("%w: %s", ErrFeedInvalidated, event.OperationType)
+	}
+	return change, nil
+}
+
+func (cs *changeStream) Close() error {
+	err := cs.iter.Close()
+	cs.session.Close()
+	return err
+}
+
+type oplog struct {
+	session *mgo.Session
+	iter    *mgo.Iter
+}
+
+type oplogEntry struct {
+	Timestamp bson.MongoTimestamp `bson:"ts"`
+	Operation string              `bson:"op"`
+	Object    bson.Raw            `bson:"o"`
+	Query     struct {
+		ID bson.ObjectId `bson:"_id"`
+	} `bson:"o2"`
+}
+
+func openOplog(db *mgo.Session, table, collection string, resumeToken interface{}) (ChangeFeed, error) {
+	session := db.Copy()
+	entries := session.DB("local").C("oplog.rs")
+
+	after, ok := resumeToken.(bson.MongoTimestamp)
+	if !ok {
+		last := oplogEntry{}
+		if err := entries.Find(nil).Sort("-$natural").One(&last); err != nil {
+			session.Close()
+			return nil, err
+		}
+		after = last.Timestamp
+	}
+
+	namespace := fmt.Sprintf("%s.%s", table, collection)
+	iter := entries.Find(bson.M{"ns": namespace, "ts": bson.M{"$gt": after}}).LogReplay().Tail(-1)
+	return &oplog{session: session, iter: iter}, nil
+}
+
+func (o *oplog) Next() (ChangeEvent, error) {
+	for {
+		entry := oplogEntry{}
+		if !o.iter.Next(&entry) {
+			if err := o.iter.Err(); err != nil {
+				return ChangeEvent{}, err
+			}
+			return ChangeEvent{}, ErrFeedInvalidated
+		}
+
+		change := ChangeEvent{Token: entry.Timestamp}
+		switch entry.Operation {
+		case "i":
+			person := Person{}
+			if err := entry.Object.Unmarshal(&person); err != nil {
+				return ChangeEvent{}, err
+			}
+			change.Operation, change.ID, change.Person = OperationInsert, person.ID, &person
+		case "u":
+			// updates hold only the modifier, so the user has to be read again
+			change.Operation, change.ID = OperationUpdate, entry.Query.ID
+		case "d":
+			key := Person{}
+			if err := entry.Object.Unmarshal(&key); err != nil {
+				return ChangeEvent{}, err
+			}
+			change.Operation, change.ID = OperationDelete, key.ID
+		default:
+			continue
+		}
+		return change, nil
+	}
+}
+
+func (o *oplog) Close() error {
+	err := o.iter.Close()
+	o.session.Close()
+	return err
+}
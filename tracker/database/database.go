@@ -1,8 +1,7 @@
 package database
 
 import (
-	"fmt"
-	"log"
+	"pub-sub/logging"
 
 	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
@@ -10,40 +9,232 @@ import (
 
 //Person definition
 type Person struct {
-	ID       bson.ObjectId `bson:"_id,omitempty"`
-	Name     string        `bson:"name,omitempty"`
-	IsActive bool          `bson:"isActive,omitempty"`
+	ID       bson.ObjectId `bson:"_id,omitempty" json:"id"`
+	Name     string        `bson:"name,omitempty" json:"name"`
+	IsActive bool          `bson:"isActive,omitempty" json:"isActive"`
+	//RateLimit overrides default rate limits and quotas of the user
+	RateLimit *RateLimit `bson:"rateLimit,omitempty" json:"rateLimit,omitempty"`
+	//APIKeyHash is the hex SHA-256 hash of the user's API key, empty when user has no key
+	APIKeyHash string `bson:"apiKeyHash,omitempty" json:"apiKeyHash,omitempty"`
+	//APISigningSecret is the secret derived from the API key that requests are signed with
+	APISigningSecret string `bson:"apiSigningSecret,omitempty" json:"apiSigningSecret,omitempty"`
+}
+
+//RateLimit holds limits of a user. Zero fields use the defaults and negative fields mean no limit.
+type RateLimit struct {
+	//PerSecond is the number of events per second, Burst the number of events at once
+	PerSecond float64 `bson:"perSecond,omitempty" json:"perSecond,omitempty"`
+	Burst     int     `bson:"burst,omitempty" json:"burst,omitempty"`
+	Daily     int64   `bson:"daily,omitempty" json:"daily,omitempty"`
+	Monthly   int64   `bson:"monthly,omitempty" json:"monthly,omitempty"`
+}
+
+//UserUpdate holds fields of a user to change, nil fields are left as they are
+type UserUpdate struct {
+	Name     *string
+	IsActive *bool
+	//RateLimit replaces limits of the user, a zero RateLimit removes them
+	RateLimit *RateLimit
+	//APIKeyHash replaces API key hash of the user, an empty hash removes it
+	APIKeyHash *string
+	//APISigningSecret replaces signing secret of the user, an empty secret removes it
+	APISigningSecret *string
+}
+
+//UserQuery selects a page of users ordered by ID
+type UserQuery struct {
+	//After is the ID of the last user on the previous page, empty for the first page
+	After string
+	Limit int
+	//IsActive selects only active or inactive users when it is set
+	IsActive *bool
 }
 
 //Storage interface definition
 type Storage interface {
 	GetUserByID(userID string) (Person, error)
+	GetUsersByIDs(userIDs []string) (map[string]Person, error)
+	CreateUser(person Person) (Person, error)
+	UpdateUser(userID string, update UserUpdate) (Person, error)
+	ListUsers(query UserQuery) ([]Person, error)
+	DeleteUser(userID string) error
+}
+
+//ValidID reports whether userID has the format of a stored ID
+func ValidID(userID string) bool {
+	return bson.IsObjectIdHex(userID)
 }
 
 //UserStorage definition
 type UserStorage struct {
 	Collection *mgo.Collection
+	Logger     *logging.Logger
 }
 
 //NewUserStorage returns new UserStorage, that handles db calls
-func NewUserStorage(db *mgo.Session, table, collection string) Storage {
+func NewUserStorage(db *mgo.Session, table, collection string, logger *logging.Logger) Storage {
 	dbCollection := db.DB(table).C(collection)
 	return &UserStorage{
 		Collection: dbCollection,
+		Logger:     logger,
+	}
+}
+
+// logError logs failed call of method, users that are not found are expected and logged only for debugging
+func (us *UserStorage) logError(method string, err error, fields ...logging.Field) {
+	fields = append([]logging.Field{logging.F("method", method)}, append(fields, logging.Err(err))...)
+	if err == mgo.ErrNotFound {
+		us.Logger.Debug("User not found", fields...)
+		return
 	}
+	us.Logger.Error("Database call failed", fields...)
 }
 
-//GetUserByID returns user from DB
+//GetUserByID returns user from DB. Errors are ErrInvalidID, ErrNotFound or wrap ErrUnavailable
+//when the database can't be reached.
 func (us *UserStorage) GetUserByID(userID string) (Person, error) {
 	person := Person{}
 	if !bson.IsObjectIdHex(userID) {
-		return Person{}, fmt.Errorf("ObjectID not valid")
+		return Person{}, ErrInvalidID
 	}
 
 	err := us.Collection.FindId(bson.ObjectIdHex(userID)).One(&person)
 	if err != nil {
-		log.Printf("method GetUserByID, error %s", err)
-		return Person{}, err
+		us.logError("GetUserByID", err, logging.F(logging.KeyAccountID, userID))
+		return Person{}, storageError(err)
+	}
+	return person, nil
+}
+
+//GetUsersByIDs returns users with given IDs from DB in one query, mapped by their ID.
+//IDs that are not valid or not found are missing from the result.
+func (us *UserStorage) GetUsersByIDs(userIDs []string) (map[string]Person, error) {
+	objectIDs := []bson.ObjectId{}
+	for _, userID := range userIDs {
+		if bson.IsObjectIdHex(userID) {
+			objectIDs = append(objectIDs, bson.ObjectIdHex(userID))
+		}
+	}
+
+	people := map[string]Person{}
+	if len(objectIDs) == 0 {
+		return people, nil
+	}
+
+	result := []Person{}
+	err := us.Collection.Find(bson.M{"_id": bson.M{"$in": objectIDs}}).All(&result)
+	if err != nil {
+		us.logError("GetUsersByIDs", err)
+		return nil, storageError(err)
+	}
+	for _, person := range result {
+		people[person.ID.Hex()] = person
+	}
+	return people, nil
+}
+
+//CreateUser inserts user and returns it. User gets a new ID if it has none, an existing ID
+//returns ErrDuplicate.
+func (us *UserStorage) CreateUser(person Person) (Person, error) {
+	if person.ID == "" {
+		person.ID = bson.NewObjectId()
+	}
+	if err := us.Collection.Insert(&person); err != nil {
+		us.logError("CreateUser", err, logging.F(logging.KeyAccountID, person.ID.Hex()))
+		return Person{}, storageError(err)
+	}
+	return person, nil
+}
+
+//UpdateUser changes fields of user that are set in update and returns the changed user
+func (us *UserStorage) UpdateUser(userID string, update UserUpdate) (Person, error) {
+	if !bson.IsObjectIdHex(userID) {
+		return Person{}, ErrInvalidID
+	}
+
+	set, unset := bson.M{}, bson.M{}
+	if update.Name != nil {
+		set["name"] = *update.Name
+	}
+	if update.IsActive != nil {
+		set["isActive"] = *update.IsActive
+	}
+	if update.RateLimit != nil {
+		if *update.RateLimit == (RateLimit{}) {
+			unset["rateLimit"] = ""
+		} else {
+			set["rateLimit"] = *update.RateLimit
+		}
+	}
+	if update.APIKeyHash != nil {
+		if *update.APIKeyHash == "" {
+			unset["apiKeyHash"] = ""
+		} else {
+			set["apiKeyHash"] = *update.APIKeyHash
+		}
+	}
+	if update.APISigningSecret != nil {
+		if *update.APISigningSecret == "" {
+			unset["apiSigningSecret"] = ""
+		} else {
+			set["apiSigningSecret"] = *update.APISigningSecret
+		}
+	}
+	if len(set) == 0 && len(unset) == 0 {
+		return us.GetUserByID(userID)
+	}
+
+	modifier := bson.M{}
+	if len(set) > 0 {
+		modifier["$set"] = set
+	}
+	if len(unset) > 0 {
+		modifier["$unset"] = unset
+	}
+	person := Person{}
+	change := mgo.Change{Update: modifier, ReturnNew: true}
+	if _, err := us.Collection.FindId(bson.ObjectIdHex(userID)).Apply(change, &person); err != nil {
+		us.logError("UpdateUser", err, logging.F(logging.KeyAccountID, userID))
+		return Person{}, storageError(err)
 	}
 	return person, nil
 }
+
+//ListUsers returns up to query.Limit users with IDs greater than query.After
+func (us *UserStorage) ListUsers(query UserQuery) ([]Person, error) {
+	filter := bson.M{}
+	if query.After != "" {
+		if !bson.IsObjectIdHex(query.After) {
+			return nil, ErrInvalidID
+		}
+		filter["_id"] = bson.M{"$gt": bson.ObjectIdHex(query.After)}
+	}
+	if query.IsActive != nil {
+		if *query.IsActive {
+			filter["isActive"] = true
+		} else {
+			// inactive users may have no isActive field at all
+			filter["isActive"] = bson.M{"$ne": true}
+		}
+	}
+
+	people := []Person{}
+	err := us.Collection.Find(filter).Sort("_id").Limit(query.Limit).All(&people)
+	if err != nil {
+		us.logError("ListUsers", err)
+		return nil, storageError(err)
+	}
+	return people, nil
+}
+
+//DeleteUser removes user from DB
+func (us *UserStorage) DeleteUser(userID string) error {
+	if !bson.IsObjectIdHex(userID) {
+		return ErrInvalidID
+	}
+	if err := us.Collection.RemoveId(bson.ObjectIdHex(userID)); err != nil {
+		us.logError("DeleteUser", err, logging.F(logging.KeyAccountID, userID))
+		return storageError(err)
+	}
+	return nil
+}
@@ -1,7 +1,7 @@
 package database_test
 
 import (
-	"fmt"
+	"errors"
 	"pub-sub/tracker/database"
 	"reflect"
 	"testing"
@@ -63,12 +63,12 @@ func Test(t *testing.T) {
 		{
 			desc:          "User not found",
 			id:            "5555e2d316ca1b6d40aaaaac",
-			expectedError: fmt.Errorf("not found"),
+			expectedError: database.ErrNotFound,
 		},
 		{
 			desc:          "Non objectId queried",
 			id:            "nonobjid",
-			expectedError: fmt.Errorf("ObjectID not valid"),
+			expectedError: database.ErrInvalidID,
 		},
 	}
 	for _, tC := range testCases {
@@ -76,11 +76,11 @@ func Test(t *testing.T) {
 			session := connectToDB()
 			defer dropData(session)
 
-			userStorage := database.NewUserStorage(session, "tracker_test", "user")
+			userStorage := database.NewUserStorage(session, "tracker_test", "user", nil)
 			person, err := userStorage.GetUserByID(tC.id)
 
-			if err != nil && err.Error() != tC.expectedError.Error() {
-				t.Errorf("Expected %s, got %s", tC.expectedError, err)
+			if !errors.Is(err, tC.expectedError) {
+				t.Errorf("Expected %v, got %v", tC.expectedError, err)
 			}
 
 			eq := reflect.DeepEqual(person, tC.expectedPerson)
@@ -89,3 +89,47 @@ func Test(t *testing.T) {
 		})
 	}
 }
+
+func TestGetUsersByIDs(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		ids           []string
+		expectedUsers []string
+	}{
+		{
+			desc:          "Returns found users in one query",
+			ids:           []string{"5555e2d316ca1b6d40aaaaaa", "5555e2d316ca1b6d40aaaaab", "5555e2d316ca1b6d40aaaaac"},
+			expectedUsers: []string{"5555e2d316ca1b6d40aaaaaa", "5555e2d316ca1b6d40aaaaab"},
+		},
+		{
+			desc:          "Skips non objectIds",
+			ids:           []string{"nonobjid", "5555e2d316ca1b6d40aaaaaa"},
+			expectedUsers: []string{"5555e2d316ca1b6d40aaaaaa"},
+		},
+		{
+			desc: "No ids",
+			ids:  []string{},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			session := connectToDB()
+			defer dropData(session)
+
+			userStorage := database.NewUserStorage(session, "tracker_test", "user", nil)
+			people, err := userStorage.GetUsersByIDs(tC.ids)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(people) != len(tC.expectedUsers) {
+				t.Errorf("Expected %d users, got %d", len(tC.expectedUsers), len(people))
+			}
+			for _, id := range tC.expectedUsers {
+				if person, ok := people[id]; !ok || person.ID.Hex() != id {
+					t.Errorf("Expected user %s, got %v", id, people)
+				}
+			}
+		})
+	}
+}
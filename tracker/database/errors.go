@@ -0,0 +1,52 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/globalsign/mgo"
+)
+
+var (
+	//ErrInvalidID is returned for IDs that are not in the format of stored IDs
+	ErrInvalidID = errors.New("ObjectID not valid")
+	//ErrNotFound is returned when there is no user with requested ID
+	ErrNotFound = errors.New("not found")
+	//ErrDuplicate is returned when a user with the same ID already exists
+	ErrDuplicate = errors.New("already exists")
+	//ErrUnavailable wraps errors caused by database not being reachable
+	ErrUnavailable = errors.New("database unavailable")
+)
+
+// storageError maps mgo errors onto the errors of this package
+func storageError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case err == mgo.ErrNotFound:
+		return ErrNotFound
+	case mgo.IsDup(err):
+		return ErrDuplicate
+	case isConnectionError(err):
+		return fmt.Errorf("%w: %s", ErrUnavailable, err)
+	}
+	return err
+}
+
+func isConnectionError(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	// mgo reports lost servers with plain errors
+	message := err.Error()
+	return message == "no reachable servers" ||
+		strings.HasPrefix(message, "Closed explicitly") ||
+		strings.Contains(message, "connection refused") ||
+		strings.Contains(message, "connection reset")
+}
@@ -0,0 +1,65 @@
+package database
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+//NewFileStorage returns Storage that keeps users in memory and writes all of them to a JSON file
+//at path on every change. The file is replaced atomically, so it always holds either the old or
+//the new users. When the file doesn't exist yet it is created with seed users.
+func NewFileStorage(path string, seed []Person) (Storage, error) {
+	persist := func(people map[string]Person) error {
+		return writeUsers(path, people)
+	}
+
+	people, err := LoadFixture(path)
+	if os.IsNotExist(err) {
+		ms := newMemoryStorage(seed, persist)
+		if err := ms.save(); err != nil {
+			return nil, err
+		}
+		return ms, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newMemoryStorage(people, persist), nil
+}
+
+// writeUsers writes users ordered by ID to a temporary file and renames it to path
+func writeUsers(path string, people map[string]Person) error {
+	sorted := make([]Person, 0, len(people))
+	for _, person := range people {
+		sorted = append(sorted, person)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].ID.Hex() < sorted[j].ID.Hex()
+	})
+
+	data, err := json.MarshalIndent(sorted, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
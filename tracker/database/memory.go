@@ -0,0 +1,207 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+//MemoryStorage is a Storage that keeps users in a map. It behaves like UserStorage and is meant
+//for local development and tests.
+type MemoryStorage struct {
+	mu     sync.RWMutex
+	people map[string]Person
+	// persist is called with all users before a change is done, the change is undone when it fails
+	persist func(people map[string]Person) error
+}
+
+//NewMemoryStorage returns new MemoryStorage with people in it
+func NewMemoryStorage(people []Person) Storage {
+	return newMemoryStorage(people, nil)
+}
+
+func newMemoryStorage(people []Person, persist func(people map[string]Person) error) *MemoryStorage {
+	ms := &MemoryStorage{people: map[string]Person{}, persist: persist}
+	for _, person := range people {
+		ms.people[person.ID.Hex()] = person
+	}
+	return ms
+}
+
+//LoadFixture reads users from a JSON file with an array of users, like
+//[{"id": "5937e2d316ca1b6d4066aa20", "name": "Test user 1", "isActive": true}]
+func LoadFixture(path string) ([]Person, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	people := []Person{}
+	if err := json.Unmarshal(data, &people); err != nil {
+		return nil, fmt.Errorf("fixture %s: %w", path, err)
+	}
+	for i, person := range people {
+		if !person.ID.Valid() {
+			return nil, fmt.Errorf("fixture %s: user %d: %w", path, i, ErrInvalidID)
+		}
+	}
+	return people, nil
+}
+
+//GetUserByID returns user from memory
+func (ms *MemoryStorage) GetUserByID(userID string) (Person, error) {
+	if !ValidID(userID) {
+		return Person{}, ErrInvalidID
+	}
+
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	person, ok := ms.people[userID]
+	if !ok {
+		return Person{}, ErrNotFound
+	}
+	return person, nil
+}
+
+//GetUsersByIDs returns users with given IDs, mapped by their ID. IDs that are not valid or not
+//found are missing from the result.
+func (ms *MemoryStorage) GetUsersByIDs(userIDs []string) (map[string]Person, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	people := map[string]Person{}
+	for _, userID := range userIDs {
+		if person, ok := ms.people[userID]; ok {
+			people[userID] = person
+		}
+	}
+	return people, nil
+}
+
+//CreateUser adds user and returns it. User gets a new ID if it has none, an existing ID
+//returns ErrDuplicate.
+func (ms *MemoryStorage) CreateUser(person Person) (Person, error) {
+	if person.ID == "" {
+		person.ID = bson.NewObjectId()
+	}
+	if !person.ID.Valid() {
+		return Person{}, ErrInvalidID
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	userID := person.ID.Hex()
+	if _, ok := ms.people[userID]; ok {
+		return Person{}, ErrDuplicate
+	}
+	ms.people[userID] = person
+	if err := ms.save(); err != nil {
+		delete(ms.people, userID)
+		return Person{}, err
+	}
+	return person, nil
+}
+
+//UpdateUser changes fields of user that are set in update and returns the changed user
+func (ms *MemoryStorage) UpdateUser(userID string, update UserUpdate) (Person, error) {
+	if !ValidID(userID) {
+		return Person{}, ErrInvalidID
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	previous, ok := ms.people[userID]
+	if !ok {
+		return Person{}, ErrNotFound
+	}
+
+	person := previous
+	if update.Name != nil {
+		person.Name = *update.Name
+	}
+	if update.IsActive != nil {
+		person.IsActive = *update.IsActive
+	}
+	if update.RateLimit != nil {
+		person.RateLimit = nil
+		if *update.RateLimit != (RateLimit{}) {
+			limit := *update.RateLimit
+			person.RateLimit = &limit
+		}
+	}
+	if update.APIKeyHash != nil {
+		person.APIKeyHash = *update.APIKeyHash
+	}
+	if update.APISigningSecret != nil {
+		person.APISigningSecret = *update.APISigningSecret
+	}
+	ms.people[userID] = person
+	if err := ms.save(); err != nil {
+		ms.people[userID] = previous
+		return Person{}, err
+	}
+	return person, nil
+}
+
+//ListUsers returns up to query.Limit users with IDs greater than query.After, all of them
+//when Limit is 0
+func (ms *MemoryStorage) ListUsers(query UserQuery) ([]Person, error) {
+	if query.After != "" && !ValidID(query.After) {
+		return nil, ErrInvalidID
+	}
+
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	// hex IDs sort in the same order as ObjectIDs in MongoDB
+	people := []Person{}
+	for userID, person := range ms.people {
+		if userID <= query.After {
+			continue
+		}
+		if query.IsActive != nil && person.IsActive != *query.IsActive {
+			continue
+		}
+		people = append(people, person)
+	}
+	sort.Slice(people, func(i, j int) bool {
+		return people[i].ID.Hex() < people[j].ID.Hex()
+	})
+
+	if query.Limit > 0 && len(people) > query.Limit {
+		people = people[:query.Limit]
+	}
+	return people, nil
+}
+
+//DeleteUser removes user
+func (ms *MemoryStorage) DeleteUser(userID string) error {
+	if !ValidID(userID) {
+		return ErrInvalidID
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	previous, ok := ms.people[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(ms.people, userID)
+	if err := ms.save(); err != nil {
+		ms.people[userID] = previous
+		return err
+	}
+	return nil
+}
+
+// save persists users, ms.mu must be held
+func (ms *MemoryStorage) save() error {
+	if ms.persist == nil {
+		return nil
+	}
+	return ms.persist(ms.people)
+}
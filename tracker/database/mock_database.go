@@ -44,3 +44,67 @@ func (m *MockStorage) GetUserByID(userID string) (Person, error) {
 func (mr *MockStorageMockRecorder) GetUserByID(userID interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserByID", reflect.TypeOf((*MockStorage)(nil).GetUserByID), userID)
 }
+
+// GetUsersByIDs mocks base method
+func (m *MockStorage) GetUsersByIDs(userIDs []string) (map[string]Person, error) {
+	ret := m.ctrl.Call(m, "GetUsersByIDs", userIDs)
+	ret0, _ := ret[0].(map[string]Person)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUsersByIDs indicates an expected call of GetUsersByIDs
+func (mr *MockStorageMockRecorder) GetUsersByIDs(userIDs interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUsersByIDs", reflect.TypeOf((*MockStorage)(nil).GetUsersByIDs), userIDs)
+}
+
+// CreateUser mocks base method
+func (m *MockStorage) CreateUser(person Person) (Person, error) {
+	ret := m.ctrl.Call(m, "CreateUser", person)
+	ret0, _ := ret[0].(Person)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CreateUser indicates an expected call of CreateUser
+func (mr *MockStorageMockRecorder) CreateUser(person interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateUser", reflect.TypeOf((*MockStorage)(nil).CreateUser), person)
+}
+
+// UpdateUser mocks base method
+func (m *MockStorage) UpdateUser(userID string, update UserUpdate) (Person, error) {
+	ret := m.ctrl.Call(m, "UpdateUser", userID, update)
+	ret0, _ := ret[0].(Person)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UpdateUser indicates an expected call of UpdateUser
+func (mr *MockStorageMockRecorder) UpdateUser(userID interface{}, update interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateUser", reflect.TypeOf((*MockStorage)(nil).UpdateUser), userID, update)
+}
+
+// ListUsers mocks base method
+func (m *MockStorage) ListUsers(query UserQuery) ([]Person, error) {
+	ret := m.ctrl.Call(m, "ListUsers", query)
+	ret0, _ := ret[0].([]Person)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListUsers indicates an expected call of ListUsers
+func (mr *MockStorageMockRecorder) ListUsers(query interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListUsers", reflect.TypeOf((*MockStorage)(nil).ListUsers), query)
+}
+
+// DeleteUser mocks base method
+func (m *MockStorage) DeleteUser(userID string) error {
+	ret := m.ctrl.Call(m, "DeleteUser", userID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteUser indicates an expected call of DeleteUser
+func (mr *MockStorageMockRecorder) DeleteUser(userID interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteUser", reflect.TypeOf((*MockStorage)(nil).DeleteUser), userID)
+}
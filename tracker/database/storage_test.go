@@ -0,0 +1,281 @@
+package database_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"pub-sub/tracker/database"
+	"reflect"
+	"testing"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// newStorage returns storage with seed users in it and a function that removes them
+type newStorage func(t *testing.T, seed []database.Person) (database.Storage, func())
+
+var (
+	activeSeed   = database.Person{ID: bson.ObjectIdHex("5555e2d316ca1b6d40aaaaaa"), Name: "test user 1", IsActive: true}
+	inactiveSeed = database.Person{ID: bson.ObjectIdHex("5555e2d316ca1b6d40aaaaab"), Name: "test user 2", IsActive: false}
+	missingID    = "5555e2d316ca1b6d40aaaaac"
+)
+
+func listIDs(people []database.Person) []string {
+	ids := []string{}
+	for _, person := range people {
+		ids = append(ids, person.ID.Hex())
+	}
+	return ids
+}
+
+// testConformance checks that storage behaves like UserStorage
+func testConformance(t *testing.T, open newStorage) {
+	testCases := []struct {
+		desc string
+		test func(t *testing.T, storage database.Storage)
+	}{
+		{
+			desc: "Gets user by ID",
+			test: func(t *testing.T, storage database.Storage) {
+				person, err := storage.GetUserByID(activeSeed.ID.Hex())
+				if err != nil || person != activeSeed {
+					t.Errorf("Expected %v, got %v, %v", activeSeed, person, err)
+				}
+				if _, err := storage.GetUserByID(missingID); !errors.Is(err, database.ErrNotFound) {
+					t.Errorf("Expected %v, got %v", database.ErrNotFound, err)
+				}
+				if _, err := storage.GetUserByID("nonobjid"); !errors.Is(err, database.ErrInvalidID) {
+					t.Errorf("Expected %v, got %v", database.ErrInvalidID, err)
+				}
+			},
+		},
+		{
+			desc: "Gets found users by IDs",
+			test: func(t *testing.T, storage database.Storage) {
+				people, err := storage.GetUsersByIDs([]string{activeSeed.ID.Hex(), inactiveSeed.ID.Hex(), missingID, "nonobjid"})
+				expected := map[string]database.Person{activeSeed.ID.Hex(): activeSeed, inactiveSeed.ID.Hex(): inactiveSeed}
+				if err != nil || !reflect.DeepEqual(people, expected) {
+					t.Errorf("Expected %v, got %v, %v", expected, people, err)
+				}
+			},
+		},
+		{
+			desc: "Creates users",
+			test: func(t *testing.T, storage database.Storage) {
+				created, err := storage.CreateUser(database.Person{Name: "test user 3", IsActive: true})
+				if err != nil || !created.ID.Valid() || created.Name != "test user 3" || !created.IsActive {
+					t.Fatalf("Expected user with new ID, got %v, %v", created, err)
+				}
+				if person, err := storage.GetUserByID(created.ID.Hex()); err != nil || person != created {
+					t.Errorf("Expected %v, got %v, %v", created, person, err)
+				}
+
+				chosen := database.Person{ID: bson.ObjectIdHex(missingID), Name: "test user 4"}
+				if created, err := storage.CreateUser(chosen); err != nil || created != chosen {
+					t.Errorf("Expected %v, got %v, %v", chosen, created, err)
+				}
+				if _, err := storage.CreateUser(activeSeed); !errors.Is(err, database.ErrDuplicate) {
+					t.Errorf("Expected %v, got %v", database.ErrDuplicate, err)
+				}
+			},
+		},
+		{
+			desc: "Updates users",
+			test: func(t *testing.T, storage database.Storage) {
+				active, name := true, "renamed"
+				updated, err := storage.UpdateUser(inactiveSeed.ID.Hex(), database.UserUpdate{IsActive: &active})
+				expected := database.Person{ID: inactiveSeed.ID, Name: inactiveSeed.Name, IsActive: true}
+				if err != nil || updated != expected {
+					t.Errorf("Expected %v, got %v, %v", expected, updated, err)
+				}
+
+				updated, err = storage.UpdateUser(inactiveSeed.ID.Hex(), database.UserUpdate{Name: &name})
+				expected.Name = name
+				if err != nil || updated != expected {
+					t.Errorf("Expected %v, got %v, %v", expected, updated, err)
+				}
+				if person, err := storage.GetUserByID(inactiveSeed.ID.Hex()); err != nil || person != expected {
+					t.Errorf("Expected %v, got %v, %v", expected, person, err)
+				}
+
+				hash, noHash := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", ""
+				updated, err = storage.UpdateUser(inactiveSeed.ID.Hex(), database.UserUpdate{APIKeyHash: &hash, APISigningSecret: &hash})
+				if err != nil || updated.APIKeyHash != hash || updated.APISigningSecret != hash || updated.Name != name {
+					t.Errorf("Expected API key hash and signing secret %s, got %v, %v", hash, updated, err)
+				}
+				updated, err = storage.UpdateUser(inactiveSeed.ID.Hex(), database.UserUpdate{APIKeyHash: &noHash, APISigningSecret: &noHash})
+				if err != nil || updated != expected {
+					t.Errorf("Expected %v, got %v, %v", expected, updated, err)
+				}
+
+				if _, err := storage.UpdateUser(missingID, database.UserUpdate{IsActive: &active}); !errors.Is(err, database.ErrNotFound) {
+					t.Errorf("Expected %v, got %v", database.ErrNotFound, err)
+				}
+				if _, err := storage.UpdateUser("nonobjid", database.UserUpdate{IsActive: &active}); !errors.Is(err, database.ErrInvalidID) {
+					t.Errorf("Expected %v, got %v", database.ErrInvalidID, err)
+				}
+			},
+		},
+		{
+			desc: "Lists users",
+			test: func(t *testing.T, storage database.Storage) {
+				active, inactive := true, false
+				queries := []struct {
+					query    database.UserQuery
+					expected []string
+				}{
+					{database.UserQuery{Limit: 1}, []string{activeSeed.ID.Hex()}},
+					{database.UserQuery{After: activeSeed.ID.Hex(), Limit: 10}, []string{inactiveSeed.ID.Hex()}},
+					{database.UserQuery{Limit: 10, IsActive: &inactive}, []string{inactiveSeed.ID.Hex()}},
+					{database.UserQuery{Limit: 10, IsActive: &active}, []string{activeSeed.ID.Hex()}},
+					{database.UserQuery{After: inactiveSeed.ID.Hex(), Limit: 10}, []string{}},
+				}
+				for _, q := range queries {
+					people, err := storage.ListUsers(q.query)
+					if err != nil || !reflect.DeepEqual(listIDs(people), q.expected) {
+						t.Errorf("Expected %v for %+v, got %v, %v", q.expected, q.query, listIDs(people), err)
+					}
+				}
+				if _, err := storage.ListUsers(database.UserQuery{After: "nonobjid"}); !errors.Is(err, database.ErrInvalidID) {
+					t.Errorf("Expected %v, got %v", database.ErrInvalidID, err)
+				}
+			},
+		},
+		{
+			desc: "Deletes users",
+			test: func(t *testing.T, storage database.Storage) {
+				if err := storage.DeleteUser(activeSeed.ID.Hex()); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := storage.GetUserByID(activeSeed.ID.Hex()); !errors.Is(err, database.ErrNotFound) {
+					t.Errorf("Expected %v, got %v", database.ErrNotFound, err)
+				}
+				if err := storage.DeleteUser(activeSeed.ID.Hex()); !errors.Is(err, database.ErrNotFound) {
+					t.Errorf("Expected %v, got %v", database.ErrNotFound, err)
+				}
+				if err := storage.DeleteUser("nonobjid"); !errors.Is(err, database.ErrInvalidID) {
+					t.Errorf("Expected %v, got %v", database.ErrInvalidID, err)
+				}
+			},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			storage, cleanup := open(t, []database.Person{activeSeed, inactiveSeed})
+			defer cleanup()
+			tC.test(t, storage)
+		})
+	}
+}
+
+func TestUserStorageConformance(t *testing.T) {
+	testConformance(t, func(t *testing.T, seed []database.Person) (database.Storage, func()) {
+		session, err := mgo.Dial("mongodb://127.0.0.1:27017")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, person := range seed {
+			if err := session.DB("tracker_test").C("user").Insert(person); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return database.NewUserStorage(session, "tracker_test", "user", nil), func() {
+			dropData(session)
+			session.Close()
+		}
+	})
+}
+
+func TestMemoryStorageConformance(t *testing.T) {
+	testConformance(t, func(t *testing.T, seed []database.Person) (database.Storage, func()) {
+		return database.NewMemoryStorage(seed), func() {}
+	})
+}
+
+func tempDir(t *testing.T) string {
+	directory, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return directory
+}
+
+func TestFileStorageConformance(t *testing.T) {
+	testConformance(t, func(t *testing.T, seed []database.Person) (database.Storage, func()) {
+		directory := tempDir(t)
+		storage, err := database.NewFileStorage(filepath.Join(directory, "users.json"), seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return storage, func() { os.RemoveAll(directory) }
+	})
+}
+
+func TestFileStoragePersists(t *testing.T) {
+	directory := tempDir(t)
+	defer os.RemoveAll(directory)
+	path := filepath.Join(directory, "users.json")
+
+	storage, err := database.NewFileStorage(path, []database.Person{activeSeed, inactiveSeed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, err := storage.CreateUser(database.Person{Name: "test user 3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.DeleteUser(activeSeed.ID.Hex()); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := database.NewFileStorage(path, []database.Person{activeSeed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	people, err := reopened.ListUsers(database.UserQuery{})
+	expected := []string{inactiveSeed.ID.Hex(), created.ID.Hex()}
+	if err != nil || !reflect.DeepEqual(listIDs(people), expected) {
+		t.Errorf("Expected %v after reopening, got %v, %v", expected, listIDs(people), err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(directory, "*"))
+	if len(files) != 1 {
+		t.Errorf("Expected only users file, got %v", files)
+	}
+}
+
+func TestLoadFixture(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		path     string
+		content  string
+		expected int
+		isError  bool
+	}{
+		{desc: "Demo accounts", path: "../fixtures/accounts.json", expected: 16},
+		{desc: "Invalid JSON", content: `[{"id": `, isError: true},
+		{desc: "Missing ID", content: `[{"name": "test user 1"}]`, isError: true},
+		{desc: "Missing file", path: "missing.json", isError: true},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			path := tC.path
+			if tC.content != "" {
+				directory := tempDir(t)
+				defer os.RemoveAll(directory)
+				path = filepath.Join(directory, "users.json")
+				ioutil.WriteFile(path, []byte(tC.content), 0644)
+			}
+
+			people, err := database.LoadFixture(path)
+			if (err != nil) != tC.isError {
+				t.Errorf("Expected error %t, got %v", tC.isError, err)
+			}
+			if len(people) != tC.expected {
+				t.Errorf("Expected %d users, got %d", tC.expected, len(people))
+			}
+		})
+	}
+}
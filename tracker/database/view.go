@@ -0,0 +1,379 @@
+package database
+
+import (
+	"container/list"
+	"errors"
+	"pub-sub/logging"
+	"sync"
+	"time"
+)
+
+const (
+	// maxAbsentIDs bounds how many IDs that are not in storage are remembered, the oldest ones are
+	// forgotten first and looked up in storage again
+	maxAbsentIDs = 10000
+	// preloadPageSize is how many users are listed at once when the view is loaded
+	preloadPageSize = 1000
+)
+
+//ViewStats are the sizes of AccountView
+type ViewStats struct {
+	Users     int
+	AbsentIDs int
+	//AbsentEvicted counts absent IDs forgotten because there were more than the view remembers
+	AbsentEvicted int64
+}
+
+type viewEntry struct {
+	person Person
+	found  bool
+}
+
+//AccountView is a Storage that keeps users in memory for as long as they are kept current by a
+//ChangeFeed. Active users are loaded from storage when a new feed is opened, others are read the
+//first time they are looked up, after that every insert, update and delete from the feed is
+//applied immediately. While the feed is down lookups go to storage, and when it is reopened it
+//resumes after the last applied change, so nothing is missed. If the feed can't be resumed, all
+//users are forgotten and loaded again. IDs that were not found are only remembered up to a limit,
+//so that lookups of random IDs can't fill the memory.
+type AccountView struct {
+	Storage
+	source ChangeSource
+	retry  time.Duration
+	logger *logging.Logger
+
+	mu     sync.RWMutex
+	people map[string]Person
+	// absent are IDs that are not in storage, oldest first
+	absent        map[string]*list.Element
+	absentOrder   *list.List
+	absentEvicted int64
+	live          bool
+	token         interface{}
+	// changes counts applied changes, lookups don't store users if it changed while they were reading
+	changes uint64
+	feed    ChangeFeed
+	closed  bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+//NewAccountView returns AccountView that reads users from storage and keeps them current from
+//feeds opened by source. Broken feeds are reopened after retry.
+func NewAccountView(storage Storage, source ChangeSource, retry time.Duration, logger *logging.Logger) *AccountView {
+	av := &AccountView{
+		Storage: storage,
+		source:  source,
+		retry:   retry,
+		logger:  logger,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	av.reset()
+	go av.run()
+	return av
+}
+
+//Live reports whether the view is kept current by an open feed
+func (av *AccountView) Live() bool {
+	av.mu.RLock()
+	defer av.mu.RUnlock()
+	return av.live
+}
+
+//Stats returns how many users and absent IDs are in memory
+func (av *AccountView) Stats() ViewStats {
+	av.mu.RLock()
+	defer av.mu.RUnlock()
+	return ViewStats{Users: len(av.people), AbsentIDs: len(av.absent), AbsentEvicted: av.absentEvicted}
+}
+
+//GetUserByID returns user from memory, or from storage if it was not looked up yet
+func (av *AccountView) GetUserByID(userID string) (Person, error) {
+	if !ValidID(userID) {
+		return Person{}, ErrInvalidID
+	}
+
+	av.mu.RLock()
+	person, found := av.people[userID]
+	_, absent := av.absent[userID]
+	live, changes := av.live, av.changes
+	av.mu.RUnlock()
+	if live && found {
+		return person, nil
+	}
+	if live && absent {
+		return Person{}, ErrNotFound
+	}
+
+	person, err := av.Storage.GetUserByID(userID)
+	if live && (err == nil || errors.Is(err, ErrNotFound)) {
+		av.store(changes, []string{userID}, map[string]viewEntry{userID: {person: person, found: err == nil}})
+	}
+	return person, err
+}
+
+//GetUsersByIDs returns users from memory and looks up the rest in one call to storage
+func (av *AccountView) GetUsersByIDs(userIDs []string) (map[string]Person, error) {
+	people := map[string]Person{}
+	missing := []string{}
+
+	av.mu.RLock()
+	live, changes := av.live, av.changes
+	for _, userID := range userIDs {
+		if !ValidID(userID) {
+			continue
+		}
+		person, found := av.people[userID]
+		_, absent := av.absent[userID]
+		switch {
+		case live && found:
+			people[userID] = person
+		case !live || !absent:
+			missing = append(missing, userID)
+		}
+	}
+	av.mu.RUnlock()
+
+	if len(missing) == 0 {
+		return people, nil
+	}
+	found, err := av.Storage.GetUsersByIDs(missing)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := map[string]viewEntry{}
+	for _, userID := range missing {
+		person, ok := found[userID]
+		entries[userID] = viewEntry{person: person, found: ok}
+		if ok {
+			people[userID] = person
+		}
+	}
+	if live {
+		av.store(changes, missing, entries)
+	}
+	return people, nil
+}
+
+//CreateUser creates user in storage and forgets that its ID was not found
+func (av *AccountView) CreateUser(person Person) (Person, error) {
+	created, err := av.Storage.CreateUser(person)
+	av.forget(created.ID.Hex())
+	return created, err
+}
+
+//UpdateUser updates user in storage, it is read again on the next lookup even if the feed is behind
+func (av *AccountView) UpdateUser(userID string, update UserUpdate) (Person, error) {
+	defer av.forget(userID)
+	return av.Storage.UpdateUser(userID, update)
+}
+
+//DeleteUser deletes user from storage and memory
+func (av *AccountView) DeleteUser(userID string) error {
+	defer av.forget(userID)
+	return av.Storage.DeleteUser(userID)
+}
+
+//Close stops following the feed
+func (av *AccountView) Close() error {
+	av.mu.Lock()
+	if av.closed {
+		av.mu.Unlock()
+		return nil
+	}
+	av.closed = true
+	av.live = false
+	feed := av.feed
+	av.mu.Unlock()
+
+	close(av.stop)
+	if feed != nil {
+		feed.Close()
+	}
+	<-av.done
+	return nil
+}
+
+func (av *AccountView) forget(userID string) {
+	av.mu.Lock()
+	defer av.mu.Unlock()
+	delete(av.people, userID)
+	av.removeAbsent(userID)
+	av.changes++
+}
+
+// reset forgets all users, it must be called with mu held or before the view is shared
+func (av *AccountView) reset() {
+	av.people = map[string]Person{}
+	av.absent = map[string]*list.Element{}
+	av.absentOrder = list.New()
+}
+
+// set saves user or that its ID is absent, it must be called with mu held
+func (av *AccountView) set(userID string, entry viewEntry) {
+	if entry.found {
+		av.people[userID] = entry.person
+		av.removeAbsent(userID)
+		return
+	}
+	delete(av.people, userID)
+	if _, ok := av.absent[userID]; ok {
+		return
+	}
+	av.absent[userID] = av.absentOrder.PushBack(userID)
+	if av.absentOrder.Len() > maxAbsentIDs {
+		oldest := av.absentOrder.Front()
+		av.absentOrder.Remove(oldest)
+		delete(av.absent, oldest.Value.(string))
+		av.absentEvicted++
+	}
+}
+
+func (av *AccountView) removeAbsent(userID string) {
+	if element, ok := av.absent[userID]; ok {
+		av.absentOrder.Remove(element)
+		delete(av.absent, userID)
+	}
+}
+
+// store saves users read from storage in the order of userIDs, unless a change was applied since
+// the read started
+func (av *AccountView) store(changes uint64, userIDs []string, entries map[string]viewEntry) {
+	av.mu.Lock()
+	defer av.mu.Unlock()
+	if !av.live || av.changes != changes {
+		return
+	}
+	for _, userID := range userIDs {
+		av.set(userID, entries[userID])
+	}
+}
+
+func (av *AccountView) run() {
+	defer close(av.done)
+	for {
+		feed, err := av.open()
+		if err == nil {
+			err = av.follow(feed)
+		}
+		av.logger.Warn("Account view not live", logging.Err(err), logging.F("retry_in", av.retry))
+
+		select {
+		case <-av.stop:
+			return
+		case <-time.After(av.retry):
+		}
+	}
+}
+
+// open opens the feed after the last applied change. When that fails but a new feed can be
+// opened, changes were lost and users are forgotten. Active users are loaded whenever a new feed
+// is opened, after it so that changes made while they are listed are applied from the feed.
+func (av *AccountView) open() (ChangeFeed, error) {
+	av.mu.RLock()
+	token := av.token
+	av.mu.RUnlock()
+
+	feed, err := av.source(token)
+	if err != nil && token != nil {
+		if fresh, freshErr := av.source(nil); freshErr == nil {
+			av.logger.Warn("Account view can't resume, forgetting users", logging.Err(err))
+			feed, err, token = fresh, nil, nil
+			av.mu.Lock()
+			av.reset()
+			av.token = nil
+			av.mu.Unlock()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if token == nil {
+		if err := av.preload(); err != nil {
+			feed.Close()
+			return nil, err
+		}
+	}
+
+	av.mu.Lock()
+	defer av.mu.Unlock()
+	if av.closed {
+		feed.Close()
+		return nil, ErrFeedInvalidated
+	}
+	av.feed = feed
+	av.live = true
+	av.changes++
+	return feed, nil
+}
+
+// preload pages through storage and keeps the active users, lookups don't store users meanwhile
+// because the view is not live yet
+func (av *AccountView) preload() error {
+	query := UserQuery{Limit: preloadPageSize}
+	loaded := 0
+	for {
+		select {
+		case <-av.stop:
+			return ErrFeedInvalidated
+		default:
+		}
+
+		people, err := av.Storage.ListUsers(query)
+		if err != nil {
+			return err
+		}
+		av.mu.Lock()
+		for _, person := range people {
+			if person.IsActive {
+				av.set(person.ID.Hex(), viewEntry{person: person, found: true})
+				loaded++
+			}
+		}
+		av.mu.Unlock()
+		if len(people) < preloadPageSize {
+			av.logger.Info("Account view loaded", logging.F("users", loaded))
+			return nil
+		}
+		query.After = people[len(people)-1].ID.Hex()
+	}
+}
+
+func (av *AccountView) follow(feed ChangeFeed) error {
+	defer func() {
+		av.mu.Lock()
+		av.live = false
+		av.feed = nil
+		av.mu.Unlock()
+		feed.Close()
+	}()
+
+	for {
+		event, err := feed.Next()
+		if err != nil {
+			return err
+		}
+		av.apply(event)
+	}
+}
+
+func (av *AccountView) apply(event ChangeEvent) {
+	av.mu.Lock()
+	defer av.mu.Unlock()
+
+	userID := event.ID.Hex()
+	switch {
+	case event.Operation == OperationDelete:
+		av.set(userID, viewEntry{})
+	case event.Person != nil:
+		av.set(userID, viewEntry{person: *event.Person, found: true})
+	default:
+		delete(av.people, userID)
+		av.removeAbsent(userID)
+	}
+	av.token = event.Token
+	av.changes++
+}
@@ -0,0 +1,390 @@
+package database_test
+
+import (
+	"errors"
+	"pub-sub/tracker/database"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/golang/mock/gomock"
+)
+
+type feedItem struct {
+	event database.ChangeEvent
+	err   error
+}
+
+// fakeFeed hands out events pushed by the test, push returns once the event is applied
+type fakeFeed struct {
+	events  chan feedItem
+	applied chan struct{}
+	closed  chan struct{}
+	started bool
+}
+
+func newFakeFeed() *fakeFeed {
+	return &fakeFeed{events: make(chan feedItem), applied: make(chan struct{}), closed: make(chan struct{})}
+}
+
+func (f *fakeFeed) Next() (database.ChangeEvent, error) {
+	if f.started {
+		select {
+		case f.applied <- struct{}{}:
+		case <-f.closed:
+			return database.ChangeEvent{}, database.ErrFeedInvalidated
+		}
+	}
+	f.started = true
+	select {
+	case item := <-f.events:
+		return item.event, item.err
+	case <-f.closed:
+		return database.ChangeEvent{}, database.ErrFeedInvalidated
+	}
+}
+
+func (f *fakeFeed) Close() error {
+	select {
+	case <-f.closed:
+	default:
+		close(f.closed)
+	}
+	return nil
+}
+
+func (f *fakeFeed) push(t *testing.T, item feedItem) {
+	select {
+	case f.events <- item:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected feed to be read")
+	}
+	if item.err != nil {
+		return
+	}
+	select {
+	case <-f.applied:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected event to be applied")
+	}
+}
+
+// fakeSource opens fake feeds and records resume tokens they were opened with
+type fakeSource struct {
+	feeds       chan *fakeFeed
+	tokens      chan interface{}
+	failResume  bool
+	unavailable bool
+}
+
+func newFakeSource() *fakeSource {
+	return &fakeSource{feeds: make(chan *fakeFeed, 10), tokens: make(chan interface{}, 10)}
+}
+
+func (s *fakeSource) open(resumeToken interface{}) (database.ChangeFeed, error) {
+	s.tokens <- resumeToken
+	if s.unavailable || (s.failResume && resumeToken != nil) {
+		return nil, errors.New("no reachable servers")
+	}
+	feed := newFakeFeed()
+	s.feeds <- feed
+	return feed, nil
+}
+
+func (s *fakeSource) nextFeed(t *testing.T) *fakeFeed {
+	select {
+	case feed := <-s.feeds:
+		return feed
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected feed to be opened")
+		return nil
+	}
+}
+
+func (s *fakeSource) nextToken(t *testing.T) interface{} {
+	select {
+	case token := <-s.tokens:
+		return token
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected source to be opened")
+		return nil
+	}
+}
+
+func waitLive(t *testing.T, view *database.AccountView) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !view.Live() {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected view to be live")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func checkUser(t *testing.T, view *database.AccountView, expected database.Person, expectedError error) {
+	person, err := view.GetUserByID(viewID)
+	if !errors.Is(err, expectedError) {
+		t.Errorf("Expected error %v, got %v", expectedError, err)
+	}
+	if person != expected {
+		t.Errorf("Expected %v, got %v", expected, person)
+	}
+}
+
+// expectPreload expects the view to list users times, people are the first page
+func expectPreload(mockDatabase *database.MockStorage, times int, people ...database.Person) {
+	mockDatabase.EXPECT().ListUsers(database.UserQuery{Limit: 1000}).Return(people, nil).Times(times)
+}
+
+const viewID = "5555e2d316ca1b6d40aaaaaa"
+
+var (
+	activeUser   = database.Person{ID: bson.ObjectIdHex(viewID), IsActive: true}
+	inactiveUser = database.Person{ID: bson.ObjectIdHex(viewID), IsActive: false}
+)
+
+func TestAccountViewAppliesChanges(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		event         database.ChangeEvent
+		databaseCall  bool
+		expected      database.Person
+		expectedError error
+	}{
+		{
+			desc:     "Update deactivates user",
+			event:    database.ChangeEvent{Token: 1, Operation: database.OperationUpdate, ID: activeUser.ID, Person: &inactiveUser},
+			expected: inactiveUser,
+		},
+		{
+			desc:          "Delete removes user",
+			event:         database.ChangeEvent{Token: 1, Operation: database.OperationDelete, ID: activeUser.ID},
+			expectedError: database.ErrNotFound,
+		},
+		{
+			desc:         "Update without user reads it again",
+			event:        database.ChangeEvent{Token: 1, Operation: database.OperationUpdate, ID: activeUser.ID},
+			databaseCall: true,
+			expected:     inactiveUser,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockDatabase := database.NewMockStorage(ctrl)
+			expectPreload(mockDatabase, 1)
+			mockDatabase.EXPECT().GetUserByID(viewID).Return(activeUser, nil)
+			if tC.databaseCall {
+				mockDatabase.EXPECT().GetUserByID(viewID).Return(inactiveUser, nil)
+			}
+
+			source := newFakeSource()
+			view := database.NewAccountView(mockDatabase, source.open, time.Millisecond, nil)
+			defer view.Close()
+			feed := source.nextFeed(t)
+			waitLive(t, view)
+
+			checkUser(t, view, activeUser, nil)
+			checkUser(t, view, activeUser, nil)
+			feed.push(t, feedItem{event: tC.event})
+			checkUser(t, view, tC.expected, tC.expectedError)
+			checkUser(t, view, tC.expected, tC.expectedError)
+		})
+	}
+}
+
+func TestAccountViewPreloadsActiveUsers(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	first := make([]database.Person, 1000)
+	for i := range first {
+		first[i] = database.Person{ID: bson.NewObjectId(), IsActive: true}
+	}
+	first[len(first)-1] = activeUser
+	inactive := database.Person{ID: bson.NewObjectId(), IsActive: false}
+	mockDatabase := database.NewMockStorage(ctrl)
+	gomock.InOrder(
+		mockDatabase.EXPECT().ListUsers(database.UserQuery{Limit: 1000}).Return(first, nil),
+		mockDatabase.EXPECT().ListUsers(database.UserQuery{After: viewID, Limit: 1000}).Return([]database.Person{inactive}, nil),
+	)
+	mockDatabase.EXPECT().GetUserByID(inactive.ID.Hex()).Return(inactive, nil)
+
+	source := newFakeSource()
+	view := database.NewAccountView(mockDatabase, source.open, time.Millisecond, nil)
+	defer view.Close()
+	source.nextFeed(t)
+	waitLive(t, view)
+
+	if stats := view.Stats(); stats.Users != 1000 {
+		t.Errorf("Expected 1000 users loaded, got %+v", stats)
+	}
+	checkUser(t, view, activeUser, nil)
+	if person, err := view.GetUserByID(inactive.ID.Hex()); err != nil || person != inactive {
+		t.Errorf("Expected %v, got %v, %v", inactive, person, err)
+	}
+}
+
+func TestAccountViewInsertsNotFoundUser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDatabase := database.NewMockStorage(ctrl)
+	expectPreload(mockDatabase, 1)
+	mockDatabase.EXPECT().GetUserByID(viewID).Return(database.Person{}, database.ErrNotFound)
+
+	source := newFakeSource()
+	view := database.NewAccountView(mockDatabase, source.open, time.Millisecond, nil)
+	defer view.Close()
+	feed := source.nextFeed(t)
+	waitLive(t, view)
+
+	checkUser(t, view, database.Person{}, database.ErrNotFound)
+	checkUser(t, view, database.Person{}, database.ErrNotFound)
+	feed.push(t, feedItem{event: database.ChangeEvent{Token: 1, Operation: database.OperationInsert, ID: activeUser.ID, Person: &activeUser}})
+	checkUser(t, view, activeUser, nil)
+}
+
+func TestAccountViewForgetsOldestAbsentIDs(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// one more than the view remembers
+	absentIDs := make([]string, 10001)
+	for i := range absentIDs {
+		absentIDs[i] = bson.NewObjectId().Hex()
+	}
+	mockDatabase := database.NewMockStorage(ctrl)
+	expectPreload(mockDatabase, 1)
+	mockDatabase.EXPECT().GetUsersByIDs(absentIDs).Return(map[string]database.Person{}, nil)
+	mockDatabase.EXPECT().GetUserByID(absentIDs[0]).Return(database.Person{}, database.ErrNotFound)
+
+	source := newFakeSource()
+	view := database.NewAccountView(mockDatabase, source.open, time.Millisecond, nil)
+	defer view.Close()
+	source.nextFeed(t)
+	waitLive(t, view)
+
+	if people, err := view.GetUsersByIDs(absentIDs); err != nil || len(people) != 0 {
+		t.Fatalf("Expected no users, got %v, %v", people, err)
+	}
+	if stats := view.Stats(); stats.AbsentIDs != 10000 || stats.AbsentEvicted != 1 {
+		t.Errorf("Expected 10000 absent IDs and 1 evicted, got %+v", stats)
+	}
+	for _, userID := range []string{absentIDs[0], absentIDs[len(absentIDs)-1]} {
+		if _, err := view.GetUserByID(userID); !errors.Is(err, database.ErrNotFound) {
+			t.Errorf("Expected %v, got %v", database.ErrNotFound, err)
+		}
+	}
+}
+
+func TestAccountViewReadsStorageWithoutFeed(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDatabase := database.NewMockStorage(ctrl)
+	mockDatabase.EXPECT().GetUserByID(viewID).Return(activeUser, nil).Times(2)
+	mockDatabase.EXPECT().GetUsersByIDs([]string{viewID}).Return(map[string]database.Person{viewID: activeUser}, nil)
+
+	source := newFakeSource()
+	source.unavailable = true
+	view := database.NewAccountView(mockDatabase, source.open, time.Hour, nil)
+	defer view.Close()
+	source.nextToken(t)
+
+	checkUser(t, view, activeUser, nil)
+	checkUser(t, view, activeUser, nil)
+	if people, err := view.GetUsersByIDs([]string{viewID}); err != nil || people[viewID] != activeUser {
+		t.Errorf("Expected %v, got %v, %v", activeUser, people, err)
+	}
+}
+
+func TestAccountViewResumes(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		failResume    bool
+		databaseCalls int
+		preloads      int
+	}{
+		{
+			desc:          "Resumes after last change",
+			databaseCalls: 1,
+			preloads:      1,
+		},
+		{
+			desc:          "Forgets users when it can't resume",
+			failResume:    true,
+			databaseCalls: 2,
+			preloads:      2,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockDatabase := database.NewMockStorage(ctrl)
+			expectPreload(mockDatabase, tC.preloads)
+			mockDatabase.EXPECT().GetUserByID(viewID).Return(activeUser, nil).Times(tC.databaseCalls)
+
+			source := newFakeSource()
+			source.failResume = tC.failResume
+			view := database.NewAccountView(mockDatabase, source.open, time.Millisecond, nil)
+			defer view.Close()
+			if token := source.nextToken(t); token != nil {
+				t.Errorf("Expected first feed without token, got %v", token)
+			}
+			feed := source.nextFeed(t)
+			waitLive(t, view)
+
+			checkUser(t, view, activeUser, nil)
+			other := bson.NewObjectId()
+			feed.push(t, feedItem{event: database.ChangeEvent{Token: 1, Operation: database.OperationInsert, ID: other, Person: &database.Person{ID: other}}})
+			feed.push(t, feedItem{event: database.ChangeEvent{Token: 2, Operation: database.OperationDelete, ID: other}})
+			feed.push(t, feedItem{err: errors.New("connection reset")})
+
+			if token := source.nextToken(t); token != 2 {
+				t.Errorf("Expected feed to resume after 2, got %v", token)
+			}
+			if tC.failResume {
+				if token := source.nextToken(t); token != nil {
+					t.Errorf("Expected new feed without token, got %v", token)
+				}
+			}
+			source.nextFeed(t)
+			waitLive(t, view)
+
+			checkUser(t, view, activeUser, nil)
+		})
+	}
+}
+
+func TestAccountViewWritesForgetUser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	active := true
+	mockDatabase := database.NewMockStorage(ctrl)
+	expectPreload(mockDatabase, 1)
+	gomock.InOrder(
+		mockDatabase.EXPECT().GetUserByID(viewID).Return(inactiveUser, nil),
+		mockDatabase.EXPECT().UpdateUser(viewID, database.UserUpdate{IsActive: &active}).Return(activeUser, nil),
+		mockDatabase.EXPECT().GetUserByID(viewID).Return(activeUser, nil),
+	)
+
+	source := newFakeSource()
+	view := database.NewAccountView(mockDatabase, source.open, time.Millisecond, nil)
+	defer view.Close()
+	source.nextFeed(t)
+	waitLive(t, view)
+
+	checkUser(t, view, inactiveUser, nil)
+	if _, err := view.UpdateUser(viewID, database.UserUpdate{IsActive: &active}); err != nil {
+		t.Fatal(err)
+	}
+	// the change from the feed may come later, but the update is seen right away
+	checkUser(t, view, activeUser, nil)
+	checkUser(t, view, activeUser, nil)
+}
@@ -0,0 +1,258 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/globalsign/mgo/bson"
+
+	"pub-sub/tracker/auth"
+	"pub-sub/tracker/database"
+)
+
+//Limits of account listing
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 500
+)
+
+// maxNameLength limits account names
+const maxNameLength = 200
+
+//AccountRequest is a JSON body for creating and changing accounts. Fields that are not set
+//are not changed, ID can only be chosen when account is created. An empty rateLimit object
+//removes account's own limits.
+type AccountRequest struct {
+	ID        string              `json:"id,omitempty"`
+	Name      *string             `json:"name"`
+	IsActive  *bool               `json:"isActive"`
+	RateLimit *database.RateLimit `json:"rateLimit"`
+}
+
+//AccountBody describes an account
+type AccountBody struct {
+	ID        string              `json:"id"`
+	Name      string              `json:"name"`
+	IsActive  bool                `json:"isActive"`
+	RateLimit *database.RateLimit `json:"rateLimit,omitempty"`
+	HasAPIKey bool                `json:"hasApiKey"`
+}
+
+func newAccountBody(person database.Person) AccountBody {
+	return AccountBody{
+		ID:        person.ID.Hex(),
+		Name:      person.Name,
+		IsActive:  person.IsActive,
+		RateLimit: person.RateLimit,
+		HasAPIKey: person.APIKeyHash != "",
+	}
+}
+
+func validName(name *string) error {
+	if name == nil {
+		return nil
+	}
+	if strings.TrimSpace(*name) == "" {
+		return fmt.Errorf("Name can't be empty")
+	}
+	if len(*name) > maxNameLength {
+		return fmt.Errorf("Name is longer than %d characters", maxNameLength)
+	}
+	return nil
+}
+
+func accountResponse(person database.Person) Response {
+	account := newAccountBody(person)
+	return Response{Account: &account}
+}
+
+//NewListAccountsHandler returns new HTTP handler that lists accounts ordered by ID. Query parameters
+//are limit, after (ID of the last account on the previous page) and isActive.
+func NewListAccountsHandler(db database.Storage) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parameters := r.URL.Query()
+		query := database.UserQuery{After: parameters.Get("after"), Limit: DefaultPageSize}
+
+		if limit := parameters.Get("limit"); limit != "" {
+			value, err := strconv.Atoi(limit)
+			if err != nil || value < 1 || value > MaxPageSize {
+				encodeJSON(w, r, http.StatusBadRequest, errorResponse(ErrorInvalidQuery, fmt.Sprintf("Limit must be between 1 and %d", MaxPageSize)))
+				return
+			}
+			query.Limit = value
+		}
+		if query.After != "" && !database.ValidID(query.After) {
+			encodeJSON(w, r, http.StatusBadRequest, errorResponse(ErrorInvalidQuery, "After is not a valid account ID"))
+			return
+		}
+		if isActive := parameters.Get("isActive"); isActive != "" {
+			value, err := strconv.ParseBool(isActive)
+			if err != nil {
+				encodeJSON(w, r, http.StatusBadRequest, errorResponse(ErrorInvalidQuery, "IsActive must be true or false"))
+				return
+			}
+			query.IsActive = &value
+		}
+
+		people, err := db.ListUsers(query)
+		if err != nil {
+			statusCode, response := databaseErrorResponse(err)
+			encodeJSON(w, r, statusCode, response)
+			return
+		}
+
+		response := Response{Accounts: []AccountBody{}}
+		for _, person := range people {
+			response.Accounts = append(response.Accounts, newAccountBody(person))
+		}
+		if len(people) == query.Limit {
+			response.Next = people[len(people)-1].ID.Hex()
+		}
+		encodeJSON(w, r, http.StatusOK, response)
+	}
+}
+
+//NewGetAccountHandler returns new HTTP handler that returns account from URL
+func NewGetAccountHandler(db database.Storage) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accountID, _ := accountIDVar(r)
+		person, err := db.GetUserByID(accountID)
+		if err != nil {
+			statusCode, response := databaseErrorResponse(err)
+			encodeJSON(w, r, statusCode, response)
+			return
+		}
+		encodeJSON(w, r, http.StatusOK, accountResponse(person))
+	}
+}
+
+//NewCreateAccountHandler returns new HTTP handler that creates account. Name is required,
+//accounts are inactive unless isActive is true.
+func NewCreateAccountHandler(db database.Storage) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		account := AccountRequest{}
+		if err := decodeBody(w, r, &account); err != nil {
+			encodeJSON(w, r, http.StatusBadRequest, errorResponse(ErrorInvalidBody, err.Error()))
+			return
+		}
+		if account.ID != "" && !database.ValidID(account.ID) {
+			encodeJSON(w, r, http.StatusBadRequest, errorResponse(ErrorInvalidAccountID, database.ErrInvalidID.Error()))
+			return
+		}
+		if account.Name == nil {
+			encodeJSON(w, r, http.StatusBadRequest, errorResponse(ErrorInvalidAccount, "Name not present"))
+			return
+		}
+		if err := validName(account.Name); err != nil {
+			encodeJSON(w, r, http.StatusBadRequest, errorResponse(ErrorInvalidAccount, err.Error()))
+			return
+		}
+
+		person := database.Person{Name: *account.Name}
+		if account.ID != "" {
+			person.ID = bson.ObjectIdHex(account.ID)
+		}
+		if account.IsActive != nil {
+			person.IsActive = *account.IsActive
+		}
+		if account.RateLimit != nil && *account.RateLimit != (database.RateLimit{}) {
+			person.RateLimit = account.RateLimit
+		}
+
+		created, err := db.CreateUser(person)
+		if err != nil {
+			statusCode, response := databaseErrorResponse(err)
+			encodeJSON(w, r, statusCode, response)
+			return
+		}
+		w.Header().Set("Location", fmt.Sprintf("/v1/accounts/%s", created.ID.Hex()))
+		encodeJSON(w, r, http.StatusCreated, accountResponse(created))
+	}
+}
+
+//NewUpdateAccountHandler returns new HTTP handler that changes name or activity of account from URL
+func NewUpdateAccountHandler(db database.Storage) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		account := AccountRequest{}
+		if err := decodeBody(w, r, &account); err != nil {
+			encodeJSON(w, r, http.StatusBadRequest, errorResponse(ErrorInvalidBody, err.Error()))
+			return
+		}
+		if account.ID != "" {
+			encodeJSON(w, r, http.StatusBadRequest, errorResponse(ErrorInvalidAccount, "Id can't be changed"))
+			return
+		}
+		if account.Name == nil && account.IsActive == nil && account.RateLimit == nil {
+			encodeJSON(w, r, http.StatusBadRequest, errorResponse(ErrorInvalidAccount, "Nothing to change"))
+			return
+		}
+		if err := validName(account.Name); err != nil {
+			encodeJSON(w, r, http.StatusBadRequest, errorResponse(ErrorInvalidAccount, err.Error()))
+			return
+		}
+
+		update := database.UserUpdate{Name: account.Name, IsActive: account.IsActive, RateLimit: account.RateLimit}
+		accountID, _ := accountIDVar(r)
+		person, err := db.UpdateUser(accountID, update)
+		if err != nil {
+			statusCode, response := databaseErrorResponse(err)
+			encodeJSON(w, r, statusCode, response)
+			return
+		}
+		encodeJSON(w, r, http.StatusOK, accountResponse(person))
+	}
+}
+
+//NewDeleteAccountHandler returns new HTTP handler that deletes account from URL
+func NewDeleteAccountHandler(db database.Storage) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accountID, _ := accountIDVar(r)
+		if err := db.DeleteUser(accountID); err != nil {
+			statusCode, response := databaseErrorResponse(err)
+			encodeJSON(w, r, statusCode, response)
+			return
+		}
+		encodeJSON(w, r, http.StatusOK, Response{Message: "Account deleted"})
+	}
+}
+
+//NewCreateKeyHandler returns new HTTP handler that gives account from URL a new API key. Only
+//the hash of the key and the secret requests are signed with are stored, the key is returned
+//once and replaces the previous one.
+func NewCreateKeyHandler(db database.Storage) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := auth.NewKey()
+		if err != nil {
+			encodeJSON(w, r, http.StatusInternalServerError, errorResponse(ErrorInternal, err.Error()))
+			return
+		}
+		keyHash, signingSecret := auth.HashKey(key), auth.SigningSecret(key)
+		accountID, _ := accountIDVar(r)
+		person, err := db.UpdateUser(accountID, database.UserUpdate{APIKeyHash: &keyHash, APISigningSecret: &signingSecret})
+		if err != nil {
+			statusCode, response := databaseErrorResponse(err)
+			encodeJSON(w, r, statusCode, response)
+			return
+		}
+		response := accountResponse(person)
+		response.APIKey = key
+		encodeJSON(w, r, http.StatusCreated, response)
+	}
+}
+
+//NewDeleteKeyHandler returns new HTTP handler that removes API key of account from URL
+func NewDeleteKeyHandler(db database.Storage) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		noKey := ""
+		accountID, _ := accountIDVar(r)
+		person, err := db.UpdateUser(accountID, database.UserUpdate{APIKeyHash: &noKey, APISigningSecret: &noKey})
+		if err != nil {
+			statusCode, response := databaseErrorResponse(err)
+			encodeJSON(w, r, statusCode, response)
+			return
+		}
+		encodeJSON(w, r, http.StatusOK, accountResponse(person))
+	}
+}
@@ -0,0 +1,273 @@
+package handler_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"pub-sub/tracker/database"
+	"pub-sub/tracker/handler"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/golang/mock/gomock"
+	"github.com/gorilla/mux"
+)
+
+func accountsRouter(db database.Storage) *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/v1/accounts", handler.NewListAccountsHandler(db)).Methods("GET")
+	r.HandleFunc("/v1/accounts", handler.NewCreateAccountHandler(db)).Methods("POST")
+	r.HandleFunc("/v1/accounts/{accountId}", handler.NewGetAccountHandler(db)).Methods("GET")
+	r.HandleFunc("/v1/accounts/{accountId}", handler.NewUpdateAccountHandler(db)).Methods("PATCH")
+	r.HandleFunc("/v1/accounts/{accountId}", handler.NewDeleteAccountHandler(db)).Methods("DELETE")
+	return r
+}
+
+func TestAccountHandlers(t *testing.T) {
+	first := database.Person{ID: bson.ObjectIdHex("5555e2d316ca1b6d40aaaaaa"), Name: "test user 1", IsActive: true}
+	second := database.Person{ID: bson.ObjectIdHex("5555e2d316ca1b6d40aaaaab"), Name: "test user 2"}
+	name, active, inactive := "test user 1", true, false
+
+	testCases := []struct {
+		desc             string
+		method           string
+		url              string
+		body             string
+		expect           func(db *database.MockStorage)
+		expectedCode     int
+		expectedError    string
+		expectedMessage  string
+		expectedAccount  *handler.AccountBody
+		expectedAccounts []handler.AccountBody
+		expectedNext     string
+	}{
+		{
+			desc:   "List first page",
+			method: "GET",
+			url:    "/v1/accounts?limit=2",
+			expect: func(db *database.MockStorage) {
+				db.EXPECT().ListUsers(database.UserQuery{Limit: 2}).Return([]database.Person{first, second}, nil)
+			},
+			expectedCode: 200,
+			expectedAccounts: []handler.AccountBody{
+				{ID: "5555e2d316ca1b6d40aaaaaa", Name: "test user 1", IsActive: true},
+				{ID: "5555e2d316ca1b6d40aaaaab", Name: "test user 2"},
+			},
+			expectedNext: "5555e2d316ca1b6d40aaaaab",
+		},
+		{
+			desc:   "List last page of inactive accounts",
+			method: "GET",
+			url:    "/v1/accounts?after=5555e2d316ca1b6d40aaaaaa&isActive=false",
+			expect: func(db *database.MockStorage) {
+				query := database.UserQuery{After: "5555e2d316ca1b6d40aaaaaa", Limit: handler.DefaultPageSize, IsActive: &inactive}
+				db.EXPECT().ListUsers(query).Return([]database.Person{second}, nil)
+			},
+			expectedCode:     200,
+			expectedAccounts: []handler.AccountBody{{ID: "5555e2d316ca1b6d40aaaaab", Name: "test user 2"}},
+		},
+		{
+			desc:            "List with limit over maximum",
+			method:          "GET",
+			url:             "/v1/accounts?limit=501",
+			expectedCode:    400,
+			expectedError:   handler.ErrorInvalidQuery,
+			expectedMessage: "Limit must be between 1 and 500",
+		},
+		{
+			desc:            "List after invalid ID",
+			method:          "GET",
+			url:             "/v1/accounts?after=nonobjid",
+			expectedCode:    400,
+			expectedError:   handler.ErrorInvalidQuery,
+			expectedMessage: "After is not a valid account ID",
+		},
+		{
+			desc:            "List with invalid isActive",
+			method:          "GET",
+			url:             "/v1/accounts?isActive=maybe",
+			expectedCode:    400,
+			expectedError:   handler.ErrorInvalidQuery,
+			expectedMessage: "IsActive must be true or false",
+		},
+		{
+			desc:   "Get account",
+			method: "GET",
+			url:    "/v1/accounts/5555e2d316ca1b6d40aaaaaa",
+			expect: func(db *database.MockStorage) {
+				db.EXPECT().GetUserByID("5555e2d316ca1b6d40aaaaaa").Return(first, nil)
+			},
+			expectedCode:    200,
+			expectedAccount: &handler.AccountBody{ID: "5555e2d316ca1b6d40aaaaaa", Name: "test user 1", IsActive: true},
+		},
+		{
+			desc:   "Get missing account",
+			method: "GET",
+			url:    "/v1/accounts/5555e2d316ca1b6d40aaaaac",
+			expect: func(db *database.MockStorage) {
+				db.EXPECT().GetUserByID("5555e2d316ca1b6d40aaaaac").Return(database.Person{}, database.ErrNotFound)
+			},
+			expectedCode:    404,
+			expectedError:   handler.ErrorAccountNotFound,
+			expectedMessage: "not found",
+		},
+		{
+			desc:   "Create account with ID",
+			method: "POST",
+			url:    "/v1/accounts",
+			body:   `{"id": "5555e2d316ca1b6d40aaaaaa", "name": "test user 1", "isActive": true}`,
+			expect: func(db *database.MockStorage) {
+				db.EXPECT().CreateUser(first).Return(first, nil)
+			},
+			expectedCode:    201,
+			expectedAccount: &handler.AccountBody{ID: "5555e2d316ca1b6d40aaaaaa", Name: "test user 1", IsActive: true},
+		},
+		{
+			desc:   "Create account with existing ID",
+			method: "POST",
+			url:    "/v1/accounts",
+			body:   `{"id": "5555e2d316ca1b6d40aaaaaa", "name": "test user 1", "isActive": true}`,
+			expect: func(db *database.MockStorage) {
+				db.EXPECT().CreateUser(first).Return(database.Person{}, database.ErrDuplicate)
+			},
+			expectedCode:    409,
+			expectedError:   handler.ErrorAccountExists,
+			expectedMessage: "already exists",
+		},
+		{
+			desc:            "Create account without name",
+			method:          "POST",
+			url:             "/v1/accounts",
+			body:            `{"isActive": true}`,
+			expectedCode:    400,
+			expectedError:   handler.ErrorInvalidAccount,
+			expectedMessage: "Name not present",
+		},
+		{
+			desc:            "Create account with empty name",
+			method:          "POST",
+			url:             "/v1/accounts",
+			body:            `{"name": "  "}`,
+			expectedCode:    400,
+			expectedError:   handler.ErrorInvalidAccount,
+			expectedMessage: "Name can't be empty",
+		},
+		{
+			desc:            "Create account with invalid ID",
+			method:          "POST",
+			url:             "/v1/accounts",
+			body:            `{"id": "nonobjid", "name": "test user 1"}`,
+			expectedCode:    400,
+			expectedError:   handler.ErrorInvalidAccountID,
+			expectedMessage: "ObjectID not valid",
+		},
+		{
+			desc:            "Create account with invalid body",
+			method:          "POST",
+			url:             "/v1/accounts",
+			body:            `{"name": `,
+			expectedCode:    400,
+			expectedError:   handler.ErrorInvalidBody,
+			expectedMessage: "Invalid JSON body",
+		},
+		{
+			desc:   "Deactivate account",
+			method: "PATCH",
+			url:    "/v1/accounts/5555e2d316ca1b6d40aaaaab",
+			body:   `{"isActive": false}`,
+			expect: func(db *database.MockStorage) {
+				db.EXPECT().UpdateUser("5555e2d316ca1b6d40aaaaab", database.UserUpdate{IsActive: &inactive}).Return(second, nil)
+			},
+			expectedCode:    200,
+			expectedAccount: &handler.AccountBody{ID: "5555e2d316ca1b6d40aaaaab", Name: "test user 2"},
+		},
+		{
+			desc:   "Rename and activate missing account",
+			method: "PATCH",
+			url:    "/v1/accounts/5555e2d316ca1b6d40aaaaac",
+			body:   `{"name": "test user 1", "isActive": true}`,
+			expect: func(db *database.MockStorage) {
+				db.EXPECT().UpdateUser("5555e2d316ca1b6d40aaaaac", database.UserUpdate{Name: &name, IsActive: &active}).Return(database.Person{}, database.ErrNotFound)
+			},
+			expectedCode:    404,
+			expectedError:   handler.ErrorAccountNotFound,
+			expectedMessage: "not found",
+		},
+		{
+			desc:            "Change nothing",
+			method:          "PATCH",
+			url:             "/v1/accounts/5555e2d316ca1b6d40aaaaab",
+			body:            `{}`,
+			expectedCode:    400,
+			expectedError:   handler.ErrorInvalidAccount,
+			expectedMessage: "Nothing to change",
+		},
+		{
+			desc:            "Change ID",
+			method:          "PATCH",
+			url:             "/v1/accounts/5555e2d316ca1b6d40aaaaab",
+			body:            `{"id": "5555e2d316ca1b6d40aaaaac"}`,
+			expectedCode:    400,
+			expectedError:   handler.ErrorInvalidAccount,
+			expectedMessage: "Id can't be changed",
+		},
+		{
+			desc:   "Delete account",
+			method: "DELETE",
+			url:    "/v1/accounts/5555e2d316ca1b6d40aaaaab",
+			expect: func(db *database.MockStorage) {
+				db.EXPECT().DeleteUser("5555e2d316ca1b6d40aaaaab").Return(nil)
+			},
+			expectedCode:    200,
+			expectedMessage: "Account deleted",
+		},
+		{
+			desc:   "Delete account with invalid ID",
+			method: "DELETE",
+			url:    "/v1/accounts/nonobjid",
+			expect: func(db *database.MockStorage) {
+				db.EXPECT().DeleteUser("nonobjid").Return(database.ErrInvalidID)
+			},
+			expectedCode:    400,
+			expectedError:   handler.ErrorInvalidAccountID,
+			expectedMessage: "ObjectID not valid",
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockDatabase := database.NewMockStorage(ctrl)
+			if tC.expect != nil {
+				tC.expect(mockDatabase)
+			}
+
+			req, _ := http.NewRequest(tC.method, tC.url, strings.NewReader(tC.body))
+			rr := httptest.NewRecorder()
+			accountsRouter(mockDatabase).ServeHTTP(rr, req)
+
+			if rr.Code != tC.expectedCode {
+				t.Errorf("Expected %d, got %d", tC.expectedCode, rr.Code)
+			}
+			response := decodeResponse(t, rr)
+			checkError(t, response, tC.expectedError, tC.expectedMessage)
+			if tC.expectedError == "" && response.Message != tC.expectedMessage {
+				t.Errorf("Expected message %q, got %q", tC.expectedMessage, response.Message)
+			}
+			if !reflect.DeepEqual(response.Account, tC.expectedAccount) {
+				t.Errorf("Expected account %v, got %v", tC.expectedAccount, response.Account)
+			}
+			if !reflect.DeepEqual(response.Accounts, tC.expectedAccounts) {
+				t.Errorf("Expected accounts %v, got %v", tC.expectedAccounts, response.Accounts)
+			}
+			if response.Next != tC.expectedNext {
+				t.Errorf("Expected next %q, got %q", tC.expectedNext, response.Next)
+			}
+			if tC.expectedCode == 201 && rr.Header().Get("Location") != "/v1/accounts/"+tC.expectedAccount.ID {
+				t.Errorf("Expected location of account, got %q", rr.Header().Get("Location"))
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/mux"
+
+	"pub-sub/tracker/auth"
+	"pub-sub/tracker/database"
+)
+
+type identityKey struct{}
+
+// identityAdmin is the identity of requests with the admin key, accounts are "account:<id>"
+const identityAdmin = "admin"
+
+// withIdentity returns request with identity of its credentials in the context
+func withIdentity(r *http.Request, identity string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, identity))
+}
+
+// requestIdentity returns identity set by Authenticator, empty when request was not authenticated
+func requestIdentity(r *http.Request) string {
+	identity, _ := r.Context().Value(identityKey{}).(string)
+	return identity
+}
+
+//Authenticator is a mux middleware that lets requests through only with valid credentials.
+//Every route needs the admin key, routes added with AllowAccount also accept the key of the
+//account in their URL and routes added with AllowAnonymous need no credentials.
+type Authenticator struct {
+	db       database.Storage
+	verifier *auth.Verifier
+
+	mu       sync.RWMutex
+	disabled bool
+	admin    auth.Credentials
+	// accountRoutes and publicRoutes are only changed before the server is started
+	accountRoutes map[*mux.Route]bool
+	publicRoutes  map[*mux.Route]bool
+}
+
+//NewAuthenticator returns new Authenticator. Admin requests are forbidden when admin has no key hash.
+func NewAuthenticator(db database.Storage, verifier *auth.Verifier, admin auth.Credentials) *Authenticator {
+	return &Authenticator{db: db, verifier: verifier, admin: admin, accountRoutes: map[*mux.Route]bool{}, publicRoutes: map[*mux.Route]bool{}}
+}
+
+//SetEnabled turns checking of credentials on and off, every request is let through while it is off
+func (a *Authenticator) SetEnabled(enabled bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.disabled = !enabled
+}
+
+//SetAdmin changes the admin key, admin requests are forbidden when admin has no key hash
+func (a *Authenticator) SetAdmin(admin auth.Credentials) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.admin = admin
+}
+
+//AllowAccount lets account in accountId of route URL use the route with its own key
+func (a *Authenticator) AllowAccount(route *mux.Route) *mux.Route {
+	a.accountRoutes[route] = true
+	return route
+}
+
+//AllowAnonymous lets anyone use route, e.g. health checks
+func (a *Authenticator) AllowAnonymous(route *mux.Route) *mux.Route {
+	a.publicRoutes[route] = true
+	return route
+}
+
+//Middleware checks credentials of requests before they are passed to next, with the identity of
+//the credentials in their context
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.mu.RLock()
+		disabled, admin := a.disabled, a.admin
+		a.mu.RUnlock()
+		if disabled || a.publicRoutes[mux.CurrentRoute(r)] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !auth.HasCredentials(r) {
+			encodeJSON(w, r, http.StatusUnauthorized, errorResponse(ErrorMissingCredentials, auth.ErrMissingCredentials.Error()))
+			return
+		}
+
+		// signatures cover the body, so it is read here and replaced for next
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+		if err != nil {
+			encodeJSON(w, r, http.StatusBadRequest, errorResponse(ErrorInvalidBody, err.Error()))
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		err = a.verifier.Verify(admin, r, body)
+		if err == nil {
+			next.ServeHTTP(w, withIdentity(r, identityAdmin))
+			return
+		}
+		if err == auth.ErrExpired || err == auth.ErrReplayed || errors.Is(err, auth.ErrReplayUnavailable) || !a.accountRoutes[mux.CurrentRoute(r)] {
+			if err == auth.ErrInvalidKey && admin.KeyHash == "" {
+				encodeJSON(w, r, http.StatusForbidden, errorResponse(ErrorForbidden, "Admin key not configured"))
+				return
+			}
+			statusCode, response := authErrorResponse(err)
+			encodeJSON(w, r, statusCode, response)
+			return
+		}
+
+		accountID, _ := accountIDVar(r)
+		account, err := a.db.GetUserByID(accountID)
+		if errors.Is(err, database.ErrNotFound) || errors.Is(err, database.ErrInvalidID) {
+			// unknown accounts look like wrong credentials, so that accounts can't be discovered
+			encodeJSON(w, r, http.StatusUnauthorized, errorResponse(ErrorInvalidCredentials, auth.ErrInvalidKey.Error()))
+			return
+		}
+		if err != nil {
+			statusCode, response := databaseErrorResponse(err)
+			encodeJSON(w, r, statusCode, response)
+			return
+		}
+		if account.APIKeyHash == "" {
+			encodeJSON(w, r, http.StatusForbidden, errorResponse(ErrorForbidden, "Account has no API key"))
+			return
+		}
+		credentials := auth.Credentials{KeyHash: account.APIKeyHash, SigningSecret: account.APISigningSecret}
+		if err := a.verifier.Verify(credentials, r, body); err != nil {
+			statusCode, response := authErrorResponse(err)
+			encodeJSON(w, r, statusCode, response)
+			return
+		}
+		next.ServeHTTP(w, withIdentity(r, "account:"+accountID))
+	})
+}
+
+// authErrorResponse maps errors from auth.Verifier to HTTP status and error code
+func authErrorResponse(err error) (int, Response) {
+	if errors.Is(err, auth.ErrReplayUnavailable) {
+		return http.StatusServiceUnavailable, errorResponse(ErrorDatabaseUnavailable, err.Error())
+	}
+	switch err {
+	case auth.ErrExpired:
+		return http.StatusUnauthorized, errorResponse(ErrorExpiredSignature, err.Error())
+	case auth.ErrReplayed:
+		return http.StatusUnauthorized, errorResponse(ErrorReplayedRequest, err.Error())
+	case auth.ErrMissingCredentials:
+		return http.StatusUnauthorized, errorResponse(ErrorMissingCredentials, err.Error())
+	}
+	return http.StatusUnauthorized, errorResponse(ErrorInvalidCredentials, err.Error())
+}
@@ -0,0 +1,322 @@
+package handler_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"pub-sub/tracker/auth"
+	"pub-sub/tracker/database"
+	"pub-sub/tracker/handler"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/gorilla/mux"
+)
+
+const (
+	adminKey   = "admin-key"
+	accountKey = "account-key"
+)
+
+// echo answers with the body of request, to show that it reached the handler unchanged
+func echo(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	w.Write(body)
+}
+
+func TestAuthenticator(t *testing.T) {
+	now := time.Now()
+	withKey := database.Person{ID: bson.ObjectIdHex("5555e2d316ca1b6d40aaaaaa"), IsActive: true, APIKeyHash: auth.HashKey(accountKey), APISigningSecret: auth.SigningSecret(accountKey)}
+	withoutKey := database.Person{ID: bson.ObjectIdHex("5555e2d316ca1b6d40aaaaab"), IsActive: true}
+	eventsURL := "/v1/accounts/5555e2d316ca1b6d40aaaaaa/events"
+
+	withHeader := func(header string, value string) func(req *http.Request) {
+		return func(req *http.Request) { req.Header.Set(header, value) }
+	}
+	signedWith := func(secret string, timestamp time.Time) func(req *http.Request) {
+		return func(req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+			req.Body = ioutil.NopCloser(strings.NewReader(string(body)))
+			req.Header.Set(auth.TimestampHeader, strconv.FormatInt(timestamp.Unix(), 10))
+			req.Header.Set(auth.SignatureHeader, auth.Sign(secret, timestamp.Unix(), req.Method, req.URL.RequestURI(), body))
+		}
+	}
+	signed := func(key string, timestamp time.Time) func(req *http.Request) {
+		return signedWith(auth.SigningSecret(key), timestamp)
+	}
+
+	testCases := []struct {
+		desc            string
+		adminKeyHash    string
+		method          string
+		url             string
+		credentials     func(req *http.Request)
+		expectedCode    int
+		expectedError   string
+		expectedMessage string
+	}{
+		{
+			desc:            "No credentials",
+			method:          "POST",
+			url:             eventsURL,
+			expectedCode:    401,
+			expectedError:   handler.ErrorMissingCredentials,
+			expectedMessage: "credentials not present",
+		},
+		{
+			desc:         "Account key",
+			method:       "POST",
+			url:          eventsURL,
+			credentials:  withHeader(auth.KeyHeader, accountKey),
+			expectedCode: 200,
+		},
+		{
+			desc:         "Account signature",
+			method:       "POST",
+			url:          eventsURL + "?source=test",
+			credentials:  signed(accountKey, now),
+			expectedCode: 200,
+		},
+		{
+			desc:            "Signature keyed with the stored key hash",
+			method:          "POST",
+			url:             eventsURL,
+			credentials:     signedWith(auth.HashKey(accountKey), now),
+			expectedCode:    401,
+			expectedError:   handler.ErrorInvalidCredentials,
+			expectedMessage: "invalid signature",
+		},
+		{
+			desc:         "Admin signature",
+			method:       "POST",
+			url:          eventsURL,
+			credentials:  signed(adminKey, now),
+			expectedCode: 200,
+		},
+		{
+			desc:         "Admin key for account",
+			method:       "POST",
+			url:          eventsURL,
+			credentials:  withHeader(auth.KeyHeader, adminKey),
+			expectedCode: 200,
+		},
+		{
+			desc:            "Wrong key",
+			method:          "POST",
+			url:             eventsURL,
+			credentials:     withHeader(auth.KeyHeader, "wrong"),
+			expectedCode:    401,
+			expectedError:   handler.ErrorInvalidCredentials,
+			expectedMessage: "invalid API key",
+		},
+		{
+			desc:            "Key of other account",
+			method:          "POST",
+			url:             "/v1/accounts/5555e2d316ca1b6d40aaaaab/events",
+			credentials:     withHeader(auth.KeyHeader, accountKey),
+			expectedCode:    403,
+			expectedError:   handler.ErrorForbidden,
+			expectedMessage: "Account has no API key",
+		},
+		{
+			desc:            "Unknown account",
+			method:          "POST",
+			url:             "/v1/accounts/5555e2d316ca1b6d40aaaaac/events",
+			credentials:     withHeader(auth.KeyHeader, accountKey),
+			expectedCode:    401,
+			expectedError:   handler.ErrorInvalidCredentials,
+			expectedMessage: "invalid API key",
+		},
+		{
+			desc:            "Old signature",
+			method:          "POST",
+			url:             eventsURL,
+			credentials:     signed(accountKey, now.Add(-10*time.Minute)),
+			expectedCode:    401,
+			expectedError:   handler.ErrorExpiredSignature,
+			expectedMessage: "timestamp is outside of the allowed window",
+		},
+		{
+			desc:   "Signature of other request",
+			method: "POST",
+			url:    eventsURL,
+			credentials: func(req *http.Request) {
+				signed(accountKey, now)(req)
+				req.URL.RawQuery = "source=other"
+			},
+			expectedCode:    401,
+			expectedError:   handler.ErrorInvalidCredentials,
+			expectedMessage: "invalid signature",
+		},
+		{
+			desc:         "Anonymous route",
+			method:       "GET",
+			url:          "/healthz",
+			expectedCode: 200,
+		},
+		{
+			desc:         "Admin key for admin route",
+			method:       "GET",
+			url:          "/v1/accounts/5555e2d316ca1b6d40aaaaaa",
+			credentials:  withHeader(auth.KeyHeader, adminKey),
+			expectedCode: 200,
+		},
+		{
+			desc:            "Account key for admin route",
+			method:          "GET",
+			url:             "/v1/accounts/5555e2d316ca1b6d40aaaaaa",
+			credentials:     withHeader(auth.KeyHeader, accountKey),
+			expectedCode:    401,
+			expectedError:   handler.ErrorInvalidCredentials,
+			expectedMessage: "invalid API key",
+		},
+		{
+			desc:            "Admin route without admin key",
+			adminKeyHash:    "-",
+			method:          "GET",
+			url:             "/v1/accounts/5555e2d316ca1b6d40aaaaaa",
+			credentials:     withHeader(auth.KeyHeader, accountKey),
+			expectedCode:    403,
+			expectedError:   handler.ErrorForbidden,
+			expectedMessage: "Admin key not configured",
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			admin := auth.Credentials{KeyHash: auth.HashKey(adminKey), SigningSecret: auth.SigningSecret(adminKey)}
+			if tC.adminKeyHash == "-" {
+				admin = auth.Credentials{}
+			}
+			db := database.NewMemoryStorage([]database.Person{withKey, withoutKey})
+			authenticator := handler.NewAuthenticator(db, auth.NewVerifier(5*time.Minute, auth.NewMemoryReplayStore(time.Now), time.Now), admin)
+
+			r := mux.NewRouter()
+			authenticator.AllowAccount(r.HandleFunc("/v1/accounts/{accountId}/events", echo).Methods("POST"))
+			r.HandleFunc("/v1/accounts/{accountId}", echo).Methods("GET")
+			authenticator.AllowAnonymous(r.HandleFunc("/healthz", echo).Methods("GET"))
+			r.Use(authenticator.Middleware)
+
+			req, _ := http.NewRequest(tC.method, tC.url, strings.NewReader(`{"data": "test"}`))
+			if tC.credentials != nil {
+				tC.credentials(req)
+			}
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+
+			if rr.Code != tC.expectedCode {
+				t.Errorf("Expected %d, got %d", tC.expectedCode, rr.Code)
+			}
+			if tC.expectedError == "" {
+				if rr.Body.String() != `{"data": "test"}` {
+					t.Errorf("Expected body to reach handler, got %s", rr.Body.String())
+				}
+				return
+			}
+			checkError(t, decodeResponse(t, rr), tC.expectedError, tC.expectedMessage)
+		})
+	}
+}
+
+// unavailableReplays is a ReplayStore whose database is down
+type unavailableReplays struct{}
+
+func (unavailableReplays) Remember(signature string, expires time.Time) (bool, error) {
+	return false, errors.New("no reachable servers")
+}
+
+func TestAuthenticatorReplayStoreUnavailable(t *testing.T) {
+	person := database.Person{ID: bson.ObjectIdHex("5555e2d316ca1b6d40aaaaaa"), IsActive: true, APIKeyHash: auth.HashKey(accountKey), APISigningSecret: auth.SigningSecret(accountKey)}
+	authenticator := handler.NewAuthenticator(database.NewMemoryStorage([]database.Person{person}), auth.NewVerifier(5*time.Minute, unavailableReplays{}, time.Now), auth.Credentials{})
+	r := mux.NewRouter()
+	authenticator.AllowAccount(r.HandleFunc("/v1/accounts/{accountId}/events", echo).Methods("POST"))
+	r.Use(authenticator.Middleware)
+
+	req, _ := http.NewRequest("POST", "/v1/accounts/5555e2d316ca1b6d40aaaaaa/events", strings.NewReader(`{"data": "test"}`))
+	timestamp := time.Now().Unix()
+	req.Header.Set(auth.TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(auth.SignatureHeader, auth.Sign(auth.SigningSecret(accountKey), timestamp, "POST", req.URL.RequestURI(), []byte(`{"data": "test"}`)))
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	if rr.Code != 503 {
+		t.Errorf("Expected 503, got %d", rr.Code)
+	}
+	checkError(t, decodeResponse(t, rr), handler.ErrorDatabaseUnavailable, "replayed requests can't be checked: no reachable servers")
+}
+
+func TestAuthenticatorReconfigure(t *testing.T) {
+	db := database.NewMemoryStorage(nil)
+	authenticator := handler.NewAuthenticator(db, auth.NewVerifier(5*time.Minute, auth.NewMemoryReplayStore(time.Now), time.Now), auth.Credentials{KeyHash: auth.HashKey(adminKey)})
+	r := mux.NewRouter()
+	r.HandleFunc("/v1/accounts", echo).Methods("GET")
+	r.Use(authenticator.Middleware)
+
+	otherKey := "other-admin-key"
+	steps := []struct {
+		desc         string
+		configure    func()
+		key          string
+		expectedCode int
+	}{
+		{desc: "No credentials", expectedCode: 401},
+		{desc: "Disabled", configure: func() { authenticator.SetEnabled(false) }, expectedCode: 200},
+		{desc: "Enabled again", configure: func() { authenticator.SetEnabled(true) }, expectedCode: 401},
+		{desc: "Admin key", key: adminKey, expectedCode: 200},
+		{desc: "Old admin key", configure: func() { authenticator.SetAdmin(auth.Credentials{KeyHash: auth.HashKey(otherKey)}) }, key: adminKey, expectedCode: 401},
+		{desc: "New admin key", key: otherKey, expectedCode: 200},
+		{desc: "Admin key removed", configure: func() { authenticator.SetAdmin(auth.Credentials{}) }, key: otherKey, expectedCode: 403},
+	}
+	for _, step := range steps {
+		if step.configure != nil {
+			step.configure()
+		}
+		req, _ := http.NewRequest("GET", "/v1/accounts", strings.NewReader(""))
+		if step.key != "" {
+			req.Header.Set(auth.KeyHeader, step.key)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if rr.Code != step.expectedCode {
+			t.Errorf("%s: expected %d, got %d", step.desc, step.expectedCode, rr.Code)
+		}
+	}
+}
+
+func TestAPIKeyHandlers(t *testing.T) {
+	person := database.Person{ID: bson.ObjectIdHex("5555e2d316ca1b6d40aaaaaa"), Name: "test user 1"}
+	db := database.NewMemoryStorage([]database.Person{person})
+	r := mux.NewRouter()
+	r.HandleFunc("/v1/accounts/{accountId}/keys", handler.NewCreateKeyHandler(db)).Methods("POST")
+	r.HandleFunc("/v1/accounts/{accountId}/keys", handler.NewDeleteKeyHandler(db)).Methods("DELETE")
+
+	req, _ := http.NewRequest("POST", "/v1/accounts/5555e2d316ca1b6d40aaaaaa/keys", nil)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	response := decodeResponse(t, rr)
+	if rr.Code != 201 || response.APIKey == "" || response.Account == nil || !response.Account.HasAPIKey {
+		t.Fatalf("Expected 201 with new key, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if stored, _ := db.GetUserByID(person.ID.Hex()); stored.APIKeyHash != auth.HashKey(response.APIKey) || stored.APISigningSecret != auth.SigningSecret(response.APIKey) {
+		t.Errorf("Expected hash and signing secret of key to be stored, got %q, %q", stored.APIKeyHash, stored.APISigningSecret)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/v1/accounts/5555e2d316ca1b6d40aaaaaa/keys", nil)
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	response = decodeResponse(t, rr)
+	if rr.Code != 200 || response.APIKey != "" || response.Account == nil || response.Account.HasAPIKey {
+		t.Errorf("Expected 200 without key, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if stored, _ := db.GetUserByID(person.ID.Hex()); stored.APIKeyHash != "" || stored.APISigningSecret != "" {
+		t.Errorf("Expected key to be removed, got %q, %q", stored.APIKeyHash, stored.APISigningSecret)
+	}
+
+	req, _ = http.NewRequest("POST", "/v1/accounts/5555e2d316ca1b6d40aaaaac/keys", nil)
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	checkError(t, decodeResponse(t, rr), handler.ErrorAccountNotFound, "not found")
+}
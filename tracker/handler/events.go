@@ -0,0 +1,192 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"pub-sub/logging"
+	"pub-sub/tracker/database"
+	"pub-sub/tracker/ratelimit"
+	"pub-sub/tracker/socket"
+
+	"github.com/gorilla/mux"
+)
+
+// maxBodySize limits the size of JSON request bodies
+const maxBodySize = 1 << 20
+
+//Statuses of single events in a batch
+const (
+	EventAccepted    = "accepted"
+	EventInactive    = "inactive"
+	EventNotFound    = "not_found"
+	EventInvalid     = "invalid"
+	EventUnavailable = "unavailable"
+	EventLimited     = "limited"
+)
+
+//EventRequest is a JSON body of a single event. Data can be any JSON value.
+type EventRequest struct {
+	AccountID string          `json:"accountId,omitempty"`
+	Data      json.RawMessage `json:"data"`
+}
+
+//BatchRequest is a JSON body of the batch endpoint
+type BatchRequest struct {
+	Events []EventRequest `json:"events"`
+}
+
+//BatchItemResult is the outcome of a single event in a batch
+type BatchItemResult struct {
+	Index     int        `json:"index"`
+	AccountID string     `json:"accountId"`
+	Status    string     `json:"status"`
+	Event     *EventBody `json:"event,omitempty"`
+	Error     *ErrorBody `json:"error,omitempty"`
+}
+
+// eventData converts JSON data to the string that is published. JSON strings are published
+// as they are, other values as compact JSON.
+func eventData(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", fmt.Errorf("Data not present")
+	}
+
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		if text == "" {
+			return "", fmt.Errorf("Data not present")
+		}
+		return text, nil
+	}
+
+	compacted := bytes.Buffer{}
+	if err := json.Compact(&compacted, raw); err != nil {
+		return "", err
+	}
+	return compacted.String(), nil
+}
+
+func decodeBody(w http.ResponseWriter, r *http.Request, body interface{}) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err := decoder.Decode(body); err != nil {
+		return fmt.Errorf("Invalid JSON body")
+	}
+	return nil
+}
+
+//NewEventHandler returns new HTTP handler that publishes a JSON event for account from URL.
+//Events are not limited when limiter is nil.
+func NewEventHandler(db database.Storage, publisher socket.Client, limiter RateLimiter) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accountID, ok := mux.Vars(r)["accountId"]
+		if !ok {
+			encodeJSON(w, r, http.StatusBadRequest, errorResponse(ErrorMissingAccountID, "AccountId not present"))
+			return
+		}
+
+		event := EventRequest{}
+		if err := decodeBody(w, r, &event); err != nil {
+			encodeJSON(w, r, http.StatusBadRequest, errorResponse(ErrorInvalidBody, err.Error()))
+			return
+		}
+		data, err := eventData(event.Data)
+		if err != nil {
+			encodeJSON(w, r, http.StatusBadRequest, errorResponse(ErrorMissingData, err.Error()))
+			return
+		}
+
+		statusCode, response := publishEvent(w, r, db, publisher, limiter, accountID, data)
+		encodeJSON(w, r, statusCode, response)
+	}
+}
+
+//NewBatchHandler returns new HTTP handler that publishes up to maxEvents events for any accounts.
+//Accounts are looked up in one database call and every event gets its own status. Events are
+//not limited when limiter is nil.
+func NewBatchHandler(db database.Storage, publisher socket.Client, limiter RateLimiter, maxEvents int) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		batch := BatchRequest{}
+		if err := decodeBody(w, r, &batch); err != nil {
+			encodeJSON(w, r, http.StatusBadRequest, errorResponse(ErrorInvalidBody, err.Error()))
+			return
+		}
+		if len(batch.Events) == 0 {
+			encodeJSON(w, r, http.StatusBadRequest, errorResponse(ErrorMissingEvents, "Events not present"))
+			return
+		}
+		if len(batch.Events) > maxEvents {
+			encodeJSON(w, r, http.StatusRequestEntityTooLarge, errorResponse(ErrorTooManyEvents, fmt.Sprintf("More than %d events", maxEvents)))
+			return
+		}
+
+		results := make([]BatchItemResult, len(batch.Events))
+		data := make([]string, len(batch.Events))
+		accountIDs := []string{}
+		for i, event := range batch.Events {
+			results[i] = BatchItemResult{Index: i, AccountID: event.AccountID}
+			if !database.ValidID(lookupID(event.AccountID)) {
+				results[i].Status = EventInvalid
+				results[i].Error = &ErrorBody{Code: ErrorInvalidAccountID, Message: "AccountId not valid"}
+				continue
+			}
+			value, err := eventData(event.Data)
+			if err != nil {
+				results[i].Status = EventInvalid
+				results[i].Error = &ErrorBody{Code: ErrorMissingData, Message: err.Error()}
+				continue
+			}
+			data[i] = value
+			accountIDs = append(accountIDs, lookupID(event.AccountID))
+		}
+
+		accounts, err := db.GetUsersByIDs(accountIDs)
+		if err != nil {
+			statusCode, response := databaseErrorResponse(err)
+			encodeJSON(w, r, statusCode, response)
+			return
+		}
+
+		for i := range results {
+			if results[i].Status != "" {
+				continue
+			}
+			account, ok := accounts[lookupID(results[i].AccountID)]
+			switch {
+			case !ok:
+				results[i].Status = EventNotFound
+			case !account.IsActive:
+				results[i].Status = EventInactive
+			default:
+				decision := ratelimit.Decision{}
+				if limiter != nil {
+					if decision = limiter.Allow(account); !decision.Allowed {
+						response := rateLimitedResponse(decision)
+						results[i].Status = EventLimited
+						results[i].Error = response.Error
+						continue
+					}
+				}
+
+				message := socket.NewMessage(results[i].AccountID, data[i])
+				logger := requestLogger(r).With(logging.F(logging.KeyAccountID, message.AccountID), logging.F(logging.KeyMessageID, message.ID))
+				if err := publisher.SendMessage(message); err != nil {
+					logger.Warn("Publishing event failed", logging.F("index", i), logging.Err(err))
+					if limiter != nil {
+						limiter.Refund(decision)
+					}
+					results[i].Status = EventUnavailable
+					results[i].Error = &ErrorBody{Code: ErrorPublisherUnavailable, Message: err.Error()}
+					continue
+				}
+				logger.Debug("Event accepted", logging.F("index", i))
+				results[i].Status = EventAccepted
+				results[i].Event = newEventBody(message)
+			}
+		}
+
+		encodeJSON(w, r, http.StatusOK, Response{Results: results})
+	}
+}
@@ -0,0 +1,308 @@
+package handler_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"pub-sub/tracker/database"
+	"pub-sub/tracker/handler"
+	"pub-sub/tracker/ratelimit"
+	"pub-sub/tracker/socket"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/golang/mock/gomock"
+	"github.com/gorilla/mux"
+)
+
+func TestEventHandler(t *testing.T) {
+	accountID := "5555e2d316ca1b6d40aaaaaa"
+	testCases := []struct {
+		desc           string
+		body           string
+		expectedCode   int
+		expectedStatus string
+		expectedError  string
+
+		returnPerson      database.Person
+		returnPersonError error
+		databaseCall      bool
+		expectedData      string
+	}{
+		{
+			desc:          "Body is not JSON",
+			body:          "data=test",
+			expectedCode:  400,
+			expectedError: handler.ErrorInvalidBody,
+		},
+		{
+			desc:          "Data not present",
+			body:          `{"value": "test"}`,
+			expectedCode:  400,
+			expectedError: handler.ErrorMissingData,
+		},
+		{
+			desc:              "User not in database",
+			body:              `{"data": "test"}`,
+			expectedCode:      404,
+			expectedError:     handler.ErrorAccountNotFound,
+			returnPersonError: database.ErrNotFound,
+			databaseCall:      true,
+		},
+		{
+			desc:           "Account is not active",
+			body:           `{"data": "test"}`,
+			expectedCode:   200,
+			expectedStatus: handler.EventInactive,
+			returnPerson:   database.Person{ID: bson.ObjectIdHex(accountID), IsActive: false},
+			databaseCall:   true,
+		},
+		{
+			desc:           "String data is published as it is",
+			body:           `{"data": "test"}`,
+			expectedCode:   202,
+			expectedStatus: handler.EventAccepted,
+			returnPerson:   database.Person{ID: bson.ObjectIdHex(accountID), IsActive: true},
+			databaseCall:   true,
+			expectedData:   "test",
+		},
+		{
+			desc:           "Structured data is published as JSON",
+			body:           `{"data": {"temperature": 21.5, "tags": ["a", "b"]}}`,
+			expectedCode:   202,
+			expectedStatus: handler.EventAccepted,
+			returnPerson:   database.Person{ID: bson.ObjectIdHex(accountID), IsActive: true},
+			databaseCall:   true,
+			expectedData:   `{"temperature":21.5,"tags":["a","b"]}`,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			req, _ := http.NewRequest("POST", "/v1/accounts/"+accountID+"/events", strings.NewReader(tC.body))
+			req = mux.SetURLVars(req, map[string]string{"accountId": accountID})
+
+			mockSocket := socket.NewMockClient(ctrl)
+			mockDatabase := database.NewMockStorage(ctrl)
+			if tC.databaseCall {
+				mockDatabase.EXPECT().GetUserByID(accountID).Return(tC.returnPerson, tC.returnPersonError)
+			}
+			if tC.expectedData != "" {
+				mockSocket.EXPECT().SendMessage(messageMatcher{accountID: accountID, data: tC.expectedData}).Return(nil)
+			}
+
+			rr := httptest.NewRecorder()
+			handler := http.HandlerFunc(handler.NewEventHandler(mockDatabase, mockSocket, nil))
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tC.expectedCode {
+				t.Errorf("Expected %d, got %d", tC.expectedCode, rr.Code)
+			}
+			response := decodeResponse(t, rr)
+			if response.Status != tC.expectedStatus {
+				t.Errorf("Expected status %q, got %q", tC.expectedStatus, response.Status)
+			}
+			if tC.expectedError != "" && (response.Error == nil || response.Error.Code != tC.expectedError) {
+				t.Errorf("Expected error %s, got %v", tC.expectedError, response.Error)
+			}
+		})
+	}
+}
+
+func TestEventHandlerPublishesAccountIDAsSent(t *testing.T) {
+	accountID := "5555E2D316CA1B6D40AAAAAA"
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	req, _ := http.NewRequest("POST", "/v1/accounts/"+accountID+"/events", strings.NewReader(`{"data": "test"}`))
+	req = mux.SetURLVars(req, map[string]string{"accountId": accountID})
+
+	mockSocket := socket.NewMockClient(ctrl)
+	mockDatabase := database.NewMockStorage(ctrl)
+	mockDatabase.EXPECT().GetUserByID(strings.ToLower(accountID)).Return(database.Person{ID: bson.ObjectIdHex(strings.ToLower(accountID)), IsActive: true}, nil)
+	sent := socket.Message{}
+	mockSocket.EXPECT().SendMessage(messageMatcher{accountID: accountID, data: "test", sent: &sent}).Return(nil)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(handler.NewEventHandler(mockDatabase, mockSocket, nil)).ServeHTTP(rr, req)
+
+	if rr.Code != 202 {
+		t.Fatalf("Expected 202, got %d", rr.Code)
+	}
+	response := decodeResponse(t, rr)
+	if response.Event == nil || response.Event.AccountID != accountID {
+		t.Errorf("Expected event for %s, got %v", accountID, response.Event)
+	}
+	if sent.AccountID != accountID {
+		t.Errorf("Expected published message for %s, got %s", accountID, sent.AccountID)
+	}
+}
+
+func TestBatchHandler(t *testing.T) {
+	active := "5555e2d316ca1b6d40aaaaaa"
+	inactive := "5555e2d316ca1b6d40aaaaab"
+	missing := "5555e2d316ca1b6d40aaaaac"
+	testCases := []struct {
+		desc            string
+		body            string
+		limiter         handler.RateLimiter
+		expectedCode    int
+		expectedError   string
+		expectedMessage string
+		expectedResults []handler.BatchItemResult
+
+		lookupIDs     []string
+		returnPeople  map[string]database.Person
+		returnError   error
+		published     []string
+		publishError  error
+		databaseCalls int
+		// publishedAccountID is the account of published messages, active if empty
+		publishedAccountID string
+	}{
+		{
+			desc:            "Body is not JSON",
+			body:            "events",
+			expectedCode:    400,
+			expectedError:   handler.ErrorInvalidBody,
+			expectedMessage: "Invalid JSON body",
+		},
+		{
+			desc:            "No events",
+			body:            `{"events": []}`,
+			expectedCode:    400,
+			expectedError:   handler.ErrorMissingEvents,
+			expectedMessage: "Events not present",
+		},
+		{
+			desc:            "Too many events",
+			body:            `{"events": [{"accountId": "a", "data": 1}, {"accountId": "b", "data": 2}, {"accountId": "c", "data": 3}, {"accountId": "d", "data": 4}, {"accountId": "e", "data": 5}]}`,
+			expectedCode:    413,
+			expectedError:   handler.ErrorTooManyEvents,
+			expectedMessage: "More than 4 events",
+		},
+		{
+			desc: "Every event gets its own status",
+			body: `{"events": [
+				{"accountId": "` + active + `", "data": "first"},
+				{"accountId": "` + inactive + `", "data": "second"},
+				{"accountId": "` + missing + `", "data": "third"},
+				{"accountId": "nonobjid", "data": "fourth"}
+			]}`,
+			expectedCode: 200,
+			expectedResults: []handler.BatchItemResult{
+				{Index: 0, AccountID: active, Status: handler.EventAccepted},
+				{Index: 1, AccountID: inactive, Status: handler.EventInactive},
+				{Index: 2, AccountID: missing, Status: handler.EventNotFound},
+				{Index: 3, AccountID: "nonobjid", Status: handler.EventInvalid, Error: &handler.ErrorBody{Code: handler.ErrorInvalidAccountID, Message: "AccountId not valid"}},
+			},
+			lookupIDs: []string{active, inactive, missing},
+			returnPeople: map[string]database.Person{
+				active:   {ID: bson.ObjectIdHex(active), IsActive: true},
+				inactive: {ID: bson.ObjectIdHex(inactive), IsActive: false},
+			},
+			published:     []string{"first"},
+			databaseCalls: 1,
+		},
+		{
+			desc:         "Account IDs in uppercase are found",
+			body:         `{"events": [{"accountId": "` + strings.ToUpper(active) + `", "data": "upper"}]}`,
+			expectedCode: 200,
+			expectedResults: []handler.BatchItemResult{
+				{Index: 0, AccountID: strings.ToUpper(active), Status: handler.EventAccepted},
+			},
+			lookupIDs:          []string{active},
+			returnPeople:       map[string]database.Person{active: {ID: bson.ObjectIdHex(active), IsActive: true}},
+			published:          []string{"upper"},
+			publishedAccountID: strings.ToUpper(active),
+			databaseCalls:      1,
+		},
+		{
+			desc:         "Publisher unavailable",
+			body:         `{"events": [{"accountId": "` + active + `", "data": {"a": 1}}]}`,
+			expectedCode: 200,
+			expectedResults: []handler.BatchItemResult{
+				{Index: 0, AccountID: active, Status: handler.EventUnavailable, Error: &handler.ErrorBody{Code: handler.ErrorPublisherUnavailable, Message: "outbound queue is full"}},
+			},
+			lookupIDs:     []string{active},
+			returnPeople:  map[string]database.Person{active: {ID: bson.ObjectIdHex(active), IsActive: true}},
+			published:     []string{`{"a":1}`},
+			publishError:  socket.ErrQueueFull,
+			databaseCalls: 1,
+		},
+		{
+			desc:         "Rate limited events",
+			body:         `{"events": [{"accountId": "` + active + `", "data": "first"}, {"accountId": "` + inactive + `", "data": "second"}]}`,
+			limiter:      &fakeLimiter{decision: ratelimit.Decision{Reason: ratelimit.ReasonDaily}},
+			expectedCode: 200,
+			expectedResults: []handler.BatchItemResult{
+				{Index: 0, AccountID: active, Status: handler.EventLimited, Error: &handler.ErrorBody{Code: handler.ErrorQuotaExceeded, Message: "Exceeded daily quota"}},
+				{Index: 1, AccountID: inactive, Status: handler.EventInactive},
+			},
+			lookupIDs: []string{active, inactive},
+			returnPeople: map[string]database.Person{
+				active:   {ID: bson.ObjectIdHex(active), IsActive: true},
+				inactive: {ID: bson.ObjectIdHex(inactive), IsActive: false},
+			},
+			databaseCalls: 1,
+		},
+		{
+			desc:            "Database error",
+			body:            `{"events": [{"accountId": "` + active + `", "data": "first"}]}`,
+			expectedCode:    503,
+			expectedError:   handler.ErrorDatabaseUnavailable,
+			expectedMessage: "database unavailable: no reachable servers",
+			lookupIDs:       []string{active},
+			returnError:     fmt.Errorf("%w: no reachable servers", database.ErrUnavailable),
+			databaseCalls:   1,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			req, _ := http.NewRequest("POST", "/v1/events:batch", strings.NewReader(tC.body))
+
+			mockSocket := socket.NewMockClient(ctrl)
+			mockDatabase := database.NewMockStorage(ctrl)
+			if tC.databaseCalls > 0 {
+				mockDatabase.EXPECT().GetUsersByIDs(tC.lookupIDs).Return(tC.returnPeople, tC.returnError).Times(tC.databaseCalls)
+			}
+			publishedAccountID := tC.publishedAccountID
+			if publishedAccountID == "" {
+				publishedAccountID = active
+			}
+			for _, data := range tC.published {
+				mockSocket.EXPECT().SendMessage(messageMatcher{accountID: publishedAccountID, data: data}).Return(tC.publishError)
+			}
+
+			rr := httptest.NewRecorder()
+			batchHandler := http.HandlerFunc(handler.NewBatchHandler(mockDatabase, mockSocket, tC.limiter, 4))
+			batchHandler.ServeHTTP(rr, req)
+
+			if rr.Code != tC.expectedCode {
+				t.Errorf("Expected %d, got %d", tC.expectedCode, rr.Code)
+			}
+			response := decodeResponse(t, rr)
+			checkError(t, response, tC.expectedError, tC.expectedMessage)
+
+			if len(response.Results) != len(tC.expectedResults) {
+				t.Fatalf("Expected %d results, got %d", len(tC.expectedResults), len(response.Results))
+			}
+			for i, result := range response.Results {
+				if (result.Status == handler.EventAccepted) != (result.Event != nil) {
+					t.Errorf("Expected event only for accepted result, got %v", result)
+				}
+				result.Event = nil
+				if !reflect.DeepEqual(result, tC.expectedResults[i]) {
+					t.Errorf("Expected %v, got %v", tC.expectedResults[i], result)
+				}
+			}
+		})
+	}
+}
@@ -1,74 +1,131 @@
 package handler
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 
+	"pub-sub/logging"
 	"pub-sub/tracker/database"
+	"pub-sub/tracker/ratelimit"
 	"pub-sub/tracker/socket"
 )
 
-//AccountCallResponse response definition
-type AccountCallResponse struct {
-	StatusCode   int
-	Error        string
-	ResponseText string
+//RateLimiter decides whether account may publish another event
+type RateLimiter interface {
+	Allow(account database.Person) ratelimit.Decision
+	//Refund gives back what Allow took for decision of an event that was not published
+	Refund(decision ratelimit.Decision)
 }
 
-func encodeJSON(data AccountCallResponse, w http.ResponseWriter) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(data.StatusCode)
-	if data.Error != "" {
-		w.Write([]byte(fmt.Sprintf(`{"error": "%s"}`, data.Error)))
-		return
+//NewAccountHandler returns new HTTP handler for account action. Events are not limited when limiter is nil.
+func NewAccountHandler(db database.Storage, publisher socket.Client, limiter RateLimiter) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accountID, ok := mux.Vars(r)["accountId"]
+		if !ok {
+			encodeJSON(w, r, http.StatusBadRequest, errorResponse(ErrorMissingAccountID, "AccountId not present"))
+			return
+		}
+		data := r.URL.Query().Get("data")
+		if data == "" {
+			encodeJSON(w, r, http.StatusBadRequest, errorResponse(ErrorMissingData, "Data not present"))
+			return
+		}
+
+		statusCode, response := publishEvent(w, r, db, publisher, limiter, accountID, data)
+		encodeJSON(w, r, statusCode, response)
 	}
+}
 
-	w.Write([]byte(fmt.Sprintf(`{"data": "%s"}`, data.ResponseText)))
+// accountIDVar returns accountId of the route URL in the form used for lookups
+func accountIDVar(r *http.Request) (string, bool) {
+	accountID, ok := mux.Vars(r)["accountId"]
+	return lookupID(accountID), ok
 }
 
-func parseURL(r *http.Request) (string, string, error) {
-	vars := mux.Vars(r)
-	accountID, ok := vars["accountId"]
-	if !ok {
-		return "", "", fmt.Errorf("AccountId not present")
+// lookupID returns accountID in lowercase, the form IDs are stored in, so that the same account
+// gets the same lookups, cache entries and idempotency keys. Events are still published with
+// the ID as the producer sent it, which is what subscribers filter on.
+func lookupID(accountID string) string {
+	return strings.ToLower(accountID)
+}
+
+// publishEvent sends data to publisher if the account exists, is active and is within its limits
+func publishEvent(w http.ResponseWriter, r *http.Request, db database.Storage, publisher socket.Client, limiter RateLimiter, accountID string, data string) (int, Response) {
+	account, err := db.GetUserByID(lookupID(accountID))
+	if err != nil {
+		return databaseErrorResponse(err)
+	}
+	if !account.IsActive {
+		return http.StatusOK, Response{Status: EventInactive, Message: "Account not active"}
+	}
+	decision := ratelimit.Decision{}
+	if limiter != nil {
+		decision = limiter.Allow(account)
+		setRateLimitHeaders(w, decision)
+		if !decision.Allowed {
+			return http.StatusTooManyRequests, rateLimitedResponse(decision)
+		}
 	}
 
-	data := r.URL.Query().Get("data")
-	if data == "" {
-		return "", "", fmt.Errorf("Data not present")
+	message := socket.NewMessage(accountID, data)
+	logger := requestLogger(r).With(logging.F(logging.KeyAccountID, accountID), logging.F(logging.KeyMessageID, message.ID))
+	if err := publisher.SendMessage(message); err != nil {
+		logger.Warn("Publishing event failed", logging.Err(err))
+		if limiter != nil {
+			limiter.Refund(decision)
+		}
+		return http.StatusServiceUnavailable, errorResponse(ErrorPublisherUnavailable, err.Error())
 	}
-	return accountID, data, nil
-}
 
-//NewAccountHandler returns new HTTP handler for account action
-func NewAccountHandler(db database.Storage, publisher socket.Client) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		accountID, data, err := parseURL(r)
+	logger.Debug("Event accepted")
+	return http.StatusAccepted, Response{Status: EventAccepted, Message: "Account accepted", Event: newEventBody(message)}
+}
 
-		if err != nil {
-			encodeJSON(AccountCallResponse{StatusCode: http.StatusBadRequest, Error: err.Error()}, w)
-			return
+// setRateLimitHeaders describes account's bucket, and when to retry if event was not allowed
+func setRateLimitHeaders(w http.ResponseWriter, decision ratelimit.Decision) {
+	if decision.Limit > 0 {
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(decision.Limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(decision.Reset)))
+	}
+	if !decision.Allowed {
+		retryAfter := ceilSeconds(decision.RetryAfter)
+		if retryAfter < 1 {
+			retryAfter = 1
 		}
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	}
+}
 
-		account, err := db.GetUserByID(accountID)
-		if err != nil {
-			if strings.Contains("not found", err.Error()) {
-				encodeJSON(AccountCallResponse{StatusCode: http.StatusNotFound, Error: err.Error()}, w)
-				return
-			}
-			encodeJSON(AccountCallResponse{StatusCode: http.StatusBadRequest, Error: err.Error()}, w)
-			return
-		}
-		if !account.IsActive {
-			encodeJSON(AccountCallResponse{StatusCode: http.StatusOK, ResponseText: "Account not active"}, w)
-			return
-		}
-		go publisher.SendMessage(accountID, data)
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+func rateLimitedResponse(decision ratelimit.Decision) Response {
+	if decision.Reason == ratelimit.ReasonRate {
+		return errorResponse(ErrorRateLimited, "Too many events")
+	}
+	return errorResponse(ErrorQuotaExceeded, fmt.Sprintf("Exceeded %s quota", decision.Reason))
+}
 
-		encodeJSON(AccountCallResponse{StatusCode: http.StatusAccepted, ResponseText: "Account acepted"}, w)
-		//time.Sleep(1 * time.Second)
+// databaseErrorResponse maps errors from database.Storage to HTTP status and error code
+func databaseErrorResponse(err error) (int, Response) {
+	switch {
+	case errors.Is(err, database.ErrInvalidID):
+		return http.StatusBadRequest, errorResponse(ErrorInvalidAccountID, err.Error())
+	case errors.Is(err, database.ErrNotFound):
+		return http.StatusNotFound, errorResponse(ErrorAccountNotFound, err.Error())
+	case errors.Is(err, database.ErrDuplicate):
+		return http.StatusConflict, errorResponse(ErrorAccountExists, err.Error())
+	case errors.Is(err, database.ErrUnavailable):
+		return http.StatusServiceUnavailable, errorResponse(ErrorDatabaseUnavailable, err.Error())
 	}
+	return http.StatusInternalServerError, errorResponse(ErrorDatabase, err.Error())
 }
@@ -1,46 +1,118 @@
 package handler_test
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"pub-sub/tracker/database"
 	"pub-sub/tracker/handler"
+	"pub-sub/tracker/ratelimit"
 	"pub-sub/tracker/socket"
 	"testing"
+	"time"
 
+	"github.com/globalsign/mgo/bson"
 	"github.com/golang/mock/gomock"
 	"github.com/gorilla/mux"
 )
 
+// messageMatcher matches socket messages by account and data, ID and timestamp are generated
+type messageMatcher struct {
+	accountID string
+	data      string
+	sent      *socket.Message
+}
+
+func (m messageMatcher) Matches(x interface{}) bool {
+	message, ok := x.(socket.Message)
+	if !ok || message.AccountID != m.accountID || message.Data != m.data {
+		return false
+	}
+	if m.sent != nil {
+		*m.sent = message
+	}
+	return true
+}
+
+func (m messageMatcher) String() string {
+	return fmt.Sprintf("is message for %s with data %s", m.accountID, m.data)
+}
+
+func decodeResponse(t *testing.T, rr *httptest.ResponseRecorder) handler.Response {
+	response := handler.Response{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Response is not valid JSON: %s, %s", err, rr.Body.String())
+	}
+	if response.Version != handler.SchemaVersion {
+		t.Errorf("Expected version %d, got %d", handler.SchemaVersion, response.Version)
+	}
+	if response.RequestID == "" || response.RequestID != rr.Header().Get(handler.RequestIDHeader) {
+		t.Errorf("Expected request ID in body and header, got %q and %q", response.RequestID, rr.Header().Get(handler.RequestIDHeader))
+	}
+	return response
+}
+
+func checkError(t *testing.T, response handler.Response, code string, message string) {
+	if code == "" {
+		if response.Error != nil {
+			t.Errorf("Expected no error, got %v", response.Error)
+		}
+		return
+	}
+	if response.Error == nil {
+		t.Fatalf("Expected error %s, got none", code)
+	}
+	if response.Error.Code != code || response.Error.Message != message {
+		t.Errorf("Expected error %s: %s, got %s: %s", code, message, response.Error.Code, response.Error.Message)
+	}
+}
+
 func TestMetricsHandler(t *testing.T) {
 	testCases := []struct {
-		desc             string
-		dataURL          string
-		addAccountID     bool
-		accountID        string
-		expectedCode     int
-		expectedResponse string
+		desc            string
+		dataURL         string
+		addAccountID    bool
+		accountID       string
+		expectedCode    int
+		expectedStatus  string
+		expectedError   string
+		expectedMessage string
 
 		returnPerson      database.Person
 		returnPersonError error
 		databaseCall      bool
 		socketCall        bool
+		socketError       error
 	}{
 		{
-			desc:             "AccountID not present",
-			dataURL:          "?data=test",
-			addAccountID:     false,
-			expectedCode:     400,
-			expectedResponse: `{"error": "AccountId not present"}`,
+			desc:            "AccountID not present",
+			dataURL:         "?data=test",
+			addAccountID:    false,
+			expectedCode:    400,
+			expectedError:   handler.ErrorMissingAccountID,
+			expectedMessage: "AccountId not present",
 		},
 		{
-			desc:             "Data not present",
-			dataURL:          "",
-			addAccountID:     true,
-			accountID:        "5555e2d316ca1b6d40aaaaaa",
-			expectedCode:     400,
-			expectedResponse: `{"error": "Data not present"}`,
+			desc:            "Data not present",
+			dataURL:         "",
+			addAccountID:    true,
+			accountID:       "5555e2d316ca1b6d40aaaaaa",
+			expectedCode:    400,
+			expectedError:   handler.ErrorMissingData,
+			expectedMessage: "Data not present",
+		},
+		{
+			desc:              "Account ID not valid",
+			dataURL:           "?data=test",
+			addAccountID:      true,
+			accountID:         "nonobjid",
+			expectedCode:      400,
+			expectedError:     handler.ErrorInvalidAccountID,
+			expectedMessage:   "ObjectID not valid",
+			returnPerson:      database.Person{},
+			returnPersonError: database.ErrInvalidID,
+			databaseCall:      true,
 		},
 		{
 			desc:              "User not in database",
@@ -48,9 +120,34 @@ func TestMetricsHandler(t *testing.T) {
 			addAccountID:      true,
 			accountID:         "5555e2d316ca1b6d40aaaaaa",
 			expectedCode:      404,
-			expectedResponse:  `{"error": "not found"}`,
+			expectedError:     handler.ErrorAccountNotFound,
+			expectedMessage:   "not found",
+			returnPerson:      database.Person{},
+			returnPersonError: database.ErrNotFound,
+			databaseCall:      true,
+		},
+		{
+			desc:              "Error containing not found is not ErrNotFound",
+			dataURL:           "?data=test",
+			addAccountID:      true,
+			accountID:         "5555e2d316ca1b6d40aaaaaa",
+			expectedCode:      500,
+			expectedError:     handler.ErrorDatabase,
+			expectedMessage:   "index not found",
 			returnPerson:      database.Person{},
-			returnPersonError: fmt.Errorf("not found"),
+			returnPersonError: fmt.Errorf("index not found"),
+			databaseCall:      true,
+		},
+		{
+			desc:              "Database is down",
+			dataURL:           "?data=test",
+			addAccountID:      true,
+			accountID:         "5555e2d316ca1b6d40aaaaaa",
+			expectedCode:      503,
+			expectedError:     handler.ErrorDatabaseUnavailable,
+			expectedMessage:   "database unavailable: no reachable servers",
+			returnPerson:      database.Person{},
+			returnPersonError: fmt.Errorf("%w: no reachable servers", database.ErrUnavailable),
 			databaseCall:      true,
 		},
 		{
@@ -58,39 +155,54 @@ func TestMetricsHandler(t *testing.T) {
 			dataURL:           "?data=test",
 			addAccountID:      true,
 			accountID:         "5555e2d316ca1b6d40aaaaaa",
-			expectedCode:      400,
-			expectedResponse:  `{"error": "error"}`,
+			expectedCode:      500,
+			expectedError:     handler.ErrorDatabase,
+			expectedMessage:   `error with "quotes"`,
 			returnPerson:      database.Person{},
-			returnPersonError: fmt.Errorf("error"),
+			returnPersonError: fmt.Errorf(`error with "quotes"`),
 			databaseCall:      true,
 		},
 		{
-			desc:             "Account is not active",
-			dataURL:          "?data=test",
-			addAccountID:     true,
-			accountID:        "5555e2d316ca1b6d40aaaaaa",
-			expectedCode:     200,
-			expectedResponse: `{"data": "Account not active"}`,
-			returnPerson:     database.Person{ID: "5555e2d316ca1b6d40aaaaaa", IsActive: false},
-			databaseCall:     true,
+			desc:            "Account is not active",
+			dataURL:         "?data=test",
+			addAccountID:    true,
+			accountID:       "5555e2d316ca1b6d40aaaaaa",
+			expectedCode:    200,
+			expectedStatus:  handler.EventInactive,
+			expectedMessage: "Account not active",
+			returnPerson:    database.Person{ID: "5555e2d316ca1b6d40aaaaaa", IsActive: false},
+			databaseCall:    true,
+		},
+		{
+			desc:            "Account is active",
+			dataURL:         "?data=test",
+			addAccountID:    true,
+			accountID:       "5555e2d316ca1b6d40aaaaaa",
+			expectedCode:    202,
+			expectedStatus:  handler.EventAccepted,
+			expectedMessage: "Account accepted",
+			returnPerson:    database.Person{ID: "5555e2d316ca1b6d40aaaaaa", IsActive: true},
+			databaseCall:    true,
+			socketCall:      true,
 		},
 		{
-			desc:             "Account is active",
-			dataURL:          "?data=test",
-			addAccountID:     true,
-			accountID:        "5555e2d316ca1b6d40aaaaaa",
-			expectedCode:     202,
-			expectedResponse: `{"data": "Account acepted"}`,
-			returnPerson:     database.Person{ID: "5555e2d316ca1b6d40aaaaaa", IsActive: true},
-			databaseCall:     true,
-			socketCall:       true,
+			desc:            "Publisher queue is full",
+			dataURL:         "?data=test",
+			addAccountID:    true,
+			accountID:       "5555e2d316ca1b6d40aaaaaa",
+			expectedCode:    503,
+			expectedError:   handler.ErrorPublisherUnavailable,
+			expectedMessage: "outbound queue is full",
+			returnPerson:    database.Person{ID: "5555e2d316ca1b6d40aaaaaa", IsActive: true},
+			databaseCall:    true,
+			socketCall:      true,
+			socketError:     socket.ErrQueueFull,
 		},
 	}
 	for _, tC := range testCases {
 		t.Run(tC.desc, func(t *testing.T) {
 			ctrl := gomock.NewController(t)
 			defer ctrl.Finish()
-			_ = tC
 			url := "/accountId"
 			url = fmt.Sprintf("%s%s", url, tC.dataURL)
 			req, _ := http.NewRequest("GET", url, nil)
@@ -103,21 +215,174 @@ func TestMetricsHandler(t *testing.T) {
 			if tC.databaseCall {
 				mockDatabase.EXPECT().GetUserByID(tC.accountID).Return(tC.returnPerson, tC.returnPersonError)
 			}
+			sent := socket.Message{}
 			if tC.socketCall {
-				mockSocket.EXPECT().SendMessage(tC.accountID, "test").AnyTimes()
+				mockSocket.EXPECT().SendMessage(messageMatcher{tC.accountID, "test", &sent}).Return(tC.socketError)
 			}
 
 			rr := httptest.NewRecorder()
-			handler := http.HandlerFunc(handler.NewAccountHandler(mockDatabase, mockSocket))
+			handler := http.HandlerFunc(handler.NewAccountHandler(mockDatabase, mockSocket, nil))
 			handler.ServeHTTP(rr, req)
 
-			if rr.Body.String() != tC.expectedResponse {
-				t.Errorf("Expected %s, got %s", tC.expectedResponse, rr.Body.String())
+			if rr.Code != tC.expectedCode {
+				t.Errorf("Expected %d, got %d", tC.expectedCode, rr.Code)
+			}
+
+			response := decodeResponse(t, rr)
+			checkError(t, response, tC.expectedError, tC.expectedMessage)
+			if response.Status != tC.expectedStatus {
+				t.Errorf("Expected status %q, got %q", tC.expectedStatus, response.Status)
+			}
+			if tC.expectedError == "" && response.Message != tC.expectedMessage {
+				t.Errorf("Expected message %q, got %q", tC.expectedMessage, response.Message)
+			}
+
+			if tC.expectedStatus != "accepted" {
+				if response.Event != nil {
+					t.Errorf("Expected no event, got %v", response.Event)
+				}
+				return
+			}
+			if response.Event == nil || response.Event.ID == "" || response.Event.ID != sent.ID || response.Event.Timestamp != sent.Timestamp {
+				t.Errorf("Expected event %v, got %v", sent, response.Event)
 			}
+		})
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	req, _ := http.NewRequest("POST", "/accountId", nil)
+	req.Header.Set(handler.RequestIDHeader, "request-1")
+
+	rr := httptest.NewRecorder()
+	handler.NewAccountHandler(database.NewMockStorage(ctrl), socket.NewMockClient(ctrl), nil)(rr, req)
+
+	response := decodeResponse(t, rr)
+	if response.RequestID != "request-1" {
+		t.Errorf("Expected request ID from header, got %s", response.RequestID)
+	}
+}
+
+// fakeLimiter returns decision for every event and records accounts it was asked about, and
+// decisions that got refunds
+type fakeLimiter struct {
+	decision ratelimit.Decision
+	accounts []string
+	refunded []ratelimit.Decision
+}
+
+func (l *fakeLimiter) Allow(account database.Person) ratelimit.Decision {
+	l.accounts = append(l.accounts, account.ID.Hex())
+	return l.decision
+}
+
+func (l *fakeLimiter) Refund(decision ratelimit.Decision) {
+	l.refunded = append(l.refunded, decision)
+}
+
+func TestRateLimitedEvent(t *testing.T) {
+	accountID := "5555e2d316ca1b6d40aaaaaa"
+	testCases := []struct {
+		desc            string
+		isActive        bool
+		decision        ratelimit.Decision
+		expectedCode    int
+		expectedError   string
+		expectedMessage string
+		expectedHeaders map[string]string
+		limiterCalls    int
+		publishError    error
+		refunds         int
+	}{
+		{
+			desc:            "Allowed event",
+			isActive:        true,
+			decision:        ratelimit.Decision{Allowed: true, Limit: 20, Remaining: 19, Reset: 50 * time.Millisecond},
+			expectedCode:    202,
+			expectedHeaders: map[string]string{"X-RateLimit-Limit": "20", "X-RateLimit-Remaining": "19", "X-RateLimit-Reset": "1", "Retry-After": ""},
+			limiterCalls:    1,
+		},
+		{
+			desc:            "Event that was not published is refunded",
+			isActive:        true,
+			decision:        ratelimit.Decision{Allowed: true, Limit: 20, Remaining: 19},
+			expectedCode:    503,
+			expectedError:   handler.ErrorPublisherUnavailable,
+			expectedMessage: "outbound queue is full",
+			limiterCalls:    1,
+			publishError:    socket.ErrQueueFull,
+			refunds:         1,
+		},
+		{
+			desc:            "Too many events",
+			isActive:        true,
+			decision:        ratelimit.Decision{Reason: ratelimit.ReasonRate, Limit: 20, Reset: 2 * time.Second, RetryAfter: 300 * time.Millisecond},
+			expectedCode:    429,
+			expectedError:   handler.ErrorRateLimited,
+			expectedMessage: "Too many events",
+			expectedHeaders: map[string]string{"X-RateLimit-Limit": "20", "X-RateLimit-Remaining": "0", "X-RateLimit-Reset": "2", "Retry-After": "1"},
+			limiterCalls:    1,
+		},
+		{
+			desc:            "Monthly quota exceeded",
+			isActive:        true,
+			decision:        ratelimit.Decision{Reason: ratelimit.ReasonMonthly, RetryAfter: 5 * time.Hour},
+			expectedCode:    429,
+			expectedError:   handler.ErrorQuotaExceeded,
+			expectedMessage: "Exceeded monthly quota",
+			expectedHeaders: map[string]string{"X-RateLimit-Limit": "", "Retry-After": "18000"},
+			limiterCalls:    1,
+		},
+		{
+			desc:            "Inactive account is not limited",
+			decision:        ratelimit.Decision{Reason: ratelimit.ReasonRate},
+			expectedCode:    200,
+			expectedHeaders: map[string]string{"X-RateLimit-Limit": "", "Retry-After": ""},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			req, _ := http.NewRequest("POST", "/accountId?data=test", nil)
+			req = mux.SetURLVars(req, map[string]string{"accountId": accountID})
+
+			mockDatabase := database.NewMockStorage(ctrl)
+			mockDatabase.EXPECT().GetUserByID(accountID).Return(database.Person{ID: bson.ObjectIdHex(accountID), IsActive: tC.isActive}, nil)
+			mockSocket := socket.NewMockClient(ctrl)
+			if tC.decision.Allowed {
+				mockSocket.EXPECT().SendMessage(messageMatcher{accountID: accountID, data: "test"}).Return(tC.publishError)
+			}
+			limiter := &fakeLimiter{decision: tC.decision}
+
+			rr := httptest.NewRecorder()
+			handler.NewAccountHandler(mockDatabase, mockSocket, limiter)(rr, req)
 
 			if rr.Code != tC.expectedCode {
 				t.Errorf("Expected %d, got %d", tC.expectedCode, rr.Code)
 			}
+			response := decodeResponse(t, rr)
+			checkError(t, response, tC.expectedError, tC.expectedMessage)
+			for header, expected := range tC.expectedHeaders {
+				if value := rr.Header().Get(header); value != expected {
+					t.Errorf("Expected %s %q, got %q", header, expected, value)
+				}
+			}
+			if len(limiter.accounts) != tC.limiterCalls {
+				t.Errorf("Expected %d limiter calls, got %v", tC.limiterCalls, limiter.accounts)
+			}
+			if len(limiter.refunded) != tC.refunds {
+				t.Errorf("Expected %d refunds, got %v", tC.refunds, limiter.refunded)
+			}
+			for _, decision := range limiter.refunded {
+				if decision != tC.decision {
+					t.Errorf("Expected refund of %+v, got %+v", tC.decision, decision)
+				}
+			}
 		})
 	}
 }
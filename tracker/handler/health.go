@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"net/http"
+
+	"pub-sub/tracker/socket"
+)
+
+//Statuses of health checks
+const (
+	HealthOK = "ok"
+	//HealthNotReady is the status of readiness check when a dependency is not ready
+	HealthNotReady = "not_ready"
+)
+
+//Pinger checks that a dependency responds
+type Pinger interface {
+	Ping() error
+}
+
+//PingerFunc is a function that is a Pinger
+type PingerFunc func() error
+
+//Ping calls f
+func (f PingerFunc) Ping() error {
+	return f()
+}
+
+//NewLivenessHandler returns new HTTP handler that answers as long as the tracker serves requests
+func NewLivenessHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		encodeJSON(w, r, http.StatusOK, Response{Status: HealthOK, Message: "Tracker is alive"})
+	}
+}
+
+//NewReadinessHandler returns new HTTP handler that answers 200 when database responds to a ping
+//and publisher is connected, and 503 otherwise. Database is not checked when it is nil.
+func NewReadinessHandler(db Pinger, publisher socket.Client) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ready := true
+		checks := map[string]string{}
+
+		if db != nil {
+			checks["database"] = HealthOK
+			if err := db.Ping(); err != nil {
+				ready = false
+				checks["database"] = err.Error()
+			}
+		}
+
+		checks["publisher"] = HealthOK
+		if status := publisher.Status(); status.State != socket.StateConnected {
+			ready = false
+			checks["publisher"] = status.State.String()
+			if status.LastError != nil {
+				checks["publisher"] += ": " + status.LastError.Error()
+			}
+		}
+
+		if !ready {
+			response := errorResponse(ErrorNotReady, "Tracker is not ready")
+			response.Status = HealthNotReady
+			response.Checks = checks
+			encodeJSON(w, r, http.StatusServiceUnavailable, response)
+			return
+		}
+		encodeJSON(w, r, http.StatusOK, Response{Status: HealthOK, Message: "Tracker is ready", Checks: checks})
+	}
+}
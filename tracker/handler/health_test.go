@@ -0,0 +1,102 @@
+package handler_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"pub-sub/tracker/handler"
+	"pub-sub/tracker/socket"
+	"reflect"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+)
+
+func TestLivenessHandler(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/healthz", nil)
+	rr := httptest.NewRecorder()
+	handler.NewLivenessHandler()(rr, req)
+
+	if rr.Code != 200 {
+		t.Errorf("Expected 200, got %d", rr.Code)
+	}
+	if response := decodeResponse(t, rr); response.Status != handler.HealthOK {
+		t.Errorf("Expected status %s, got %s", handler.HealthOK, response.Status)
+	}
+}
+
+func TestReadinessHandler(t *testing.T) {
+	testCases := []struct {
+		desc           string
+		db             handler.Pinger
+		status         socket.ConnectionStatus
+		expectedCode   int
+		expectedStatus string
+		expectedChecks map[string]string
+	}{
+		{
+			desc:           "Ready",
+			db:             handler.PingerFunc(func() error { return nil }),
+			status:         socket.ConnectionStatus{State: socket.StateConnected},
+			expectedCode:   200,
+			expectedStatus: handler.HealthOK,
+			expectedChecks: map[string]string{"database": "ok", "publisher": "ok"},
+		},
+		{
+			desc:           "Ready without database",
+			status:         socket.ConnectionStatus{State: socket.StateConnected},
+			expectedCode:   200,
+			expectedStatus: handler.HealthOK,
+			expectedChecks: map[string]string{"publisher": "ok"},
+		},
+		{
+			desc:           "Database not responding",
+			db:             handler.PingerFunc(func() error { return errors.New("no reachable servers") }),
+			status:         socket.ConnectionStatus{State: socket.StateConnected},
+			expectedCode:   503,
+			expectedStatus: handler.HealthNotReady,
+			expectedChecks: map[string]string{"database": "no reachable servers", "publisher": "ok"},
+		},
+		{
+			desc:           "Publisher disconnected",
+			db:             handler.PingerFunc(func() error { return nil }),
+			status:         socket.ConnectionStatus{State: socket.StateDisconnected, LastError: errors.New("connection refused")},
+			expectedCode:   503,
+			expectedStatus: handler.HealthNotReady,
+			expectedChecks: map[string]string{"database": "ok", "publisher": "disconnected: connection refused"},
+		},
+		{
+			desc:           "Publisher connecting",
+			status:         socket.ConnectionStatus{State: socket.StateConnecting},
+			expectedCode:   503,
+			expectedStatus: handler.HealthNotReady,
+			expectedChecks: map[string]string{"publisher": "connecting"},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			mockSocket := socket.NewMockClient(ctrl)
+			mockSocket.EXPECT().Status().Return(tC.status)
+
+			req, _ := http.NewRequest("GET", "/readyz", nil)
+			rr := httptest.NewRecorder()
+			handler.NewReadinessHandler(tC.db, mockSocket)(rr, req)
+
+			if rr.Code != tC.expectedCode {
+				t.Errorf("Expected %d, got %d", tC.expectedCode, rr.Code)
+			}
+			response := decodeResponse(t, rr)
+			if response.Status != tC.expectedStatus {
+				t.Errorf("Expected status %s, got %s", tC.expectedStatus, response.Status)
+			}
+			if !reflect.DeepEqual(response.Checks, tC.expectedChecks) {
+				t.Errorf("Expected checks %v, got %v", tC.expectedChecks, response.Checks)
+			}
+			if tC.expectedCode == 503 {
+				checkError(t, response, handler.ErrorNotReady, "Tracker is not ready")
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"pub-sub/logging"
+	"pub-sub/tracker/idempotency"
+)
+
+//Headers of idempotent requests
+const (
+	IdempotencyKeyHeader = "Idempotency-Key"
+	//IdempotentReplayedHeader is set on responses that are repeated for a retried request
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+)
+
+// maxIdempotencyKeyLength limits the size of idempotency keys
+const maxIdempotencyKeyLength = 255
+
+// responseRecorder passes response to http.ResponseWriter and keeps a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (rr *responseRecorder) WriteHeader(statusCode int) {
+	rr.statusCode = statusCode
+	rr.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rr *responseRecorder) Write(data []byte) (int, error) {
+	rr.body.Write(data)
+	return rr.ResponseWriter.Write(data)
+}
+
+//NewIdempotentHandler returns new HTTP handler that passes requests to next once per
+//Idempotency-Key header of an account, or of the authenticated sender on routes without
+//account, and answers retries with the saved response. Responses
+//with status 429 or 5xx, and batch responses with events that were limited or unavailable, are
+//not saved, since the request can succeed when it is retried. The key is released as well
+//when next panics. Requests without the header, or all of them when store is nil, are passed
+//to next.
+func NewIdempotentHandler(store idempotency.Store, next func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" || store == nil {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			encodeJSON(w, r, http.StatusBadRequest, errorResponse(ErrorInvalidIdempotencyKey, fmt.Sprintf("Idempotency key is longer than %d characters", maxIdempotencyKeyLength)))
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+		if err != nil {
+			encodeJSON(w, r, http.StatusBadRequest, errorResponse(ErrorInvalidBody, err.Error()))
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		fingerprint := requestFingerprint(r, body)
+
+		// keys are scoped to accounts, so that accounts can't see responses of each other, and
+		// keys of routes without account to whoever sent the request
+		scope, ok := accountIDVar(r)
+		if !ok {
+			scope = "batch"
+			if identity := requestIdentity(r); identity != "" {
+				scope += ":" + identity
+			}
+		}
+		storeKey := scope + ":" + key
+
+		record, found, err := store.Begin(storeKey, fingerprint)
+		if err != nil {
+			requestLogger(r).Error("Error reserving idempotency key", logging.F("idempotency_key", storeKey), logging.Err(err))
+			next(w, r)
+			return
+		}
+		if found {
+			replay(w, r, record, fingerprint)
+			return
+		}
+
+		defer func() {
+			if p := recover(); p != nil {
+				if err := store.Abort(storeKey); err != nil {
+					requestLogger(r).Error("Error releasing idempotency key", logging.F("idempotency_key", storeKey), logging.Err(err))
+				}
+				panic(p)
+			}
+		}()
+		recorder := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		next(recorder, r)
+
+		if retryable(recorder.statusCode, recorder.body.Bytes()) {
+			err = store.Abort(storeKey)
+		} else {
+			header := http.Header{}
+			for name, values := range recorder.Header() {
+				header[name] = values
+			}
+			err = store.Finish(storeKey, idempotency.Record{
+				Fingerprint: fingerprint,
+				StatusCode:  recorder.statusCode,
+				Header:      header,
+				Body:        recorder.body.Bytes(),
+			})
+		}
+		if err != nil {
+			requestLogger(r).Error("Error saving response for idempotency key", logging.F("idempotency_key", storeKey), logging.Err(err))
+		}
+	}
+}
+
+// retryable reports whether a retry of the request can get another response: it was rate
+// limited, failed on the server, or is a batch with events that were not published
+func retryable(statusCode int, body []byte) bool {
+	if statusCode == http.StatusTooManyRequests || statusCode >= 500 {
+		return true
+	}
+	response := Response{}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return false
+	}
+	for _, result := range response.Results {
+		if result.Status == EventUnavailable || result.Status == EventLimited {
+			return true
+		}
+	}
+	return false
+}
+
+// replay answers with the saved response, if it is for the same request and is done
+func replay(w http.ResponseWriter, r *http.Request, record idempotency.Record, fingerprint string) {
+	if record.Fingerprint != fingerprint {
+		encodeJSON(w, r, http.StatusUnprocessableEntity, errorResponse(ErrorIdempotencyKeyReused, "Idempotency key was used for another request"))
+		return
+	}
+	if record.Pending {
+		encodeJSON(w, r, http.StatusConflict, errorResponse(ErrorRequestInProgress, "Request with this idempotency key is in progress"))
+		return
+	}
+
+	for name, values := range record.Header {
+		w.Header()[name] = values
+	}
+	w.Header().Set(IdempotentReplayedHeader, "true")
+	w.WriteHeader(record.StatusCode)
+	w.Write(record.Body)
+}
+
+// requestFingerprint is the hash of method, URI and body of request
+func requestFingerprint(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n%s\n", r.Method, r.URL.RequestURI())
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,288 @@
+package handler_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"pub-sub/tracker/auth"
+	"pub-sub/tracker/database"
+	"pub-sub/tracker/handler"
+	"pub-sub/tracker/idempotency"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestIdempotentHandler(t *testing.T) {
+	type request struct {
+		url             string
+		key             string
+		body            string
+		expectedCode    int
+		expectedBody    string
+		expectedError   string
+		expectedMessage string
+		replayed        bool
+	}
+	testCases := []struct {
+		desc          string
+		statusCode    int
+		requests      []request
+		expectedCalls int
+	}{
+		{
+			desc:       "Retry gets the same response",
+			statusCode: 202,
+			requests: []request{
+				{url: "/5555e2d316ca1b6d40aaaaaa", key: "retry", body: "test", expectedCode: 202, expectedBody: "response 1"},
+				{url: "/5555e2d316ca1b6d40aaaaaa", key: "retry", body: "test", expectedCode: 202, expectedBody: "response 1", replayed: true},
+			},
+			expectedCalls: 1,
+		},
+		{
+			desc:       "Requests without key",
+			statusCode: 202,
+			requests: []request{
+				{url: "/5555e2d316ca1b6d40aaaaaa", body: "test", expectedCode: 202, expectedBody: "response 1"},
+				{url: "/5555e2d316ca1b6d40aaaaaa", body: "test", expectedCode: 202, expectedBody: "response 2"},
+			},
+			expectedCalls: 2,
+		},
+		{
+			desc:       "Same key of other account",
+			statusCode: 202,
+			requests: []request{
+				{url: "/5555e2d316ca1b6d40aaaaaa", key: "retry", body: "test", expectedCode: 202, expectedBody: "response 1"},
+				{url: "/5555e2d316ca1b6d40aaaaab", key: "retry", body: "test", expectedCode: 202, expectedBody: "response 2"},
+			},
+			expectedCalls: 2,
+		},
+		{
+			desc:       "Same key for other request",
+			statusCode: 202,
+			requests: []request{
+				{url: "/5555e2d316ca1b6d40aaaaaa", key: "retry", body: "test", expectedCode: 202, expectedBody: "response 1"},
+				{url: "/5555e2d316ca1b6d40aaaaaa", key: "retry", body: "other", expectedCode: 422, expectedError: handler.ErrorIdempotencyKeyReused, expectedMessage: "Idempotency key was used for another request"},
+			},
+			expectedCalls: 1,
+		},
+		{
+			desc:       "Failed requests are not saved",
+			statusCode: 503,
+			requests: []request{
+				{url: "/5555e2d316ca1b6d40aaaaaa", key: "retry", body: "test", expectedCode: 503, expectedBody: "response 1"},
+				{url: "/5555e2d316ca1b6d40aaaaaa", key: "retry", body: "test", expectedCode: 503, expectedBody: "response 2"},
+			},
+			expectedCalls: 2,
+		},
+		{
+			desc:       "Client errors are saved",
+			statusCode: 404,
+			requests: []request{
+				{url: "/5555e2d316ca1b6d40aaaaaa", key: "retry", body: "test", expectedCode: 404, expectedBody: "response 1"},
+				{url: "/5555e2d316ca1b6d40aaaaaa", key: "retry", body: "test", expectedCode: 404, expectedBody: "response 1", replayed: true},
+			},
+			expectedCalls: 1,
+		},
+		{
+			desc: "Too long key",
+			requests: []request{
+				{url: "/5555e2d316ca1b6d40aaaaaa", key: strings.Repeat("k", 256), body: "test", expectedCode: 400, expectedError: handler.ErrorInvalidIdempotencyKey, expectedMessage: "Idempotency key is longer than 255 characters"},
+			},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			calls := 0
+			next := func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				w.Header().Set("X-Call", fmt.Sprint(calls))
+				w.WriteHeader(tC.statusCode)
+				fmt.Fprintf(w, "response %d", calls)
+			}
+			store := idempotency.NewMemoryStore(10, time.Minute, time.Now)
+			r := mux.NewRouter()
+			r.HandleFunc("/{accountId}", handler.NewIdempotentHandler(store, next)).Methods("POST")
+
+			for i, request := range tC.requests {
+				req, _ := http.NewRequest("POST", request.url, strings.NewReader(request.body))
+				if request.key != "" {
+					req.Header.Set(handler.IdempotencyKeyHeader, request.key)
+				}
+				rr := httptest.NewRecorder()
+				r.ServeHTTP(rr, req)
+
+				if rr.Code != request.expectedCode {
+					t.Errorf("Request %d: expected %d, got %d", i, request.expectedCode, rr.Code)
+				}
+				if request.expectedError != "" {
+					checkError(t, decodeResponse(t, rr), request.expectedError, request.expectedMessage)
+					continue
+				}
+				if rr.Body.String() != request.expectedBody {
+					t.Errorf("Request %d: expected %q, got %q", i, request.expectedBody, rr.Body.String())
+				}
+				if replayed := rr.Header().Get(handler.IdempotentReplayedHeader) == "true"; replayed != request.replayed {
+					t.Errorf("Request %d: expected replayed %t, got %t", i, request.replayed, replayed)
+				}
+				if rr.Header().Get("X-Call") == "" {
+					t.Errorf("Request %d: expected headers of response", i)
+				}
+			}
+			if calls != tC.expectedCalls {
+				t.Errorf("Expected %d calls, got %d", tC.expectedCalls, calls)
+			}
+		})
+	}
+}
+
+func TestIdempotentHandlerInProgress(t *testing.T) {
+	store := idempotency.NewMemoryStore(10, time.Minute, time.Now)
+	started, finish := make(chan struct{}), make(chan struct{})
+	next := func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-finish
+		w.WriteHeader(202)
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/{accountId}", handler.NewIdempotentHandler(store, next)).Methods("POST")
+
+	newRequest := func() *http.Request {
+		req, _ := http.NewRequest("POST", "/5555e2d316ca1b6d40aaaaaa", strings.NewReader("test"))
+		req.Header.Set(handler.IdempotencyKeyHeader, "retry")
+		return req
+	}
+	done := make(chan struct{})
+	go func() {
+		r.ServeHTTP(httptest.NewRecorder(), newRequest())
+		close(done)
+	}()
+	<-started
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, newRequest())
+	if rr.Code != 409 {
+		t.Errorf("Expected 409, got %d", rr.Code)
+	}
+	checkError(t, decodeResponse(t, rr), handler.ErrorRequestInProgress, "Request with this idempotency key is in progress")
+	close(finish)
+	<-done
+}
+
+func TestIdempotentHandlerReleasesKeyOnPanic(t *testing.T) {
+	store := idempotency.NewMemoryStore(10, time.Minute, time.Now)
+	calls := 0
+	next := func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			panic(http.ErrAbortHandler)
+		}
+		w.WriteHeader(202)
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/{accountId}", handler.NewIdempotentHandler(store, next)).Methods("POST")
+
+	serve := func() (rr *httptest.ResponseRecorder, recovered interface{}) {
+		defer func() {
+			recovered = recover()
+		}()
+		req, _ := http.NewRequest("POST", "/5555e2d316ca1b6d40aaaaaa", strings.NewReader("test"))
+		req.Header.Set(handler.IdempotencyKeyHeader, "retry")
+		rr = httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr, nil
+	}
+	if _, recovered := serve(); recovered != http.ErrAbortHandler {
+		t.Fatalf("Expected panic to be passed on, got %v", recovered)
+	}
+	rr, _ := serve()
+	if rr.Code != 202 || calls != 2 {
+		t.Errorf("Expected retry to be handled, got %d after %d calls", rr.Code, calls)
+	}
+}
+
+func TestIdempotentHandlerBatchResults(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		status        string
+		expectedCalls int
+	}{
+		{desc: "Accepted events are saved", status: handler.EventAccepted, expectedCalls: 1},
+		{desc: "Invalid events are saved", status: handler.EventInvalid, expectedCalls: 1},
+		{desc: "Unavailable events are not saved", status: handler.EventUnavailable, expectedCalls: 2},
+		{desc: "Limited events are not saved", status: handler.EventLimited, expectedCalls: 2},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			calls := 0
+			next := func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				w.WriteHeader(200)
+				fmt.Fprintf(w, `{"results": [{"index": 0, "status": "accepted"}, {"index": 1, "status": %q}]}`, tC.status)
+			}
+			store := idempotency.NewMemoryStore(10, time.Minute, time.Now)
+			r := mux.NewRouter()
+			r.HandleFunc("/v1/events:batch", handler.NewIdempotentHandler(store, next)).Methods("POST")
+
+			for i := 0; i < 2; i++ {
+				req, _ := http.NewRequest("POST", "/v1/events:batch", strings.NewReader(`{"events": []}`))
+				req.Header.Set(handler.IdempotencyKeyHeader, "retry")
+				r.ServeHTTP(httptest.NewRecorder(), req)
+			}
+			if calls != tC.expectedCalls {
+				t.Errorf("Expected %d calls, got %d", tC.expectedCalls, calls)
+			}
+		})
+	}
+}
+
+// keyRecorder is an idempotency.Store that records reserved keys
+type keyRecorder struct {
+	idempotency.Store
+	keys []string
+}
+
+func (kr *keyRecorder) Begin(key string, fingerprint string) (idempotency.Record, bool, error) {
+	kr.keys = append(kr.keys, key)
+	return kr.Store.Begin(key, fingerprint)
+}
+
+func TestIdempotentHandlerScopesBatchesBySender(t *testing.T) {
+	adminKey := "admin-key"
+	testCases := []struct {
+		desc        string
+		auth        bool
+		expectedKey string
+	}{
+		{desc: "Admin key", auth: true, expectedKey: "batch:admin:retry"},
+		{desc: "Authentication disabled", expectedKey: "batch:retry"},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			store := &keyRecorder{Store: idempotency.NewMemoryStore(10, time.Minute, time.Now)}
+			next := func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(200)
+			}
+			r := mux.NewRouter()
+			r.HandleFunc("/v1/events:batch", handler.NewIdempotentHandler(store, next)).Methods("POST")
+			authenticator := handler.NewAuthenticator(database.NewMemoryStorage(nil), auth.NewVerifier(time.Minute, auth.NewMemoryReplayStore(time.Now), time.Now), auth.Credentials{KeyHash: auth.HashKey(adminKey)})
+			authenticator.SetEnabled(tC.auth)
+			r.Use(authenticator.Middleware)
+
+			req, _ := http.NewRequest("POST", "/v1/events:batch", strings.NewReader(`{"events": []}`))
+			req.Header.Set(handler.IdempotencyKeyHeader, "retry")
+			req.Header.Set(auth.KeyHeader, adminKey)
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+
+			if rr.Code != 200 {
+				t.Fatalf("Expected 200, got %d", rr.Code)
+			}
+			if len(store.keys) != 1 || store.keys[0] != tC.expectedKey {
+				t.Errorf("Expected key %s, got %v", tC.expectedKey, store.keys)
+			}
+		})
+	}
+}
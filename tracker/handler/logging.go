@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"pub-sub/logging"
+)
+
+type requestIDKey struct{}
+
+//RequestLogger is a mux middleware that gives every request an ID and a logger with the ID in
+//its context, and logs every served request
+type RequestLogger struct {
+	logger *logging.Logger
+}
+
+//NewRequestLogger returns new RequestLogger that writes to logger
+func NewRequestLogger(logger *logging.Logger) *RequestLogger {
+	return &RequestLogger{logger: logger}
+}
+
+//Middleware passes request to next with request ID and logger in its context
+func (l *RequestLogger) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := requestID(r)
+		logger := l.logger.With(logging.F(logging.KeyRequestID, id))
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		r = r.WithContext(logging.NewContext(ctx, logger))
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		logger.Info("Request served",
+			logging.F("method", r.Method),
+			logging.F("path", r.URL.Path),
+			logging.F("status", recorder.statusCode),
+			logging.F("duration", time.Since(start)),
+		)
+	})
+}
+
+// requestLogger returns logger of r, it discards records of requests that didn't pass RequestLogger
+func requestLogger(r *http.Request) *logging.Logger {
+	return logging.FromContext(r.Context())
+}
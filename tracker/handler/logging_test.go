@@ -0,0 +1,92 @@
+package handler_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"pub-sub/logging"
+	"pub-sub/tracker/database"
+	"pub-sub/tracker/handler"
+	"pub-sub/tracker/socket"
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/golang/mock/gomock"
+	"github.com/gorilla/mux"
+)
+
+func TestRequestLogger(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		requestID string
+	}{
+		{
+			desc:      "Request ID from header",
+			requestID: "request-1",
+		},
+		{
+			desc: "Generated request ID",
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			accountID := "5555e2d316ca1b6d40aaaaaa"
+			mockDatabase := database.NewMockStorage(ctrl)
+			mockDatabase.EXPECT().GetUserByID(accountID).Return(database.Person{ID: bson.ObjectIdHex(accountID), IsActive: true}, nil)
+			mockSocket := socket.NewMockClient(ctrl)
+			var sent socket.Message
+			mockSocket.EXPECT().SendMessage(messageMatcher{accountID: accountID, data: "data", sent: &sent}).Return(socket.ErrQueueFull)
+
+			recorder := logging.NewRecorder()
+			r := mux.NewRouter()
+			r.Use(handler.NewRequestLogger(logging.New(recorder)).Middleware)
+			r.HandleFunc("/{accountId}", handler.NewAccountHandler(mockDatabase, mockSocket, nil)).Methods("POST")
+
+			req, _ := http.NewRequest("POST", "/"+accountID+"?data=data", nil)
+			if tC.requestID != "" {
+				req.Header.Set(handler.RequestIDHeader, tC.requestID)
+			}
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+
+			response := decodeResponse(t, rr)
+			if tC.requestID != "" && response.RequestID != tC.requestID {
+				t.Errorf("Expected request ID %s, got %s", tC.requestID, response.RequestID)
+			}
+
+			records := recorder.Records()
+			if len(records) != 3 {
+				t.Fatalf("Expected 3 records, got %v", records)
+			}
+			for _, record := range records {
+				if id, _ := record.Field(logging.KeyRequestID); id != response.RequestID {
+					t.Errorf("Expected request_id %s in %q, got %v", response.RequestID, record.Message, id)
+				}
+			}
+
+			failed := recorder.Find("Publishing event failed")
+			if len(failed) != 1 || failed[0].Level != logging.LevelWarn {
+				t.Fatalf("Expected failed event to be logged as warning, got %v", failed)
+			}
+			if id, _ := failed[0].Field(logging.KeyMessageID); id != sent.ID {
+				t.Errorf("Expected message_id %s, got %v", sent.ID, id)
+			}
+			if account, _ := failed[0].Field(logging.KeyAccountID); account != accountID {
+				t.Errorf("Expected account_id %s, got %v", accountID, account)
+			}
+
+			if len(recorder.Find("Request failed")) != 1 {
+				t.Errorf("Expected response with status 503 to be logged as failed")
+			}
+			served := recorder.Find("Request served")
+			if len(served) != 1 {
+				t.Fatalf("Expected served request to be logged, got %v", records)
+			}
+			if status, _ := served[0].Field("status"); status != http.StatusServiceUnavailable {
+				t.Errorf("Expected status 503, got %v", status)
+			}
+		})
+	}
+}
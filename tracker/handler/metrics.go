@@ -0,0 +1,167 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"pub-sub/tracker/database"
+	"pub-sub/tracker/metrics"
+	"pub-sub/tracker/socket"
+)
+
+//Results of sending messages to publisher
+const (
+	MessageSent    = "sent"
+	MessageFailed  = "failed"
+	MessageDropped = "dropped"
+)
+
+//Metrics are the Prometheus metrics of the tracker
+type Metrics struct {
+	registry *metrics.Registry
+	requests *metrics.Counter
+	duration *metrics.Histogram
+	lookups  *metrics.Histogram
+	messages *metrics.Counter
+}
+
+//NewMetrics registers metrics of requests, user lookups and messages in registry
+func NewMetrics(registry *metrics.Registry) *Metrics {
+	return &Metrics{
+		registry: registry,
+		requests: registry.NewCounter("tracker_http_requests_total", "Number of HTTP requests by route and status.", "route", "method", "status"),
+		duration: registry.NewHistogram("tracker_http_request_duration_seconds", "Time spent handling HTTP requests.", metrics.DefaultBuckets, "route", "method"),
+		lookups:  registry.NewHistogram("tracker_user_lookup_duration_seconds", "Time spent looking up users, including the cache.", metrics.DefaultBuckets, "operation"),
+		messages: registry.NewCounter("tracker_publisher_messages_total", "Number of messages given to the publisher client by result.", "result"),
+	}
+}
+
+// statusRecorder remembers status code of the response
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (sr *statusRecorder) WriteHeader(statusCode int) {
+	sr.statusCode = statusCode
+	sr.ResponseWriter.WriteHeader(statusCode)
+}
+
+//Middleware counts requests and measures how long they take, by the route template
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		m.duration.Observe(time.Since(start).Seconds(), route, r.Method)
+		m.requests.Inc(route, r.Method, strconv.Itoa(recorder.statusCode))
+	})
+}
+
+// timedStorage measures user lookups of Storage
+type timedStorage struct {
+	database.Storage
+	lookups *metrics.Histogram
+}
+
+//Storage returns db that measures how long user lookups take
+func (m *Metrics) Storage(db database.Storage) database.Storage {
+	return &timedStorage{Storage: db, lookups: m.lookups}
+}
+
+func (ts *timedStorage) GetUserByID(userID string) (database.Person, error) {
+	defer ts.observe("GetUserByID", time.Now())
+	return ts.Storage.GetUserByID(userID)
+}
+
+func (ts *timedStorage) GetUsersByIDs(userIDs []string) (map[string]database.Person, error) {
+	defer ts.observe("GetUsersByIDs", time.Now())
+	return ts.Storage.GetUsersByIDs(userIDs)
+}
+
+func (ts *timedStorage) observe(operation string, start time.Time) {
+	ts.lookups.Observe(time.Since(start).Seconds(), operation)
+}
+
+// countingClient counts messages sent with Client
+type countingClient struct {
+	socket.Client
+	messages *metrics.Counter
+}
+
+//Publisher returns publisher that counts sent, failed and dropped messages, and registers metrics of
+//its queue and connection
+func (m *Metrics) Publisher(publisher socket.Client) socket.Client {
+	m.registry.NewGaugeFunc("tracker_publisher_queue_depth", "Number of messages waiting to be written to the publisher.", func() float64 {
+		return float64(publisher.Status().QueueDepth)
+	})
+	m.registry.NewCounterFunc("tracker_publisher_reconnects_total", "Number of times the publisher connection was restored.", func() float64 {
+		return float64(publisher.Status().Reconnects)
+	})
+	m.registry.NewGaugeFunc("tracker_publisher_connected", "1 when the publisher is connected, 0 otherwise.", func() float64 {
+		if publisher.Status().State == socket.StateConnected {
+			return 1
+		}
+		return 0
+	})
+	return &countingClient{Client: publisher, messages: m.messages}
+}
+
+func (cc *countingClient) SendMessage(message socket.Message) error {
+	err := cc.Client.SendMessage(message)
+	switch {
+	case err == socket.ErrDropped:
+		cc.messages.Inc(MessageDropped)
+	case err != nil:
+		cc.messages.Inc(MessageFailed)
+	default:
+		cc.messages.Inc(MessageSent)
+	}
+	return err
+}
+
+//Cache registers metrics of cache lookups
+func (m *Metrics) Cache(cache *database.CachedStorage) {
+	m.registry.NewCounterFunc("tracker_cache_hits_total", "Number of users found in the cache, including unknown users.", func() float64 {
+		stats := cache.Stats()
+		return float64(stats.Hits + stats.NegativeHits)
+	})
+	m.registry.NewCounterFunc("tracker_cache_misses_total", "Number of users looked up in the database.", func() float64 {
+		return float64(cache.Stats().Misses)
+	})
+	m.registry.NewGaugeFunc("tracker_cache_hit_ratio", "Fraction of lookups answered from the cache since start.", func() float64 {
+		stats := cache.Stats()
+		hits := float64(stats.Hits + stats.NegativeHits)
+		if total := hits + float64(stats.Misses); total > 0 {
+			return hits / total
+		}
+		return 0
+	})
+	m.registry.NewGaugeFunc("tracker_cache_entries", "Number of users in the cache.", func() float64 {
+		return float64(cache.Stats().Entries)
+	})
+}
+
+//View registers metrics of the users and absent IDs kept by view
+func (m *Metrics) View(view *database.AccountView) {
+	m.registry.NewGaugeFunc("tracker_view_users", "Number of users kept in memory by the account view.", func() float64 {
+		return float64(view.Stats().Users)
+	})
+	m.registry.NewGaugeFunc("tracker_view_absent_ids", "Number of IDs remembered as not found by the account view.", func() float64 {
+		return float64(view.Stats().AbsentIDs)
+	})
+	m.registry.NewCounterFunc("tracker_view_absent_evictions_total", "Number of absent IDs forgotten because the account view remembers too many.", func() float64 {
+		return float64(view.Stats().AbsentEvicted)
+	})
+}
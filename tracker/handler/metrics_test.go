@@ -0,0 +1,178 @@
+package handler_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"pub-sub/tracker/database"
+	"pub-sub/tracker/handler"
+	"pub-sub/tracker/metrics"
+	"pub-sub/tracker/socket"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/golang/mock/gomock"
+	"github.com/gorilla/mux"
+)
+
+func scrape(t *testing.T, r *mux.Router) string {
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != 200 {
+		t.Fatalf("Expected 200 from /metrics, got %d", rr.Code)
+	}
+	return rr.Body.String()
+}
+
+func checkSamples(t *testing.T, scraped string, expected []string) {
+	lines := map[string]bool{}
+	for _, line := range strings.Split(scraped, "\n") {
+		lines[line] = true
+	}
+	for _, sample := range expected {
+		if !lines[sample] {
+			t.Errorf("Expected sample %s in\n%s", sample, scraped)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	active := "5555e2d316ca1b6d40aaaaaa"
+	inactive := "5555e2d316ca1b6d40aaaaab"
+	missing := "5555e2d316ca1b6d40aaaaac"
+	mockDatabase := database.NewMockStorage(ctrl)
+	mockDatabase.EXPECT().GetUserByID(active).Return(database.Person{ID: bson.ObjectIdHex(active), IsActive: true}, nil).Times(4)
+	mockDatabase.EXPECT().GetUserByID(inactive).Return(database.Person{ID: bson.ObjectIdHex(inactive)}, nil)
+	mockDatabase.EXPECT().GetUserByID(missing).Return(database.Person{}, database.ErrNotFound)
+	mockSocket := socket.NewMockClient(ctrl)
+	gomock.InOrder(
+		mockSocket.EXPECT().SendMessage(gomock.Any()).Return(nil).Times(2),
+		mockSocket.EXPECT().SendMessage(gomock.Any()).Return(socket.ErrQueueFull),
+		mockSocket.EXPECT().SendMessage(gomock.Any()).Return(socket.ErrDropped),
+	)
+	mockSocket.EXPECT().Status().Return(socket.ConnectionStatus{State: socket.StateConnected, QueueDepth: 3, Reconnects: 4}).AnyTimes()
+
+	registry := metrics.NewRegistry()
+	m := handler.NewMetrics(registry)
+	r := mux.NewRouter()
+	r.HandleFunc("/{accountId}", handler.NewAccountHandler(m.Storage(mockDatabase), m.Publisher(mockSocket), nil)).Methods("POST")
+	r.Handle("/metrics", registry.Handler()).Methods("GET")
+	r.Use(m.Middleware)
+
+	for _, accountID := range []string{active, active, inactive, missing, active, active} {
+		req, _ := http.NewRequest("POST", "/"+accountID+"?data=test", nil)
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	checkSamples(t, scrape(t, r), []string{
+		`tracker_http_requests_total{route="/{accountId}",method="POST",status="202"} 2`,
+		`tracker_http_requests_total{route="/{accountId}",method="POST",status="200"} 1`,
+		`tracker_http_requests_total{route="/{accountId}",method="POST",status="404"} 1`,
+		`tracker_http_requests_total{route="/{accountId}",method="POST",status="503"} 2`,
+		`tracker_http_request_duration_seconds_count{route="/{accountId}",method="POST"} 6`,
+		`tracker_http_request_duration_seconds_bucket{route="/{accountId}",method="POST",le="+Inf"} 6`,
+		`tracker_user_lookup_duration_seconds_count{operation="GetUserByID"} 6`,
+		`tracker_publisher_messages_total{result="sent"} 2`,
+		`tracker_publisher_messages_total{result="failed"} 1`,
+		`tracker_publisher_messages_total{result="dropped"} 1`,
+		`tracker_publisher_queue_depth 3`,
+		`tracker_publisher_reconnects_total 4`,
+		`tracker_publisher_connected 1`,
+	})
+
+	// the previous scrape is counted too
+	checkSamples(t, scrape(t, r), []string{
+		`tracker_http_requests_total{route="/metrics",method="GET",status="200"} 1`,
+	})
+}
+
+func TestCacheMetrics(t *testing.T) {
+	person := database.Person{ID: bson.ObjectIdHex("5555e2d316ca1b6d40aaaaaa"), IsActive: true}
+	cache := database.NewCachedStorage(database.NewMemoryStorage([]database.Person{person}), database.CacheOptions{Size: 10, TTL: time.Minute})
+
+	registry := metrics.NewRegistry()
+	handler.NewMetrics(registry).Cache(cache)
+	r := mux.NewRouter()
+	r.Handle("/metrics", registry.Handler())
+
+	for _, userID := range []string{person.ID.Hex(), person.ID.Hex(), person.ID.Hex(), "5555e2d316ca1b6d40aaaaab"} {
+		cache.GetUserByID(userID)
+	}
+
+	checkSamples(t, scrape(t, r), []string{
+		`tracker_cache_hits_total 2`,
+		`tracker_cache_misses_total 2`,
+		`tracker_cache_hit_ratio 0.5`,
+		`tracker_cache_entries 1`,
+	})
+}
+
+// idleFeed is a change feed without changes
+type idleFeed struct {
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (f *idleFeed) Next() (database.ChangeEvent, error) {
+	<-f.closed
+	return database.ChangeEvent{}, database.ErrFeedInvalidated
+}
+
+func (f *idleFeed) Close() error {
+	f.once.Do(func() { close(f.closed) })
+	return nil
+}
+
+func TestViewMetrics(t *testing.T) {
+	person := database.Person{ID: bson.ObjectIdHex("5555e2d316ca1b6d40aaaaaa"), IsActive: true}
+	source := func(interface{}) (database.ChangeFeed, error) { return &idleFeed{closed: make(chan struct{})}, nil }
+	view := database.NewAccountView(database.NewMemoryStorage([]database.Person{person}), source, time.Hour, nil)
+	defer view.Close()
+
+	registry := metrics.NewRegistry()
+	handler.NewMetrics(registry).View(view)
+	r := mux.NewRouter()
+	r.Handle("/metrics", registry.Handler())
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !view.Live() {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected view to be live")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	view.GetUserByID("5555e2d316ca1b6d40aaaaab")
+
+	checkSamples(t, scrape(t, r), []string{
+		`tracker_view_users 1`,
+		`tracker_view_absent_ids 1`,
+		`tracker_view_absent_evictions_total 0`,
+	})
+}
+
+func TestTimedStorage(t *testing.T) {
+	registry := metrics.NewRegistry()
+	m := handler.NewMetrics(registry)
+	db := m.Storage(database.NewMemoryStorage(nil))
+
+	if _, err := db.GetUsersByIDs([]string{"5555e2d316ca1b6d40aaaaaa"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetUserByID("nonobjid"); !errors.Is(err, database.ErrInvalidID) {
+		t.Errorf("Expected errors of storage to be returned, got %v", err)
+	}
+
+	r := mux.NewRouter()
+	r.Handle("/metrics", registry.Handler())
+	checkSamples(t, scrape(t, r), []string{
+		`tracker_user_lookup_duration_seconds_count{operation="GetUsersByIDs"} 1`,
+		`tracker_user_lookup_duration_seconds_count{operation="GetUserByID"} 1`,
+	})
+}
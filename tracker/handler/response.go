@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+
+	"pub-sub/logging"
+	"pub-sub/tracker/socket"
+)
+
+//SchemaVersion is the version of the response schema, it changes only with breaking changes
+const SchemaVersion = 1
+
+//RequestIDHeader is read from requests and set on every response
+const RequestIDHeader = "X-Request-ID"
+
+//Machine-readable error codes
+const (
+	ErrorInvalidBody           = "invalid_body"
+	ErrorMissingAccountID      = "missing_account_id"
+	ErrorMissingData           = "missing_data"
+	ErrorMissingEvents         = "missing_events"
+	ErrorTooManyEvents         = "too_many_events"
+	ErrorAccountNotFound       = "account_not_found"
+	ErrorInvalidAccountID      = "invalid_account_id"
+	ErrorInvalidAccount        = "invalid_account"
+	ErrorAccountExists         = "account_exists"
+	ErrorInvalidQuery          = "invalid_query"
+	ErrorDatabase              = "database_error"
+	ErrorDatabaseUnavailable   = "database_unavailable"
+	ErrorPublisherUnavailable  = "publisher_unavailable"
+	ErrorRateLimited           = "rate_limited"
+	ErrorQuotaExceeded         = "quota_exceeded"
+	ErrorMissingCredentials    = "missing_credentials"
+	ErrorInvalidCredentials    = "invalid_credentials"
+	ErrorExpiredSignature      = "expired_signature"
+	ErrorReplayedRequest       = "replayed_request"
+	ErrorForbidden             = "forbidden"
+	ErrorInternal              = "internal_error"
+	ErrorInvalidIdempotencyKey = "invalid_idempotency_key"
+	ErrorIdempotencyKeyReused  = "idempotency_key_reused"
+	ErrorRequestInProgress     = "request_in_progress"
+	ErrorNotReady              = "not_ready"
+)
+
+//Response is the JSON body of every tracker response. Fields that don't apply are omitted.
+type Response struct {
+	Version   int    `json:"version"`
+	RequestID string `json:"requestId"`
+	//Status is one of the Event* statuses for publish requests and Health* for health checks
+	Status  string            `json:"status,omitempty"`
+	Message string            `json:"message,omitempty"`
+	Event   *EventBody        `json:"event,omitempty"`
+	Results []BatchItemResult `json:"results,omitempty"`
+	Account *AccountBody      `json:"account,omitempty"`
+	//Accounts is a page of accounts, Next is the value of after parameter for the next page
+	Accounts []AccountBody `json:"accounts,omitempty"`
+	Next     string        `json:"next,omitempty"`
+	//APIKey is a new API key of account, it is returned only once
+	APIKey string `json:"apiKey,omitempty"`
+	//Checks describes every dependency of the readiness check
+	Checks map[string]string `json:"checks,omitempty"`
+	Error  *ErrorBody        `json:"error,omitempty"`
+}
+
+//ErrorBody describes why a request failed
+type ErrorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+//EventBody describes an accepted event
+type EventBody struct {
+	ID        string `json:"id"`
+	AccountID string `json:"accountId"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+func newEventBody(message socket.Message) *EventBody {
+	return &EventBody{
+		ID:        message.ID,
+		AccountID: message.AccountID,
+		Timestamp: message.Timestamp,
+	}
+}
+
+func errorResponse(code string, message string) Response {
+	return Response{Error: &ErrorBody{Code: code, Message: message}}
+}
+
+// requestID returns ID given by RequestLogger, ID sent by client, or a new one
+func requestID(r *http.Request) string {
+	if id, ok := r.Context().Value(requestIDKey{}).(string); ok {
+		return id
+	}
+	if id := r.Header.Get(RequestIDHeader); id != "" {
+		return id
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func encodeJSON(w http.ResponseWriter, r *http.Request, statusCode int, response Response) {
+	response.Version = SchemaVersion
+	response.RequestID = requestID(r)
+	if statusCode >= http.StatusInternalServerError && response.Error != nil {
+		requestLogger(r).Error("Request failed", logging.F("code", response.Error.Code), logging.F(logging.KeyError, response.Error.Message))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(RequestIDHeader, response.RequestID)
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,217 @@
+package idempotency
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+//Record is the response to the first request with an idempotency key
+type Record struct {
+	//Fingerprint identifies the request, retries must have the same one
+	Fingerprint string `bson:"fingerprint"`
+	//Pending is true while the first request is still being handled
+	Pending    bool        `bson:"pending"`
+	StatusCode int         `bson:"statusCode,omitempty"`
+	Header     http.Header `bson:"header,omitempty"`
+	Body       []byte      `bson:"body,omitempty"`
+}
+
+//Store remembers responses by idempotency key for a window of time
+type Store interface {
+	//Begin reserves key for request with fingerprint. When key is already reserved it returns
+	//its Record and true instead.
+	Begin(key string, fingerprint string) (Record, bool, error)
+	//Finish saves response of the request that reserved key
+	Finish(key string, record Record) error
+	//Abort releases key, so that the request can be retried
+	Abort(key string) error
+}
+
+// pendingLease is how long a key stays reserved for a request that is being handled. After it
+// the key can be reserved again, so that a tracker that stopped while handling a request
+// doesn't block retries until the window is over.
+const pendingLease = time.Minute
+
+// leaseEnd is when a key reserved at now can be reserved again, unless it is finished first
+func leaseEnd(now time.Time, window time.Duration) time.Time {
+	if window < pendingLease {
+		return now.Add(window)
+	}
+	return now.Add(pendingLease)
+}
+
+type memoryEntry struct {
+	key     string
+	record  Record
+	expires time.Time
+}
+
+//MemoryStore is a Store that keeps at most size records in memory, least recently used records
+//are forgotten first. Pending records are only forgotten once they expire, so the store can hold
+//more than size records while that many requests are being handled.
+type MemoryStore struct {
+	size   int
+	window time.Duration
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+//NewMemoryStore returns new MemoryStore that remembers records for window
+func NewMemoryStore(size int, window time.Duration, now func() time.Time) Store {
+	return &MemoryStore{size: size, window: window, now: now, entries: map[string]*list.Element{}, lru: list.New()}
+}
+
+//Begin reserves key, unless it is reserved and not expired. Pending records expire after a
+//lease of a minute, finished ones after window.
+func (ms *MemoryStore) Begin(key string, fingerprint string) (Record, bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := ms.now()
+	if element, ok := ms.entries[key]; ok {
+		entry := element.Value.(*memoryEntry)
+		if now.Before(entry.expires) {
+			ms.lru.MoveToFront(element)
+			return entry.record, true, nil
+		}
+		ms.remove(element)
+	}
+
+	entry := &memoryEntry{key: key, record: Record{Fingerprint: fingerprint, Pending: true}, expires: leaseEnd(now, ms.window)}
+	ms.entries[key] = ms.lru.PushFront(entry)
+	ms.evict(now)
+	return Record{}, false, nil
+}
+
+//Finish saves record of key for window, if it wasn't forgotten in the meantime
+func (ms *MemoryStore) Finish(key string, record Record) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if element, ok := ms.entries[key]; ok {
+		entry := element.Value.(*memoryEntry)
+		entry.record = record
+		entry.expires = ms.now().Add(ms.window)
+	}
+	return nil
+}
+
+//Abort forgets key
+func (ms *MemoryStore) Abort(key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if element, ok := ms.entries[key]; ok {
+		ms.remove(element)
+	}
+	return nil
+}
+
+// evict forgets least recently used records over size, skipping pending ones that are not
+// expired, so that a retry can't be handled twice. ms.mu must be held.
+func (ms *MemoryStore) evict(now time.Time) {
+	element := ms.lru.Back()
+	for ms.size > 0 && ms.lru.Len() > ms.size && element != nil {
+		previous := element.Prev()
+		if entry := element.Value.(*memoryEntry); !entry.record.Pending || !now.Before(entry.expires) {
+			ms.remove(element)
+		}
+		element = previous
+	}
+}
+
+// remove removes entry of element, ms.mu must be held
+func (ms *MemoryStore) remove(element *list.Element) {
+	ms.lru.Remove(element)
+	delete(ms.entries, element.Value.(*memoryEntry).key)
+}
+
+type mongoRecord struct {
+	Key     string    `bson:"_id"`
+	Record  Record    `bson:",inline"`
+	Expires time.Time `bson:"expires"`
+}
+
+//MongoStore is a Store that keeps records in a MongoDB collection, so that they are shared by
+//all trackers
+type MongoStore struct {
+	Collection *mgo.Collection
+	window     time.Duration
+	now        func() time.Time
+}
+
+//NewMongoStore returns new MongoStore that remembers records for window. Collection gets a TTL
+//index, so MongoDB removes expired records.
+func NewMongoStore(db *mgo.Session, table, collection string, window time.Duration, now func() time.Time) (Store, error) {
+	dbCollection := db.DB(table).C(collection)
+	index := mgo.Index{Key: []string{"expires"}, ExpireAfter: time.Second}
+	if err := dbCollection.EnsureIndex(index); err != nil {
+		return nil, err
+	}
+	return &MongoStore{Collection: dbCollection, window: window, now: now}, nil
+}
+
+//Begin reserves key by inserting a pending record, which fails when key is already reserved.
+//Pending records expire after a lease of a minute, finished ones after window.
+func (ms *MongoStore) Begin(key string, fingerprint string) (Record, bool, error) {
+	now := ms.now()
+	pending := mongoRecord{Key: key, Record: Record{Fingerprint: fingerprint, Pending: true}, Expires: leaseEnd(now, ms.window)}
+
+	// MongoDB removes expired records only once a minute, so an expired record may still be there
+	for attempt := 0; attempt < 2; attempt++ {
+		err := ms.Collection.Insert(pending)
+		if err == nil {
+			return Record{}, false, nil
+		}
+		if !mgo.IsDup(err) {
+			return Record{}, false, err
+		}
+
+		existing := mongoRecord{}
+		err = ms.Collection.FindId(key).One(&existing)
+		if err == mgo.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return Record{}, false, err
+		}
+		if now.Before(existing.Expires) {
+			return existing.Record, true, nil
+		}
+		if err := ms.Collection.Remove(bson.M{"_id": key, "expires": existing.Expires}); err != nil && err != mgo.ErrNotFound {
+			return Record{}, false, err
+		}
+	}
+	return Record{}, false, fmt.Errorf("idempotency key %s keeps changing", key)
+}
+
+//Finish saves record of key for window
+func (ms *MongoStore) Finish(key string, record Record) error {
+	update := bson.M{"$set": bson.M{
+		"fingerprint": record.Fingerprint,
+		"pending":     record.Pending,
+		"statusCode":  record.StatusCode,
+		"header":      record.Header,
+		"body":        record.Body,
+		"expires":     ms.now().Add(ms.window),
+	}}
+	if err := ms.Collection.UpdateId(key, update); err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+//Abort removes record of key
+func (ms *MongoStore) Abort(key string) error {
+	if err := ms.Collection.RemoveId(key); err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package idempotency_test
+
+import (
+	"net/http"
+	"pub-sub/tracker/idempotency"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo"
+)
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// newStore returns store with a window of a minute and a function that removes its records
+type newStore func(t *testing.T, now func() time.Time) (idempotency.Store, func())
+
+func begin(t *testing.T, store idempotency.Store, key string, fingerprint string) (idempotency.Record, bool) {
+	record, found, err := store.Begin(key, fingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record, found
+}
+
+// testStore checks behaviour that every Store has
+func testStore(t *testing.T, open newStore) {
+	done := idempotency.Record{
+		Fingerprint: "first",
+		StatusCode:  202,
+		Header:      http.Header{"Content-Type": []string{"application/json"}},
+		Body:        []byte(`{"status": "accepted"}`),
+	}
+	testCases := []struct {
+		desc string
+		test func(t *testing.T, store idempotency.Store, clock *fakeClock)
+	}{
+		{
+			desc: "Returns pending record until request is finished",
+			test: func(t *testing.T, store idempotency.Store, clock *fakeClock) {
+				if _, found := begin(t, store, "account:key", "first"); found {
+					t.Fatal("Expected new key to be reserved")
+				}
+				record, found := begin(t, store, "account:key", "second")
+				if !found || !record.Pending || record.Fingerprint != "first" {
+					t.Errorf("Expected pending record of first request, got %+v, %t", record, found)
+				}
+
+				if err := store.Finish("account:key", done); err != nil {
+					t.Fatal(err)
+				}
+				record, found = begin(t, store, "account:key", "first")
+				if !found || !reflect.DeepEqual(record, done) {
+					t.Errorf("Expected %+v, got %+v, %t", done, record, found)
+				}
+			},
+		},
+		{
+			desc: "Keys are independent",
+			test: func(t *testing.T, store idempotency.Store, clock *fakeClock) {
+				begin(t, store, "account:key", "first")
+				if _, found := begin(t, store, "other:key", "first"); found {
+					t.Error("Expected key of other account to be reserved")
+				}
+			},
+		},
+		{
+			desc: "Aborted key can be reserved again",
+			test: func(t *testing.T, store idempotency.Store, clock *fakeClock) {
+				begin(t, store, "account:key", "first")
+				if err := store.Abort("account:key"); err != nil {
+					t.Fatal(err)
+				}
+				if _, found := begin(t, store, "account:key", "first"); found {
+					t.Error("Expected aborted key to be reserved again")
+				}
+				if err := store.Abort("missing:key"); err != nil {
+					t.Errorf("Expected no error for missing key, got %v", err)
+				}
+			},
+		},
+		{
+			desc: "Pending record can be reserved again after lease",
+			test: func(t *testing.T, store idempotency.Store, clock *fakeClock) {
+				begin(t, store, "account:key", "first")
+				clock.Advance(59 * time.Second)
+				if record, found := begin(t, store, "account:key", "first"); !found || !record.Pending {
+					t.Errorf("Expected pending record within lease, got %+v, %t", record, found)
+				}
+				clock.Advance(time.Second)
+				if _, found := begin(t, store, "account:key", "first"); found {
+					t.Error("Expected key to be reserved again after lease")
+				}
+			},
+		},
+		{
+			desc: "Window starts when request is finished",
+			test: func(t *testing.T, store idempotency.Store, clock *fakeClock) {
+				begin(t, store, "account:key", "first")
+				clock.Advance(30 * time.Second)
+				store.Finish("account:key", done)
+				clock.Advance(45 * time.Second)
+				if _, found := begin(t, store, "account:key", "first"); !found {
+					t.Error("Expected finished record within window")
+				}
+			},
+		},
+		{
+			desc: "Forgets records after window",
+			test: func(t *testing.T, store idempotency.Store, clock *fakeClock) {
+				begin(t, store, "account:key", "first")
+				store.Finish("account:key", done)
+				clock.Advance(30 * time.Second)
+				if _, found := begin(t, store, "account:key", "first"); !found {
+					t.Error("Expected record within window")
+				}
+				clock.Advance(31 * time.Second)
+				if _, found := begin(t, store, "account:key", "second"); found {
+					t.Error("Expected expired key to be reserved again")
+				}
+			},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			clock := &fakeClock{now: time.Date(2020, time.June, 11, 12, 0, 0, 0, time.UTC)}
+			store, cleanup := open(t, clock.Now)
+			defer cleanup()
+			tC.test(t, store, clock)
+		})
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, func(t *testing.T, now func() time.Time) (idempotency.Store, func()) {
+		return idempotency.NewMemoryStore(10, time.Minute, now), func() {}
+	})
+}
+
+func TestMongoStore(t *testing.T) {
+	testStore(t, func(t *testing.T, now func() time.Time) (idempotency.Store, func()) {
+		session, err := mgo.Dial("mongodb://127.0.0.1:27017")
+		if err != nil {
+			t.Fatal(err)
+		}
+		store, err := idempotency.NewMongoStore(session, "tracker_test", "idempotency", time.Minute, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store, func() {
+			session.DB("tracker_test").C("idempotency").DropCollection()
+			session.Close()
+		}
+	})
+}
+
+// finish reserves key and saves a response for it
+func finish(t *testing.T, store idempotency.Store, key string) {
+	begin(t, store, key, key)
+	if err := store.Finish(key, idempotency.Record{Fingerprint: key, StatusCode: 202}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	store := idempotency.NewMemoryStore(2, time.Minute, time.Now)
+	finish(t, store, "first")
+	finish(t, store, "second")
+	begin(t, store, "first", "first")
+	finish(t, store, "third")
+
+	if _, found := begin(t, store, "second", "second"); found {
+		t.Error("Expected least recently used key to be forgotten")
+	}
+	if _, found := begin(t, store, "third", "third"); !found {
+		t.Error("Expected recently used key to be remembered")
+	}
+}
+
+func TestMemoryStoreKeepsPendingRecords(t *testing.T) {
+	store := idempotency.NewMemoryStore(1, time.Minute, time.Now)
+	begin(t, store, "first", "first")
+	begin(t, store, "second", "second")
+	if record, found := begin(t, store, "first", "first"); !found || !record.Pending {
+		t.Fatalf("Expected pending record to be remembered over size, got %v, %t", record, found)
+	}
+
+	// finished records make room, pending ones stay
+	store.Finish("first", idempotency.Record{Fingerprint: "first", StatusCode: 202})
+	begin(t, store, "third", "third")
+	if record, found := begin(t, store, "second", "second"); !found || !record.Pending {
+		t.Errorf("Expected pending record to be remembered, got %v, %t", record, found)
+	}
+	if _, found := begin(t, store, "first", "first"); found {
+		t.Error("Expected finished record to be forgotten")
+	}
+}
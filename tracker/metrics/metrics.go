@@ -0,0 +1,272 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//DefaultBuckets are upper bounds of histogram buckets in seconds, for latencies of requests
+var DefaultBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// metric is a family of samples with the same name
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+//Registry holds metrics and writes them in the Prometheus text exposition format
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+//NewRegistry returns new empty Registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+//Write writes all metrics to w, in the order they were registered
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	metrics := append([]metric{}, r.metrics...)
+	r.mu.Unlock()
+
+	buffered := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(buffered)
+	}
+	return buffered.Flush()
+}
+
+//Handler returns HTTP handler that serves the metrics for Prometheus
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(w)
+	})
+}
+
+// family holds the parts that metrics with labels have in common
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (f *family) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, escapeHelp(f.help), f.name, f.kind)
+}
+
+// key joins label values, so that they can be used as a map key
+func (f *family) key(values []string) string {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s has labels %v, got values %v", f.name, f.labels, values))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelPairs formats labels with values, and extra label pairs that are already formatted
+func (f *family) labelPairs(values []string, extra ...string) string {
+	pairs := []string{}
+	for i, label := range f.labels {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, label, escapeValue(values[i])))
+	}
+	pairs = append(pairs, extra...)
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+//Counter is a value that only goes up, with a separate value for every combination of labels
+type Counter struct {
+	family
+	mu     sync.Mutex
+	values map[string]float64
+	keys   map[string][]string
+}
+
+//NewCounter registers new Counter with label names
+func (r *Registry) NewCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{family: family{name, help, "counter", labels}, values: map[string]float64{}, keys: map[string][]string{}}
+	r.register(c)
+	return c
+}
+
+//Inc adds 1 to counter with label values
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+//Add adds delta to counter with label values
+func (c *Counter) Add(delta float64, values ...string) {
+	key := c.key(values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.keys[key]; !ok {
+		c.keys[key] = append([]string{}, values...)
+	}
+	c.values[key] += delta
+}
+
+//Value returns value of counter with label values
+func (c *Counter) Value(values ...string) float64 {
+	key := c.key(values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[key]
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeHeader(w)
+	for _, key := range sortedKeys(c.keys) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelPairs(c.keys[key]), formatValue(c.values[key]))
+	}
+}
+
+type histogramValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+//Histogram counts observations in buckets, with separate buckets for every combination of labels
+type Histogram struct {
+	family
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogramValue
+	keys    map[string][]string
+}
+
+//NewHistogram registers new Histogram with upper bounds of buckets and label names
+func (r *Registry) NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	sorted := append([]float64{}, buckets...)
+	sort.Float64s(sorted)
+	h := &Histogram{
+		family:  family{name, help, "histogram", labels},
+		buckets: sorted,
+		values:  map[string]*histogramValue{},
+		keys:    map[string][]string{},
+	}
+	r.register(h)
+	return h
+}
+
+//Observe adds value to histogram with label values
+func (h *Histogram) Observe(value float64, values ...string) {
+	key := h.key(values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	v, ok := h.values[key]
+	if !ok {
+		v = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = v
+		h.keys[key] = append([]string{}, values...)
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			v.counts[i]++
+		}
+	}
+	v.count++
+	v.sum += value
+}
+
+//Count returns the number of observations of histogram with label values
+func (h *Histogram) Count(values ...string) uint64 {
+	key := h.key(values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if v, ok := h.values[key]; ok {
+		return v.count
+	}
+	return 0
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.writeHeader(w)
+	for _, key := range sortedKeys(h.keys) {
+		values, v := h.keys[key], h.values[key]
+		for i, bound := range h.buckets {
+			le := fmt.Sprintf(`le="%s"`, formatValue(bound))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(values, le), v.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(values, `le="+Inf"`), v.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelPairs(values), formatValue(v.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelPairs(values), v.count)
+	}
+}
+
+// valueFunc is a metric without labels whose value is read when metrics are written
+type valueFunc struct {
+	family
+	value func() float64
+}
+
+//NewCounterFunc registers a counter whose value is returned by value, for counters that are
+//kept elsewhere
+func (r *Registry) NewCounterFunc(name string, help string, value func() float64) {
+	r.register(&valueFunc{family{name: name, help: help, kind: "counter"}, value})
+}
+
+//NewGaugeFunc registers a gauge, a value that goes up and down, that is returned by value
+func (r *Registry) NewGaugeFunc(name string, help string, value func() float64) {
+	r.register(&valueFunc{family{name: name, help: help, kind: "gauge"}, value})
+}
+
+func (v *valueFunc) write(w *bufio.Writer) {
+	v.writeHeader(w)
+	fmt.Fprintf(w, "%s %s\n", v.name, formatValue(v.value()))
+}
+
+func sortedKeys(keys map[string][]string) []string {
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	valueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func escapeValue(value string) string {
+	return valueEscaper.Replace(value)
+}
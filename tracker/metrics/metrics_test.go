@@ -0,0 +1,127 @@
+package metrics_test
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"pub-sub/tracker/metrics"
+	"testing"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		register func(r *metrics.Registry)
+		expected string
+	}{
+		{
+			desc: "Counter with labels",
+			register: func(r *metrics.Registry) {
+				c := r.NewCounter("requests_total", "Number of requests.", "route", "status")
+				c.Inc("/{accountId}", "202")
+				c.Inc("/{accountId}", "202")
+				c.Add(3, "/healthz", "200")
+			},
+			expected: `# HELP requests_total Number of requests.
+# TYPE requests_total counter
+requests_total{route="/healthz",status="200"} 3
+requests_total{route="/{accountId}",status="202"} 2
+`,
+		},
+		{
+			desc: "Counter without labels",
+			register: func(r *metrics.Registry) {
+				r.NewCounter("events_total", "Number of events.").Inc()
+			},
+			expected: `# HELP events_total Number of events.
+# TYPE events_total counter
+events_total 1
+`,
+		},
+		{
+			desc: "Histogram",
+			register: func(r *metrics.Registry) {
+				h := r.NewHistogram("duration_seconds", "Duration.", []float64{1, 0.1}, "operation")
+				h.Observe(0.05, "get")
+				h.Observe(0.5, "get")
+				h.Observe(2, "get")
+			},
+			expected: `# HELP duration_seconds Duration.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{operation="get",le="0.1"} 1
+duration_seconds_bucket{operation="get",le="1"} 2
+duration_seconds_bucket{operation="get",le="+Inf"} 3
+duration_seconds_sum{operation="get"} 2.55
+duration_seconds_count{operation="get"} 3
+`,
+		},
+		{
+			desc: "Functions",
+			register: func(r *metrics.Registry) {
+				r.NewGaugeFunc("queue_depth", "Messages in queue.", func() float64 { return 7 })
+				r.NewCounterFunc("reconnects_total", "Reconnects.", func() float64 { return 2 })
+				r.NewGaugeFunc("hit_ratio", "Ratio.", func() float64 { return math.NaN() })
+			},
+			expected: `# HELP queue_depth Messages in queue.
+# TYPE queue_depth gauge
+queue_depth 7
+# HELP reconnects_total Reconnects.
+# TYPE reconnects_total counter
+reconnects_total 2
+# HELP hit_ratio Ratio.
+# TYPE hit_ratio gauge
+hit_ratio NaN
+`,
+		},
+		{
+			desc: "Escaped values",
+			register: func(r *metrics.Registry) {
+				r.NewCounter("errors_total", "Errors\nby message.", "message").Inc("say \"hi\"\\")
+			},
+			expected: `# HELP errors_total Errors\nby message.
+# TYPE errors_total counter
+errors_total{message="say \"hi\"\\"} 1
+`,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			registry := metrics.NewRegistry()
+			tC.register(registry)
+
+			written := bytes.Buffer{}
+			if err := registry.Write(&written); err != nil {
+				t.Fatal(err)
+			}
+			if written.String() != tC.expected {
+				t.Errorf("Expected\n%s\ngot\n%s", tC.expected, written.String())
+			}
+		})
+	}
+}
+
+func TestRegistryHandler(t *testing.T) {
+	registry := metrics.NewRegistry()
+	registry.NewCounter("events_total", "Number of events.").Inc()
+
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	rr := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(rr, req)
+
+	if rr.Code != 200 || rr.Header().Get("Content-Type") != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("Expected 200 with text format, got %d %s", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	if !bytes.Contains(rr.Body.Bytes(), []byte("events_total 1\n")) {
+		t.Errorf("Expected counter, got %s", rr.Body.String())
+	}
+}
+
+func TestWrongLabelValues(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected panic for missing label value")
+		}
+	}()
+	metrics.NewRegistry().NewCounter("requests_total", "Number of requests.", "route", "status").Inc("/healthz")
+}
@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+//CounterStore keeps quota counters
+type CounterStore interface {
+	//Increment adds delta to counter key and returns its new value. Counters that don't exist
+	//start at 0, and are removed some time after expires.
+	Increment(key string, delta int64, expires time.Time) (int64, error)
+}
+
+//MemoryCounterStore is a CounterStore that keeps counters in a map, they are lost on restart
+type MemoryCounterStore struct {
+	mu       sync.Mutex
+	counters map[string]int64
+	// periods are keys of counters by the time they expire, counters of a period are removed together
+	periods map[int64][]string
+	now     func() time.Time
+}
+
+//NewMemoryCounterStore returns new MemoryCounterStore
+func NewMemoryCounterStore(now func() time.Time) CounterStore {
+	return &MemoryCounterStore{counters: map[string]int64{}, periods: map[int64][]string{}, now: now}
+}
+
+//Increment adds delta to counter key, counters of expired periods are removed on the way
+func (mcs *MemoryCounterStore) Increment(key string, delta int64, expires time.Time) (int64, error) {
+	mcs.mu.Lock()
+	defer mcs.mu.Unlock()
+
+	value, ok := mcs.counters[key]
+	if !ok {
+		now := mcs.now().UnixNano()
+		for end, keys := range mcs.periods {
+			if now > end {
+				for _, expired := range keys {
+					delete(mcs.counters, expired)
+				}
+				delete(mcs.periods, end)
+			}
+		}
+		end := expires.UnixNano()
+		mcs.periods[end] = append(mcs.periods[end], key)
+	}
+	value += delta
+	mcs.counters[key] = value
+	return value, nil
+}
+
+//MongoCounterStore is a CounterStore that keeps counters in a MongoDB collection, so they
+//survive restarts and are shared by all trackers
+type MongoCounterStore struct {
+	Collection *mgo.Collection
+}
+
+//NewMongoCounterStore returns new MongoCounterStore. Collection gets a TTL index, so MongoDB
+//removes expired counters.
+func NewMongoCounterStore(db *mgo.Session, table, collection string) (CounterStore, error) {
+	dbCollection := db.DB(table).C(collection)
+	index := mgo.Index{Key: []string{"expires"}, ExpireAfter: time.Second}
+	if err := dbCollection.EnsureIndex(index); err != nil {
+		return nil, err
+	}
+	return &MongoCounterStore{Collection: dbCollection}, nil
+}
+
+//Increment adds delta to counter key in one atomic update
+func (mcs *MongoCounterStore) Increment(key string, delta int64, expires time.Time) (int64, error) {
+	counter := struct {
+		Value int64 `bson:"value"`
+	}{}
+	change := mgo.Change{
+		Update:    bson.M{"$inc": bson.M{"value": delta}, "$setOnInsert": bson.M{"expires": expires}},
+		Upsert:    true,
+		ReturnNew: true,
+	}
+	if _, err := mcs.Collection.FindId(key).Apply(change, &counter); err != nil {
+		return 0, err
+	}
+	return counter.Value, nil
+}
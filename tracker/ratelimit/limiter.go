@@ -0,0 +1,302 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"pub-sub/logging"
+	"pub-sub/tracker/database"
+)
+
+//Reasons why an event is not allowed
+const (
+	ReasonRate    = "rate"
+	ReasonDaily   = "daily"
+	ReasonMonthly = "monthly"
+)
+
+// sweepInterval is how often buckets of idle accounts are removed
+const sweepInterval = time.Minute
+
+//Decision is the outcome of Limiter.Allow
+type Decision struct {
+	Allowed bool
+	//Reason is one of Reason* when event is not allowed
+	Reason string
+	//Limit and Remaining are the size of account's bucket and tokens left in it, 0 when rate is not limited
+	Limit     int
+	Remaining int
+	//Reset is the time until the bucket is full again
+	Reset time.Duration
+	//RetryAfter is the time until the next event can be allowed
+	RetryAfter time.Duration
+
+	charge charge
+}
+
+// charge is what Allow took for an allowed event, so that Refund gives back exactly that even
+// when the period has ended since
+type charge struct {
+	accountID string
+	token     bool
+	// quotas are the counters the event was counted in, unused ones have no key
+	quotas [2]chargedQuota
+}
+
+type chargedQuota struct {
+	key string
+	end time.Time
+}
+
+type bucket struct {
+	tokens    float64
+	updated   time.Time
+	perSecond float64
+	burst     float64
+}
+
+func (b *bucket) describe(decision *Decision) {
+	decision.Remaining = int(b.tokens)
+	decision.Reset = seconds((b.burst - b.tokens) / b.perSecond)
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.updated).Seconds()*b.perSecond)
+	b.updated = now
+}
+
+//Limiter allows events of every account at a steady rate with bursts, using a token bucket per
+//account, and counts them against daily and monthly quotas. Limits of the account override
+//the defaults.
+type Limiter struct {
+	counters CounterStore
+	now      func() time.Time
+	logger   *logging.Logger
+
+	mu       sync.Mutex
+	defaults database.RateLimit
+	disabled bool
+	buckets  map[string]*bucket
+	swept    time.Time
+}
+
+//NewLimiter returns new Limiter with default limits, that keeps quotas in counters
+func NewLimiter(defaults database.RateLimit, counters CounterStore, now func() time.Time, logger *logging.Logger) *Limiter {
+	return &Limiter{
+		defaults: defaults,
+		counters: counters,
+		now:      now,
+		logger:   logger,
+		buckets:  map[string]*bucket{},
+		swept:    now(),
+	}
+}
+
+//SetDefaults changes the default limits, accounts keep the limits they set themselves
+func (l *Limiter) SetDefaults(defaults database.RateLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.defaults = defaults
+}
+
+//SetEnabled turns limiting on and off, all events are allowed while it is off
+func (l *Limiter) SetEnabled(enabled bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.disabled = !enabled
+}
+
+//Limits returns limits of account, its own limits with defaults for the fields it doesn't set
+func (l *Limiter) Limits(account database.Person) database.RateLimit {
+	l.mu.Lock()
+	limits := l.defaults
+	l.mu.Unlock()
+	if account.RateLimit == nil {
+		return limits
+	}
+	if account.RateLimit.PerSecond != 0 {
+		limits.PerSecond = account.RateLimit.PerSecond
+	}
+	if account.RateLimit.Burst != 0 {
+		limits.Burst = account.RateLimit.Burst
+	}
+	if account.RateLimit.Daily != 0 {
+		limits.Daily = account.RateLimit.Daily
+	}
+	if account.RateLimit.Monthly != 0 {
+		limits.Monthly = account.RateLimit.Monthly
+	}
+	return limits
+}
+
+//Allow takes a token from account's bucket and counts the event in its quotas. Events that are
+//not allowed don't use up anything. When quotas can't be counted the event is allowed.
+func (l *Limiter) Allow(account database.Person) Decision {
+	l.mu.Lock()
+	disabled := l.disabled
+	l.mu.Unlock()
+	if disabled {
+		return Decision{Allowed: true}
+	}
+
+	accountID := account.ID.Hex()
+	limits := l.Limits(account)
+	now := l.now()
+
+	decision := l.take(accountID, limits, now)
+	if !decision.Allowed {
+		return decision
+	}
+	decision.charge = charge{accountID: accountID, token: limits.PerSecond > 0}
+
+	quotas := accountQuotas(accountID, limits, now)
+	for i, quota := range quotas {
+		if quota.limit <= 0 {
+			continue
+		}
+		count, err := l.counters.Increment(quota.key, 1, quota.end)
+		if err != nil {
+			l.logger.Error("Error counting quota", logging.F("quota", quota.reason), logging.F(logging.KeyAccountID, accountID), logging.Err(err))
+			continue
+		}
+		if count <= quota.limit {
+			decision.charge.quotas[i] = chargedQuota{key: quota.key, end: quota.end}
+			continue
+		}
+
+		// undo counting of this event, so that rejected events don't use up quotas
+		l.uncount(quotas[:i+1])
+		if decision.charge.token {
+			l.refund(accountID, &decision)
+		}
+		decision.Allowed = false
+		decision.Reason = quota.reason
+		decision.RetryAfter = quota.end.Sub(now)
+		decision.charge = charge{}
+		return decision
+	}
+	return decision
+}
+
+//Refund gives back the token and the quotas that Allow took for decision, when the event was
+//allowed but could not be published. Quotas are refunded in the periods the event was counted
+//in, also when the period has ended since.
+func (l *Limiter) Refund(decision Decision) {
+	if !decision.Allowed {
+		return
+	}
+	for _, quota := range decision.charge.quotas {
+		if quota.key != "" {
+			l.counters.Increment(quota.key, -1, quota.end)
+		}
+	}
+	if decision.charge.token {
+		l.refund(decision.charge.accountID, &Decision{})
+	}
+}
+
+// take takes a token from account's bucket
+func (l *Limiter) take(accountID string, limits database.RateLimit, now time.Time) Decision {
+	if limits.PerSecond <= 0 {
+		return Decision{Allowed: true}
+	}
+	burst := float64(limits.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	b, ok := l.buckets[accountID]
+	if !ok {
+		b = &bucket{tokens: burst, updated: now}
+		l.buckets[accountID] = b
+	}
+	// limits of account may have changed since the last event
+	b.perSecond, b.burst = limits.PerSecond, burst
+	b.refill(now)
+
+	decision := Decision{Limit: int(burst)}
+	if b.tokens >= 1 {
+		b.tokens--
+		decision.Allowed = true
+	} else {
+		decision.Reason = ReasonRate
+		decision.RetryAfter = seconds((1 - b.tokens) / limits.PerSecond)
+	}
+	b.describe(&decision)
+	return decision
+}
+
+// refund returns the token of an event that was not allowed or not published
+func (l *Limiter) refund(accountID string, decision *Decision) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b, ok := l.buckets[accountID]; ok {
+		b.tokens = math.Min(b.burst, b.tokens+1)
+		b.describe(decision)
+	}
+}
+
+// quota counts events of an account until end
+type quota struct {
+	reason string
+	limit  int64
+	key    string
+	end    time.Time
+}
+
+func accountQuotas(accountID string, limits database.RateLimit, now time.Time) []quota {
+	return []quota{
+		{ReasonDaily, limits.Daily, dailyKey(accountID, now), endOfDay(now)},
+		{ReasonMonthly, limits.Monthly, monthlyKey(accountID, now), endOfMonth(now)},
+	}
+}
+
+// uncount undoes counting of an event in quotas
+func (l *Limiter) uncount(quotas []quota) {
+	for _, quota := range quotas {
+		if quota.limit > 0 {
+			l.counters.Increment(quota.key, -1, quota.end)
+		}
+	}
+}
+
+// sweep removes buckets that are full again, l.mu must be held
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < sweepInterval {
+		return
+	}
+	l.swept = now
+	for accountID, b := range l.buckets {
+		if b.refill(now); b.tokens >= b.burst {
+			delete(l.buckets, accountID)
+		}
+	}
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(math.Ceil(s * float64(time.Second)))
+}
+
+func dailyKey(accountID string, now time.Time) string {
+	return fmt.Sprintf("%s:day:%s", accountID, now.UTC().Format("2006-01-02"))
+}
+
+func monthlyKey(accountID string, now time.Time) string {
+	return fmt.Sprintf("%s:month:%s", accountID, now.UTC().Format("2006-01"))
+}
+
+func endOfDay(now time.Time) time.Time {
+	year, month, day := now.UTC().Date()
+	return time.Date(year, month, day+1, 0, 0, 0, 0, time.UTC)
+}
+
+func endOfMonth(now time.Time) time.Time {
+	year, month, _ := now.UTC().Date()
+	return time.Date(year, month+1, 1, 0, 0, 0, 0, time.UTC)
+}
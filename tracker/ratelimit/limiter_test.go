@@ -0,0 +1,269 @@
+package ratelimit_test
+
+import (
+	"errors"
+	"pub-sub/logging"
+	"pub-sub/tracker/database"
+	"pub-sub/tracker/ratelimit"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// fakeClock is moved forward by tests
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+type failingCounters struct{}
+
+func (failingCounters) Increment(key string, delta int64, expires time.Time) (int64, error) {
+	return 0, errors.New("no reachable servers")
+}
+
+var account = database.Person{ID: bson.ObjectIdHex("5555e2d316ca1b6d40aaaaaa"), IsActive: true}
+
+func TestLimiterAllow(t *testing.T) {
+	type step struct {
+		advance  time.Duration
+		expected ratelimit.Decision
+	}
+	testCases := []struct {
+		desc     string
+		defaults database.RateLimit
+		account  database.Person
+		counters ratelimit.CounterStore
+		steps    []step
+	}{
+		{
+			desc:     "Allows burst and then steady rate",
+			defaults: database.RateLimit{PerSecond: 2, Burst: 2},
+			account:  account,
+			steps: []step{
+				{expected: ratelimit.Decision{Allowed: true, Limit: 2, Remaining: 1, Reset: 500 * time.Millisecond}},
+				{expected: ratelimit.Decision{Allowed: true, Limit: 2, Remaining: 0, Reset: time.Second}},
+				{expected: ratelimit.Decision{Reason: ratelimit.ReasonRate, Limit: 2, Remaining: 0, Reset: time.Second, RetryAfter: 500 * time.Millisecond}},
+				{advance: 250 * time.Millisecond, expected: ratelimit.Decision{Reason: ratelimit.ReasonRate, Limit: 2, Remaining: 0, Reset: 750 * time.Millisecond, RetryAfter: 250 * time.Millisecond}},
+				{advance: 250 * time.Millisecond, expected: ratelimit.Decision{Allowed: true, Limit: 2, Remaining: 0, Reset: time.Second}},
+				{advance: time.Hour, expected: ratelimit.Decision{Allowed: true, Limit: 2, Remaining: 1, Reset: 500 * time.Millisecond}},
+			},
+		},
+		{
+			desc:     "Account overrides defaults",
+			defaults: database.RateLimit{PerSecond: 2, Burst: 2},
+			account:  database.Person{ID: account.ID, RateLimit: &database.RateLimit{Burst: 1}},
+			steps: []step{
+				{expected: ratelimit.Decision{Allowed: true, Limit: 1, Remaining: 0, Reset: 500 * time.Millisecond}},
+				{expected: ratelimit.Decision{Reason: ratelimit.ReasonRate, Limit: 1, Remaining: 0, Reset: 500 * time.Millisecond, RetryAfter: 500 * time.Millisecond}},
+			},
+		},
+		{
+			desc:     "Account without limit",
+			defaults: database.RateLimit{PerSecond: 2, Burst: 1, Daily: 1},
+			account:  database.Person{ID: account.ID, RateLimit: &database.RateLimit{PerSecond: -1, Daily: -1}},
+			steps: []step{
+				{expected: ratelimit.Decision{Allowed: true}},
+				{expected: ratelimit.Decision{Allowed: true}},
+				{expected: ratelimit.Decision{Allowed: true}},
+			},
+		},
+		{
+			desc:     "Daily quota",
+			defaults: database.RateLimit{Daily: 2},
+			account:  account,
+			steps: []step{
+				{expected: ratelimit.Decision{Allowed: true}},
+				{expected: ratelimit.Decision{Allowed: true}},
+				{expected: ratelimit.Decision{Reason: ratelimit.ReasonDaily, RetryAfter: 12 * time.Hour}},
+				{advance: 12 * time.Hour, expected: ratelimit.Decision{Allowed: true}},
+			},
+		},
+		{
+			desc:     "Monthly quota does not use up daily quota or tokens when exceeded",
+			defaults: database.RateLimit{PerSecond: 1, Burst: 2, Daily: 2, Monthly: 1},
+			account:  account,
+			steps: []step{
+				{expected: ratelimit.Decision{Allowed: true, Limit: 2, Remaining: 1, Reset: time.Second}},
+				{expected: ratelimit.Decision{Reason: ratelimit.ReasonMonthly, Limit: 2, Remaining: 1, Reset: time.Second, RetryAfter: (19*24 + 12) * time.Hour}},
+				{advance: 20 * 24 * time.Hour, expected: ratelimit.Decision{Allowed: true, Limit: 2, Remaining: 1, Reset: time.Second}},
+			},
+		},
+		{
+			desc:     "Allows events when quotas can't be counted",
+			defaults: database.RateLimit{Daily: 1},
+			account:  account,
+			counters: failingCounters{},
+			steps: []step{
+				{expected: ratelimit.Decision{Allowed: true}},
+				{expected: ratelimit.Decision{Allowed: true}},
+			},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			clock := &fakeClock{now: time.Date(2020, time.June, 11, 12, 0, 0, 0, time.UTC)}
+			counters := tC.counters
+			if counters == nil {
+				counters = ratelimit.NewMemoryCounterStore(clock.Now)
+			}
+			limiter := ratelimit.NewLimiter(tC.defaults, counters, clock.Now, nil)
+
+			for i, step := range tC.steps {
+				clock.Advance(step.advance)
+				if decision := outcome(limiter.Allow(tC.account)); decision != step.expected {
+					t.Errorf("Step %d: expected %+v, got %+v", i, step.expected, decision)
+				}
+			}
+		})
+	}
+}
+
+func TestLimiterLogsCounterErrors(t *testing.T) {
+	recorder := logging.NewRecorder()
+	limiter := ratelimit.NewLimiter(database.RateLimit{Daily: 1}, failingCounters{}, time.Now, logging.New(recorder))
+	account := database.Person{ID: bson.ObjectIdHex("5555e2d316ca1b6d40aaaaaa"), IsActive: true}
+	limiter.Allow(account)
+
+	records := recorder.Find("Error counting quota")
+	if len(records) != 1 || records[0].Level != logging.LevelError {
+		t.Fatalf("Expected counter error to be logged, got %v", recorder.Records())
+	}
+	if id, _ := records[0].Field(logging.KeyAccountID); id != account.ID.Hex() {
+		t.Errorf("Expected account_id %s, got %v", account.ID.Hex(), id)
+	}
+	if quota, _ := records[0].Field("quota"); quota != ratelimit.ReasonDaily {
+		t.Errorf("Expected daily quota, got %v", quota)
+	}
+}
+
+func TestLimiterAccountsAreIndependent(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	limiter := ratelimit.NewLimiter(database.RateLimit{PerSecond: 1, Burst: 1}, ratelimit.NewMemoryCounterStore(clock.Now), clock.Now, nil)
+	other := database.Person{ID: bson.ObjectIdHex("5555e2d316ca1b6d40aaaaab")}
+
+	if !limiter.Allow(account).Allowed || limiter.Allow(account).Allowed {
+		t.Error("Expected only first event of account to be allowed")
+	}
+	if !limiter.Allow(other).Allowed {
+		t.Error("Expected event of other account to be allowed")
+	}
+}
+
+func TestLimiterReconfigure(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	limiter := ratelimit.NewLimiter(database.RateLimit{PerSecond: 1, Burst: 1}, ratelimit.NewMemoryCounterStore(clock.Now), clock.Now, nil)
+
+	if !limiter.Allow(account).Allowed || limiter.Allow(account).Allowed {
+		t.Fatal("Expected only first event of account to be allowed")
+	}
+
+	limiter.SetEnabled(false)
+	if decision := limiter.Allow(account); decision != (ratelimit.Decision{Allowed: true}) {
+		t.Errorf("Expected event to be allowed without limits, got %+v", decision)
+	}
+
+	// bucket of the account grows to the new burst
+	limiter.SetEnabled(true)
+	limiter.SetDefaults(database.RateLimit{PerSecond: 1, Burst: 3})
+	if limits := limiter.Limits(account); limits.Burst != 3 {
+		t.Errorf("Expected burst 3, got %d", limits.Burst)
+	}
+	clock.Advance(3 * time.Second)
+	for i := 0; i < 3; i++ {
+		if !limiter.Allow(account).Allowed {
+			t.Errorf("Expected event %d to be allowed", i)
+		}
+	}
+	if limiter.Allow(account).Allowed {
+		t.Error("Expected event over new burst not to be allowed")
+	}
+}
+
+func TestLimiterRefund(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	limiter := ratelimit.NewLimiter(database.RateLimit{PerSecond: 1, Burst: 1, Daily: 1}, ratelimit.NewMemoryCounterStore(clock.Now), clock.Now, nil)
+
+	decision := limiter.Allow(account)
+	if !decision.Allowed {
+		t.Fatal("Expected first event to be allowed")
+	}
+	limiter.Refund(decision)
+	if decision := limiter.Allow(account); !decision.Allowed {
+		t.Fatalf("Expected refunded event to be allowed again, got %+v", decision)
+	}
+	if decision := limiter.Allow(account); decision.Allowed {
+		t.Errorf("Expected event over limits not to be allowed, got %+v", decision)
+	}
+}
+
+func TestLimiterRefundsChargedPeriod(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, time.June, 11, 23, 59, 59, 0, time.UTC)}
+	counters := ratelimit.NewMemoryCounterStore(clock.Now)
+	limiter := ratelimit.NewLimiter(database.RateLimit{Daily: 1}, counters, clock.Now, nil)
+
+	decision := limiter.Allow(account)
+	if !decision.Allowed {
+		t.Fatal("Expected first event to be allowed")
+	}
+	clock.Advance(500 * time.Millisecond)
+	next := limiter.Allow(account)
+	if next.Allowed {
+		t.Fatalf("Expected event over daily quota not to be allowed, got %+v", next)
+	}
+
+	// refund after the day has ended leaves the quota of the new day alone
+	clock.Advance(time.Second)
+	limiter.Refund(decision)
+	limiter.Refund(next)
+	if !limiter.Allow(account).Allowed {
+		t.Fatal("Expected first event of the next day to be allowed")
+	}
+	if limiter.Allow(account).Allowed {
+		t.Error("Expected refund not to be given to the next day")
+	}
+}
+
+// outcome returns decision without what it charged, which can't be compared
+func outcome(decision ratelimit.Decision) ratelimit.Decision {
+	return ratelimit.Decision{
+		Allowed:    decision.Allowed,
+		Reason:     decision.Reason,
+		Limit:      decision.Limit,
+		Remaining:  decision.Remaining,
+		Reset:      decision.Reset,
+		RetryAfter: decision.RetryAfter,
+	}
+}
+
+func TestMemoryCounterStoreExpires(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, time.June, 11, 12, 0, 0, 0, time.UTC)}
+	counters := ratelimit.NewMemoryCounterStore(clock.Now)
+	end := time.Date(2020, time.June, 12, 0, 0, 0, 0, time.UTC)
+
+	counters.Increment("day", 1, end)
+	if value, _ := counters.Increment("day", 1, end); value != 2 {
+		t.Fatalf("Expected 2, got %d", value)
+	}
+
+	// a new counter removes the ones of the period that ended
+	clock.Advance(13 * time.Hour)
+	counters.Increment("next day", 1, end.Add(24*time.Hour))
+	if value, _ := counters.Increment("day", 1, end); value != 1 {
+		t.Errorf("Expected expired counter to start again at 1, got %d", value)
+	}
+}
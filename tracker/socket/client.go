@@ -1,8 +1,14 @@
 package socket
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"pub-sub/logging"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -10,46 +16,285 @@ import (
 
 //Message definition
 type Message struct {
+	// ID is unique per message. The outbox may deliver a message again with the same ID after
+	// a crash: the ones shipped within the last fsync interval, at most one with "always".
+	ID        string `json:"id"`
 	AccountID string `json:"accountId"`
 	Data      string `json:"data"`
 	Timestamp int64  `json:"timestamp"`
 }
 
+//NewMessage returns a message for account with new random ID and current time
+func NewMessage(accountID string, data string) Message {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return Message{
+		ID:        hex.EncodeToString(id),
+		AccountID: accountID,
+		Data:      data,
+		Timestamp: time.Now().Unix(),
+	}
+}
+
+//OverflowPolicy defines what SendMessage does when the outbound queue is full
+type OverflowPolicy string
+
+const (
+	//OverflowBlock waits until the writer makes space in the queue
+	OverflowBlock OverflowPolicy = "block"
+	//OverflowDrop discards the message, logs it and returns ErrDropped
+	OverflowDrop OverflowPolicy = "drop"
+	//OverflowReject returns ErrQueueFull, so the caller can answer with 503
+	OverflowReject OverflowPolicy = "reject"
+)
+
+var (
+	//ErrQueueFull is returned by SendMessage with OverflowReject when the queue is full
+	ErrQueueFull = errors.New("outbound queue is full")
+	//ErrDropped is returned by SendMessage with OverflowDrop when the message was discarded
+	ErrDropped = errors.New("outbound queue is full, message dropped")
+	//ErrClosed is returned by SendMessage after the client was closed
+	ErrClosed = errors.New("publisher client is closed")
+)
+
+//ParseOverflowPolicy returns OverflowPolicy for its config name
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	switch policy := OverflowPolicy(name); policy {
+	case OverflowBlock, OverflowDrop, OverflowReject:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown overflow policy %q", name)
+}
+
+//Conn is the part of *websocket.Conn used by the senders
+type Conn interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	Close() error
+}
+
 //Client interface definition
 type Client interface {
-	SendMessage(accountID string, data string) (bool, error)
+	SendMessage(message Message) error
+	Status() ConnectionStatus
+	//Shutdown stops accepting messages and writes the queued ones until ctx is done, then closes
+	//the connection
+	Shutdown(ctx context.Context) error
+	Close() error
 }
 
-//ClientSender definition
+// closeTimeout limits how long writing the close frame may take
+const closeTimeout = time.Second
+
+// controlWriter is implemented by connections that can write control frames, like *websocket.Conn
+type controlWriter interface {
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+}
+
+// closeConnection tells the other side that the connection is closed normally, if conn supports it, and closes it
+func closeConnection(conn Conn, logger *logging.Logger) error {
+	if writer, ok := conn.(controlWriter); ok {
+		frame := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "tracker is shutting down")
+		if err := writer.WriteControl(websocket.CloseMessage, frame, time.Now().Add(closeTimeout)); err != nil {
+			logger.Warn("Error writing close frame", logging.Err(err))
+		}
+	}
+	return conn.Close()
+}
+
+//SyncClient is a Client that can also wait until a message is written to the publisher
+type SyncClient interface {
+	Client
+	DeliverMessage(message Message) error
+}
+
+type outboundMessage struct {
+	message Message
+	// written receives the result of writing the message, if someone is waiting for it
+	written chan error
+}
+
+//ClientSender queues messages and writes them to the connection from a single goroutine,
+//because websocket connections support only one concurrent writer
 type ClientSender struct {
-	Connection *websocket.Conn
+	Connection Conn
+	Overflow   OverflowPolicy
+	Logger     *logging.Logger
+
+	queue chan outboundMessage
+	done  chan struct{}
+	// closing is closed by Shutdown first, so that senders waiting for space in queue give up
+	closing     chan struct{}
+	closingOnce sync.Once
+
+	// mu guards closed, senders are counted in it before they put message in queue, so that
+	// Shutdown closes queue only after they are done
+	mu      sync.RWMutex
+	closed  bool
+	senders sync.WaitGroup
 }
 
-//NewSocketSender returns new ClientSender object
-func NewSocketSender(connection *websocket.Conn) Client {
-	return &ClientSender{
+//NewSocketSender returns new ClientSender object and starts its writer
+func NewSocketSender(connection Conn, queueSize int, overflow OverflowPolicy, logger *logging.Logger) SyncClient {
+	sender := &ClientSender{
 		Connection: connection,
+		Overflow:   overflow,
+		Logger:     logger,
+		queue:      make(chan outboundMessage, queueSize),
+		done:       make(chan struct{}),
+		closing:    make(chan struct{}),
 	}
+	go sender.writeMessages()
+	return sender
 }
 
-//SendMessage sends a message to a socket
-func (s *ClientSender) SendMessage(accountID string, data string) (bool, error) {
-	message := Message{
-		AccountID: accountID,
-		Data:      data,
-		Timestamp: time.Now().Unix(),
+//SendMessage puts a message in the outbound queue. What happens when the queue is full depends on Overflow.
+func (s *ClientSender) SendMessage(message Message) error {
+	if !s.enter() {
+		return ErrClosed
 	}
+	defer s.senders.Done()
 
+	outbound := outboundMessage{message: message}
+	switch s.Overflow {
+	case OverflowDrop:
+		select {
+		case s.queue <- outbound:
+		default:
+			s.Logger.Warn("Outbound queue full, dropping message", messageFields(message)...)
+			return ErrDropped
+		}
+	case OverflowReject:
+		select {
+		case s.queue <- outbound:
+		default:
+			return ErrQueueFull
+		}
+	default:
+		return s.enqueue(outbound)
+	}
+	return nil
+}
+
+//DeliverMessage queues a message, ignoring Overflow, and waits until it is written to the connection
+func (s *ClientSender) DeliverMessage(message Message) error {
+	if !s.enter() {
+		return ErrClosed
+	}
+	written := make(chan error, 1)
+	err := s.enqueue(outboundMessage{message: message, written: written})
+	s.senders.Done()
+	if err != nil {
+		return err
+	}
+	return <-written
+}
+
+// enter counts a sender unless the client is closed, the sender must call senders.Done
+func (s *ClientSender) enter() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return false
+	}
+	s.senders.Add(1)
+	return true
+}
+
+// enqueue waits for space in queue, or returns ErrClosed once Shutdown starts
+func (s *ClientSender) enqueue(outbound outboundMessage) error {
+	select {
+	case s.queue <- outbound:
+		return nil
+	case <-s.closing:
+		return ErrClosed
+	}
+}
+
+//Shutdown stops accepting messages and waits until the queued ones are written or ctx is done,
+//then closes the connection. Messages that were not written by then are dropped.
+func (s *ClientSender) Shutdown(ctx context.Context) error {
+	s.closingOnce.Do(func() { close(s.closing) })
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosed
+	}
+	s.closed = true
+	s.mu.Unlock()
+	// senders waiting for space give up, messages already in queue are still written
+	s.senders.Wait()
+	close(s.queue)
+
+	var err error
+	select {
+	case <-s.done:
+	case <-ctx.Done():
+		select {
+		case <-s.done:
+		default:
+			// closing the connection fails the write that is waiting and the rest of the queue
+			err = ctx.Err()
+			s.Logger.Warn("Dropping queued messages", logging.F("queued", len(s.queue)), logging.Err(err))
+		}
+	}
+
+	closeErr := closeConnection(s.Connection, s.Logger)
+	<-s.done
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+//Close stops accepting messages, waits for the queued ones to be written and closes the connection
+func (s *ClientSender) Close() error {
+	return s.Shutdown(context.Background())
+}
+
+//Status returns the state of the connection and the queue. Connections that don't report their
+//state are assumed connected until closed.
+func (s *ClientSender) Status() ConnectionStatus {
+	if reporter, ok := s.Connection.(StatusReporter); ok {
+		status := reporter.Status()
+		status.QueueDepth = len(s.queue)
+		return status
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return ConnectionStatus{State: StateClosed}
+	}
+	return ConnectionStatus{State: StateConnected, QueueDepth: len(s.queue)}
+}
+
+func (s *ClientSender) writeMessages() {
+	defer close(s.done)
+	for message := range s.queue {
+		err := s.writeMessage(message.message)
+		if message.written != nil {
+			message.written <- err
+		}
+	}
+}
+
+func (s *ClientSender) writeMessage(message Message) error {
 	messageToSend, err := json.Marshal(message)
 	if err != nil {
-		return false, err
+		s.Logger.Error("Error encoding message", append(messageFields(message), logging.Err(err))...)
+		return err
 	}
-	log.Printf("Sending message to socket, %s", messageToSend)
+	s.Logger.Debug("Sending message to socket", messageFields(message)...)
 
 	err = s.Connection.WriteMessage(websocket.TextMessage, messageToSend)
 	if err != nil {
-		log.Printf("Error writing to socket %s", err)
-		return false, err
+		s.Logger.Warn("Error writing to socket", append(messageFields(message), logging.Err(err))...)
 	}
-	return true, nil
+	return err
+}
+
+// messageFields identify message in log records
+func messageFields(message Message) []logging.Field {
+	return []logging.Field{logging.F(logging.KeyMessageID, message.ID), logging.F(logging.KeyAccountID, message.AccountID)}
 }
@@ -0,0 +1,200 @@
+package socket_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"pub-sub/logging"
+	"pub-sub/tracker/socket"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// recordingConn fails the test if WriteMessage is ever called concurrently. messages is
+// appended without a lock on purpose, so the race detector reports concurrent writers too.
+type recordingConn struct {
+	t        *testing.T
+	writing  int32
+	release  chan struct{}
+	messages []socket.Message
+	closed   bool
+}
+
+func (c *recordingConn) WriteMessage(messageType int, data []byte) error {
+	if atomic.AddInt32(&c.writing, 1) != 1 {
+		c.t.Error("WriteMessage called concurrently")
+	}
+	defer atomic.AddInt32(&c.writing, -1)
+
+	if c.release != nil {
+		<-c.release
+	}
+	message := socket.Message{}
+	if err := json.Unmarshal(data, &message); err != nil {
+		c.t.Errorf("Written message is not valid JSON: %s", err)
+	}
+	c.messages = append(c.messages, message)
+	return nil
+}
+
+func (c *recordingConn) ReadMessage() (int, []byte, error) {
+	select {}
+}
+
+func (c *recordingConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestSendMessageConcurrently(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		queueSize int
+		senders   int
+	}{
+		{
+			desc:      "Unbuffered queue",
+			queueSize: 0,
+			senders:   300,
+		},
+		{
+			desc:      "Queue smaller than number of senders",
+			queueSize: 16,
+			senders:   500,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			conn := &recordingConn{t: t}
+			client := socket.NewSocketSender(conn, tC.queueSize, socket.OverflowBlock, nil)
+
+			var wg sync.WaitGroup
+			for i := 0; i < tC.senders; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					if err := client.SendMessage(socket.NewMessage(fmt.Sprintf("account%d", i), "data")); err != nil {
+						t.Errorf("Expected message to be queued, got %v", err)
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			if err := client.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !conn.closed {
+				t.Error("Expected connection to be closed")
+			}
+			if len(conn.messages) != tC.senders {
+				t.Fatalf("Expected %d messages, got %d", tC.senders, len(conn.messages))
+			}
+			seen := map[string]bool{}
+			for _, message := range conn.messages {
+				seen[message.AccountID] = true
+			}
+			if len(seen) != tC.senders {
+				t.Errorf("Expected messages from %d accounts, got %d", tC.senders, len(seen))
+			}
+		})
+	}
+}
+
+func TestSendMessageQueueFull(t *testing.T) {
+	testCases := []struct {
+		desc            string
+		overflow        socket.OverflowPolicy
+		expectedError   error
+		expectedDropped bool
+	}{
+		{
+			desc:          "Reject returns ErrQueueFull",
+			overflow:      socket.OverflowReject,
+			expectedError: socket.ErrQueueFull,
+		},
+		{
+			desc:            "Drop discards message with ErrDropped",
+			overflow:        socket.OverflowDrop,
+			expectedError:   socket.ErrDropped,
+			expectedDropped: true,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			conn := &recordingConn{t: t, release: make(chan struct{})}
+			recorder := logging.NewRecorder()
+			client := socket.NewSocketSender(conn, 1, tC.overflow, logging.New(recorder))
+
+			// writer blocks on the first message, the second one fills the queue
+			client.SendMessage(socket.NewMessage("first", "data"))
+			for atomic.LoadInt32(&conn.writing) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			if err := client.SendMessage(socket.NewMessage("second", "data")); err != nil {
+				t.Fatal(err)
+			}
+			if depth := client.Status().QueueDepth; depth != 1 {
+				t.Errorf("Expected queue depth 1, got %d", depth)
+			}
+			third := socket.NewMessage("third", "data")
+			err := client.SendMessage(third)
+			if err != tC.expectedError {
+				t.Errorf("Expected %v, got %v", tC.expectedError, err)
+			}
+			dropped := recorder.Find("Outbound queue full, dropping message")
+			if (len(dropped) == 1) != tC.expectedDropped {
+				t.Fatalf("Expected dropped message to be logged %t, got %v", tC.expectedDropped, dropped)
+			}
+			if tC.expectedDropped {
+				if id, _ := dropped[0].Field(logging.KeyMessageID); id != third.ID {
+					t.Errorf("Expected message_id %s, got %v", third.ID, id)
+				}
+				if account, _ := dropped[0].Field(logging.KeyAccountID); account != "third" {
+					t.Errorf("Expected account_id third, got %v", account)
+				}
+			}
+
+			close(conn.release)
+			client.Close()
+			if len(conn.messages) != 2 || conn.messages[1].AccountID != "second" {
+				t.Errorf("Expected first and second message to be written, got %v", conn.messages)
+			}
+		})
+	}
+}
+
+func TestSendMessageAfterClose(t *testing.T) {
+	client := socket.NewSocketSender(&recordingConn{t: t}, 1, socket.OverflowBlock, nil)
+	client.Close()
+
+	err := client.SendMessage(socket.NewMessage("test", "data"))
+	if err != socket.ErrClosed {
+		t.Errorf("Expected %v, got %v", socket.ErrClosed, err)
+	}
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		name     string
+		expected socket.OverflowPolicy
+		isError  bool
+	}{
+		{desc: "Block", name: "block", expected: socket.OverflowBlock},
+		{desc: "Drop", name: "drop", expected: socket.OverflowDrop},
+		{desc: "Reject", name: "reject", expected: socket.OverflowReject},
+		{desc: "Unknown", name: "queue", isError: true},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			policy, err := socket.ParseOverflowPolicy(tC.name)
+			if (err != nil) != tC.isError {
+				t.Errorf("Expected error %t, got %v", tC.isError, err)
+			}
+			if policy != tC.expected {
+				t.Errorf("Expected %s, got %s", tC.expected, policy)
+			}
+		})
+	}
+}
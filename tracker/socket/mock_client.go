@@ -5,6 +5,7 @@
 package socket
 
 import (
+	context "context"
 	reflect "reflect"
 
 	gomock "github.com/golang/mock/gomock"
@@ -34,14 +35,49 @@ func (m *MockClient) EXPECT() *MockClientMockRecorder {
 }
 
 // SendMessage mocks base method
-func (m *MockClient) SendMessage(accountID, data string) (bool, error) {
-	ret := m.ctrl.Call(m, "SendMessage", accountID, data)
-	ret0, _ := ret[0].(bool)
-	ret1, _ := ret[1].(error)
-	return ret0, ret1
+func (m *MockClient) SendMessage(message Message) error {
+	ret := m.ctrl.Call(m, "SendMessage", message)
+	ret0, _ := ret[0].(error)
+	return ret0
 }
 
 // SendMessage indicates an expected call of SendMessage
-func (mr *MockClientMockRecorder) SendMessage(accountID, data interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SendMessage", reflect.TypeOf((*MockClient)(nil).SendMessage), accountID, data)
+func (mr *MockClientMockRecorder) SendMessage(message interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SendMessage", reflect.TypeOf((*MockClient)(nil).SendMessage), message)
+}
+
+// Status mocks base method
+func (m *MockClient) Status() ConnectionStatus {
+	ret := m.ctrl.Call(m, "Status")
+	ret0, _ := ret[0].(ConnectionStatus)
+	return ret0
+}
+
+// Status indicates an expected call of Status
+func (mr *MockClientMockRecorder) Status() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Status", reflect.TypeOf((*MockClient)(nil).Status))
+}
+
+// Shutdown mocks base method
+func (m *MockClient) Shutdown(ctx context.Context) error {
+	ret := m.ctrl.Call(m, "Shutdown", ctx)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Shutdown indicates an expected call of Shutdown
+func (mr *MockClientMockRecorder) Shutdown(ctx interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Shutdown", reflect.TypeOf((*MockClient)(nil).Shutdown), ctx)
+}
+
+// Close mocks base method
+func (m *MockClient) Close() error {
+	ret := m.ctrl.Call(m, "Close")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Close indicates an expected call of Close
+func (mr *MockClientMockRecorder) Close() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockClient)(nil).Close))
 }
@@ -0,0 +1,166 @@
+package socket
+
+import (
+	"context"
+	"pub-sub/backoff"
+	"pub-sub/logging"
+	"sync"
+	"time"
+)
+
+// shipBackoff spaces out deliveries of a message that the publisher did not accept
+var shipBackoff = backoff.Backoff{Initial: 100 * time.Millisecond, Max: 10 * time.Second, Multiplier: 2, Jitter: 0.2}
+
+//DurableClient is a Client that appends every message to a write-ahead log on disk before
+//acknowledging it. A background shipper delivers logged messages to the publisher in order,
+//retrying with backoff, and removes them once written. Unshipped messages are delivered after
+//the next start.
+type DurableClient struct {
+	publisher SyncClient
+	log       *writeAheadLog
+	logger    *logging.Logger
+
+	mu       sync.RWMutex
+	closed   bool
+	appended chan struct{}
+	// drain is closed when no more messages are appended, stop when shipping must stop
+	drain chan struct{}
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+//NewDurableClient opens the write-ahead log in options.Directory and starts shipping it to publisher
+func NewDurableClient(publisher SyncClient, options WALOptions, logger *logging.Logger) (Client, error) {
+	wal, err := openWriteAheadLog(options, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &DurableClient{
+		publisher: publisher,
+		log:       wal,
+		logger:    logger,
+		appended:  make(chan struct{}, 1),
+		drain:     make(chan struct{}),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go client.ship()
+	return client, nil
+}
+
+//SendMessage appends a message to the log. It is acknowledged once the log is written and synced.
+func (d *DurableClient) SendMessage(message Message) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return ErrClosed
+	}
+	if err := d.log.append(message); err != nil {
+		d.logger.Error("Error appending message to outbox", append(messageFields(message), logging.Err(err))...)
+		return err
+	}
+
+	select {
+	case d.appended <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+//Status returns the state of the publisher connection
+func (d *DurableClient) Status() ConnectionStatus {
+	return d.publisher.Status()
+}
+
+//Shutdown stops accepting messages and ships the logged ones until ctx is done, then closes the
+//log and the publisher client. Messages that were not shipped by then stay in the log.
+func (d *DurableClient) Shutdown(ctx context.Context) error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return ErrClosed
+	}
+	d.closed = true
+	d.mu.Unlock()
+
+	close(d.drain)
+	var err error
+	select {
+	case <-d.done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	close(d.stop)
+
+	// once ctx is done the publisher is closed right away, which fails a delivery that is waiting
+	publisherErr := d.publisher.Shutdown(ctx)
+	<-d.done
+	d.log.close()
+	if err != nil {
+		return err
+	}
+	return publisherErr
+}
+
+//Close stops the shipper, closes the log and the publisher client. Messages that were not
+//shipped yet stay in the log.
+func (d *DurableClient) Close() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := d.Shutdown(ctx); err != context.Canceled {
+		return err
+	}
+	return nil
+}
+
+func (d *DurableClient) ship() {
+	defer close(d.done)
+	failures := 0
+	for {
+		select {
+		case <-d.stop:
+			return
+		default:
+		}
+
+		message, ok, err := d.log.next()
+		if err != nil {
+			d.logger.Error("Error reading outbox", logging.Err(err))
+			select {
+			case <-time.After(time.Second):
+				continue
+			case <-d.stop:
+				return
+			}
+		}
+		if !ok {
+			select {
+			case <-d.appended:
+				continue
+			case <-d.drain:
+				// caught up and nothing is appended anymore
+				return
+			case <-d.stop:
+				return
+			}
+		}
+
+		if err := d.publisher.DeliverMessage(message); err != nil {
+			delay := shipBackoff.Delay(failures)
+			failures++
+			d.logger.Warn("Error shipping message from outbox", append(messageFields(message), logging.F("attempt", failures), logging.F("retry_in", delay), logging.Err(err))...)
+			// the message is read again after the delay, also while draining until Shutdown gives up
+			select {
+			case <-time.After(delay):
+				continue
+			case <-d.stop:
+				return
+			}
+		}
+		failures = 0
+		if err := d.log.ack(); err != nil {
+			d.logger.Error("Error saving outbox cursor", logging.Err(err))
+		}
+	}
+}
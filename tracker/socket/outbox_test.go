@@ -0,0 +1,316 @@
+package socket_test
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"pub-sub/tracker/socket"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingPublisher is a SyncClient that records delivered messages, or fails with err.
+// The first failures deliveries fail with ErrClosed.
+type recordingPublisher struct {
+	mu       sync.Mutex
+	messages []socket.Message
+	err      error
+	failures int
+}
+
+func (p *recordingPublisher) SendMessage(message socket.Message) error {
+	return p.DeliverMessage(message)
+}
+
+func (p *recordingPublisher) DeliverMessage(message socket.Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	if p.failures > 0 {
+		p.failures--
+		return socket.ErrClosed
+	}
+	p.messages = append(p.messages, message)
+	return nil
+}
+
+func (p *recordingPublisher) Status() socket.ConnectionStatus {
+	return socket.ConnectionStatus{State: socket.StateConnected}
+}
+
+func (p *recordingPublisher) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+func (p *recordingPublisher) Close() error {
+	return nil
+}
+
+func (p *recordingPublisher) waitFor(t *testing.T, count int) []socket.Message {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		p.mu.Lock()
+		messages := append([]socket.Message{}, p.messages...)
+		p.mu.Unlock()
+		if len(messages) >= count {
+			return messages
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d delivered messages, got %d", count, len(messages))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func outboxOptions(t *testing.T) socket.WALOptions {
+	directory, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return socket.WALOptions{Directory: directory, SegmentSize: 200, Sync: socket.SyncAlways}
+}
+
+func segmentFiles(t *testing.T, directory string) []string {
+	files, err := filepath.Glob(filepath.Join(directory, "*.wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func sendMessages(t *testing.T, client socket.Client, from, to int) {
+	for i := from; i < to; i++ {
+		if err := client.SendMessage(socket.NewMessage(fmt.Sprintf("account%d", i), "data")); err != nil {
+			t.Fatalf("Expected message to be accepted, got %v", err)
+		}
+	}
+}
+
+func checkOrder(t *testing.T, messages []socket.Message, from int) {
+	for i, message := range messages {
+		expected := fmt.Sprintf("account%d", from+i)
+		if message.AccountID != expected {
+			t.Errorf("Expected message %d for %s, got %s", i, expected, message.AccountID)
+		}
+	}
+}
+
+func TestDurableClientShipsInOrder(t *testing.T) {
+	options := outboxOptions(t)
+	defer os.RemoveAll(options.Directory)
+
+	publisher := &recordingPublisher{}
+	client, err := socket.NewDurableClient(publisher, options, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sendMessages(t, client, 0, 20)
+	messages := publisher.waitFor(t, 20)
+	client.Close()
+
+	if len(messages) != 20 {
+		t.Fatalf("Expected 20 messages, got %d", len(messages))
+	}
+	checkOrder(t, messages, 0)
+	if files := segmentFiles(t, options.Directory); len(files) != 1 {
+		t.Errorf("Expected shipped segments to be removed, got %v", files)
+	}
+}
+
+func TestDurableClientRetriesFailedDelivery(t *testing.T) {
+	options := outboxOptions(t)
+	defer os.RemoveAll(options.Directory)
+
+	publisher := &recordingPublisher{failures: 2}
+	client, err := socket.NewDurableClient(publisher, options, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	sendMessages(t, client, 0, 5)
+	messages := publisher.waitFor(t, 5)
+	if len(messages) != 5 {
+		t.Fatalf("Expected 5 messages, got %d", len(messages))
+	}
+	checkOrder(t, messages, 0)
+}
+
+func TestDurableClientRejectsSyncInterval(t *testing.T) {
+	options := outboxOptions(t)
+	defer os.RemoveAll(options.Directory)
+	options.Sync = socket.SyncInterval
+
+	if _, err := socket.NewDurableClient(&recordingPublisher{}, options, nil); err == nil {
+		t.Fatal("Expected error for fsync interval 0")
+	}
+}
+
+func TestDurableClientRestart(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		firstError  error
+		firstCount  int
+		secondCount int
+		expected    int
+		expectedAt  int
+	}{
+		{
+			desc:        "Replays messages that were not shipped",
+			firstError:  socket.ErrClosed,
+			firstCount:  10,
+			secondCount: 2,
+			expected:    12,
+			expectedAt:  0,
+		},
+		{
+			desc:        "Does not replay shipped messages",
+			firstCount:  10,
+			secondCount: 2,
+			expected:    2,
+			expectedAt:  10,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			options := outboxOptions(t)
+			defer os.RemoveAll(options.Directory)
+
+			first := &recordingPublisher{err: tC.firstError}
+			client, err := socket.NewDurableClient(first, options, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sendMessages(t, client, 0, tC.firstCount)
+			if tC.firstError == nil {
+				first.waitFor(t, tC.firstCount)
+			}
+			client.Close()
+
+			second := &recordingPublisher{}
+			client, err = socket.NewDurableClient(second, options, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			sendMessages(t, client, tC.firstCount, tC.firstCount+tC.secondCount)
+
+			messages := second.waitFor(t, tC.expected)
+			time.Sleep(50 * time.Millisecond)
+			messages = second.waitFor(t, tC.expected)
+			if len(messages) != tC.expected {
+				t.Fatalf("Expected %d messages, got %d", tC.expected, len(messages))
+			}
+			checkOrder(t, messages, tC.expectedAt)
+		})
+	}
+}
+
+func TestDurableClientSkipsCorruptRecords(t *testing.T) {
+	options := outboxOptions(t)
+	options.SegmentSize = 1 << 20
+	defer os.RemoveAll(options.Directory)
+
+	client, err := socket.NewDurableClient(&recordingPublisher{err: socket.ErrClosed}, options, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendMessages(t, client, 0, 3)
+	client.Close()
+
+	// simulate a crash in the middle of writing the fourth record
+	files := segmentFiles(t, options.Directory)
+	file, err := os.OpenFile(files[len(files)-1], os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{0, 0, 0, 40, 1, 2, 3, 4, '{', '"'})
+	file.Close()
+
+	publisher := &recordingPublisher{}
+	client, err = socket.NewDurableClient(publisher, options, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	sendMessages(t, client, 3, 5)
+
+	messages := publisher.waitFor(t, 5)
+	if len(messages) != 5 {
+		t.Fatalf("Expected 5 messages, got %d", len(messages))
+	}
+	checkOrder(t, messages, 0)
+}
+
+func TestDurableClientResyncsAfterCorruptRecord(t *testing.T) {
+	options := outboxOptions(t)
+	options.SegmentSize = 1 << 20
+	defer os.RemoveAll(options.Directory)
+
+	client, err := socket.NewDurableClient(&recordingPublisher{err: socket.ErrClosed}, options, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendMessages(t, client, 0, 3)
+	client.Close()
+
+	// flip a byte in the payload of the second record
+	files := segmentFiles(t, options.Directory)
+	content, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := 8 + int(binary.BigEndian.Uint32(content[0:4]))
+	content[second+8+4] ^= 0xff
+	if err := ioutil.WriteFile(files[0], content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	publisher := &recordingPublisher{}
+	client, err = socket.NewDurableClient(publisher, options, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	messages := publisher.waitFor(t, 2)
+	time.Sleep(50 * time.Millisecond)
+	messages = publisher.waitFor(t, 2)
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(messages))
+	}
+	checkOrder(t, messages[:1], 0)
+	checkOrder(t, messages[1:], 2)
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		name     string
+		expected socket.SyncPolicy
+		isError  bool
+	}{
+		{desc: "Always", name: "always", expected: socket.SyncAlways},
+		{desc: "Interval", name: "interval", expected: socket.SyncInterval},
+		{desc: "Never", name: "never", expected: socket.SyncNever},
+		{desc: "Unknown", name: "sometimes", isError: true},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			policy, err := socket.ParseSyncPolicy(tC.name)
+			if (err != nil) != tC.isError {
+				t.Errorf("Expected error %t, got %v", tC.isError, err)
+			}
+			if policy != tC.expected {
+				t.Errorf("Expected %s, got %s", tC.expected, policy)
+			}
+		})
+	}
+}
@@ -0,0 +1,286 @@
+package socket
+
+import (
+	"errors"
+	"pub-sub/backoff"
+	"pub-sub/logging"
+	"sync"
+	"time"
+)
+
+//ConnectionState describes the state of the publisher connection
+type ConnectionState int
+
+const (
+	//StateConnecting is the state before the first connection was made
+	StateConnecting ConnectionState = iota
+	//StateConnected means messages are being written to the publisher
+	StateConnected
+	//StateDisconnected means the connection was lost and is being redialed
+	StateDisconnected
+	//StateClosed means the connection was closed and will not be redialed
+	StateClosed
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+//ConnectionStatus is a snapshot of the publisher connection
+type ConnectionStatus struct {
+	State      ConnectionState
+	Reconnects int
+	LastError  error
+	//QueueDepth is the number of messages waiting to be written
+	QueueDepth int
+}
+
+//StatusReporter is implemented by connections that know their own state
+type StatusReporter interface {
+	Status() ConnectionStatus
+}
+
+// errRedial is the last error of connections that were closed by Redial
+var errRedial = errors.New("publisher address changed")
+
+//DialFunc opens a new connection to the publisher
+type DialFunc func() (Conn, error)
+
+//ReconnectingConn is a Conn that redials the publisher whenever reading or writing fails.
+//WriteMessage blocks while disconnected, so when it is used by ClientSender the queue acts
+//as a bounded outbox and queued messages are written in order once the connection is back.
+type ReconnectingConn struct {
+	backoff backoff.Backoff
+	logger  *logging.Logger
+	// redial wakes up the backoff wait when dial was changed
+	redial chan struct{}
+
+	mu   sync.Mutex
+	dial DialFunc
+	// dials counts changes of dial, connections made with an old dial are dropped
+	dials      int
+	conn       Conn
+	connected  chan struct{}
+	lost       chan struct{}
+	state      ConnectionState
+	reconnects int
+	lastError  error
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	done      chan struct{}
+}
+
+//NewReconnectingConn returns new ReconnectingConn and starts dialing in the background
+func NewReconnectingConn(dial DialFunc, policy backoff.Backoff, logger *logging.Logger) *ReconnectingConn {
+	r := &ReconnectingConn{
+		dial:      dial,
+		backoff:   policy,
+		logger:    logger,
+		redial:    make(chan struct{}, 1),
+		connected: make(chan struct{}),
+		state:     StateConnecting,
+		closed:    make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+//NewReconnectingSender returns a Client that keeps the publisher connection alive and buffers
+//up to queueSize messages while it is down
+func NewReconnectingSender(dial DialFunc, policy backoff.Backoff, queueSize int, overflow OverflowPolicy, logger *logging.Logger) SyncClient {
+	return NewSocketSender(NewReconnectingConn(dial, policy, logger), queueSize, overflow, logger)
+}
+
+//WriteMessage writes to the current connection. If there is none, it waits for one.
+//If writing fails, the connection is redialed and the message is written again.
+func (r *ReconnectingConn) WriteMessage(messageType int, data []byte) error {
+	for {
+		r.mu.Lock()
+		conn, connected := r.conn, r.connected
+		r.mu.Unlock()
+
+		if conn == nil {
+			select {
+			case <-connected:
+				continue
+			case <-r.closed:
+				return ErrClosed
+			}
+		}
+
+		err := conn.WriteMessage(messageType, data)
+		if err == nil {
+			return nil
+		}
+		r.connectionLost(conn, err)
+	}
+}
+
+//ReadMessage is not supported, messages from publisher are read and discarded internally
+func (r *ReconnectingConn) ReadMessage() (int, []byte, error) {
+	<-r.closed
+	return 0, nil, ErrClosed
+}
+
+//Close stops redialing and closes the current connection
+func (r *ReconnectingConn) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.closed)
+	})
+	<-r.done
+	return nil
+}
+
+//Status returns current state of the connection
+func (r *ReconnectingConn) Status() ConnectionStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return ConnectionStatus{
+		State:      r.state,
+		Reconnects: r.reconnects,
+		LastError:  r.lastError,
+	}
+}
+
+//Redial makes the connection use dial from now on. The current connection is closed with a
+//close frame and redialed; messages being written are written again to the new connection.
+func (r *ReconnectingConn) Redial(dial DialFunc) {
+	r.mu.Lock()
+	r.dial = dial
+	r.dials++
+	conn := r.conn
+	r.mu.Unlock()
+
+	select {
+	case r.redial <- struct{}{}:
+	default:
+	}
+	if conn != nil && r.disconnect(conn, errRedial) {
+		r.logger.Info("Reconnecting to publisher at new address")
+		closeConnection(conn, r.logger)
+	}
+}
+
+func (r *ReconnectingConn) run() {
+	defer close(r.done)
+
+	attempt := 0
+	for {
+		r.mu.Lock()
+		dial, dials := r.dial, r.dials
+		r.mu.Unlock()
+
+		conn, err := dial()
+		if err != nil {
+			r.mu.Lock()
+			r.lastError = err
+			r.mu.Unlock()
+
+			delay := r.backoff.Delay(attempt)
+			attempt++
+			r.logger.Warn("Error connecting to publisher", logging.Err(err), logging.F("retry_in", delay))
+			select {
+			case <-time.After(delay):
+				continue
+			case <-r.redial:
+				attempt = 0
+				continue
+			case <-r.closed:
+				r.setClosed(nil)
+				return
+			}
+		}
+		attempt = 0
+
+		lost, ok := r.setConnection(conn, dials)
+		if !ok {
+			// dial changed while dialing
+			closeConnection(conn, r.logger)
+			continue
+		}
+		go r.readMessages(conn)
+
+		select {
+		case <-lost:
+			// a redial requested while connected is handled by this reconnect
+			select {
+			case <-r.redial:
+			default:
+			}
+		case <-r.closed:
+			r.setClosed(conn)
+			return
+		}
+	}
+}
+
+func (r *ReconnectingConn) setConnection(conn Conn, dials int) (chan struct{}, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.dials != dials {
+		return nil, false
+	}
+	if r.state == StateDisconnected {
+		r.reconnects++
+	}
+	r.conn = conn
+	r.lost = make(chan struct{})
+	r.state = StateConnected
+	close(r.connected)
+	return r.lost, true
+}
+
+func (r *ReconnectingConn) setClosed(conn Conn) {
+	r.mu.Lock()
+	r.conn = nil
+	r.state = StateClosed
+	r.mu.Unlock()
+	if conn != nil {
+		closeConnection(conn, r.logger)
+	}
+}
+
+// readMessages keeps reading from connection so that closed connections are noticed
+// even when there is nothing to write
+func (r *ReconnectingConn) readMessages(conn Conn) {
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			r.connectionLost(conn, err)
+			return
+		}
+	}
+}
+
+func (r *ReconnectingConn) connectionLost(conn Conn, err error) {
+	if r.disconnect(conn, err) {
+		r.logger.Warn("Lost connection to publisher", logging.Err(err))
+		conn.Close()
+	}
+}
+
+// disconnect forgets conn so that it is redialed, it returns false when conn is not current anymore
+func (r *ReconnectingConn) disconnect(conn Conn, err error) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn != conn {
+		return false
+	}
+	r.conn = nil
+	r.lastError = err
+	r.state = StateDisconnected
+	r.connected = make(chan struct{})
+	close(r.lost)
+	return true
+}
@@ -0,0 +1,236 @@
+package socket_test
+
+import (
+	"errors"
+	"pub-sub/backoff"
+	"pub-sub/tracker/socket"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConn records written messages until it is broken, after that reads and writes fail
+type fakeConn struct {
+	mu       sync.Mutex
+	messages []string
+	broken   chan struct{}
+	once     sync.Once
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{broken: make(chan struct{})}
+}
+
+func (c *fakeConn) ReadMessage() (int, []byte, error) {
+	<-c.broken
+	return 0, nil, errors.New("connection reset")
+}
+
+func (c *fakeConn) WriteMessage(messageType int, data []byte) error {
+	select {
+	case <-c.broken:
+		return errors.New("broken pipe")
+	default:
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.messages = append(c.messages, string(data))
+	return nil
+}
+
+func (c *fakeConn) Close() error {
+	c.once.Do(func() { close(c.broken) })
+	return nil
+}
+
+func (c *fakeConn) written() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string{}, c.messages...)
+}
+
+// fakeDialer hands out connections from conns channel and fails when there is none
+type fakeDialer struct {
+	conns chan *fakeConn
+}
+
+func (d *fakeDialer) dial() (socket.Conn, error) {
+	select {
+	case conn := <-d.conns:
+		return conn, nil
+	default:
+		return nil, errors.New("connection refused")
+	}
+}
+
+var testBackoff = backoff.Backoff{Initial: time.Millisecond, Max: 5 * time.Millisecond, Multiplier: 2}
+
+func waitForState(t *testing.T, conn socket.StatusReporter, state socket.ConnectionState) {
+	deadline := time.Now().Add(2 * time.Second)
+	for conn.Status().State != state {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected state %s, got %s", state, conn.Status().State)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReconnectingConnWrite(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		breakConn bool
+		expected  []string
+	}{
+		{
+			desc:     "Writes to connected socket",
+			expected: []string{"first", "second"},
+		},
+		{
+			desc:      "Redials after connection is lost and writes in order",
+			breakConn: true,
+			expected:  []string{"first", "second"},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			first, second := newFakeConn(), newFakeConn()
+			dialer := &fakeDialer{conns: make(chan *fakeConn, 2)}
+			dialer.conns <- first
+
+			conn := socket.NewReconnectingConn(dialer.dial, testBackoff, nil)
+			defer conn.Close()
+			waitForState(t, conn, socket.StateConnected)
+
+			if tC.breakConn {
+				first.Close()
+				waitForState(t, conn, socket.StateDisconnected)
+			}
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for _, msg := range tC.expected {
+					if err := conn.WriteMessage(1, []byte(msg)); err != nil {
+						t.Error(err)
+					}
+				}
+			}()
+
+			target := first
+			if tC.breakConn {
+				dialer.conns <- second
+				target = second
+			}
+			<-done
+
+			written := target.written()
+			if len(written) != len(tC.expected) {
+				t.Fatalf("Expected %v, got %v", tC.expected, written)
+			}
+			for i := range written {
+				if written[i] != tC.expected[i] {
+					t.Errorf("Expected %v, got %v", tC.expected, written)
+				}
+			}
+			if tC.breakConn && conn.Status().Reconnects != 1 {
+				t.Errorf("Expected 1 reconnect, got %d", conn.Status().Reconnects)
+			}
+		})
+	}
+}
+
+func TestReconnectingConnRedial(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		connected bool
+	}{
+		{desc: "Closes current connection and dials new address", connected: true},
+		{desc: "Dials new address without waiting for backoff"},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			old := &fakeDialer{conns: make(chan *fakeConn, 1)}
+			first := newFakeConn()
+			if tC.connected {
+				old.conns <- first
+			}
+			slow := backoff.Backoff{Initial: time.Hour, Max: time.Hour}
+			conn := socket.NewReconnectingConn(old.dial, slow, nil)
+			defer conn.Close()
+			if tC.connected {
+				waitForState(t, conn, socket.StateConnected)
+			} else {
+				deadline := time.Now().Add(2 * time.Second)
+				for conn.Status().LastError == nil {
+					if time.Now().After(deadline) {
+						t.Fatal("Expected first dial to fail")
+					}
+					time.Sleep(time.Millisecond)
+				}
+			}
+
+			second := newFakeConn()
+			changed := &fakeDialer{conns: make(chan *fakeConn, 1)}
+			changed.conns <- second
+			conn.Redial(changed.dial)
+
+			if err := conn.WriteMessage(1, []byte("message")); err != nil {
+				t.Fatal(err)
+			}
+			if written := second.written(); len(written) != 1 {
+				t.Errorf("Expected message on new connection, got %v", written)
+			}
+			if written := first.written(); len(written) != 0 {
+				t.Errorf("Expected nothing on old connection, got %v", written)
+			}
+			if tC.connected {
+				select {
+				case <-first.broken:
+				default:
+					t.Error("Expected old connection to be closed")
+				}
+			}
+		})
+	}
+}
+
+func TestReconnectingSenderBuffersWhileDisconnected(t *testing.T) {
+	dialer := &fakeDialer{conns: make(chan *fakeConn, 1)}
+	client := socket.NewReconnectingSender(dialer.dial, testBackoff, 10, socket.OverflowReject, nil)
+
+	accounts := []string{"a", "b", "c"}
+	for _, account := range accounts {
+		if err := client.SendMessage(socket.NewMessage(account, "data")); err != nil {
+			t.Fatalf("Expected message to be buffered, got %v", err)
+		}
+	}
+	if state := client.Status().State; state != socket.StateConnecting {
+		t.Errorf("Expected state %s, got %s", socket.StateConnecting, state)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for client.Status().LastError == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected last dial error to be reported")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	conn := newFakeConn()
+	dialer.conns <- conn
+	client.Close()
+
+	written := conn.written()
+	if len(written) != len(accounts) {
+		t.Fatalf("Expected %d messages, got %v", len(accounts), written)
+	}
+	for i, account := range accounts {
+		expected := `"accountId":"` + account + `"`
+		if !strings.Contains(written[i], expected) {
+			t.Errorf("Expected message %d to contain %s, got %s", i, expected, written[i])
+		}
+	}
+	if state := client.Status().State; state != socket.StateClosed {
+		t.Errorf("Expected state %s, got %s", socket.StateClosed, state)
+	}
+}
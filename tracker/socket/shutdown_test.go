@@ -0,0 +1,184 @@
+package socket_test
+
+import (
+	"context"
+	"os"
+	"pub-sub/tracker/socket"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// closingConn is a fakeConn that records close frames, like *websocket.Conn writes them
+type closingConn struct {
+	*fakeConn
+	mu     sync.Mutex
+	frames [][]byte
+}
+
+func (c *closingConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if messageType == websocket.CloseMessage {
+		c.frames = append(c.frames, data)
+	}
+	return nil
+}
+
+func TestReconnectingSenderShutdown(t *testing.T) {
+	testCases := []struct {
+		desc            string
+		connected       bool
+		timeout         time.Duration
+		expectedError   error
+		expectedWritten int
+	}{
+		{
+			desc:            "Writes queued messages and closes connection",
+			connected:       true,
+			timeout:         time.Second,
+			expectedWritten: 3,
+		},
+		{
+			desc:          "Stops at deadline while disconnected",
+			timeout:       50 * time.Millisecond,
+			expectedError: context.DeadlineExceeded,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			dialer := &fakeDialer{conns: make(chan *fakeConn, 1)}
+			conn := newFakeConn()
+			closing := &closingConn{fakeConn: conn}
+			dial := dialer.dial
+			if tC.connected {
+				dial = func() (socket.Conn, error) { return closing, nil }
+			}
+			client := socket.NewReconnectingSender(dial, testBackoff, 10, socket.OverflowReject, nil)
+			for _, account := range []string{"a", "b", "c"} {
+				if err := client.SendMessage(socket.NewMessage(account, "data")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), tC.timeout)
+			defer cancel()
+			start := time.Now()
+			if err := client.Shutdown(ctx); err != tC.expectedError {
+				t.Errorf("Expected %v, got %v", tC.expectedError, err)
+			}
+			if elapsed := time.Since(start); elapsed > tC.timeout+time.Second {
+				t.Errorf("Expected shutdown within %s, took %s", tC.timeout, elapsed)
+			}
+
+			if written := conn.written(); len(written) != tC.expectedWritten {
+				t.Errorf("Expected %d written messages, got %v", tC.expectedWritten, written)
+			}
+			if state := client.Status().State; state != socket.StateClosed {
+				t.Errorf("Expected state %s, got %s", socket.StateClosed, state)
+			}
+			if err := client.SendMessage(socket.NewMessage("d", "data")); err != socket.ErrClosed {
+				t.Errorf("Expected %v after shutdown, got %v", socket.ErrClosed, err)
+			}
+
+			if tC.connected {
+				closing.mu.Lock()
+				defer closing.mu.Unlock()
+				expected := string(websocket.FormatCloseMessage(websocket.CloseNormalClosure, "tracker is shutting down"))
+				if len(closing.frames) != 1 || string(closing.frames[0]) != expected {
+					t.Errorf("Expected normal close frame, got %q", closing.frames)
+				}
+			}
+		})
+	}
+}
+
+func TestReconnectingSenderShutdownWithBlockedSenders(t *testing.T) {
+	dialer := &fakeDialer{conns: make(chan *fakeConn, 1)}
+	client := socket.NewReconnectingSender(dialer.dial, testBackoff, 1, socket.OverflowBlock, nil)
+	// the writer waits for the connection with the first message, the second one fills the queue
+	for _, account := range []string{"a", "b"} {
+		if err := client.SendMessage(socket.NewMessage(account, "data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	blocked := make(chan error, 3)
+	for _, account := range []string{"c", "d", "e"} {
+		go func(account string) {
+			blocked <- client.SendMessage(socket.NewMessage(account, "data"))
+		}(account)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- client.Shutdown(ctx)
+	}()
+	select {
+	case err := <-shutdown:
+		if err != context.DeadlineExceeded {
+			t.Errorf("Expected %v, got %v", context.DeadlineExceeded, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected shutdown to stop at its deadline")
+	}
+	for i := 0; i < 3; i++ {
+		if err := <-blocked; err != socket.ErrClosed {
+			t.Errorf("Expected blocked sender to get %v, got %v", socket.ErrClosed, err)
+		}
+	}
+}
+
+func TestDurableClientShutdown(t *testing.T) {
+	options := outboxOptions(t)
+	defer os.RemoveAll(options.Directory)
+
+	publisher := &recordingPublisher{}
+	client, err := socket.NewDurableClient(publisher, options, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendMessages(t, client, 0, 20)
+	if err := client.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	publisher.mu.Lock()
+	defer publisher.mu.Unlock()
+	if len(publisher.messages) != 20 {
+		t.Fatalf("Expected all messages to be shipped before shutdown returns, got %d", len(publisher.messages))
+	}
+	checkOrder(t, publisher.messages, 0)
+}
+
+func TestDurableClientShutdownWhileDisconnected(t *testing.T) {
+	options := outboxOptions(t)
+	defer os.RemoveAll(options.Directory)
+
+	dialer := &fakeDialer{conns: make(chan *fakeConn)}
+	client, err := socket.NewDurableClient(socket.NewReconnectingSender(dialer.dial, testBackoff, 10, socket.OverflowReject, nil), options, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendMessages(t, client, 0, 5)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := client.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	// messages that were not shipped are shipped after the next start
+	publisher := &recordingPublisher{}
+	client, err = socket.NewDurableClient(publisher, options, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	checkOrder(t, publisher.waitFor(t, 5), 0)
+}
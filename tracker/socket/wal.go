@@ -0,0 +1,537 @@
+package socket
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"pub-sub/logging"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//SyncPolicy defines when the write-ahead log is flushed to disk
+type SyncPolicy string
+
+const (
+	//SyncAlways flushes every record before SendMessage returns
+	SyncAlways SyncPolicy = "always"
+	//SyncInterval flushes records in the background every SyncInterval
+	SyncInterval SyncPolicy = "interval"
+	//SyncNever leaves flushing to the operating system
+	SyncNever SyncPolicy = "never"
+)
+
+//ParseSyncPolicy returns SyncPolicy for its config name
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	switch policy := SyncPolicy(name); policy {
+	case SyncAlways, SyncInterval, SyncNever:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown fsync policy %q", name)
+}
+
+//WALOptions configures the write-ahead log
+type WALOptions struct {
+	Directory    string
+	SegmentSize  int64
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+}
+
+const (
+	segmentExtension = ".wal"
+	cursorFile       = "cursor"
+	// every record starts with payload length and CRC-32 of the payload
+	recordHeaderSize = 8
+	maxRecordSize    = 16 << 20
+)
+
+var errCorruptRecord = errors.New("corrupt record")
+
+// writeAheadLog is a directory of append-only segment files. Records are appended to the
+// last (active) segment, and read back in order by a single reader which remembers its
+// position in the cursor file. Segments are removed once the reader has passed them.
+// With the interval policy the cursor is saved on every fsync tick, otherwise after every
+// acknowledged record.
+type writeAheadLog struct {
+	options WALOptions
+	logger  *logging.Logger
+
+	mu         sync.Mutex
+	segments   []uint64
+	active     *os.File
+	activeID   uint64
+	activeSize int64
+	dirty      bool
+	// position after the last acknowledged record, cursorDirty if it is not saved yet
+	cursorID     uint64
+	cursorOffset int64
+	cursorDirty  bool
+
+	// cursorMu serializes cursor writes, it is taken before mu
+	cursorMu sync.Mutex
+
+	// read side is only used by the shipper goroutine
+	readFile    *os.File
+	readID      uint64
+	readOffset  int64
+	nextOffset  int64
+	stopSyncing chan struct{}
+}
+
+func openWriteAheadLog(options WALOptions, logger *logging.Logger) (*writeAheadLog, error) {
+	if options.Sync == SyncInterval && options.SyncInterval <= 0 {
+		return nil, fmt.Errorf("fsync interval must be positive, got %s", options.SyncInterval)
+	}
+	if err := os.MkdirAll(options.Directory, 0755); err != nil {
+		return nil, err
+	}
+	l := &writeAheadLog{options: options, logger: logger, stopSyncing: make(chan struct{})}
+
+	segments, err := l.listSegments()
+	if err != nil {
+		return nil, err
+	}
+	readID, readOffset, err := l.readCursor()
+	if err != nil {
+		return nil, err
+	}
+	removed := false
+	for _, id := range segments {
+		if id < readID {
+			os.Remove(l.segmentPath(id))
+			removed = true
+			continue
+		}
+		l.segments = append(l.segments, id)
+	}
+	if removed {
+		if err := l.syncDir(); err != nil {
+			return nil, err
+		}
+	}
+	if len(l.segments) == 0 || l.segments[0] != readID {
+		readOffset = 0
+	}
+
+	// a new active segment is started on every open, so a torn record at the end of
+	// the previous one can only ever be found by the reader
+	l.activeID = readID
+	if len(l.segments) > 0 {
+		l.activeID = l.segments[len(l.segments)-1] + 1
+	}
+	if err := l.openSegment(l.activeID); err != nil {
+		return nil, err
+	}
+
+	l.readID = l.activeID
+	if len(l.segments) > 1 {
+		l.readID = l.segments[0]
+	}
+	l.readOffset = readOffset
+	l.nextOffset = readOffset
+	l.cursorID, l.cursorOffset = l.readID, l.readOffset
+
+	if options.Sync == SyncInterval {
+		go l.syncPeriodically()
+	}
+	return l, nil
+}
+
+func (l *writeAheadLog) segmentPath(id uint64) string {
+	return filepath.Join(l.options.Directory, fmt.Sprintf("%020d%s", id, segmentExtension))
+}
+
+func (l *writeAheadLog) listSegments() ([]uint64, error) {
+	files, err := ioutil.ReadDir(l.options.Directory)
+	if err != nil {
+		return nil, err
+	}
+	segments := []uint64{}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, segmentExtension) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExtension), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, id)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+func (l *writeAheadLog) readCursor() (uint64, int64, error) {
+	content, err := ioutil.ReadFile(filepath.Join(l.options.Directory, cursorFile))
+	if os.IsNotExist(err) {
+		return 1, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	var id uint64
+	var offset int64
+	if _, err := fmt.Sscanf(string(content), "%d %d", &id, &offset); err != nil {
+		return 0, 0, fmt.Errorf("invalid outbox cursor: %s", err)
+	}
+	return id, offset, nil
+}
+
+func (l *writeAheadLog) writeCursor(id uint64, offset int64) error {
+	path := filepath.Join(l.options.Directory, cursorFile)
+	file, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(file, "%d %d\n", id, offset); err != nil {
+		file.Close()
+		return err
+	}
+	if l.options.Sync != SyncNever {
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	return l.syncDir()
+}
+
+// syncDir makes created, renamed and removed files in the log directory durable
+func (l *writeAheadLog) syncDir() error {
+	if l.options.Sync == SyncNever {
+		return nil
+	}
+	dir, err := os.Open(l.options.Directory)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (l *writeAheadLog) openSegment(id uint64) error {
+	file, err := os.OpenFile(l.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if err := l.syncDir(); err != nil {
+		file.Close()
+		return err
+	}
+	l.active = file
+	l.activeID = id
+	l.activeSize = info.Size()
+	if len(l.segments) == 0 || l.segments[len(l.segments)-1] != id {
+		l.segments = append(l.segments, id)
+	}
+	return nil
+}
+
+// append writes message to the active segment and syncs it according to the policy
+func (l *writeAheadLog) append(message Message) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	record := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[recordHeaderSize:], payload)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active == nil {
+		return ErrClosed
+	}
+
+	if l.activeSize > 0 && l.activeSize+int64(len(record)) > l.options.SegmentSize {
+		if err := l.active.Sync(); err != nil {
+			return err
+		}
+		l.active.Close()
+		if err := l.openSegment(l.activeID + 1); err != nil {
+			l.active = nil
+			return err
+		}
+	}
+
+	n, err := l.active.Write(record)
+	l.activeSize += int64(n)
+	if err != nil {
+		return err
+	}
+
+	switch l.options.Sync {
+	case SyncAlways:
+		return l.active.Sync()
+	case SyncInterval:
+		l.dirty = true
+	}
+	return nil
+}
+
+func (l *writeAheadLog) syncPeriodically() {
+	ticker := time.NewTicker(l.options.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.mu.Lock()
+			if l.dirty && l.active != nil {
+				if err := l.active.Sync(); err != nil {
+					l.logger.Error("Error syncing outbox", logging.Err(err))
+				}
+				l.dirty = false
+			}
+			l.mu.Unlock()
+			if err := l.saveCursor(); err != nil {
+				l.logger.Error("Error saving outbox cursor", logging.Err(err))
+			}
+		case <-l.stopSyncing:
+			return
+		}
+	}
+}
+
+// next returns the record after the last acknowledged one. It returns false if the
+// reader has caught up with the writer.
+func (l *writeAheadLog) next() (Message, bool, error) {
+	for {
+		l.mu.Lock()
+		isActive := l.readID == l.activeID
+		limit := l.activeSize
+		nextID := l.readID
+		for _, id := range l.segments {
+			if id > l.readID {
+				nextID = id
+				break
+			}
+		}
+		l.mu.Unlock()
+
+		if isActive && l.readOffset >= limit {
+			return Message{}, false, nil
+		}
+
+		if l.readFile == nil {
+			file, err := os.Open(l.segmentPath(l.readID))
+			if os.IsNotExist(err) && !isActive {
+				l.readID, l.readOffset, l.nextOffset = nextID, 0, 0
+				continue
+			}
+			if err != nil {
+				return Message{}, false, err
+			}
+			l.readFile = file
+		}
+
+		message, size, err := l.readRecord()
+		if err == nil {
+			l.nextOffset = l.readOffset + size
+			return message, true, nil
+		}
+		if err == errCorruptRecord {
+			offset, found, resyncErr := l.resync(isActive, limit)
+			if resyncErr != nil {
+				return Message{}, false, resyncErr
+			}
+			if found {
+				l.logger.Error("Skipping corrupt outbox record", logging.F("segment", l.readID), logging.F("offset", l.readOffset), logging.F("skipped_bytes", offset-l.readOffset))
+				l.readOffset, l.nextOffset = offset, offset
+				continue
+			}
+		}
+		if isActive {
+			return Message{}, false, err
+		}
+		if err != io.EOF {
+			// nothing intact follows, the previous process stopped in the middle of a write
+			l.logger.Warn("Skipping rest of outbox segment", logging.F("segment", l.readID), logging.F("offset", l.readOffset), logging.Err(err))
+		}
+
+		// sealed segment is fully shipped, move on to the next one
+		if err := l.removeSegment(l.readID, nextID); err != nil {
+			return Message{}, false, err
+		}
+	}
+}
+
+func (l *writeAheadLog) readRecord() (Message, int64, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := l.readFile.ReadAt(header, l.readOffset); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errCorruptRecord
+		}
+		return Message{}, 0, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > maxRecordSize {
+		return Message{}, 0, errCorruptRecord
+	}
+	payload := make([]byte, length)
+	if _, err := l.readFile.ReadAt(payload, l.readOffset+recordHeaderSize); err != nil {
+		return Message{}, 0, errCorruptRecord
+	}
+	message, err := decodeRecord(header, payload)
+	if err != nil {
+		return Message{}, 0, err
+	}
+	return message, recordHeaderSize + int64(length), nil
+}
+
+func decodeRecord(header, payload []byte) (Message, error) {
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return Message{}, errCorruptRecord
+	}
+	message := Message{}
+	if err := json.Unmarshal(payload, &message); err != nil {
+		return Message{}, errCorruptRecord
+	}
+	return message, nil
+}
+
+// resync scans forward from a corrupt record at the read offset for the next intact one,
+// so that a single damaged record doesn't lose the rest of the segment. The active segment
+// is only scanned up to limit, the part that is completely written.
+func (l *writeAheadLog) resync(isActive bool, limit int64) (int64, bool, error) {
+	end := limit
+	if !isActive {
+		info, err := l.readFile.Stat()
+		if err != nil {
+			return 0, false, err
+		}
+		end = info.Size()
+	}
+	start := l.readOffset + 1
+	if end-start < recordHeaderSize {
+		return 0, false, nil
+	}
+	buffer := make([]byte, end-start)
+	n, err := l.readFile.ReadAt(buffer, start)
+	if err != nil && err != io.EOF {
+		return 0, false, err
+	}
+	buffer = buffer[:n]
+
+	for i := 0; i+recordHeaderSize <= len(buffer); i++ {
+		header := buffer[i : i+recordHeaderSize]
+		length := int64(binary.BigEndian.Uint32(header[0:4]))
+		if length > maxRecordSize || int64(i)+recordHeaderSize+length > int64(len(buffer)) {
+			continue
+		}
+		payload := buffer[i+recordHeaderSize : int64(i)+recordHeaderSize+length]
+		if _, err := decodeRecord(header, payload); err == nil {
+			return start + int64(i), true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+func (l *writeAheadLog) removeSegment(id, nextID uint64) error {
+	l.readFile.Close()
+	l.readFile = nil
+	l.readID = nextID
+	l.readOffset = 0
+	l.nextOffset = 0
+	l.setCursor(l.readID, l.readOffset)
+	if err := l.saveCursor(); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	for i, segment := range l.segments {
+		if segment == id {
+			l.segments = append(l.segments[:i], l.segments[i+1:]...)
+			break
+		}
+	}
+	l.mu.Unlock()
+	if err := os.Remove(l.segmentPath(id)); err != nil {
+		return err
+	}
+	return l.syncDir()
+}
+
+// ack marks the record returned by next as delivered. With the interval policy the cursor
+// is saved on the next fsync tick, so the records acknowledged within the last interval are
+// delivered again after a crash. Otherwise it is saved right away.
+func (l *writeAheadLog) ack() error {
+	l.readOffset = l.nextOffset
+	l.setCursor(l.readID, l.readOffset)
+	if l.options.Sync == SyncInterval {
+		return nil
+	}
+	return l.saveCursor()
+}
+
+func (l *writeAheadLog) setCursor(id uint64, offset int64) {
+	l.mu.Lock()
+	l.cursorID, l.cursorOffset, l.cursorDirty = id, offset, true
+	l.mu.Unlock()
+}
+
+// saveCursor writes the cursor if records were acknowledged since it was last written
+func (l *writeAheadLog) saveCursor() error {
+	l.cursorMu.Lock()
+	defer l.cursorMu.Unlock()
+	l.mu.Lock()
+	id, offset, dirty := l.cursorID, l.cursorOffset, l.cursorDirty
+	l.cursorDirty = false
+	l.mu.Unlock()
+	if !dirty {
+		return nil
+	}
+	if err := l.writeCursor(id, offset); err != nil {
+		l.mu.Lock()
+		l.cursorDirty = true
+		l.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (l *writeAheadLog) close() error {
+	l.mu.Lock()
+	if l.active == nil {
+		l.mu.Unlock()
+		return ErrClosed
+	}
+	close(l.stopSyncing)
+	if l.readFile != nil {
+		l.readFile.Close()
+	}
+	l.mu.Unlock()
+	// the shipper has stopped, so nothing is acknowledged anymore
+	if err := l.saveCursor(); err != nil {
+		l.logger.Error("Error saving outbox cursor", logging.Err(err))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.active.Sync()
+	l.active.Close()
+	l.active = nil
+	return err
+}
@@ -0,0 +1,108 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+//Client authentication policies of ServerOptions
+const (
+	//ClientAuthNone doesn't ask clients for certificates
+	ClientAuthNone = "none"
+	//ClientAuthOptional verifies certificates of clients that send one
+	ClientAuthOptional = "optional"
+	//ClientAuthRequire lets in only clients with a certificate signed by ClientCAFile
+	ClientAuthRequire = "require"
+)
+
+//ClientOptions configures TLS of connections made by the tracker
+type ClientOptions struct {
+	//CAFile is a PEM bundle of CAs that are trusted instead of the system ones
+	CAFile string
+	//ServerName overrides the host name that the server certificate is checked against
+	ServerName string
+	//CertFile and KeyFile are the client certificate, for servers that require one
+	CertFile string
+	KeyFile  string
+}
+
+//ServerOptions configures TLS of the tracker listener
+type ServerOptions struct {
+	CertFile string
+	KeyFile  string
+	//ClientAuth is one of ClientAuth*, ClientCAFile is needed for all but ClientAuthNone
+	ClientAuth   string
+	ClientCAFile string
+}
+
+//Client returns TLS config for dialing with options
+func Client(options ClientOptions) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: options.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if options.CAFile != "" {
+		pool, err := loadPool(options.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if options.CertFile != "" || options.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
+
+//Server returns TLS config for listening with options
+func Server(options ServerOptions) (*tls.Config, error) {
+	if options.CertFile == "" || options.KeyFile == "" {
+		return nil, errors.New("certificate and key files are needed")
+	}
+	certificate, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	switch options.ClientAuth {
+	case ClientAuthNone, "":
+		return config, nil
+	case ClientAuthOptional:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown client auth %q, want %s, %s or %s", options.ClientAuth, ClientAuthNone, ClientAuthOptional, ClientAuthRequire)
+	}
+	if options.ClientCAFile == "" {
+		return nil, fmt.Errorf("client auth %s needs a client CA file", options.ClientAuth)
+	}
+	if config.ClientCAs, err = loadPool(options.ClientCAFile); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// loadPool returns pool with all certificates of the PEM file at path
+func loadPool(path string) (*x509.CertPool, error) {
+	bundle, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("no certificates in CA file %s", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,253 @@
+package tlsconfig_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"pub-sub/tracker/tlsconfig"
+	"strings"
+	"testing"
+	"time"
+)
+
+// certificates are PEM files of a test CA and certificates signed by it
+type certificates struct {
+	directory                 string
+	caFile                    string
+	serverCertFile, serverKey string
+	clientCertFile, clientKey string
+	otherCAFile               string
+}
+
+// newCertificates writes a CA, a server certificate for 127.0.0.1 and tracker.test and a client
+// certificate into a temporary directory
+func newCertificates(t *testing.T) certificates {
+	t.Helper()
+	directory, err := ioutil.TempDir("", "tlsconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := certificates{directory: directory}
+
+	ca, caKey := writeCertificate(t, directory, "ca", &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+	c.caFile = filepath.Join(directory, "ca.pem")
+	writeCertificate(t, directory, "server", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "tracker.test"},
+		DNSNames:    []string{"tracker.test"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	c.serverCertFile, c.serverKey = filepath.Join(directory, "server.pem"), filepath.Join(directory, "server-key.pem")
+	writeCertificate(t, directory, "client", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "subscriber"},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+	c.clientCertFile, c.clientKey = filepath.Join(directory, "client.pem"), filepath.Join(directory, "client-key.pem")
+	writeCertificate(t, directory, "other", &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "other CA"},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+	c.otherCAFile = filepath.Join(directory, "other.pem")
+	return c
+}
+
+var serial int64
+
+// writeCertificate writes template signed by parent, or self-signed without parent, to name.pem and name-key.pem
+func writeCertificate(t *testing.T, directory string, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial++
+	template.SerialNumber = big.NewInt(serial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, filepath.Join(directory, name+".pem"), "CERTIFICATE", der)
+	writePEM(t, filepath.Join(directory, name+"-key.pem"), "EC PRIVATE KEY", keyDER)
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate, key
+}
+
+func writePEM(t *testing.T, path string, blockType string, der []byte) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnections(t *testing.T) {
+	certs := newCertificates(t)
+	defer os.RemoveAll(certs.directory)
+
+	testCases := []struct {
+		desc          string
+		server        tlsconfig.ServerOptions
+		client        tlsconfig.ClientOptions
+		expectedError string
+	}{
+		{
+			desc:   "Trusts server signed by CA",
+			server: tlsconfig.ServerOptions{CertFile: certs.serverCertFile, KeyFile: certs.serverKey},
+			client: tlsconfig.ClientOptions{CAFile: certs.caFile},
+		},
+		{
+			desc:          "Rejects server signed by other CA",
+			server:        tlsconfig.ServerOptions{CertFile: certs.serverCertFile, KeyFile: certs.serverKey},
+			client:        tlsconfig.ClientOptions{CAFile: certs.otherCAFile},
+			expectedError: "certificate signed by unknown authority",
+		},
+		{
+			desc:   "Checks overridden server name",
+			server: tlsconfig.ServerOptions{CertFile: certs.serverCertFile, KeyFile: certs.serverKey},
+			client: tlsconfig.ClientOptions{CAFile: certs.caFile, ServerName: "tracker.test"},
+		},
+		{
+			desc:          "Rejects wrong server name",
+			server:        tlsconfig.ServerOptions{CertFile: certs.serverCertFile, KeyFile: certs.serverKey},
+			client:        tlsconfig.ClientOptions{CAFile: certs.caFile, ServerName: "publisher.test"},
+			expectedError: "publisher.test",
+		},
+		{
+			desc:   "Required client certificate",
+			server: tlsconfig.ServerOptions{CertFile: certs.serverCertFile, KeyFile: certs.serverKey, ClientAuth: tlsconfig.ClientAuthRequire, ClientCAFile: certs.caFile},
+			client: tlsconfig.ClientOptions{CAFile: certs.caFile, CertFile: certs.clientCertFile, KeyFile: certs.clientKey},
+		},
+		{
+			desc:          "Missing client certificate",
+			server:        tlsconfig.ServerOptions{CertFile: certs.serverCertFile, KeyFile: certs.serverKey, ClientAuth: tlsconfig.ClientAuthRequire, ClientCAFile: certs.caFile},
+			client:        tlsconfig.ClientOptions{CAFile: certs.caFile},
+			expectedError: "certificate",
+		},
+		{
+			desc:   "Optional client certificate",
+			server: tlsconfig.ServerOptions{CertFile: certs.serverCertFile, KeyFile: certs.serverKey, ClientAuth: tlsconfig.ClientAuthOptional, ClientCAFile: certs.caFile},
+			client: tlsconfig.ClientOptions{CAFile: certs.caFile},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			serverConfig, err := tlsconfig.Server(tC.server)
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("ok"))
+			}))
+			server.TLS = serverConfig
+			server.StartTLS()
+			defer server.Close()
+
+			clientConfig, err := tlsconfig.Client(tC.client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+			res, err := client.Get(server.URL)
+			if tC.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tC.expectedError) {
+					t.Errorf("Expected error with %q, got %v", tC.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Errorf("Expected 200, got %d", res.StatusCode)
+			}
+		})
+	}
+}
+
+func TestOptionErrors(t *testing.T) {
+	certs := newCertificates(t)
+	defer os.RemoveAll(certs.directory)
+
+	testCases := []struct {
+		desc          string
+		server        *tlsconfig.ServerOptions
+		client        *tlsconfig.ClientOptions
+		expectedError string
+	}{
+		{
+			desc:          "Server without certificate",
+			server:        &tlsconfig.ServerOptions{},
+			expectedError: "certificate and key files are needed",
+		},
+		{
+			desc:          "Server with missing key",
+			server:        &tlsconfig.ServerOptions{CertFile: certs.serverCertFile, KeyFile: certs.directory + "/missing.pem"},
+			expectedError: "failed to load certificate",
+		},
+		{
+			desc:          "Unknown client auth",
+			server:        &tlsconfig.ServerOptions{CertFile: certs.serverCertFile, KeyFile: certs.serverKey, ClientAuth: "always"},
+			expectedError: `unknown client auth "always"`,
+		},
+		{
+			desc:          "Client auth without CA",
+			server:        &tlsconfig.ServerOptions{CertFile: certs.serverCertFile, KeyFile: certs.serverKey, ClientAuth: tlsconfig.ClientAuthRequire},
+			expectedError: "needs a client CA file",
+		},
+		{
+			desc:          "CA file without certificates",
+			client:        &tlsconfig.ClientOptions{CAFile: certs.serverKey},
+			expectedError: "no certificates in CA file",
+		},
+		{
+			desc:          "Missing CA file",
+			client:        &tlsconfig.ClientOptions{CAFile: certs.directory + "/missing.pem"},
+			expectedError: "failed to read CA file",
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			var err error
+			if tC.server != nil {
+				_, err = tlsconfig.Server(*tC.server)
+			} else {
+				_, err = tlsconfig.Client(*tC.client)
+			}
+			if err == nil || !strings.Contains(err.Error(), tC.expectedError) {
+				t.Errorf("Expected error with %q, got %v", tC.expectedError, err)
+			}
+		})
+	}
+}